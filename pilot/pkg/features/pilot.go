@@ -284,4 +284,19 @@ var (
 	EnableServiceApis = env.RegisterBoolVar("PILOT_ENABLED_SERVICE_APIS", false,
 		"If this is set to true, support for Kubernetes service-apis (github.com/kubernetes-sigs/service-apis) will "+
 			" be enabled. This feature is currently experimental, and is off by default.").Get()
+
+	DisableLocalityLB = env.RegisterBoolVar(
+		"PILOT_DISABLE_LOCALITY_LB",
+		false,
+		"If enabled, locality load balancing settings of the mesh config and destination rules are ignored, "+
+			"and the load assignments are sent exactly as generated. This is meant for incident response.",
+	).Get()
+
+	EnableLocalityLBMetrics = env.RegisterBoolVar(
+		"PILOT_ENABLE_LOCALITY_LB_METRICS",
+		false,
+		"If enabled, the weights and failover priorities locality load balancing assigns to the localities of every "+
+			"cluster are recorded for every proxy locality. The number of series grows with the number of clusters "+
+			"times the square of the number of localities.",
+	).Get()
 )
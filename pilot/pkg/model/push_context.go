@@ -15,6 +15,7 @@
 package model
 
 import (
+	"context"
 	"encoding/json"
 	"net"
 	"sort"
@@ -133,6 +134,10 @@ type PushContext struct {
 
 	Version string
 
+	// TraceContext carries the tracing span of the push, which the config generated for the push is
+	// attributed to. Nil when the push is not traced.
+	TraceContext context.Context `json:"-"`
+
 	// cache gateways addresses for each network
 	// this is mainly used for kubernetes multi-cluster scenario
 	networkGateways map[string][]*Gateway
@@ -448,6 +453,13 @@ var (
 		"Number of clusters without instances.",
 	)
 
+	// ProxyStatusLocalityLbWarnings tracks clusters whose locality lb setting could not be fully honored
+	// for the locality of a proxy, e.g. a failover region without endpoints.
+	ProxyStatusLocalityLbWarnings = monitoring.NewGauge(
+		"pilot_locality_lb_warnings",
+		"Number of clusters with a locality lb setting that could not be fully honored.",
+	)
+
 	// DuplicatedDomains tracks rejected VirtualServices due to duplicated hostname.
 	DuplicatedDomains = monitoring.NewGauge(
 		"pilot_vservice_dup_domain",
@@ -485,6 +497,7 @@ var (
 		ProxyStatusConflictInboundListener,
 		DuplicatedClusters,
 		ProxyStatusClusterNoInstances,
+		ProxyStatusLocalityLbWarnings,
 		DuplicatedDomains,
 		DuplicatedSubsets,
 	}
@@ -30,7 +30,6 @@ import (
 	structpb "github.com/golang/protobuf/ptypes/struct"
 	"github.com/golang/protobuf/ptypes/wrappers"
 
-	meshconfig "istio.io/api/mesh/v1alpha1"
 	networking "istio.io/api/networking/v1alpha3"
 	"istio.io/pkg/log"
 
@@ -834,7 +833,7 @@ func applyTrafficPolicy(opts buildClusterOpts, proxy *model.Proxy) {
 
 	applyConnectionPool(opts.push, opts.cluster, connectionPool)
 	applyOutlierDetection(opts.cluster, outlierDetection)
-	applyLoadBalancer(opts.cluster, loadBalancer, opts.port, proxy, opts.push.Mesh)
+	applyLoadBalancer(opts.cluster, loadBalancer, opts.port, proxy, opts.push)
 
 	if opts.clusterMode != SniDnatClusterMode && opts.direction != model.TrafficDirectionInbound {
 		autoMTLSEnabled := opts.push.Mesh.GetEnableAutoMtls().Value
@@ -1005,7 +1004,7 @@ func applyOutlierDetection(cluster *apiv2.Cluster, outlier *networking.OutlierDe
 	}
 }
 
-func applyLoadBalancer(cluster *apiv2.Cluster, lb *networking.LoadBalancerSettings, port *model.Port, proxy *model.Proxy, meshConfig *meshconfig.MeshConfig) {
+func applyLoadBalancer(cluster *apiv2.Cluster, lb *networking.LoadBalancerSettings, port *model.Port, proxy *model.Proxy, push *model.PushContext) {
 	if cluster.OutlierDetection != nil {
 		if cluster.CommonLbConfig == nil {
 			cluster.CommonLbConfig = &apiv2.Cluster_CommonLbConfig{}
@@ -1017,8 +1016,9 @@ func applyLoadBalancer(cluster *apiv2.Cluster, lb *networking.LoadBalancerSettin
 	}
 
 	// Use locality lb settings from load balancer settings if present, else use mesh wide locality lb settings
-	lbSetting := loadbalancer.GetLocalityLbSetting(meshConfig.GetLocalityLbSetting(), lb.GetLocalityLbSetting())
-	applyLocalityLBSetting(proxy.Locality, cluster, lbSetting)
+	lbSetting := loadbalancer.GetLocalityLbSetting(push.Mesh.GetLocalityLbSetting(), lb.GetLocalityLbSetting())
+	// consistent hashing is configured right below, from the same load balancer settings.
+	applyLocalityLBSetting(push, proxy, cluster, lbSetting, lb.GetConsistentHash() != nil)
 
 	// The following order is important. If cluster type has been identified as Original DST since Resolution is PassThrough,
 	// and port is named as redis-xxx we end up creating a cluster with type Original DST and LbPolicy as MAGLEV which would be
@@ -1075,10 +1075,13 @@ func applyLoadBalancer(cluster *apiv2.Cluster, lb *networking.LoadBalancerSettin
 }
 
 func applyLocalityLBSetting(
-	locality *core.Locality,
+	push *model.PushContext,
+	proxy *model.Proxy,
 	cluster *apiv2.Cluster,
 	localityLB *networking.LocalityLoadBalancerSetting,
+	consistentHash bool,
 ) {
+	locality := proxy.Locality
 	if locality == nil || localityLB == nil {
 		return
 	}
@@ -1086,7 +1089,14 @@ func applyLocalityLBSetting(
 	// Failover should only be applied with outlier detection, or traffic will never failover.
 	enabledFailover := cluster.OutlierDetection != nil
 	if cluster.LoadAssignment != nil {
-		loadbalancer.ApplyLocalityLBSetting(locality, cluster.LoadAssignment, localityLB, enabledFailover)
+		result := loadbalancer.ApplyLocalityLBSettingWithOptions(locality, cluster.LoadAssignment, localityLB, enabledFailover,
+			&loadbalancer.Options{ConsistentHash: consistentHash, TraceContext: push.TraceContext})
+		if !result.Applied {
+			log.Debugf("locality lb setting of cluster %s does not apply to locality %s", cluster.Name, util.LocalityToString(locality))
+		}
+		if len(result.Warnings) > 0 {
+			push.AddMetric(model.ProxyStatusLocalityLbWarnings, cluster.Name, proxy, strings.Join(result.Warnings, "; "))
+		}
 	}
 }
 
@@ -1212,7 +1212,7 @@ func TestSidecarLocalityLB(t *testing.T) {
 	for _, localityLbEndpoint := range clusters[0].LoadAssignment.Endpoints {
 		locality := localityLbEndpoint.Locality
 		if locality.Region == "region1" && locality.SubZone == "subzone1" {
-			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(34)))
+			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(33)))
 			g.Expect(localityLbEndpoint.LbEndpoints[0].LoadBalancingWeight.GetValue()).To(Equal(uint32(40)))
 		} else if locality.Region == "region1" && locality.SubZone == "subzone2" {
 			g.Expect(localityLbEndpoint.LoadBalancingWeight.GetValue()).To(Equal(uint32(17)))
@@ -2184,7 +2184,7 @@ func TestApplyLoadBalancer(t *testing.T) {
 				defer os.Unsetenv("PILOT_ENABLE_REDIS_FILTER")
 			}
 
-			applyLoadBalancer(cluster, test.lbSettings, test.port, &proxy, &meshconfig.MeshConfig{})
+			applyLoadBalancer(cluster, test.lbSettings, test.port, &proxy, &model.PushContext{Mesh: &meshconfig.MeshConfig{}})
 
 			if cluster.LbPolicy != test.expectedLbPolicy {
 				t.Errorf("cluster LbPolicy %s != expected %s", cluster.LbPolicy, test.expectedLbPolicy)
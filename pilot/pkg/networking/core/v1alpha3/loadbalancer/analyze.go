@@ -0,0 +1,75 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"strings"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// AnalyzeLocalityLB is a dry run of ApplyLocalityLB: the setting resolved from the mesh config and the
+// destination rule is applied to a copy of the load assignment, which is returned along with a human
+// readable report of the resolved setting, the applied mode, the warnings and the changes made.
+// The given load assignment is left untouched.
+func AnalyzeLocalityLB(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) (*apiv2.ClusterLoadAssignment, string) {
+	if loadAssignment == nil {
+		return nil, "no load assignment\n"
+	}
+	analyzed := util.CloneClusterLoadAssignment(loadAssignment)
+	localityLB, provenance := GetLocalityLbSettingWithProvenance(mesh, destrule, "")
+	before := snapshotLocalities(&analyzed)
+	result := ApplyLocalityLBSettingWithOptions(locality, &analyzed, localityLB, enableFailover,
+		&Options{Provenance: provenance, sideEffectFree: true})
+	after := snapshotLocalities(&analyzed)
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "cluster: %s\n", analyzed.ClusterName)
+	fmt.Fprintf(&sb, "proxy locality: %s\n", util.LocalityToString(locality))
+	fmt.Fprintf(&sb, "setting: %s\n", strings.TrimSpace(provenance.String()))
+	fmt.Fprintf(&sb, "mode: %s\n", result.Mode)
+	if localityLB != nil && LocalityLBDisabled() {
+		sb.WriteString("warning: locality lb is disabled mesh wide\n")
+	}
+	for _, warning := range result.Warnings {
+		fmt.Fprintf(&sb, "warning: %s\n", warning)
+	}
+	if result.Mode == ModeNone && localityLB != nil && localityLB.GetDistribute() == nil && !enableFailover {
+		sb.WriteString("warning: failover is not applied without outlier detection\n")
+	}
+	fmt.Fprintf(&sb, "changes:%s\n", diffLocalities(before, after))
+	sb.WriteString("localities:\n")
+	for i, state := range after {
+		if state.endpoints == 0 {
+			fmt.Fprintf(&sb, "  [%d] %s: dropped\n", i, state.locality)
+			continue
+		}
+		fmt.Fprintf(&sb, "  [%d] %s: priority %d, weight %d, %d endpoints\n",
+			i, state.locality, state.priority, state.weight, state.endpoints)
+	}
+	return &analyzed, sb.String()
+}
@@ -0,0 +1,142 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestAnalyzeLocalityLB(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	distribute := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/zone1/*": 20,
+				},
+			},
+		},
+	}
+	failover := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region3",
+			},
+		},
+	}
+
+	cases := []struct {
+		name           string
+		mesh           *networking.LocalityLoadBalancerSetting
+		dr             *networking.LocalityLoadBalancerSetting
+		enableFailover bool
+		report         string
+	}{
+		{
+			name: "disabled",
+			report: "cluster: outbound|8080||test.example.org\n" +
+				"proxy locality: region1/zone1\n" +
+				"setting: none\n" +
+				"mode: none\n" +
+				"changes: no changes\n" +
+				"localities:\n" +
+				"  [0] region1/zone1: priority 0, weight 0, 2 endpoints\n" +
+				"  [1] region2/zone1: priority 0, weight 0, 1 endpoints\n" +
+				"  [2] region3/zone1: priority 0, weight 0, 1 endpoints\n",
+		},
+		{
+			name: "distribute",
+			mesh: failover,
+			dr:   distribute,
+			report: "cluster: outbound|8080||test.example.org\n" +
+				"proxy locality: region1/zone1\n" +
+				"setting: destination rule\n" +
+				"mode: distribute\n" +
+				"changes:\n" +
+				"  [0] region1/zone1: weight 0->80\n" +
+				"  [1] region2/zone1: weight 0->20\n" +
+				"  [2] region3/zone1: dropped\n" +
+				"localities:\n" +
+				"  [0] region1/zone1: priority 0, weight 80, 2 endpoints\n" +
+				"  [1] region2/zone1: priority 0, weight 20, 1 endpoints\n" +
+				"  [2] region3/zone1: dropped\n",
+		},
+		{
+			name:           "failover",
+			mesh:           failover,
+			enableFailover: true,
+			report: "cluster: outbound|8080||test.example.org\n" +
+				"proxy locality: region1/zone1\n" +
+				"setting: mesh config\n" +
+				"mode: failover\n" +
+				"changes:\n" +
+				"  [1] region2/zone1: priority 0->2\n" +
+				"  [2] region3/zone1: priority 0->1\n" +
+				"localities:\n" +
+				"  [0] region1/zone1: priority 0, weight 0, 2 endpoints\n" +
+				"  [1] region2/zone1: priority 2, weight 0, 1 endpoints\n" +
+				"  [2] region3/zone1: priority 1, weight 0, 1 endpoints\n",
+		},
+		{
+			name: "failover without outlier detection",
+			mesh: failover,
+			report: "cluster: outbound|8080||test.example.org\n" +
+				"proxy locality: region1/zone1\n" +
+				"setting: mesh config\n" +
+				"mode: none\n" +
+				"warning: failover is not applied without outlier detection\n" +
+				"changes: no changes\n" +
+				"localities:\n" +
+				"  [0] region1/zone1: priority 0, weight 0, 2 endpoints\n" +
+				"  [1] region2/zone1: priority 0, weight 0, 1 endpoints\n" +
+				"  [2] region3/zone1: priority 0, weight 0, 1 endpoints\n",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 2},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			original := snapshotLocalities(cla)
+			analyzed, report := AnalyzeLocalityLB(locality, cla, tt.mesh, tt.dr, tt.enableFailover)
+			if report != tt.report {
+				t.Errorf("Got report:\n%s\nexpected:\n%s", report, tt.report)
+			}
+			if got := snapshotLocalities(cla); !reflect.DeepEqual(got, original) {
+				t.Errorf("The load assignment was modified: %v", got)
+			}
+			expected := cla
+			if setting := GetLocalityLbSetting(tt.mesh, tt.dr); setting != nil {
+				ApplyLocalityLBSetting(locality, expected, setting, tt.enableFailover)
+			}
+			if !reflect.DeepEqual(snapshotLocalities(analyzed), snapshotLocalities(expected)) {
+				t.Errorf("Got analyzed load assignment %v expected %v", snapshotLocalities(analyzed), snapshotLocalities(expected))
+			}
+		})
+	}
+}
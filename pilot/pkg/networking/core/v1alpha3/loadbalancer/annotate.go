@@ -0,0 +1,148 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"strings"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+)
+
+// LocalityLbMetadataFilter is the filter metadata namespace under which the priority and the weight
+// assigned to the locality of an endpoint are recorded, see Options.AnnotateMetadata.
+const LocalityLbMetadataFilter = "istio.locality_lb"
+
+// annotateMetadata records the priority and the weight of their group in the metadata of every endpoint,
+// when withPriority is set, and the rationale of their group when rationales are given. The endpoints, their
+// metadata and the slices holding them are copied, see util.CloneClusterLoadAssignment.
+func annotateMetadata(loadAssignment *apiv2.ClusterLoadAssignment, withPriority bool, r *rationales) {
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		fields := map[string]*structpb.Value{}
+		if withPriority {
+			fields["priority"] = &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: float64(ep.Priority)}}
+			if ep.LoadBalancingWeight != nil {
+				fields["weight"] = &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: float64(ep.LoadBalancingWeight.Value)}}
+			}
+		}
+		if r != nil {
+			fields["rationale"] = &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: r.rationale(ep)}}
+		}
+		ep.LbEndpoints = withLocalityLbFields(ep.LbEndpoints, fields)
+	}
+}
+
+// withLocalityLbFields returns copies of the endpoints whose LocalityLbMetadataFilter metadata holds the
+// given fields along with the ones already recorded there, the given ones taking precedence.
+func withLocalityLbFields(lbEndpoints []*endpoint.LbEndpoint, fields map[string]*structpb.Value) []*endpoint.LbEndpoint {
+	annotatedEndpoints := make([]*endpoint.LbEndpoint, 0, len(lbEndpoints))
+	for _, lbEp := range lbEndpoints {
+		annotated := *lbEp
+		filterMetadata := make(map[string]*structpb.Struct, len(lbEp.GetMetadata().GetFilterMetadata())+1)
+		for filter, metadata := range lbEp.GetMetadata().GetFilterMetadata() {
+			filterMetadata[filter] = metadata
+		}
+		merged := make(map[string]*structpb.Value, len(fields))
+		for name, value := range filterMetadata[LocalityLbMetadataFilter].GetFields() {
+			merged[name] = value
+		}
+		for name, value := range fields {
+			merged[name] = value
+		}
+		filterMetadata[LocalityLbMetadataFilter] = &structpb.Struct{Fields: merged}
+		annotated.Metadata = &core.Metadata{FilterMetadata: filterMetadata}
+		annotatedEndpoints = append(annotatedEndpoints, &annotated)
+	}
+	return annotatedEndpoints
+}
+
+// rationales records why the transform weighted and prioritized the groups of endpoints, see
+// Options.AnnotateRationale.
+type rationales struct {
+	weights    map[*endpoint.LocalityLbEndpoints]string
+	priorities map[*endpoint.LocalityLbEndpoints]string
+}
+
+func newRationales() *rationales {
+	return &rationales{
+		weights:    map[*endpoint.LocalityLbEndpoints]string{},
+		priorities: map[*endpoint.LocalityLbEndpoints]string{},
+	}
+}
+
+// annotating returns whether the rationales of the groups of endpoints are annotated, the callers formatting
+// a rationale check it first so that nothing is formatted otherwise.
+func (o *Options) annotating() bool {
+	return o.rationales != nil
+}
+
+// recordWeightRationale records why a group of endpoints got its weight, when rationales are annotated.
+func (o *Options) recordWeightRationale(ep *endpoint.LocalityLbEndpoints, rationale string) {
+	if o.annotating() {
+		o.rationales.weights[ep] = rationale
+	}
+}
+
+// recordPriorityRationale records why a group of endpoints got its priority, when rationales are annotated.
+func (o *Options) recordPriorityRationale(ep *endpoint.LocalityLbEndpoints, rationale string) {
+	if o.annotating() {
+		o.rationales.priorities[ep] = rationale
+	}
+}
+
+// failoverRationale describes the failover tier of a group of endpoints.
+func failoverRationale(priority priorityKey, regionFailover bool, ep *endpoint.LocalityLbEndpoints) string {
+	switch priority.tier {
+	case PrioritySubzoneMatch:
+		if priority.sub > 0 {
+			return "measured latency"
+		}
+		return "same locality"
+	case PriorityZoneMatch:
+		return "same zone"
+	case PriorityRegionMatch:
+		return "same region"
+	case PriorityOtherRegion:
+		if regionFailover {
+			return fmt.Sprintf("region=%s", ep.Locality.GetRegion())
+		}
+		return "other region"
+	case PriorityFailoverMiss:
+		return "other region, not a failover target"
+	default:
+		return "demoted"
+	}
+}
+
+// rationale returns the rationale of a group of endpoints, the priority being the final one, once compacted.
+func (r *rationales) rationale(ep *endpoint.LocalityLbEndpoints) string {
+	var parts []string
+	if rationale, ok := r.weights[ep]; ok {
+		parts = append(parts, rationale)
+	}
+	if rationale, ok := r.priorities[ep]; ok {
+		parts = append(parts, fmt.Sprintf("failover priority %d via %s", ep.Priority, rationale))
+	}
+	if len(parts) == 0 {
+		return "untouched"
+	}
+	return strings.Join(parts, "; ")
+}
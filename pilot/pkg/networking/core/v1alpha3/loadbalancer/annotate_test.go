@@ -0,0 +1,160 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestApplyLocalityLBSettingAnnotateMetadata(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/zone1/*": 20,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 2},
+		localitySpec{locality: "region2/zone1", priority: 1, endpoints: 1},
+	)
+	// the existing metadata must be kept, and the original endpoints left untouched as they may be shared.
+	setWeightMetadata(cla.Endpoints[0].LbEndpoints[0], &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: 7}})
+	original := cla.Endpoints[0].LbEndpoints[0]
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{AnnotateMetadata: true})
+
+	for _, localityEndpoint := range cla.Endpoints {
+		for _, lbEp := range localityEndpoint.LbEndpoints {
+			fields := lbEp.GetMetadata().GetFilterMetadata()[LocalityLbMetadataFilter].GetFields()
+			if got := fields["priority"].GetNumberValue(); got != float64(localityEndpoint.Priority) {
+				t.Errorf("Got priority %v expected %d", got, localityEndpoint.Priority)
+			}
+			if got := fields["weight"].GetNumberValue(); got != float64(localityEndpoint.LoadBalancingWeight.GetValue()) {
+				t.Errorf("Got weight %v expected %d", got, localityEndpoint.LoadBalancingWeight.GetValue())
+			}
+		}
+	}
+	if got := cla.Endpoints[0].LbEndpoints[0].GetMetadata().GetFilterMetadata()["istio"].GetFields()["weight"].GetNumberValue(); got != 7 {
+		t.Errorf("Got istio weight metadata %v expected 7", got)
+	}
+	if got := cla.Endpoints[1].LbEndpoints[0].GetMetadata().GetFilterMetadata()[LocalityLbMetadataFilter].GetFields()["weight"].GetNumberValue(); got != 20 {
+		t.Errorf("Got weight %v expected 20", got)
+	}
+	if _, ok := original.GetMetadata().GetFilterMetadata()[LocalityLbMetadataFilter]; ok {
+		t.Errorf("the original endpoint must not be annotated")
+	}
+}
+
+func TestApplyLocalityLBSettingAnnotateRationale(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 50,
+					"region2/*":       30,
+				},
+			},
+		},
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected []string
+	}{
+		{
+			name: "combined with residual weights",
+			opts: &Options{AnnotateRationale: true, UnlistedLocalities: UnlistedLocalityResidual},
+			expected: []string{
+				"matched To region1/zone1/* @50%; failover priority 0 via same locality",
+				"kept, unmatched, residual weight 10; failover priority 1 via same region",
+				"matched To region2/* @30%; failover priority 2 via region=region2",
+				"kept, unmatched, residual weight 10; failover priority 3 via other region, not a failover target",
+			},
+		},
+		{
+			name: "distribute keeping unlisted localities",
+			opts: &Options{AnnotateRationale: true, UnlistedLocalities: UnlistedLocalityKeep},
+			expected: []string{
+				"matched To region1/zone1/* @50%; failover priority 0 via same locality",
+				"kept, unmatched, weight 1; failover priority 1 via same region",
+				"matched To region2/* @30%; failover priority 2 via region=region2",
+				"kept, unmatched, weight 1; failover priority 3 via other region, not a failover target",
+			},
+		},
+		{
+			// the dropped groups of endpoints have no endpoint to annotate.
+			name: "distribute dropping unlisted localities",
+			opts: &Options{AnnotateRationale: true, AnnotateMetadata: true},
+			expected: []string{
+				"matched To region1/zone1/* @50%; failover priority 0 via same locality",
+				"",
+				"matched To region2/* @30%; failover priority 1 via region=region2",
+				"",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			rationales := make([]string, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				rationale := ""
+				for _, lbEp := range localityEndpoint.LbEndpoints {
+					fields := lbEp.GetMetadata().GetFilterMetadata()[LocalityLbMetadataFilter].GetFields()
+					rationale = fields["rationale"].GetStringValue()
+					if _, ok := fields["priority"]; ok != tt.opts.AnnotateMetadata {
+						t.Errorf("Got priority annotated %v expected %v", ok, tt.opts.AnnotateMetadata)
+					}
+				}
+				rationales = append(rationales, rationale)
+			}
+			if !reflect.DeepEqual(rationales, tt.expected) {
+				t.Errorf("Got rationales %q expected %q", rationales, tt.expected)
+			}
+		})
+	}
+}
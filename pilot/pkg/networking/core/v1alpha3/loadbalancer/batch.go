@@ -0,0 +1,118 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"context"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// ComputeFailoverForLocalities applies the failover settings to the base load assignment for each of the
+// given proxy localities, e.g. the ones of the proxies sharing a cluster. It returns the transformed load
+// assignments keyed by locality string (region/zone/subzone). The groups of endpoints of baseCLA are
+// indexed once by locality, for all the proxies, and the failover priority of each endpoint locality is
+// computed once per proxy locality, whatever the number of groups of endpoints it has. Each load
+// assignment is a copy of the groups of endpoints of baseCLA, see util.CloneClusterLoadAssignment, with
+// the same priorities as ApplyLocalityLBSetting computes for its proxy locality; baseCLA is left untouched.
+// The warnings ApplyLocalityLBSetting logs and its metrics are not reported. The computation is traced as a
+// child of the span in traceContext, if any, as with Options.TraceContext.
+func ComputeFailoverForLocalities(
+	traceContext context.Context,
+	localities []*core.Locality,
+	baseCLA *apiv2.ClusterLoadAssignment,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover,
+) map[string]*apiv2.ClusterLoadAssignment {
+	if baseCLA == nil {
+		return nil
+	}
+	if span := startComputeFailoverSpan(traceContext, baseCLA, len(localities)); span != nil {
+		defer span.End()
+	}
+	// as in ApplyLocalityLBSetting, the endpoints are sent as is when failover does not apply.
+	untouched := LocalityLBDisabled() || withoutLocalities(baseCLA)
+	opts := &Options{}
+	index := newFailoverIndex(baseCLA)
+	out := make(map[string]*apiv2.ClusterLoadAssignment, len(localities))
+	for _, locality := range localities {
+		if locality == nil {
+			continue
+		}
+		key := util.LocalityToString(locality)
+		if _, exist := out[key]; exist {
+			continue
+		}
+		transformed := util.CloneClusterLoadAssignment(baseCLA)
+		out[key] = &transformed
+		if untouched || locality.GetRegion() == "" {
+			continue
+		}
+		targets := opts.failoverTargets(locality, failover)
+		priorityMap := make(map[priorityKey][]int, len(index.localities))
+		for i, endpointLocality := range index.localities {
+			priority, _ := opts.localityPriority(locality, endpointLocality, targets)
+			priorityMap[priority] = append(priorityMap[priority], i)
+		}
+		for compacted, priority := range sortedPriorities(priorityMap) {
+			for _, i := range priorityMap[priority] {
+				for _, group := range index.groups[i] {
+					transformed.Endpoints[group].Priority = uint32(compacted)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// failoverIndex groups the groups of endpoints of a load assignment by locality, the failover priority
+// of a group of endpoints only depending on its locality.
+type failoverIndex struct {
+	// the distinct localities of the groups of endpoints, nil for the groups without a locality
+	localities []*core.Locality
+	// the indexes of the groups of endpoints of each locality, in the order of localities
+	groups [][]int
+}
+
+func newFailoverIndex(loadAssignment *apiv2.ClusterLoadAssignment) *failoverIndex {
+	// a group without a locality is not in the same locality as a group with an empty one.
+	type localityKey struct {
+		region, zone, subzone string
+		none                  bool
+	}
+	index := &failoverIndex{}
+	positions := map[localityKey]int{}
+	for i, ep := range loadAssignment.Endpoints {
+		key := localityKey{
+			region:  ep.Locality.GetRegion(),
+			zone:    ep.Locality.GetZone(),
+			subzone: ep.Locality.GetSubZone(),
+			none:    ep.Locality == nil,
+		}
+		position, ok := positions[key]
+		if !ok {
+			position = len(index.localities)
+			positions[key] = position
+			index.localities = append(index.localities, ep.Locality)
+			index.groups = append(index.groups, nil)
+		}
+		index.groups[position] = append(index.groups[position], i)
+	}
+	return index
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestComputeFailoverForLocalities(t *testing.T) {
+	failover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region3",
+		},
+	}
+	localities := []*envoycore.Locality{
+		{Region: "region1", Zone: "zone1"},
+		{Region: "region1", Zone: "zone2"},
+		{Region: "region2", Zone: "zone1"},
+		{Region: "region1", Zone: "zone1"},
+		{Zone: "zone1"},
+		nil,
+	}
+	base := buildCLA(
+		localitySpec{locality: "region1/zone1", weight: 2, endpoints: 2},
+		localitySpec{locality: "region1/zone2", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+		localitySpec{locality: "region1/zone2", endpoints: 2},
+		localitySpec{endpoints: 1},
+	)
+	before := SnapshotLoadAssignment(base)
+
+	computed := ComputeFailoverForLocalities(nil, localities, base, failover)
+	if len(computed) != 4 {
+		t.Errorf("Got %d load assignments expected one per distinct locality, 4", len(computed))
+	}
+	for _, locality := range localities {
+		if locality == nil {
+			continue
+		}
+		transformed, ok := computed[util.LocalityToString(locality)]
+		if !ok {
+			t.Fatalf("Got no load assignment for locality %s", util.LocalityToString(locality))
+		}
+		expected := util.CloneClusterLoadAssignment(base)
+		ApplyLocalityLBSetting(locality, &expected, &networking.LocalityLoadBalancerSetting{Failover: failover}, true)
+		for _, diff := range CompareSnapshots(SnapshotLoadAssignment(&expected), SnapshotLoadAssignment(transformed)) {
+			t.Errorf("locality %s: load assignment differs from the per proxy transform: %v",
+				util.LocalityToString(locality), diff)
+		}
+	}
+	for _, diff := range CompareSnapshots(before, SnapshotLoadAssignment(base)) {
+		t.Errorf("the base load assignment was modified: %v", diff)
+	}
+	if ComputeFailoverForLocalities(nil, localities, nil, failover) != nil {
+		t.Errorf("expected no load assignments without a base load assignment")
+	}
+}
+
+// benchmarkProxyLocalities returns the localities of 100 proxies spread over 8 localities.
+func benchmarkProxyLocalities() []*envoycore.Locality {
+	localities := make([]*envoycore.Locality, 0, 100)
+	for i := 0; i < 100; i++ {
+		localities = append(localities, &envoycore.Locality{
+			Region: fmt.Sprintf("region%d", i%4),
+			Zone:   fmt.Sprintf("zone%d", i%8),
+		})
+	}
+	return localities
+}
+
+func benchmarkFailover() []*networking.LocalityLoadBalancerSetting_Failover {
+	return []*networking.LocalityLoadBalancerSetting_Failover{
+		{From: "region0", To: "region1"},
+		{From: "region1", To: "region0"},
+	}
+}
+
+func BenchmarkComputeFailoverForLocalities(b *testing.B) {
+	localities := benchmarkProxyLocalities()
+	failover := benchmarkFailover()
+	cla := benchmarkCLA(1000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ComputeFailoverForLocalities(nil, localities, cla, failover)
+	}
+}
+
+// BenchmarkComputeFailoverPerProxy transforms a copy of the load assignment for every proxy.
+func BenchmarkComputeFailoverPerProxy(b *testing.B) {
+	localities := benchmarkProxyLocalities()
+	setting := &networking.LocalityLoadBalancerSetting{Failover: benchmarkFailover()}
+	cla := benchmarkCLA(1000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, locality := range localities {
+			transformed := util.CloneClusterLoadAssignment(cla)
+			ApplyLocalityLBSetting(locality, &transformed, setting, true)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"sync"
+	"sync/atomic"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// transformKey identifies the inputs of a transform of a load assignment. It is compared as a whole on a
+// lookup, two different inputs never share an entry.
+type transformKey struct {
+	cluster        string
+	version        string
+	locality       string
+	noLocality     bool
+	setting        *v1alpha3.LocalityLoadBalancerSetting
+	enableFailover bool
+}
+
+// cachedTransform is a load assignment transformed for a locality, along with the result of its transform.
+type cachedTransform struct {
+	loadAssignment *apiv2.ClusterLoadAssignment
+	result         *Result
+}
+
+// TransformCache caches the load assignments transformed by ApplyLocalityLBSettingWithOptions, keyed by
+// the cluster, the version of its endpoints, the proxy locality and the setting, so that the proxies
+// sharing a locality share the transform of a cluster. The setting is identified by its pointer: it must
+// not be modified while cached, as the settings of a push are not. The options are part of the cache: they
+// must not change while it is used, and the transforms with the options that make them depend on more than
+// these inputs, Deadline and PriorWeights, are never cached. Entries are never evicted, a cache is meant to
+// live for a version of the endpoints.
+type TransformCache struct {
+	opts *Options
+
+	mu      sync.RWMutex
+	entries map[transformKey]cachedTransform
+
+	hits   uint64
+	misses uint64
+}
+
+// NewTransformCache returns an empty cache of the transforms with the given options, nil meaning the
+// zero Options.
+func NewTransformCache(opts *Options) *TransformCache {
+	if opts == nil {
+		opts = &Options{}
+	}
+	return &TransformCache{
+		opts:    opts,
+		entries: map[transformKey]cachedTransform{},
+	}
+}
+
+// Apply returns the load assignment transformed for a proxy in the given locality, and the result of the
+// transform, as ApplyLocalityLBSettingWithOptions would. version identifies the endpoints of the load
+// assignment within its cluster: it must change whenever they do, e.g. with every push, and tell apart the
+// load assignments of the cluster built differently for different proxies, e.g. for their network. The
+// given load assignment is not modified, while the returned one and the result are shared with the cache
+// and must not be modified either. When locality lb is disabled mesh wide, the given load assignment is
+// returned as is.
+func (c *TransformCache) Apply(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	version string,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) (*apiv2.ClusterLoadAssignment, *Result) {
+	if loadAssignment == nil || LocalityLBDisabled() {
+		// the load assignment is left untouched, only the result is reported.
+		return loadAssignment, ApplyLocalityLBSettingWithOptions(locality, loadAssignment, localityLB, enableFailover, c.opts)
+	}
+	if !c.opts.cacheable() {
+		return c.transform(locality, loadAssignment, localityLB, enableFailover)
+	}
+	key := transformKey{
+		cluster:        loadAssignment.ClusterName,
+		version:        version,
+		locality:       util.LocalityToString(locality),
+		noLocality:     locality == nil,
+		setting:        localityLB,
+		enableFailover: enableFailover,
+	}
+
+	c.mu.RLock()
+	cached, ok := c.entries[key]
+	c.mu.RUnlock()
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+		transformCacheHits.Increment()
+		return cached.loadAssignment, cached.result
+	}
+	atomic.AddUint64(&c.misses, 1)
+	transformCacheMisses.Increment()
+	transformed, result := c.transform(locality, loadAssignment, localityLB, enableFailover)
+	c.mu.Lock()
+	c.entries[key] = cachedTransform{loadAssignment: transformed, result: result}
+	c.mu.Unlock()
+	return transformed, result
+}
+
+// Stats returns the number of hits and misses of the cache.
+func (c *TransformCache) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&c.hits), atomic.LoadUint64(&c.misses)
+}
+
+// transform applies the setting to a copy of the load assignment.
+func (c *TransformCache) transform(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) (*apiv2.ClusterLoadAssignment, *Result) {
+	transformed := util.CloneClusterLoadAssignment(loadAssignment)
+	result := ApplyLocalityLBSettingWithOptions(locality, &transformed, localityLB, enableFailover, c.opts)
+	return &transformed, result
+}
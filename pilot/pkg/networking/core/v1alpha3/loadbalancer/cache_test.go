@@ -0,0 +1,151 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestTransformCache(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To: map[string]uint32{
+					"region1/*": 80,
+					"region2/*": 20,
+				},
+			},
+		},
+	}
+	otherSetting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	newCLA := func() *apiv2.ClusterLoadAssignment {
+		return buildCLA(
+			localitySpec{locality: "region1/zone1", endpoints: 2},
+			localitySpec{locality: "region2/zone1", endpoints: 1},
+		)
+	}
+	otherCluster := newCLA()
+	otherCluster.ClusterName = "outbound|8080||other.example.org"
+	moreEndpoints := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 3},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+	)
+
+	cache := NewTransformCache(nil)
+	steps := []struct {
+		name           string
+		locality       *envoycore.Locality
+		cla            *apiv2.ClusterLoadAssignment
+		version        string
+		setting        *networking.LocalityLoadBalancerSetting
+		enableFailover bool
+		hit            bool
+	}{
+		{name: "first", locality: locality, cla: newCLA(), version: "1", setting: setting},
+		{name: "identical", locality: locality, cla: newCLA(), version: "1", setting: setting, hit: true},
+		{name: "other setting", locality: locality, cla: newCLA(), version: "1", setting: otherSetting},
+		{name: "failover enabled", locality: locality, cla: newCLA(), version: "1", setting: otherSetting, enableFailover: true},
+		{name: "other locality", locality: &envoycore.Locality{Region: "region2"}, cla: newCLA(), version: "1", setting: setting},
+		{name: "nil locality", cla: newCLA(), version: "1", setting: setting},
+		{name: "other cluster", locality: locality, cla: otherCluster, version: "1", setting: setting},
+		{name: "other version", locality: locality, cla: moreEndpoints, version: "2", setting: setting},
+		{name: "identical again", locality: locality, cla: newCLA(), version: "1", setting: setting, hit: true},
+	}
+	var hits, misses uint64
+	for _, step := range steps {
+		input := step.cla
+		before := util.CloneClusterLoadAssignment(input)
+		got, result := cache.Apply(step.locality, input, step.version, step.setting, step.enableFailover)
+		if step.hit {
+			hits++
+		} else {
+			misses++
+		}
+		if gotHits, gotMisses := cache.Stats(); gotHits != hits || gotMisses != misses {
+			t.Fatalf("%s: got %d hits and %d misses expected %d and %d", step.name, gotHits, gotMisses, hits, misses)
+		}
+		if !reflect.DeepEqual(input, &before) {
+			t.Errorf("%s: the input load assignment was modified", step.name)
+		}
+		expected := util.CloneClusterLoadAssignment(input)
+		expectedResult := ApplyLocalityLBSettingWithOptions(step.locality, &expected, step.setting, step.enableFailover, nil)
+		if !reflect.DeepEqual(got, &expected) {
+			t.Errorf("%s: got %v expected %v", step.name, got, &expected)
+		}
+		if !reflect.DeepEqual(result, expectedResult) {
+			t.Errorf("%s: got result %+v expected %+v", step.name, result, expectedResult)
+		}
+	}
+}
+
+func TestTransformCacheNondeterministicOptions(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To: map[string]uint32{
+					"region1/*": 80,
+					"region2/*": 20,
+				},
+			},
+		},
+	}
+	for name, opts := range map[string]*Options{
+		"deadline":      {Deadline: time.Hour},
+		"prior weights": {PriorWeights: map[string]uint32{"region1/zone1": 80}},
+	} {
+		cache := NewTransformCache(opts)
+		for i := 0; i < 2; i++ {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 2},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			got, _ := cache.Apply(locality, cla, "1", setting, false)
+			expected := util.CloneClusterLoadAssignment(cla)
+			ApplyLocalityLBSettingWithOptions(locality, &expected, setting, false, opts)
+			if !reflect.DeepEqual(got, &expected) {
+				t.Errorf("%s: got %v expected %v", name, got, &expected)
+			}
+		}
+		if hits, misses := cache.Stats(); hits != 0 || misses != 0 {
+			t.Errorf("%s: got %d hits and %d misses expected the transforms not to be cached", name, hits, misses)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"sort"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// LocalityComparator orders the localities of the endpoints by preference from the point of view of a
+// proxy, for failover to assign them priorities, e.g. by measured RTT or by cost. Less must be a strict
+// weak ordering: the localities neither less than the other share a priority.
+type LocalityComparator interface {
+	// Less reports whether the endpoints in locality a are preferred over the ones in locality b by
+	// the proxy in the proxy locality.
+	Less(proxy, a, b *core.Locality) bool
+}
+
+// TopologyComparator is the region/zone/subzone tiering failover applies by default, without the failover
+// settings: the localities sharing more levels with the proxy locality are preferred.
+type TopologyComparator struct{}
+
+// Less implements LocalityComparator.
+func (TopologyComparator) Less(proxy, a, b *core.Locality) bool {
+	return util.LbPriority(proxy, a) < util.LbPriority(proxy, b)
+}
+
+// comparatorRanks returns the rank of every group of endpoints of the load assignment by the comparator,
+// the preferred ones ranking 0 and the equivalent ones sharing a rank. The groups of endpoints without a
+// locality are not compared, they rank last.
+func comparatorRanks(
+	proxyLocality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	comparator LocalityComparator,
+) map[int]int {
+	var indexes, unlocated []int
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		if localityEndpoint.Locality == nil {
+			unlocated = append(unlocated, i)
+		} else {
+			indexes = append(indexes, i)
+		}
+	}
+	less := func(i, j int) bool {
+		return comparator.Less(proxyLocality, loadAssignment.Endpoints[i].Locality, loadAssignment.Endpoints[j].Locality)
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return less(indexes[i], indexes[j])
+	})
+	ranks := make(map[int]int, len(loadAssignment.Endpoints))
+	rank := 0
+	for j, i := range indexes {
+		if j > 0 && less(indexes[j-1], i) {
+			rank++
+		}
+		ranks[i] = rank
+	}
+	if len(indexes) > 0 {
+		rank++
+	}
+	for _, i := range unlocated {
+		ranks[i] = rank
+	}
+	return ranks
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+// costComparator prefers the cheapest regions, whatever the proxy locality.
+type costComparator map[string]int
+
+func (c costComparator) Less(_, a, b *envoycore.Locality) bool {
+	return c[a.GetRegion()] < c[b.GetRegion()]
+}
+
+func TestApplyLocalityFailoverLocalityComparator(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		setting    *networking.LocalityLoadBalancerSetting
+		comparator LocalityComparator
+		expected   []uint32
+	}{
+		{
+			name:     "default",
+			setting:  setting,
+			expected: []uint32{0, 1, 2, 3, 3, 4},
+		},
+		{
+			// the failover settings are ignored, the cheapest region comes first.
+			name:       "custom comparator",
+			setting:    setting,
+			comparator: costComparator{"region3": 1, "region1": 2, "region2": 3},
+			expected:   []uint32{1, 1, 2, 0, 0, 3},
+		},
+		{
+			// the regions missing from the costs are the cheapest.
+			name:       "custom comparator with unknown costs",
+			setting:    setting,
+			comparator: costComparator{"region1": 1, "region3": 1},
+			expected:   []uint32{1, 1, 0, 1, 1, 2},
+		},
+		{
+			name:       "topology comparator",
+			setting:    &networking.LocalityLoadBalancerSetting{},
+			comparator: TopologyComparator{},
+			expected:   []uint32{0, 1, 2, 2, 2, 3},
+		},
+		{
+			name:     "topology without comparator",
+			setting:  &networking.LocalityLoadBalancerSetting{},
+			expected: []uint32{0, 1, 2, 2, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone2", endpoints: 1},
+				localitySpec{endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, true, &Options{LocalityComparator: tt.comparator})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+			if err := ValidateTransformedCLA(cla); err != nil {
+				t.Errorf("Got an invalid load assignment: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"strings"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/pkg/log"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+var lbLog = log.RegisterScope("locality", "locality load balancing debugging", 0)
+
+// localityState is the locality load balancing state of a group of endpoints.
+type localityState struct {
+	locality  string
+	priority  uint32
+	weight    uint32
+	endpoints int
+}
+
+// snapshotLocalities records the locality load balancing state of every group of endpoints.
+func snapshotLocalities(loadAssignment *apiv2.ClusterLoadAssignment) []localityState {
+	states := make([]localityState, 0, len(loadAssignment.Endpoints))
+	for _, ep := range loadAssignment.Endpoints {
+		states = append(states, localityState{
+			locality:  util.LocalityToString(ep.Locality),
+			priority:  ep.Priority,
+			weight:    ep.LoadBalancingWeight.GetValue(),
+			endpoints: len(ep.LbEndpoints),
+		})
+	}
+	return states
+}
+
+// diffLocalities describes the changes between two snapshots of the same load assignment,
+// one line per group of endpoints whose priority, weight or endpoints changed, or that was removed.
+func diffLocalities(before, after []localityState) string {
+	var sb strings.Builder
+	// groups of endpoints may have been removed, match the remaining ones by locality.
+	var removed []string
+	if len(before) != len(after) {
+		before, removed = matchLocalities(before, after)
+	}
+	for i := range after {
+		if i >= len(before) || before[i] == after[i] {
+			continue
+		}
+		changes := make([]string, 0, 3)
+		if before[i].priority != after[i].priority {
+			changes = append(changes, fmt.Sprintf("priority %d->%d", before[i].priority, after[i].priority))
+		}
+		if before[i].weight != after[i].weight {
+			changes = append(changes, fmt.Sprintf("weight %d->%d", before[i].weight, after[i].weight))
+		}
+		if before[i].endpoints != after[i].endpoints {
+			if after[i].endpoints == 0 {
+				changes = append(changes, "dropped")
+			} else {
+				changes = append(changes, fmt.Sprintf("endpoints %d->%d", before[i].endpoints, after[i].endpoints))
+			}
+		}
+		fmt.Fprintf(&sb, "\n  [%d] %s: %s", i, after[i].locality, strings.Join(changes, ", "))
+	}
+	for _, locality := range removed {
+		fmt.Fprintf(&sb, "\n  %s: removed", locality)
+	}
+	if sb.Len() == 0 {
+		return " no changes"
+	}
+	return sb.String()
+}
+
+// matchLocalities returns the state before the transform of each group of endpoints remaining after it,
+// along with the localities of the groups of endpoints that were removed.
+func matchLocalities(before, after []localityState) ([]localityState, []string) {
+	used := make([]bool, len(before))
+	matched := make([]localityState, len(after))
+	for i := range after {
+		// a group of endpoints with no state before the transform is reported as unchanged.
+		matched[i] = after[i]
+		for j := range before {
+			if !used[j] && before[j].locality == after[i].locality {
+				used[j] = true
+				matched[i] = before[j]
+				break
+			}
+		}
+	}
+	var removed []string
+	for j := range before {
+		if !used[j] {
+			removed = append(removed, before[j].locality)
+		}
+	}
+	return matched, removed
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/pkg/log"
+)
+
+func TestDiffLocalities(t *testing.T) {
+	before := []localityState{
+		{locality: "region1/zone1", endpoints: 2},
+		{locality: "region1/zone2", endpoints: 1},
+		{locality: "region2", endpoints: 1},
+	}
+	after := []localityState{
+		{locality: "region1/zone1", weight: 80, endpoints: 2},
+		{locality: "region1/zone2", endpoints: 1},
+		{locality: "region2", priority: 1},
+	}
+	expected := "\n  [0] region1/zone1: weight 0->80" +
+		"\n  [2] region2: priority 0->1, dropped"
+	if got := diffLocalities(before, after); got != expected {
+		t.Errorf("Got diff %q expected %q", got, expected)
+	}
+	if got := diffLocalities(before, before); got != " no changes" {
+		t.Errorf("Got diff %q expected no changes", got)
+	}
+	removed := []localityState{
+		{locality: "region2", priority: 0, weight: 100, endpoints: 1},
+	}
+	expected = "\n  [0] region2: weight 0->100" +
+		"\n  region1/zone1: removed" +
+		"\n  region1/zone2: removed"
+	if got := diffLocalities(before, removed); got != expected {
+		t.Errorf("Got diff %q expected %q", got, expected)
+	}
+}
+
+func TestApplyLocalityLBSettingDebugLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "locality")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := filepath.Join(dir, "log")
+
+	o := log.DefaultOptions()
+	o.OutputPaths = []string{logFile}
+	o.SetOutputLevel("locality", log.DebugLevel)
+	if err := log.Configure(o); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = log.Configure(log.DefaultOptions())
+	}()
+
+	locality := &envoycore.Locality{Region: "region1", Zone: "zone1"}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/zone1": 100},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region1/zone2", endpoints: 1},
+	)
+	ApplyLocalityLBSetting(locality, cla, setting, true)
+	_ = log.Sync()
+
+	out, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"applied locality lb setting to outbound|8080||test.example.org",
+		"[0] region1/zone1: weight 0->100",
+		"region1/zone2: removed",
+	} {
+		if !strings.Contains(string(out), expected) {
+			t.Errorf("expected log output to contain %q, got %q", expected, out)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"math"
+	"reflect"
+	"testing"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// envoyOverprovisioningFactor is the default overprovisioning factor of Envoy, 1.4.
+const envoyOverprovisioningFactor = 1.4
+
+// markUnhealthy marks the first count endpoints of a group of endpoints as unhealthy.
+func markUnhealthy(cla *apiv2.ClusterLoadAssignment, group, count int) {
+	for i := 0; i < count; i++ {
+		cla.Endpoints[group].LbEndpoints[i].HealthStatus = envoycore.HealthStatus_UNHEALTHY
+	}
+}
+
+// healthyFraction returns the fraction of the given endpoints that are not unhealthy.
+func healthyFraction(healthy, total int) float64 {
+	if total == 0 {
+		return 0
+	}
+	return math.Min(1, envoyOverprovisioningFactor*float64(healthy)/float64(total))
+}
+
+// envoyTraffic computes the fraction of the traffic each locality receives, following the model of
+// https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/load_balancing/priority
+// and https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/load_balancing/locality_weight.
+// The health of a priority is its healthy ratio multiplied by the overprovisioning factor, capped at 100%.
+// Each priority receives the traffic its health allows and the rest spills over to the next priority,
+// the loads being normalized if the sum of the health of all priorities is less than 100%.
+// Within a priority, a locality receives traffic in proportion to its effective weight, the locality
+// weight multiplied by its availability, computed as the health of the priority.
+func envoyTraffic(cla *apiv2.ClusterLoadAssignment) map[string]float64 {
+	type priorityState struct {
+		healthy, total int
+		weights        map[string]float64
+	}
+	priorities := map[uint32]*priorityState{}
+	maxPriority := uint32(0)
+	for _, group := range cla.Endpoints {
+		if len(group.LbEndpoints) == 0 {
+			continue
+		}
+		state := priorities[group.Priority]
+		if state == nil {
+			state = &priorityState{weights: map[string]float64{}}
+			priorities[group.Priority] = state
+		}
+		healthy := 0
+		for _, ep := range group.LbEndpoints {
+			if ep.HealthStatus != envoycore.HealthStatus_UNHEALTHY {
+				healthy++
+			}
+		}
+		state.healthy += healthy
+		state.total += len(group.LbEndpoints)
+		weight := float64(1)
+		if group.LoadBalancingWeight != nil {
+			weight = float64(group.LoadBalancingWeight.Value)
+		}
+		state.weights[util.LocalityToString(group.Locality)] += weight * healthyFraction(healthy, len(group.LbEndpoints))
+		if group.Priority > maxPriority {
+			maxPriority = group.Priority
+		}
+	}
+
+	loads := map[uint32]float64{}
+	remaining, totalHealth := float64(1), float64(0)
+	for p := uint32(0); p <= maxPriority; p++ {
+		state := priorities[p]
+		if state == nil {
+			continue
+		}
+		health := healthyFraction(state.healthy, state.total)
+		loads[p] = math.Min(remaining, health)
+		remaining -= loads[p]
+		totalHealth += health
+	}
+
+	traffic := map[string]float64{}
+	for p, load := range loads {
+		if totalHealth < 1 && totalHealth > 0 {
+			load /= totalHealth
+		}
+		totalWeight := float64(0)
+		for _, weight := range priorities[p].weights {
+			totalWeight += weight
+		}
+		for locality, weight := range priorities[p].weights {
+			if totalWeight > 0 {
+				traffic[locality] += load * weight / totalWeight
+			}
+		}
+	}
+	return traffic
+}
+
+// envoyEndpointTraffic splits the traffic of each locality between its endpoints in proportion to their
+// weights, an endpoint without a weight counting as 1.
+func envoyEndpointTraffic(cla *apiv2.ClusterLoadAssignment) map[string]float64 {
+	localities := envoyTraffic(cla)
+	traffic := map[string]float64{}
+	for _, group := range cla.Endpoints {
+		weights := make([]float64, 0, len(group.LbEndpoints))
+		totalWeight := float64(0)
+		for _, ep := range group.LbEndpoints {
+			weight := float64(1)
+			if ep.LoadBalancingWeight != nil {
+				weight = float64(ep.LoadBalancingWeight.Value)
+			}
+			weights = append(weights, weight)
+			totalWeight += weight
+		}
+		for i, ep := range group.LbEndpoints {
+			traffic[ep.GetEndpoint().GetAddress().GetSocketAddress().GetAddress()] +=
+				localities[util.LocalityToString(group.Locality)] * weights[i] / totalWeight
+		}
+	}
+	return traffic
+}
+
+func assertTraffic(t *testing.T, got, expected map[string]float64) {
+	t.Helper()
+	for locality, fraction := range expected {
+		if math.Abs(got[locality]-fraction) > 0.001 {
+			t.Errorf("locality %s: got traffic %v expected %v (all: %v)", locality, got[locality], fraction, got)
+		}
+	}
+	for locality, fraction := range got {
+		if _, ok := expected[locality]; !ok && fraction > 0 {
+			t.Errorf("locality %s: got unexpected traffic %v", locality, fraction)
+		}
+	}
+}
+
+func TestApplyLocalityWeightEnvoyConformance(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 20,
+					"region1/zone2/*": 80,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		unhealthy map[int]int
+		expected  map[string]float64
+	}{
+		{
+			// all localities fully available, the traffic follows the distribute percentages.
+			name: "healthy",
+			expected: map[string]float64{
+				"region1/zone1/subzone1": 0.1,
+				"region1/zone1/subzone2": 0.1,
+				"region1/zone2/subzone1": 0.8,
+			},
+		},
+		{
+			// 75% healthy, availability min(1, 1.4 * 0.75) = 1, the split is unchanged.
+			name:      "partially healthy within overprovisioning",
+			unhealthy: map[int]int{2: 1},
+			expected: map[string]float64{
+				"region1/zone1/subzone1": 0.1,
+				"region1/zone1/subzone2": 0.1,
+				"region1/zone2/subzone1": 0.8,
+			},
+		},
+		{
+			// 50% healthy, availability 1.4 * 0.5 = 0.7, effective weights 10, 10 and 80 * 0.7 = 56.
+			name:      "partially healthy beyond overprovisioning",
+			unhealthy: map[int]int{2: 2},
+			expected: map[string]float64{
+				"region1/zone1/subzone1": 10.0 / 76,
+				"region1/zone1/subzone2": 10.0 / 76,
+				"region1/zone2/subzone1": 56.0 / 76,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 4},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 4},
+				localitySpec{locality: "region1/zone2/subzone1", endpoints: 4},
+				localitySpec{locality: "region2/zone1/subzone1", endpoints: 4},
+			)
+			for group, count := range tt.unhealthy {
+				markUnhealthy(cla, group, count)
+			}
+			ApplyLocalityLBSetting(locality, cla, setting, true)
+			assertTraffic(t, envoyTraffic(cla), tt.expected)
+		})
+	}
+}
+
+func TestApplyLocalityFailoverEnvoyConformance(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		unhealthy map[int]int
+		expected  map[string]float64
+	}{
+		{
+			name:     "healthy",
+			expected: map[string]float64{"region1/zone1": 1},
+		},
+		{
+			// P0 80% healthy, health min(100%, 1.4 * 80%) = 100%.
+			name:      "P0 within overprovisioning",
+			unhealthy: map[int]int{0: 2},
+			expected:  map[string]float64{"region1/zone1": 1},
+		},
+		{
+			// P0 50% healthy, health 70%, the remaining 30% spill over to P1.
+			name:      "P0 beyond overprovisioning",
+			unhealthy: map[int]int{0: 5},
+			expected: map[string]float64{
+				"region1/zone1": 0.7,
+				"region2/zone1": 0.3,
+			},
+		},
+		{
+			// P0 fully unhealthy, all traffic goes to P1.
+			name:      "P0 unhealthy",
+			unhealthy: map[int]int{0: 10},
+			expected:  map[string]float64{"region2/zone1": 1},
+		},
+		{
+			// P0 unhealthy, P1 20% healthy (health 28%), P2 healthy: P1 28%, P2 72%.
+			name:      "P0 unhealthy and P1 degraded",
+			unhealthy: map[int]int{0: 10, 1: 8},
+			expected: map[string]float64{
+				"region2/zone1": 0.28,
+				"region3/zone1": 0.72,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 10},
+				localitySpec{locality: "region2/zone1", endpoints: 10},
+				localitySpec{locality: "region3/zone1", endpoints: 10},
+			)
+			for group, count := range tt.unhealthy {
+				markUnhealthy(cla, group, count)
+			}
+			ApplyLocalityLBSetting(locality, cla, setting, true)
+			assertTraffic(t, envoyTraffic(cla), tt.expected)
+		})
+	}
+}
+
+func TestApplyLocalityWeightEndpointWeights(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/*":       80,
+					"region2/zone1/*": 20,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 2},
+		localitySpec{locality: "region1/zone2", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 2},
+	)
+	// the weights of the groups are unset, the 80% of region1 is split 3:1 according to the endpoint weights.
+	endpointWeights := [][]uint32{{10, 20}, {10}, {1, 99}}
+	for i, weights := range endpointWeights {
+		for j, weight := range weights {
+			cla.Endpoints[i].LbEndpoints[j].LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+		}
+	}
+	ApplyLocalityLBSetting(locality, cla, setting, true)
+
+	assertTraffic(t, envoyTraffic(cla), map[string]float64{
+		"region1/zone1": 0.6,
+		"region1/zone2": 0.2,
+		"region2/zone1": 0.2,
+	})
+	// within a locality, the endpoints keep their weights and share its traffic accordingly.
+	for i, weights := range endpointWeights {
+		for j, weight := range weights {
+			if got := cla.Endpoints[i].LbEndpoints[j].GetLoadBalancingWeight().GetValue(); got != weight {
+				t.Errorf("endpoint %d/%d: got weight %d expected %d", i, j, got, weight)
+			}
+		}
+	}
+	assertTraffic(t, envoyEndpointTraffic(cla), map[string]float64{
+		"10.0.0.0": 0.2,
+		"10.0.0.1": 0.4,
+		"10.0.1.0": 0.2,
+		"10.0.2.0": 0.002,
+		"10.0.2.1": 0.198,
+	})
+}
+
+// TestApplyLocalityLBSettingIgnoresHealth pins the contract that the emitted weights and priorities are the
+// configured ones whatever the health of the endpoints, Envoy being the one scaling them by health.
+func TestApplyLocalityLBSettingIgnoresHealth(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	settings := map[string]*networking.LocalityLoadBalancerSetting{
+		"distribute": {
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/zone1/*": 70,
+						"region2/zone1/*": 30,
+					},
+				},
+			},
+		},
+		"failover": {
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{
+					From: "region1",
+					To:   "region2",
+				},
+			},
+		},
+	}
+	for name, setting := range settings {
+		t.Run(name, func(t *testing.T) {
+			healthy := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 4},
+				localitySpec{locality: "region2/zone1", endpoints: 4},
+			)
+			degraded := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 4},
+				localitySpec{locality: "region2/zone1", endpoints: 4},
+			)
+			markUnhealthy(degraded, 0, 3)
+			markUnhealthy(degraded, 1, 4)
+			ApplyLocalityLBSetting(locality, healthy, setting, true)
+			ApplyLocalityLBSetting(locality, degraded, setting, true)
+			for _, diff := range CompareSnapshots(SnapshotLoadAssignment(healthy), SnapshotLoadAssignment(degraded)) {
+				t.Errorf("the health of the endpoints changed the transform: %v", diff)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightRegionUnit(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/*": 50,
+					"region2/*": 50,
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		opts    *Options
+		weights []uint32
+	}{
+		{
+			// the share of region1 follows the weights of its subzones.
+			name:    "weights",
+			weights: []uint32{40, 5, 5, 50},
+		},
+		{
+			// the share of region1 follows the number of endpoints of its subzones.
+			name:    "region unit",
+			opts:    &Options{RegionUnitWeighting: true},
+			weights: []uint32{10, 20, 20, 50},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", weight: 8, endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", weight: 1, endpoints: 2},
+				localitySpec{locality: "region1/zone2/subzone1", weight: 1, endpoints: 2},
+				localitySpec{locality: "region2/zone1/subzone1", weight: 1, endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			weights := make([]uint32, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			// region1, with three subzones, and region2, with one, each receive half of the traffic.
+			regions := map[string]float64{}
+			for locality, fraction := range envoyTraffic(cla) {
+				regions[util.ConvertLocality(locality).Region] += fraction
+			}
+			assertTraffic(t, regions, map[string]float64{"region1": 0.5, "region2": 0.5})
+		})
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// enforceMinHealthyEndpoints scales down the weight of the groups of endpoints of each priority with fewer
+// than min healthy endpoints by their number of healthy endpoints out of min, to at least 1, and splits the
+// weight taken from them between the groups of endpoints of the priority with enough healthy endpoints,
+// in proportion to their weights, so that the weights of the priority keep their sum. If no group of the
+// priority has enough healthy endpoints, the weights are only scaled down. The groups of endpoints without
+// endpoints or without a weight are left as is.
+func enforceMinHealthyEndpoints(loadAssignment *apiv2.ClusterLoadAssignment, min int) {
+	priorities := map[uint32][]int{}
+	for i, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 && ep.LoadBalancingWeight != nil {
+			priorities[ep.Priority] = append(priorities[ep.Priority], i)
+		}
+	}
+	for _, indexes := range priorities {
+		var healthy []int
+		var healthyWeights []uint32
+		freed := uint32(0)
+		for _, i := range indexes {
+			ep := loadAssignment.Endpoints[i]
+			count := healthyEndpoints(ep)
+			if count >= min {
+				healthy = append(healthy, i)
+				healthyWeights = append(healthyWeights, ep.LoadBalancingWeight.Value)
+				continue
+			}
+			weight := uint32(uint64(ep.LoadBalancingWeight.Value) * uint64(count) / uint64(min))
+			if weight == 0 {
+				weight = 1
+			}
+			lbLog.Debugf("locality %s of %s has %d healthy endpoints out of %d, scaling its weight down from %d to %d",
+				util.LocalityToString(ep.Locality), loadAssignment.ClusterName, count, min, ep.LoadBalancingWeight.Value, weight)
+			freed += ep.LoadBalancingWeight.Value - weight
+			ep.LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+		}
+		if freed == 0 || len(healthy) == 0 {
+			continue
+		}
+		for j, share := range apportionExact(healthyWeights, freed) {
+			ep := loadAssignment.Endpoints[healthy[j]]
+			ep.LoadBalancingWeight = &wrappers.UInt32Value{Value: ep.LoadBalancingWeight.Value + share}
+		}
+	}
+}
+
+// healthyEndpoints returns the number of endpoints of a group that are not reported unhealthy, draining
+// or timed out.
+func healthyEndpoints(ep *endpoint.LocalityLbEndpoints) int {
+	healthy := 0
+	for _, lbEp := range ep.LbEndpoints {
+		switch lbEp.HealthStatus {
+		case core.HealthStatus_UNHEALTHY, core.HealthStatus_DRAINING, core.HealthStatus_TIMEOUT:
+		default:
+			healthy++
+		}
+	}
+	return healthy
+}
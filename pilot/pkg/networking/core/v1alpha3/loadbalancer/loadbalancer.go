@@ -16,65 +16,689 @@
 package loadbalancer
 
 import (
-	"math"
+	"fmt"
 	"sort"
+	"strings"
+	"sync/atomic"
 
 	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
 	"github.com/golang/protobuf/ptypes/wrappers"
 
 	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/networking/util"
 )
 
+// localityLBDisabled is 1 when locality load balancing is bypassed mesh wide.
+var localityLBDisabled int32
+
+func init() {
+	SetLocalityLBDisabled(features.DisableLocalityLB)
+}
+
+// SetLocalityLBDisabled bypasses locality load balancing mesh wide: when disabled, ApplyLocalityLBSetting
+// leaves the load assignments untouched regardless of the settings. It is safe for concurrent use.
+func SetLocalityLBDisabled(disabled bool) {
+	value := int32(0)
+	if disabled {
+		value = 1
+	}
+	atomic.StoreInt32(&localityLBDisabled, value)
+}
+
+// LocalityLBDisabled returns whether locality load balancing is bypassed mesh wide.
+func LocalityLBDisabled() bool {
+	return atomic.LoadInt32(&localityLBDisabled) == 1
+}
+
 func GetLocalityLbSetting(
 	mesh *v1alpha3.LocalityLoadBalancerSetting,
 	destrule *v1alpha3.LocalityLoadBalancerSetting,
+) *v1alpha3.LocalityLoadBalancerSetting {
+	return GetLocalityLbSettingForWorkload(mesh, destrule, nil, nil)
+}
+
+// GetLocalityLbSettingForWorkload resolves the locality lb setting along the chain mesh config, destination
+// rule, subset of the destination rule, then workload, e.g. a setting read from the annotations of a workload
+// entry. Each setting in the chain overrides the less specific ones, and the most specific Enabled decides
+// whether locality lb is enabled, so a workload may disable it whatever the destination rule says. Locality lb
+// is enabled by the mesh config unless overridden.
+func GetLocalityLbSettingForWorkload(
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+	subset *v1alpha3.LocalityLoadBalancerSetting,
+	workload *v1alpha3.LocalityLoadBalancerSetting,
 ) *v1alpha3.LocalityLoadBalancerSetting {
 	// Locality lb is enabled if its defined in mesh config
 	enabled := mesh != nil
-	// Unless we explicitly override this in destination rule
-	if destrule != nil && destrule.Enabled != nil {
-		enabled = destrule.Enabled.GetValue()
+	// Otherwise fall back to mesh default
+	setting := mesh
+	// The more specific settings override the mesh config. If they are defined, use them
+	for _, override := range []*v1alpha3.LocalityLoadBalancerSetting{destrule, subset, workload} {
+		if override == nil {
+			continue
+		}
+		// Unless we explicitly override this in the more specific setting
+		if override.Enabled != nil {
+			enabled = override.Enabled.GetValue()
+		}
+		setting = override
 	}
 	if !enabled {
 		return nil
 	}
+	return setting
+}
 
-	// Destination Rule overrides mesh config. If its defined, use that
-	if destrule != nil {
-		return destrule
+// MergeLocalityLbSetting resolves the locality lb setting field by field rather than letting the destination
+// rule override the mesh config as a whole: the Distribute and Failover settings the destination rule leaves
+// unset fall back to the ones of the mesh config, and the destination rule Enabled, if set, decides whether
+// locality lb is enabled, so that an explicit false disables it whatever the mesh config says. It returns
+// the mesh config or the destination rule setting as is when the other one is nil, a merged copy otherwise.
+// The FailoverPriority of later versions of the API is not part of LocalityLoadBalancerSetting here.
+func MergeLocalityLbSetting(
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+) *v1alpha3.LocalityLoadBalancerSetting {
+	setting := GetLocalityLbSetting(mesh, destrule)
+	if setting == nil || mesh == nil || destrule == nil {
+		return setting
 	}
-	// Otherwise fall back to mesh default
-	return mesh
+	merged := *destrule
+	if merged.Enabled == nil {
+		merged.Enabled = mesh.Enabled
+	}
+	if merged.Distribute == nil {
+		merged.Distribute = mesh.Distribute
+	}
+	if merged.Failover == nil {
+		merged.Failover = mesh.Failover
+	}
+	return &merged
+}
+
+// GetLocalityLbSettingWithMeshFailover resolves the locality lb setting as GetLocalityLbSetting does, except
+// that a destination rule providing distribute rules but no failover keeps the failover of the mesh config:
+// the distribute rules weight the localities of the primary priority and the mesh failover orders the
+// others. The setting is then a copy of the destination rule one.
+func GetLocalityLbSettingWithMeshFailover(
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+) *v1alpha3.LocalityLoadBalancerSetting {
+	setting := GetLocalityLbSetting(mesh, destrule)
+	if setting == nil || setting != destrule || len(destrule.GetDistribute()) == 0 ||
+		len(destrule.GetFailover()) > 0 || len(mesh.GetFailover()) == 0 {
+		return setting
+	}
+	merged := *destrule
+	merged.Failover = mesh.Failover
+	return &merged
+}
+
+// PortLocalityLbSettings selects a locality lb setting by the port of a cluster, e.g. to configure the HTTP
+// and gRPC ports of a service differently. The load assignment of a cluster is for a single port, so the
+// setting selected for the port of the cluster applies to all of its endpoints.
+type PortLocalityLbSettings struct {
+	// ByPort maps port numbers to their setting.
+	ByPort map[uint32]*v1alpha3.LocalityLoadBalancerSetting
+	// ByProtocol maps protocols, e.g. HTTP or GRPC as in protocol.Instance, to the setting of the ports
+	// not listed in ByPort.
+	ByProtocol map[string]*v1alpha3.LocalityLoadBalancerSetting
+}
+
+// Select returns the setting of a port, nil if none is configured for it.
+func (p *PortLocalityLbSettings) Select(port uint32, protocol string) *v1alpha3.LocalityLoadBalancerSetting {
+	if p == nil {
+		return nil
+	}
+	if setting, ok := p.ByPort[port]; ok {
+		return setting
+	}
+	return p.ByProtocol[protocol]
+}
+
+// GetLocalityLbSettingForPort resolves the locality lb setting as GetLocalityLbSetting does, the setting
+// selected for the port of the cluster overriding the destination rule as a subset would.
+func GetLocalityLbSettingForPort(
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+	ports *PortLocalityLbSettings,
+	port uint32,
+	protocol string,
+) *v1alpha3.LocalityLoadBalancerSetting {
+	return GetLocalityLbSettingForWorkload(mesh, destrule, ports.Select(port, protocol), nil)
+}
+
+// GetLocalityLbSettingWithProvenance behaves like GetLocalityLbSetting, and also reports where the
+// resolved setting comes from. destruleName identifies the destination rule, e.g. namespace/name.
+func GetLocalityLbSettingWithProvenance(
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+	destruleName string,
+) (*v1alpha3.LocalityLoadBalancerSetting, Provenance) {
+	setting := GetLocalityLbSetting(mesh, destrule)
+	switch {
+	case setting == nil:
+		return nil, Provenance{}
+	case setting == destrule:
+		return setting, Provenance{Source: SourceDestinationRule, DestinationRule: destruleName}
+	default:
+		return setting, Provenance{Source: SourceMeshConfig}
+	}
+}
+
+// ResolveAll maps the name of every destination rule to its setting as resolved by GetLocalityLbSetting.
+func ResolveAll(
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrules map[string]*v1alpha3.LocalityLoadBalancerSetting,
+) map[string]*v1alpha3.LocalityLoadBalancerSetting {
+	resolved := make(map[string]*v1alpha3.LocalityLoadBalancerSetting, len(destrules))
+	for name, destrule := range destrules {
+		resolved[name] = GetLocalityLbSetting(mesh, destrule)
+	}
+	return resolved
 }
 
+// ApplyLocalityLBSetting applies the locality lb setting to the load assignment of a proxy in the given locality.
+// Only the groups of endpoints are transformed, so endpoints referenced by name from the groups, and
+// resolved from NamedEndpoints, are handled like inline ones.
+// The weights and priorities are computed from the settings and the configured weights only, never from
+// the health of the endpoints: the weights express the intended split in the steady state, and Envoy scales
+// them by the availability of the localities. This is the contract weighted priority health relies on, an
+// option of the load assignment policy in later versions of the Envoy API that is not part of the v2 API.
+// The LbEndpoints of a group of endpoints are never reordered, whatever groups are dropped or removed:
+// merged duplicate localities append their endpoints to the ones of the first group, and the groups
+// split by preferred metadata keep the relative order of their endpoints.
+// A setting with both distribute and failover settings weights the localities first, then the failover
+// settings prioritize the weighted localities, if enableFailover is set, so that Envoy promotes the next
+// priority once the weighted localities drain. Failover applies on its own when no distribute rule matches
+// the proxy locality, and the localities the distribute settings drop get the lowest priority.
+// It returns whether the setting applied to the proxy, as Result.Applied reports it: it does not when no
+// distribute rule matches the proxy locality and failover is not applied, e.g. for a proxy of another
+// region, and the load assignment is then left to round robin as is.
 func ApplyLocalityLBSetting(
 	locality *core.Locality,
 	loadAssignment *apiv2.ClusterLoadAssignment,
 	localityLB *v1alpha3.LocalityLoadBalancerSetting,
 	enableFailover bool,
-) {
-	if locality == nil || loadAssignment == nil {
-		return
+) bool {
+	return ApplyLocalityLBSettingWithOptions(locality, loadAssignment, localityLB, enableFailover, nil).Applied
+}
+
+// ApplyLocalityLB resolves the locality lb setting from the mesh config and the destination rule, as
+// GetLocalityLbSetting does, and applies it to the load assignment. It returns the effective setting,
+// nil if locality lb is disabled, in which case the load assignment is left untouched.
+func ApplyLocalityLB(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) *v1alpha3.LocalityLoadBalancerSetting {
+	localityLB := GetLocalityLbSetting(mesh, destrule)
+	ApplyLocalityLBSetting(locality, loadAssignment, localityLB, enableFailover)
+	return localityLB
+}
+
+// ApplyLocalityLBSettingWithOptions behaves like ApplyLocalityLBSetting, tuned by the given options.
+// A nil opts is equivalent to the zero Options. It reports the mode it applied.
+func ApplyLocalityLBSettingWithOptions(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+	opts *Options,
+) *Result {
+	if opts == nil {
+		opts = &Options{}
+	}
+	result := &Result{Mode: ModeNone, Setting: localityLB, Provenance: opts.Provenance}
+	if loadAssignment != nil {
+		result.MaxPriority = maxPriority(loadAssignment)
+	}
+	// a nil setting means locality lb is disabled, do not rely on the nil-safe getters for that.
+	if locality == nil || loadAssignment == nil || localityLB == nil {
+		return result
+	}
+	// an empty setting has nothing to apply unless failover is enabled: failover then prioritizes the
+	// endpoints by topology, the default locality failover, so that case is not skipped.
+	if len(localityLB.GetDistribute()) == 0 && len(localityLB.GetFailover()) == 0 && !enableFailover {
+		return result
+	}
+	if LocalityLBDisabled() {
+		lbLog.Debugf("locality lb is disabled, not applying it to %s", loadAssignment.ClusterName)
+		return result
+	}
+	// the endpoints of DNS clusters are hostnames, they have no locality to weight or prioritize by.
+	if withoutLocalities(loadAssignment) {
+		lbLog.Debugf("the endpoints of %s have no locality, e.g. hostnames of a DNS cluster, not applying locality lb",
+			loadAssignment.ClusterName)
+		return result
+	}
+	if opts.ApplyDistributeToUnknownLocality && locality.GetRegion() == "" {
+		localityLB = unknownLocalityDistribute(locality, localityLB)
+	}
+	span := startApplySpan(loadAssignment, opts)
+	defer endApplySpan(span, result)
+
+	// the original load assignment is restored if the transform overruns its deadline or is invalid.
+	var original apiv2.ClusterLoadAssignment
+	if opts.Deadline > 0 || opts.ValidateTransform || opts.VerifyAddresses {
+		original = util.CloneClusterLoadAssignment(loadAssignment)
+	}
+	if opts.Deadline > 0 {
+		budgeted := *opts
+		budgeted.deadline = budgeted.now().Add(opts.Deadline)
+		opts = &budgeted
+	}
+	if opts.AnnotateRationale {
+		annotated := *opts
+		annotated.rationales = newRationales()
+		opts = &annotated
+	}
+	var addresses map[string]bool
+	if opts.VerifyAddresses {
+		addresses = endpointAddresses(loadAssignment)
+		verified := *opts
+		verified.intendedDrops = map[string]bool{}
+		opts = &verified
 	}
 
-	// one of Distribute or Failover settings can be applied.
-	if localityLB.GetDistribute() != nil {
-		applyLocalityWeight(locality, loadAssignment, localityLB.GetDistribute())
-	} else if enableFailover {
+	if opts.RecordOriginals {
+		recordOriginals(loadAssignment)
+	}
+	// several groups of endpoints with the same locality would be weighted as distinct localities.
+	mergeDuplicateLocalities(loadAssignment, opts.MergeDuplicateLocalities)
+	if factor := opts.overprovisioningFactor(); factor > 0 {
+		setOverprovisioningFactor(loadAssignment, factor)
+	}
+
+	// the snapshot is only taken when debug logging is enabled, to keep the common path cheap.
+	var before []localityState
+	if lbLog.DebugEnabled() {
+		before = snapshotLocalities(loadAssignment)
+		defer func() {
+			lbLog.Debugf("applied locality lb setting to %s:%s",
+				loadAssignment.ClusterName, diffLocalities(before, snapshotLocalities(loadAssignment)))
+		}()
+	}
+
+	// the Failover settings are applied after the Distribute settings, if any.
+	distribute := localityLB.GetDistribute() != nil
+	failover := enableFailover && (!distribute || len(localityLB.GetFailover()) > 0)
+	// a proxy without a region is as far from every locality, it has no locality to prefer.
+	if failover && locality.GetRegion() == "" {
+		lbLog.Debugf("proxy locality %q has no region, not applying locality failover to %s",
+			util.LocalityToString(locality), loadAssignment.ClusterName)
+		failover = false
+	}
+
+	// failover orders the endpoints of a group by their metadata by splitting the group in two,
+	// the groups of endpoints have to be split before being masked.
+	if opts.FailoverPreferredMetadata != nil && failover {
+		splitPreferredEndpoints(loadAssignment, opts)
+	}
+
+	// only the groups of endpoints in the priorities that may be modified are transformed,
+	// their failover priorities come after the frozen ones.
+	masked, basePriority := loadAssignment, uint32(0)
+	if opts.PriorityMask != nil {
+		masked, basePriority = maskPriorities(loadAssignment, opts.PriorityMask)
+	}
+
+	// the groups of endpoints the distribute settings drop, failover must not prefer them.
+	var dropped map[*endpoint.LocalityLbEndpoints]bool
+	// the number of groups of endpoints the distribute settings drop, for the metrics.
+	distributeDropped := 0
+	if distribute {
+		local := localEndpoints(locality, masked)
+		distributeDropped = localitiesWithEndpoints(masked)
+		if failover {
+			dropped = map[*endpoint.LocalityLbEndpoints]bool{}
+			for _, ep := range masked.Endpoints {
+				if len(ep.LbEndpoints) > 0 {
+					dropped[ep] = true
+				}
+			}
+		}
+		result.Applied = applyLocalityWeight(locality, masked, localityLB.GetDistribute(), opts)
+		distributeDropped -= localitiesWithEndpoints(masked)
+		for _, ep := range masked.Endpoints {
+			if len(ep.LbEndpoints) > 0 {
+				delete(dropped, ep)
+			}
+		}
+		result.Mode = ModeDistribute
+		// a To leaving out the proxy locality is almost always a mistake, the proxy loses its local endpoints.
+		if local > 0 && localEndpoints(locality, masked) == 0 && !opts.overrun() {
+			warning := fmt.Sprintf("the distribute rules of %s drop the endpoints of the proxy locality %s, "+
+				"their To localities do not list it", loadAssignment.ClusterName, util.LocalityToString(locality))
+			lbLog.Debug(warning)
+			result.Warnings = append(result.Warnings, warning)
+		}
+		// combined, the residency is enforced once both modes are applied.
+		if opts.StrictResidency && !failover {
+			if dropped := enforceResidency(locality, masked, localityLB, result.Mode, opts); len(dropped) > 0 && opts.PriorityMask == nil {
+				compactPriorities(masked, dropped)
+			}
+		}
+		if opts.MinHealthyEndpoints > 0 {
+			enforceMinHealthyEndpoints(masked, opts.MinHealthyEndpoints)
+		}
+		if opts.MaxSkewRatio >= 1 {
+			enforceMaxSkewRatio(masked, opts.MaxSkewRatio)
+		}
+		// the callers enable failover along with locality weighted load balancing, on outlier detection.
+		if opts.SkipSingleLocalityWeight && !enableFailover {
+			skipSingleLocalityWeight(masked)
+		}
+	}
+	if failover {
 		// Failover needs outlier detection, otherwise Envoy will never drop down to a lower priority.
-		applyLocalityFailover(locality, loadAssignment, localityLB.GetFailover())
+		result.Warnings = append(result.Warnings, applyLocalityFailover(locality, masked, localityLB.GetFailover(), opts)...)
+		result.Applied = true
+		// the distribute rules are independent of failover, they may not apply to the proxy locality.
+		result.Mode = ModeFailover
+		if distribute && composeDistribute(locality, masked, localityLB.GetDistribute(), opts) != nil {
+			result.Mode = ModeCombined
+			// the distributed weights sum up to 100 across priorities, each priority is weighted on its own.
+			normalizePriorityWeights(masked, 100*opts.weightScale())
+		}
+		if len(dropped) > 0 && opts.PriorityMask == nil {
+			compactPriorities(masked, droppedIndexes(masked, dropped))
+		}
+		if opts.StrictResidency {
+			if dropped := enforceResidency(locality, masked, localityLB, result.Mode, opts); len(dropped) > 0 {
+				compactPriorities(masked, dropped)
+			}
+		}
+		for _, ep := range masked.Endpoints {
+			ep.Priority += basePriority
+		}
+		if opts.FailoverTricklePercent > 0 {
+			applyFailoverTrickle(loadAssignment, basePriority, opts.FailoverTricklePercent, opts)
+		}
+	} else if !distribute && opts.StrictResidency {
+		enforceResidency(locality, masked, localityLB, result.Mode, opts)
+	}
+	if opts.overrun() {
+		warning := fmt.Sprintf("locality lb setting of %s overran its deadline of %v, sending the endpoints untransformed",
+			loadAssignment.ClusterName, opts.Deadline)
+		lbLog.Debug(warning)
+		*loadAssignment = original
+		result.Mode = ModeNone
+		result.Applied = false
+		result.Warnings = append(result.Warnings, warning)
+		result.MaxPriority = maxPriority(loadAssignment)
+		return result
+	}
+	var err error
+	if opts.ValidateTransform {
+		err = ValidateTransformedCLA(loadAssignment)
+	}
+	if err == nil && opts.VerifyAddresses {
+		err = verifyAddresses(addresses, loadAssignment, opts.intendedDrops)
+	}
+	if err != nil {
+		warning := fmt.Sprintf("locality lb setting of %s produced an invalid load assignment, "+
+			"sending the endpoints untransformed: %v", loadAssignment.ClusterName, err)
+		lbLog.Debug(warning)
+		*loadAssignment = original
+		result.Mode = ModeNone
+		result.Applied = false
+		result.Warnings = append(result.Warnings, warning)
+		result.MaxPriority = maxPriority(loadAssignment)
+		return result
+	}
+	if opts.PerPriorityFactors != nil {
+		result.Warnings = append(result.Warnings, applyPerPriorityFactors(loadAssignment, opts.PerPriorityFactors)...)
+	}
+	if opts.AnnotateMetadata || opts.AnnotateRationale {
+		annotateMetadata(masked, opts.AnnotateMetadata, opts.rationales)
+	}
+	if opts.RecordMetrics && !opts.sideEffectFree {
+		recordLocalityWeights(locality, loadAssignment)
+		if distribute {
+			recordDroppedLocalities(locality, loadAssignment, distributeDropped)
+		}
+		if failover {
+			recordPriorityEndpoints(locality, loadAssignment)
+		}
+	}
+	result.MaxPriority = maxPriority(loadAssignment)
+	return result
+}
+
+// unknownLocalityDistribute returns the setting to apply to a proxy without a region: if none of the
+// distribute rules matches it, a copy of the setting whose first distribute rule applies to any proxy.
+func unknownLocalityDistribute(
+	locality *core.Locality,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting,
+) *v1alpha3.LocalityLoadBalancerSetting {
+	distribute := localityLB.GetDistribute()
+	if len(distribute) == 0 || distribute[0] == nil || len(matchingDistributes(locality, distribute)) > 0 {
+		return localityLB
+	}
+	lbLog.Debugf("proxy locality %q matches no distribute rule, applying the rule from %q to it",
+		util.LocalityToString(locality), distribute[0].From)
+	defaulted := *localityLB
+	defaulted.Distribute = []*v1alpha3.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "*",
+			To:   distribute[0].To,
+		},
+	}
+	return &defaulted
+}
+
+// droppedIndexes returns the indexes of the given groups of endpoints in the load assignment.
+func droppedIndexes(loadAssignment *apiv2.ClusterLoadAssignment, dropped map[*endpoint.LocalityLbEndpoints]bool) []int {
+	var indexes []int
+	for i, ep := range loadAssignment.Endpoints {
+		if dropped[ep] {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// withoutLocalities returns whether a load assignment has groups of endpoints, none of which has a locality.
+func withoutLocalities(loadAssignment *apiv2.ClusterLoadAssignment) bool {
+	for _, ep := range loadAssignment.Endpoints {
+		if util.LocalityToString(ep.Locality) != "" {
+			return false
+		}
+	}
+	return len(loadAssignment.Endpoints) > 0
+}
+
+// localEndpoints returns the number of endpoints of a load assignment in the proxy locality, including the
+// more specific localities, e.g. the subzones of the proxy zone.
+func localEndpoints(locality *core.Locality, loadAssignment *apiv2.ClusterLoadAssignment) int {
+	if locality.GetRegion() == "" {
+		return 0
+	}
+	proxyLocality := util.LocalityToString(locality)
+	count := 0
+	for _, ep := range loadAssignment.Endpoints {
+		if util.LocalityMatch(ep.Locality, proxyLocality) {
+			count += len(ep.LbEndpoints)
+		}
+	}
+	return count
+}
+
+// localitiesWithEndpoints returns the number of groups of endpoints of a load assignment with endpoints.
+func localitiesWithEndpoints(loadAssignment *apiv2.ClusterLoadAssignment) int {
+	count := 0
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 {
+			count++
+		}
+	}
+	return count
+}
+
+// skipSingleLocalityWeight unsets the weight of the only group of endpoints left with endpoints, if any.
+func skipSingleLocalityWeight(loadAssignment *apiv2.ClusterLoadAssignment) {
+	var single *endpoint.LocalityLbEndpoints
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		if single != nil {
+			return
+		}
+		single = ep
+	}
+	if single != nil {
+		single.LoadBalancingWeight = nil
+	}
+}
+
+// maxPriority returns the highest priority number of the groups of endpoints of a load assignment.
+func maxPriority(loadAssignment *apiv2.ClusterLoadAssignment) uint32 {
+	max := uint32(0)
+	for _, ep := range loadAssignment.Endpoints {
+		if ep.Priority > max {
+			max = ep.Priority
+		}
 	}
+	return max
 }
 
-// set locality loadbalancing weight
+// mergeDuplicateLocalities detects the groups of endpoints sharing a locality with a previous group.
+// If merge is set, their endpoints are moved into the first group of the locality, whose weight becomes
+// the sum of the weights of the merged groups, otherwise they are only logged.
+func mergeDuplicateLocalities(loadAssignment *apiv2.ClusterLoadAssignment, merge bool) {
+	// locality -> index of the first group of endpoints in that locality
+	seen := make(map[string]int, len(loadAssignment.Endpoints))
+	duplicates := false
+	for i, ep := range loadAssignment.Endpoints {
+		locality := util.LocalityToString(ep.Locality)
+		if _, ok := seen[locality]; ok {
+			duplicates = true
+			continue
+		}
+		seen[locality] = i
+	}
+	if !duplicates {
+		return
+	}
+	if !merge {
+		lbLog.Debugf("cluster %s has several groups of endpoints in the same locality, their weights are not merged",
+			loadAssignment.ClusterName)
+		return
+	}
+
+	merged := make([]*endpoint.LocalityLbEndpoints, 0, len(seen))
+	for i, ep := range loadAssignment.Endpoints {
+		firstIndex := seen[util.LocalityToString(ep.Locality)]
+		if i == firstIndex {
+			merged = append(merged, ep)
+			continue
+		}
+		first := loadAssignment.Endpoints[firstIndex]
+		if first.LoadBalancingWeight != nil || ep.LoadBalancingWeight != nil {
+			// an unset weight counts as 1, as it does for Envoy.
+			weight := first.LoadBalancingWeight.GetValue()
+			if first.LoadBalancingWeight == nil {
+				weight = 1
+			}
+			if ep.LoadBalancingWeight == nil {
+				weight++
+			} else {
+				weight += ep.LoadBalancingWeight.Value
+			}
+			first.LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+		}
+		// the endpoints of the first group may be shared with the load assignment it was cloned from,
+		// they are appended to a new slice rather than to theirs.
+		lbEndpoints := make([]*endpoint.LbEndpoint, 0, len(first.LbEndpoints)+len(ep.LbEndpoints))
+		first.LbEndpoints = append(append(lbEndpoints, first.LbEndpoints...), ep.LbEndpoints...)
+	}
+	lbLog.Debugf("merged %d groups of endpoints of cluster %s into %d localities",
+		len(loadAssignment.Endpoints), loadAssignment.ClusterName, len(merged))
+	loadAssignment.Endpoints = merged
+}
+
+// setOverprovisioningFactor sets the overprovisioning factor of the load assignment policy, keeping the
+// other fields of an existing policy such as DropOverloads. The policy is copied rather than modified in place,
+// see util.CloneClusterLoadAssignment.
+func setOverprovisioningFactor(loadAssignment *apiv2.ClusterLoadAssignment, factor uint32) {
+	policy := &apiv2.ClusterLoadAssignment_Policy{}
+	if loadAssignment.Policy != nil {
+		*policy = *loadAssignment.Policy
+	}
+	policy.OverprovisioningFactor = &wrappers.UInt32Value{Value: factor}
+	loadAssignment.Policy = policy
+}
+
+// applyPerPriorityFactors sets the overprovisioning factor of the most preferred priority with endpoints
+// that has one as the factor of the load assignment, and returns a warning for each other priority with
+// endpoints whose factor differs, which Envoy cannot honor.
+func applyPerPriorityFactors(loadAssignment *apiv2.ClusterLoadAssignment, factors map[uint32]uint32) []string {
+	present := map[uint32]bool{}
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 {
+			present[ep.Priority] = true
+		}
+	}
+	priorities := make([]int, 0, len(present))
+	for priority := range present {
+		if _, ok := factors[priority]; ok {
+			priorities = append(priorities, int(priority))
+		}
+	}
+	if len(priorities) == 0 {
+		return nil
+	}
+	sort.Ints(priorities)
+	primary := uint32(priorities[0])
+	factor := factors[primary]
+	setOverprovisioningFactor(loadAssignment, factor)
+	var warnings []string
+	for _, priority := range priorities[1:] {
+		if factors[uint32(priority)] == factor {
+			continue
+		}
+		warning := fmt.Sprintf("the overprovisioning factor %d of priority %d of %s is not supported by Envoy, "+
+			"the factor %d of priority %d applies to all priorities", factors[uint32(priority)], priority,
+			loadAssignment.ClusterName, factor, primary)
+		lbLog.Debug(warning)
+		warnings = append(warnings, warning)
+	}
+	return warnings
+}
+
+// maskPriorities returns a shallow copy of the load assignment holding only the groups of endpoints
+// whose priority is in the mask, along with the priority following the highest frozen priority.
+// The groups are shared with the original load assignment, so transforming them modifies it.
+func maskPriorities(loadAssignment *apiv2.ClusterLoadAssignment, mask map[uint32]bool) (*apiv2.ClusterLoadAssignment, uint32) {
+	masked := *loadAssignment
+	masked.Endpoints = make([]*endpoint.LocalityLbEndpoints, 0, len(loadAssignment.Endpoints))
+	basePriority := uint32(0)
+	for _, ep := range loadAssignment.Endpoints {
+		if mask[ep.Priority] {
+			masked.Endpoints = append(masked.Endpoints, ep)
+		} else if ep.Priority+1 > basePriority {
+			basePriority = ep.Priority + 1
+		}
+	}
+	return &masked, basePriority
+}
+
+// set locality loadbalancing weight, returns whether a distribute rule matches the proxy locality.
 func applyLocalityWeight(
 	locality *core.Locality,
 	loadAssignment *apiv2.ClusterLoadAssignment,
-	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute) {
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute,
+	opts *Options) bool {
 	if distribute == nil {
-		return
+		return false
 	}
 
 	// Support Locality weighted load balancing
@@ -82,99 +706,847 @@ func applyLocalityWeight(
 	// by providing weights in LocalityLbEndpoints via load_balancing_weight.
 	// By setting weights across different localities, it can allow
 	// Envoy to weight assignments across different zones and geographical locations.
+	// All the rules whose From matches the proxy locality are composed, the more specific ones taking
+	// precedence for the endpoint localities they list. Rules that do not match must not have any side
+	// effect on the load assignment.
+	rule := composeDistribute(locality, loadAssignment, distribute, opts)
+	if rule == nil {
+		return false
+	}
+	index := newLocalityWeightIndex(locality, loadAssignment, rule, opts)
+	// the index is incomplete, the load assignment is about to be restored.
+	if opts.overrun() {
+		return true
+	}
+	index.apply(loadAssignment, rule.to, opts)
+	return true
+}
+
+// composedDistribute is the composition of the distribute rules whose From matches the proxy locality.
+type composedDistribute struct {
+	// From of the composed rules, from the most to the least specific
+	froms []string
+	// To localities in the order they claim the groups of endpoints, the ones of the more specific rules first
+	order []string
+	// To locality -> percentage, taken from the most specific rule listing the To locality
+	to map[string]uint32
+	// To locality -> From of the rule it is taken from
+	fromOf map[string]string
+	// whether the To localities only match the endpoint localities equal to them
+	exact bool
+	// To locality -> its matcher, split once when composed rather than on every match
+	matchers map[string]util.LocalityMatcher
+}
+
+// composeDistribute composes the distribute rules whose From matches the proxy locality, or returns nil if
+// none matches. A group of endpoints matched by the To localities of several rules is given its percentage
+// by the rule with the most specific From, e.g. a zone level one over a region level one, or by the first
+// listed rule if they are as specific. Within a rule, a group of endpoints matched by overlapping To
+// localities, e.g. region1/* and region1/zone1/*, is given its percentage by the most specific one,
+// then by the first one in lexical order, so that the weights do not depend on the iteration order of
+// the map. The To localities may mix granularities, e.g. a zone and one of its subzones, each group of
+// endpoints is claimed once and its weight never counted twice. The percentages of the composed rules
+// are taken as is, they only sum up to 100 if the rules do not overlap. The BalancedDistribute entries
+// are expanded against the localities of the load assignment.
+func composeDistribute(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute,
+	opts *Options,
+) *composedDistribute {
+	if composed, ok := opts.precomputed.composedFor(locality, distribute); ok {
+		return composed
+	}
+	rules := matchingDistributes(locality, distribute)
+	if len(rules) == 0 {
+		return nil
+	}
+	composed := &composedDistribute{
+		to:       map[string]uint32{},
+		fromOf:   map[string]string{},
+		exact:    opts.ExactLocalityMatch,
+		matchers: map[string]util.LocalityMatcher{},
+	}
+	for _, rule := range rules {
+		composed.froms = append(composed.froms, rule.From)
+		for _, to := range specificTo(rule.To) {
+			if _, exist := composed.to[to]; exist || to == BalancedDistribute {
+				continue
+			}
+			composed.order = append(composed.order, to)
+			composed.to[to] = rule.To[to]
+			composed.fromOf[to] = rule.From
+			composed.matchers[to] = util.NewLocalityMatcher(to)
+		}
+		// the balanced share goes to the localities the rule and the more specific ones do not list.
+		if weight, ok := rule.To[BalancedDistribute]; ok {
+			composed.balance(loadAssignment, weight, rule.From)
+		}
+	}
+	return composed
+}
+
+// matchingDistributes returns the distribute rules whose From matches the proxy locality, from the most to
+// the least specific From, the equally specific ones in the order they are listed.
+func matchingDistributes(
+	locality *core.Locality,
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute,
+) []*v1alpha3.LocalityLoadBalancerSetting_Distribute {
+	var rules []*v1alpha3.LocalityLoadBalancerSetting_Distribute
 	for _, localityWeightSetting := range distribute {
 		if localityWeightSetting != nil &&
-			util.LocalityMatch(locality, localityWeightSetting.From) {
-			misMatched := map[int]struct{}{}
-			for i := range loadAssignment.Endpoints {
-				misMatched[i] = struct{}{}
-			}
-			for locality, weight := range localityWeightSetting.To {
-				// index -> original weight
-				destLocMap := map[int]uint32{}
-				totalWeight := uint32(0)
-				for i, ep := range loadAssignment.Endpoints {
-					if _, exist := misMatched[i]; exist {
-						if util.LocalityMatch(ep.Locality, locality) {
-							delete(misMatched, i)
-							if ep.LoadBalancingWeight != nil {
-								destLocMap[i] = ep.LoadBalancingWeight.Value
-							} else {
-								destLocMap[i] = 1
-							}
-							totalWeight += destLocMap[i]
-						}
-					}
-				}
-				// in case wildcard dest matching multi groups of endpoints
-				// the load balancing weight for a locality is divided by the sum of the weights of all localities
-				for index, originalWeight := range destLocMap {
-					destWeight := float64(originalWeight*weight) / float64(totalWeight)
-					if destWeight > 0 {
-						loadAssignment.Endpoints[index].LoadBalancingWeight = &wrappers.UInt32Value{
-							Value: uint32(math.Ceil(destWeight)),
-						}
-					}
-				}
-			}
+			proxyLocalityMatch(locality, localityWeightSetting.From) {
+			rules = append(rules, localityWeightSetting)
+		}
+	}
+	sort.SliceStable(rules, func(i, j int) bool {
+		return fromSpecificity(rules[i].From) > fromSpecificity(rules[j].From)
+	})
+	return rules
+}
 
-			// remove groups of endpoints in a locality that miss matched
-			for i := range misMatched {
-				loadAssignment.Endpoints[i].LbEndpoints = nil
-			}
-			break
+// BalancedDistribute is a distribute To keyword standing for the localities present in the load assignment
+// that the other To localities of the rule do not list. Its percentage is split evenly between them when the
+// rule is applied, so that the traffic is spread evenly across whatever localities exist, e.g. with a To of
+// {"~balanced": 100}. It is not a valid locality label, so it cannot clash with an actual locality.
+const BalancedDistribute = "~balanced"
+
+// claim returns the To locality claiming a group of endpoints of the given locality, if any.
+func (c *composedDistribute) claim(endpointLocality *core.Locality) (string, bool) {
+	for _, to := range c.order {
+		if c.match(endpointLocality, to) {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// match checks whether the locality of a group of endpoints matches a To locality of the composed rules, as
+// endpointLocalityMatch does, or, with exact matching, whether it has the region, zone and subzone of the
+// To locality, a wildcard only matching itself.
+func (c *composedDistribute) match(endpointLocality *core.Locality, to string) bool {
+	if endpointLocality == nil {
+		return false
+	}
+	matcher := c.matchers[to]
+	if c.exact {
+		return endpointLocality.Region == matcher.Region &&
+			endpointLocality.Zone == matcher.Zone && endpointLocality.SubZone == matcher.SubZone
+	}
+	return matcher.Match(endpointLocality)
+}
+
+// balance splits the percentage of a BalancedDistribute To entry evenly between the localities with
+// endpoints that no composed To locality matches yet, the rounding remainder going to the first ones in
+// lexical order so that the shares sum up to the percentage.
+func (c *composedDistribute) balance(loadAssignment *apiv2.ClusterLoadAssignment, weight uint32, from string) {
+	present := map[string]bool{}
+	for _, ep := range loadAssignment.Endpoints {
+		if ep.Locality == nil || len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		if _, listed := c.claim(ep.Locality); !listed {
+			present[util.LocalityToString(ep.Locality)] = true
+		}
+	}
+	localities := make([]string, 0, len(present))
+	for locality := range present {
+		localities = append(localities, locality)
+	}
+	sort.Strings(localities)
+	even := make([]uint32, len(localities))
+	for i := range even {
+		even[i] = 1
+	}
+	shares := apportionExact(even, weight)
+	for i, locality := range localities {
+		c.order = append(c.order, locality)
+		c.to[locality] = shares[i]
+		c.fromOf[locality] = from
+		c.matchers[locality] = util.NewLocalityMatcher(locality)
+	}
+}
+
+// fromSpecificity returns the number of locality levels a distribute From or To names, a wildcard not counting.
+func fromSpecificity(from string) int {
+	specificity := 0
+	region, zone, subzone := util.SplitLocality(from)
+	for _, level := range []string{region, zone, subzone} {
+		if level != "" && level != "*" {
+			specificity++
+		}
+	}
+	return specificity
+}
+
+// specificTo returns the To localities of a distribute rule from the most to the least specific, the
+// equally specific ones in lexical order.
+func specificTo(to map[string]uint32) []string {
+	localities := sortedTo(to)
+	sort.SliceStable(localities, func(i, j int) bool {
+		return fromSpecificity(localities[i]) > fromSpecificity(localities[j])
+	})
+	return localities
+}
+
+// sortedTo returns the To localities of a distribute rule in lexical order.
+func sortedTo(to map[string]uint32) []string {
+	localities := make([]string, 0, len(to))
+	for locality := range to {
+		localities = append(localities, locality)
+	}
+	sort.Strings(localities)
+	return localities
+}
+
+// localityLbWeight returns the original weight of a group of endpoints. If LoadBalancingWeight is unset,
+// the weights stored in the LbEndpoints metadata under opts.WeightMetadataKey are summed up, or else
+// the LoadBalancingWeight of the LbEndpoints if any of them is set, an unset one counting as the default.
+// The weight defaults to opts.DefaultWeight, or 1 as in Envoy.
+// Envoy picks a locality by its weight first, then an endpoint of the locality by the endpoint weights,
+// so the weights of the endpoints never need to be rescaled for the locality split to hold.
+func localityLbWeight(ep *endpoint.LocalityLbEndpoints, opts *Options) uint32 {
+	if ep.LoadBalancingWeight != nil {
+		return ep.LoadBalancingWeight.Value
+	}
+	if opts.WeightMetadataKey != nil {
+		weight := uint32(0)
+		for _, lbEp := range ep.LbEndpoints {
+			weight += opts.WeightMetadataKey.weight(lbEp.GetMetadata())
+		}
+		if weight > 0 {
+			return weight
 		}
 	}
+	weight, weighted := uint32(0), false
+	for _, lbEp := range ep.LbEndpoints {
+		if lbEp.LoadBalancingWeight != nil {
+			weighted = true
+			weight += lbEp.LoadBalancingWeight.Value
+		} else {
+			weight += opts.defaultWeight()
+		}
+	}
+	if weighted && weight > 0 {
+		return weight
+	}
+	return opts.defaultWeight()
+}
+
+// endpointLocalityMatch checks whether the locality of a group of endpoints matches a locality of a rule.
+// A group of endpoints without a locality matches no rule, not even a wildcard one.
+func endpointLocalityMatch(endpointLocality *core.Locality, ruleLocality string) bool {
+	return endpointLocality != nil && util.LocalityMatch(endpointLocality, ruleLocality)
+}
+
+// proxyLocalityMatch checks whether the proxy locality matches the From locality of a rule.
+// If the proxy locality is less specific than the rule, e.g. the proxy only reports a region
+// while the rule is zone-qualified, the rule falls back to the levels the proxy does report.
+func proxyLocalityMatch(proxyLocality *core.Locality, ruleLocality string) bool {
+	if util.LocalityMatch(proxyLocality, ruleLocality) {
+		return true
+	}
+	if proxyLocality.GetRegion() == "" {
+		return false
+	}
+
+	region, zone, subzone := util.SplitLocality(ruleLocality)
+	var fallback string
+	switch {
+	case proxyLocality.GetZone() == "" && zone != "":
+		fallback = region
+	case proxyLocality.GetSubZone() == "" && subzone != "":
+		fallback = region + "/" + zone
+	default:
+		return false
+	}
+	if !util.LocalityMatch(proxyLocality, fallback) {
+		return false
+	}
+	lbLog.Debugf("proxy locality %q has insufficient topology labels for locality lb rule %q, falling back to %q",
+		util.LocalityToString(proxyLocality), ruleLocality, fallback)
+	return true
 }
 
-// set locality loadbalancing priority
+// The tiers failover assigns to the groups of endpoints, from the most to the least preferred. They are
+// compacted into Envoy priorities without gaps: a tier without endpoints takes no priority.
+const (
+	// PrioritySubzoneMatch is the tier of the endpoints in the proxy subzone.
+	PrioritySubzoneMatch = iota
+	// PriorityZoneMatch is the tier of the endpoints in the proxy zone but another subzone.
+	PriorityZoneMatch
+	// PriorityRegionMatch is the tier of the endpoints in the proxy region but another zone.
+	PriorityRegionMatch
+	// PriorityOtherRegion is the tier of the endpoints in other regions. When a failover setting applies
+	// to the proxy region, only the endpoints of its failover region keep it.
+	PriorityOtherRegion
+	// PriorityFailoverMiss is the tier of the endpoints in other regions than the failover region.
+	PriorityFailoverMiss
+	// PriorityDemoted is the tier of the demoted localities and of the endpoints without a locality.
+	PriorityDemoted
+)
+
+// priorityKey orders the groups of endpoints by preference, the lower the key the higher the priority.
+type priorityKey struct {
+	// base is the priority the group of endpoints arrives with, see Options.PreservePriorities.
+	base int
+	// tier is the priority computed from the locality topology and the failover settings.
+	tier int
+	// sub breaks ties between groups of endpoints in the same tier.
+	sub int
+	// metadata breaks ties between groups of endpoints with the same tier and sub, see
+	// Options.FailoverPreferredMetadata.
+	metadata int
+}
+
+func (k priorityKey) less(other priorityKey) bool {
+	if k.base != other.base {
+		return k.base < other.base
+	}
+	if k.tier != other.tier {
+		return k.tier < other.tier
+	}
+	if k.sub != other.sub {
+		return k.sub < other.sub
+	}
+	return k.metadata < other.metadata
+}
+
+// set locality loadbalancing priority, returning warnings about the failover settings
+// The zone level and region level failover settings compose into a single ladder: the proxy zone first,
+// then the zones of the proxy region in the FailoverZones order, then the failover region, or the regions
+// of the FailoverRegions chain in order, each ordered by the distance to the proxy zone unless NoFailoverZonePreference is set, then the
+// localities matching no failover setting, the ones in the geo of the proxy first if RegionGeos is set,
+// and finally the demoted localities and the groups of endpoints without a locality. The localities with
+// a latency in the LatencyMatrix skip the ladder, they come right after the proxy subzone.
 func applyLocalityFailover(
 	locality *core.Locality,
 	loadAssignment *apiv2.ClusterLoadAssignment,
-	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover) {
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover,
+	opts *Options) []string {
+	if opts.ExplicitPriorities != nil {
+		applyExplicitPriorities(loadAssignment, opts.ExplicitPriorities)
+		for _, localityEndpoint := range loadAssignment.Endpoints {
+			opts.recordPriorityRationale(localityEndpoint, "explicit priorities")
+		}
+		return nil
+	}
+	if opts.LocalOnly != LocalOnlyOff {
+		return applyLocalOnly(locality, loadAssignment, opts)
+	}
+	var warnings []string
 	// key is priority, value is the index of the LocalityLbEndpoints in ClusterLoadAssignment
-	priorityMap := map[int][]int{}
+	priorityMap := map[priorityKey][]int{}
+	targets := opts.failoverTargets(locality, failover)
+	// the indexes of the endpoints of the weighted failover regions
+	weightedGroups := map[string][]int{}
+	// the rank of the latency from the proxy to the groups of endpoints, if measured
+	latencyRanks := opts.latencyRanks(locality, loadAssignment)
+	// the rank of the groups of endpoints by the comparator of the caller, if any
+	var comparedRanks map[int]int
+	if opts.LocalityComparator != nil {
+		comparedRanks = comparatorRanks(locality, loadAssignment, opts.LocalityComparator)
+	}
 
 	// 1. calculate the LocalityLbEndpoints.Priority compared with proxy locality
 	for i, localityEndpoint := range loadAssignment.Endpoints {
-		// if region/zone/subZone all match, the priority is 0.
-		// if region/zone match, the priority is 1.
-		// if region matches, the priority is 2.
-		// if locality not match, the priority is 3.
-		priority := util.LbPriority(locality, localityEndpoint.Locality)
-		// region not match, apply failover settings when specified
-		// update localityLbEndpoints' priority to 4 if failover not match
-		if priority == 3 {
-			for _, failoverSetting := range failover {
-				if failoverSetting.From == locality.Region {
-					if localityEndpoint.Locality == nil || localityEndpoint.Locality.Region != failoverSetting.To {
-						priority = 4
-					}
-					break
-				}
-			}
+		if opts.overrun() {
+			return warnings
+		}
+		// the comparator of the caller replaces the topology and the failover settings.
+		if rank, ok := comparedRanks[i]; ok {
+			opts.recordPriorityRationale(localityEndpoint, "locality comparator")
+			priority := priorityKey{base: opts.basePriority(localityEndpoint), tier: rank}
+			priorityMap[priority] = append(priorityMap[priority], i)
+			continue
+		}
+		priority, weighted := opts.localityPriority(locality, localityEndpoint.Locality, targets)
+		if weighted {
+			region := localityEndpoint.Locality.GetRegion()
+			weightedGroups[region] = append(weightedGroups[region], i)
+		}
+		// the measured latencies order the localities past the proxy subzone, before the unmeasured ones
+		if rank, ok := latencyRanks[i]; ok && priority.tier != PrioritySubzoneMatch && priority.tier != PriorityDemoted {
+			priority = priorityKey{tier: PrioritySubzoneMatch, sub: rank + 1}
+		}
+		// within a priority, the preferred endpoints come first
+		if opts.FailoverPreferredMetadata != nil && !opts.FailoverPreferredMetadata.matchesAll(localityEndpoint) {
+			priority.metadata = 1
+		}
+		priority.base = opts.basePriority(localityEndpoint)
+		if opts.annotating() {
+			opts.recordPriorityRationale(localityEndpoint, failoverRationale(priority, targets.regionFailover(), localityEndpoint))
 		}
-		loadAssignment.Endpoints[i].Priority = uint32(priority)
 		priorityMap[priority] = append(priorityMap[priority], i)
 	}
 
-	// since Priorities should range from 0 (highest) to N (lowest) without skipping.
+	// 1.1 split the weight of the weighted failover tier between its regions, each region weight between its
+	// groups of endpoints by their original weights.
+	for region, indexes := range weightedGroups {
+		weights := make([]uint32, len(indexes))
+		for i, index := range indexes {
+			weights[i] = localityLbWeight(loadAssignment.Endpoints[index], opts)
+		}
+		for i, share := range apportion(weights, targets.weighted[region]) {
+			loadAssignment.Endpoints[indexes[i]].LoadBalancingWeight = &wrappers.UInt32Value{Value: share}
+		}
+	}
+
 	// 2. adjust the priorities in order
-	// 2.1 sort all priorities in increasing order.
-	priorities := []int{}
+	priorities := assignPriorities(loadAssignment, priorityMap)
+
+	// 2.1 demote the localities with too many degraded endpoints by one priority
+	if opts.DegradedThreshold > 0 {
+		priorities = demoteDegradedLocalities(loadAssignment, opts.DegradedThreshold)
+	}
+
+	// 2.2 only the nearest localities are active.
+	if opts.MaxActiveLocalities > 0 {
+		priorities = capActiveLocalities(loadAssignment, opts.MaxActiveLocalities)
+	}
+
+	// 2.3 a priority with too few endpoints shares its traffic with the next ones.
+	if opts.MinPriorityEndpoints > 0 {
+		priorities = mergeSmallPriorities(loadAssignment, opts.MinPriorityEndpoints)
+	}
+
+	// 2.4 only the allowed localities serve as primary.
+	if opts.PrimaryAllowlist != nil {
+		var warning string
+		if priorities, warning = restrictPrimary(loadAssignment, opts); warning != "" {
+			lbLog.Debug(warning)
+			warnings = append(warnings, warning)
+		}
+	}
+
+	// 3. all endpoints collapsed into a single priority, Envoy has nowhere to fail over to.
+	if priorities == 1 && len(failover) > 0 {
+		if warning := ensureFailoverPriority(locality, loadAssignment, failover, opts); warning != "" {
+			lbLog.Debug(warning)
+			warnings = append(warnings, warning)
+		}
+	}
+
+	// 4. the failover region has no endpoints, traffic has nowhere to go once the proxy region fails.
+	// Checking the regions of all the failover settings covers the failover region of the proxy.
+	if opts.CheckFailoverRegions {
+		for _, warning := range CheckFailoverRegions(loadAssignment, failover) {
+			lbLog.Debug(warning)
+			warnings = append(warnings, warning)
+		}
+	} else if targets.weighted == nil && targets.regions == nil {
+		if warning := checkFailoverTarget(locality, loadAssignment, failover); warning != "" {
+			lbLog.Debug(warning)
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// splitPreferredEndpoints splits every group of endpoints mixing endpoints matching the metadata and
+// endpoints not matching it into two groups of the same locality, priority and weight, the matching
+// endpoints staying in the original group and the others moving to a new group right after it.
+// The groups of endpoints outside of the priority mask are left as is.
+func splitPreferredEndpoints(loadAssignment *apiv2.ClusterLoadAssignment, opts *Options) {
+	match := opts.FailoverPreferredMetadata
+	split := make([]*endpoint.LocalityLbEndpoints, 0, len(loadAssignment.Endpoints))
+	for _, localityEndpoint := range loadAssignment.Endpoints {
+		if opts.PriorityMask != nil && !opts.PriorityMask[localityEndpoint.Priority] {
+			split = append(split, localityEndpoint)
+			continue
+		}
+		var preferred, others []*endpoint.LbEndpoint
+		for _, lbEp := range localityEndpoint.LbEndpoints {
+			if match.matches(lbEp.GetMetadata()) {
+				preferred = append(preferred, lbEp)
+			} else {
+				others = append(others, lbEp)
+			}
+		}
+		if len(preferred) == 0 || len(others) == 0 {
+			split = append(split, localityEndpoint)
+			continue
+		}
+		localityEndpoint.LbEndpoints = preferred
+		// the new group shares the locality, it is never modified in place.
+		otherEndpoint := *localityEndpoint
+		otherEndpoint.LbEndpoints = others
+		if localityEndpoint.LoadBalancingWeight != nil {
+			otherEndpoint.LoadBalancingWeight = &wrappers.UInt32Value{Value: localityEndpoint.LoadBalancingWeight.Value}
+		}
+		split = append(split, localityEndpoint, &otherEndpoint)
+	}
+	loadAssignment.Endpoints = split
+}
+
+// demoteDegradedLocalities moves the groups of endpoints whose fraction of degraded endpoints exceeds
+// the threshold to the next priority, and compacts the priorities. It returns the number of priorities.
+func demoteDegradedLocalities(loadAssignment *apiv2.ClusterLoadAssignment, threshold float64) int {
+	for _, localityEndpoint := range loadAssignment.Endpoints {
+		if len(localityEndpoint.LbEndpoints) == 0 {
+			continue
+		}
+		degraded := 0
+		for _, lbEp := range localityEndpoint.LbEndpoints {
+			if lbEp.HealthStatus == core.HealthStatus_DEGRADED {
+				degraded++
+			}
+		}
+		if float64(degraded)/float64(len(localityEndpoint.LbEndpoints)) > threshold {
+			lbLog.Debugf("demoting the degraded locality %s of %s",
+				util.LocalityToString(localityEndpoint.Locality), loadAssignment.ClusterName)
+			localityEndpoint.Priority++
+		}
+	}
+	priorityMap := map[priorityKey][]int{}
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		priority := priorityKey{tier: int(localityEndpoint.Priority)}
+		priorityMap[priority] = append(priorityMap[priority], i)
+	}
+	return assignPriorities(loadAssignment, priorityMap)
+}
+
+// capActiveLocalities moves the first max localities with endpoints, in priority order, to priority 0 and
+// the other groups of endpoints after them, keeping their order, and compacts the priorities. Within a
+// priority, the localities come in the order of the load assignment. It returns the number of priorities.
+func capActiveLocalities(loadAssignment *apiv2.ClusterLoadAssignment, max int) int {
+	indexes := make([]int, len(loadAssignment.Endpoints))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return loadAssignment.Endpoints[indexes[i]].Priority < loadAssignment.Endpoints[indexes[j]].Priority
+	})
+	// the groups of endpoints split by preferred metadata share their locality.
+	active := map[string]bool{}
+	priorityMap := map[priorityKey][]int{}
+	for _, i := range indexes {
+		localityEndpoint := loadAssignment.Endpoints[i]
+		locality := util.LocalityToString(localityEndpoint.Locality)
+		if len(localityEndpoint.LbEndpoints) > 0 && (active[locality] || len(active) < max) {
+			active[locality] = true
+			priorityMap[priorityKey{}] = append(priorityMap[priorityKey{}], i)
+			continue
+		}
+		priority := priorityKey{tier: 1, sub: int(localityEndpoint.Priority)}
+		priorityMap[priority] = append(priorityMap[priority], i)
+	}
+	return assignPriorities(loadAssignment, priorityMap)
+}
+
+// mergeSmallPriorities merges every priority with fewer than min endpoints with the following priorities,
+// until the merged priority has at least min endpoints, and compacts the priorities. The weights of the
+// merged priorities are completed, see completeWeights. It returns the number of priorities.
+func mergeSmallPriorities(loadAssignment *apiv2.ClusterLoadAssignment, min int) int {
+	endpoints := map[uint32]int{}
+	for _, localityEndpoint := range loadAssignment.Endpoints {
+		endpoints[localityEndpoint.Priority] += len(localityEndpoint.LbEndpoints)
+	}
+	merged := make(map[uint32]int, len(endpoints))
+	current, count := 0, 0
+	for priority, max := uint32(0), maxPriority(loadAssignment); priority <= max; priority++ {
+		merged[priority] = current
+		count += endpoints[priority]
+		if count >= min {
+			current++
+			count = 0
+		}
+	}
+	priorityMap := map[priorityKey][]int{}
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		priority := priorityKey{tier: merged[localityEndpoint.Priority]}
+		priorityMap[priority] = append(priorityMap[priority], i)
+	}
+	priorities := assignPriorities(loadAssignment, priorityMap)
+	completeWeights(loadAssignment)
+	return priorities
+}
+
+// restrictPrimary moves the groups of endpoints of the localities not allowed as primary by the options
+// out of priority 0: the allowed groups of endpoints of the best priority having any take priority 0, and
+// the other groups of endpoints follow them in their order. It returns the number of priorities, and a
+// warning if no allowed locality has endpoints, in which case the priorities are left as is.
+func restrictPrimary(loadAssignment *apiv2.ClusterLoadAssignment, opts *Options) (int, string) {
+	primary, found := uint32(0), false
+	for _, localityEndpoint := range loadAssignment.Endpoints {
+		if len(localityEndpoint.LbEndpoints) > 0 && opts.isPrimaryAllowed(localityEndpoint.Locality) &&
+			(!found || localityEndpoint.Priority < primary) {
+			primary, found = localityEndpoint.Priority, true
+		}
+	}
+	if !found {
+		return int(maxPriority(loadAssignment)) + 1, fmt.Sprintf(
+			"none of the localities allowed as primary for %s have endpoints, the priorities are left as is",
+			loadAssignment.ClusterName)
+	}
+	priorityMap := map[priorityKey][]int{}
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		priority := priorityKey{tier: int(localityEndpoint.Priority) + 1}
+		if localityEndpoint.Priority == primary && opts.isPrimaryAllowed(localityEndpoint.Locality) {
+			priority.tier = 0
+		}
+		priorityMap[priority] = append(priorityMap[priority], i)
+	}
+	return assignPriorities(loadAssignment, priorityMap), ""
+}
+
+// checkFailoverTarget returns a warning if the failover region of the proxy region has no endpoints.
+func checkFailoverTarget(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover) string {
+	failoverRegion, ok := failoverTarget(locality, failover)
+	if !ok {
+		return ""
+	}
+	for _, localityEndpoint := range loadAssignment.Endpoints {
+		if localityEndpoint.Locality.GetRegion() == failoverRegion && len(localityEndpoint.LbEndpoints) > 0 {
+			return ""
+		}
+	}
+	return fmt.Sprintf("locality failover of %s from region %q to region %q has no endpoints in region %q",
+		loadAssignment.ClusterName, locality.Region, failoverRegion, failoverRegion)
+}
+
+// CheckFailoverRegions returns a warning for every failover From or To region that none of the groups of
+// endpoints of the load assignment is in, e.g. a misspelled region, whatever the proxy locality: such a
+// setting never changes the priorities. A From wildcard, e.g. "us-*", needs a region it matches. The
+// endpoints come and go, so the warnings diagnose the setting without preventing it from applying. The
+// catch-all From "*" and the To FailoverSelfRegion are not checked.
+func CheckFailoverRegions(
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover) []string {
+	regions := map[string]bool{}
+	for _, localityEndpoint := range loadAssignment.GetEndpoints() {
+		if len(localityEndpoint.LbEndpoints) > 0 {
+			regions[localityEndpoint.Locality.GetRegion()] = true
+		}
+	}
+	var warnings []string
+	reported := map[string]bool{}
+	check := func(direction, region string) {
+		if reported[direction+region] {
+			return
+		}
+		for endpointRegion := range regions {
+			if failoverFromMatch(region, endpointRegion) {
+				return
+			}
+		}
+		reported[direction+region] = true
+		warnings = append(warnings, fmt.Sprintf("locality failover of %s %s region %q has no endpoints in that region",
+			loadAssignment.GetClusterName(), direction, region))
+	}
+	for _, failoverSetting := range failover {
+		if failoverSetting == nil {
+			continue
+		}
+		if failoverSetting.From != "*" {
+			check("from", failoverSetting.From)
+		}
+		if failoverSetting.To != FailoverSelfRegion {
+			check("to", failoverSetting.To)
+		}
+	}
+	return warnings
+}
+
+// failoverFromPrefix returns the prefix of the regions a failover From region with a trailing wildcard
+// applies to, e.g. "us-" for "us-*" and "" for the catch-all "*", and whether the From is such a wildcard.
+func failoverFromPrefix(from string) (string, bool) {
+	if !strings.HasSuffix(from, "*") {
+		return "", false
+	}
+	return strings.TrimSuffix(from, "*"), true
+}
+
+// failoverFromMatch checks whether a failover From region applies to a region, exactly or by its wildcard.
+func failoverFromMatch(from, region string) bool {
+	if prefix, ok := failoverFromPrefix(from); ok {
+		return strings.HasPrefix(region, prefix)
+	}
+	return from == region
+}
+
+// FailoverSelfRegion is a failover To keyword standing for the region of the proxy, e.g. in a catch-all
+// failover setting from "*". The traffic then fails over within the proxy region, and to the other
+// regions last, as it does without failover settings.
+const FailoverSelfRegion = "self-region"
+
+// failoverTarget returns the region the failover settings send the traffic of the proxy region to, and
+// whether a failover setting applies. A setting from the proxy region takes precedence over the ones from
+// a wildcard matching it, e.g. "us-*", the longest prefix first, and over the catch-all one from "*".
+func failoverTarget(
+	locality *core.Locality,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover,
+) (string, bool) {
+	var target *v1alpha3.LocalityLoadBalancerSetting_Failover
+	specificity := -1
+	for _, failoverSetting := range failover {
+		if failoverSetting == nil {
+			continue
+		}
+		if failoverSetting.From == locality.GetRegion() {
+			target = failoverSetting
+			break
+		}
+		if prefix, ok := failoverFromPrefix(failoverSetting.From); ok && len(prefix) > specificity &&
+			strings.HasPrefix(locality.GetRegion(), prefix) {
+			target, specificity = failoverSetting, len(prefix)
+		}
+	}
+	if target == nil {
+		return "", false
+	}
+	if target.To == FailoverSelfRegion {
+		return locality.GetRegion(), true
+	}
+	return target.To, true
+}
+
+// applyExplicitPriorities sets the priorities of the groups of endpoints from the priorities given per
+// locality, regardless of the topology. The localities without an explicit priority come last,
+// and the priorities are compacted.
+func applyExplicitPriorities(loadAssignment *apiv2.ClusterLoadAssignment, explicitPriorities map[string]uint32) {
+	lowest := 0
+	for _, priority := range explicitPriorities {
+		if int(priority) >= lowest {
+			lowest = int(priority) + 1
+		}
+	}
+	priorityMap := map[priorityKey][]int{}
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		priority := priorityKey{tier: lowest}
+		if explicit, ok := explicitPriorities[util.LocalityToString(localityEndpoint.Locality)]; ok {
+			priority.tier = int(explicit)
+		}
+		priorityMap[priority] = append(priorityMap[priority], i)
+	}
+	assignPriorities(loadAssignment, priorityMap)
+}
+
+// assignPriorities sets the priority of the groups of endpoints from their priority keys, and returns
+// the number of priorities.
+func assignPriorities(loadAssignment *apiv2.ClusterLoadAssignment, priorityMap map[priorityKey][]int) int {
+	priorities := sortedPriorities(priorityMap)
+	// adjust LocalityLbEndpoints priority
+	for i, priority := range priorities {
+		// the LocalityLbEndpoints index in ClusterLoadAssignment.Endpoints
+		for _, index := range priorityMap[priority] {
+			loadAssignment.Endpoints[index].Priority = uint32(i)
+		}
+	}
+	return len(priorities)
+}
+
+// sortedPriorities returns the priorities of the map in increasing order, the index of a priority being
+// its compacted priority, since Priorities should range from 0 (highest) to N (lowest) without skipping.
+func sortedPriorities(priorityMap map[priorityKey][]int) []priorityKey {
+	priorities := make([]priorityKey, 0, len(priorityMap))
 	for priority := range priorityMap {
 		priorities = append(priorities, priority)
 	}
-	sort.Ints(priorities)
-	// 2.2 adjust LocalityLbEndpoints priority
-	// if the index and value of priorities array is not equal.
-	for i, priority := range priorities {
-		if i != priority {
-			// the LocalityLbEndpoints index in ClusterLoadAssignment.Endpoints
-			for _, index := range priorityMap[priority] {
-				loadAssignment.Endpoints[index].Priority = uint32(i)
+	sort.Slice(priorities, func(i, j int) bool {
+		return priorities[i].less(priorities[j])
+	})
+	return priorities
+}
+
+// zoneFailoverPriority returns the priority of a group of endpoints in the proxy region but not in its zone.
+// The zones listed as targets keep the region tier, ordered by their position in the list, the others
+// are considered as not matching the failover settings.
+func zoneFailoverPriority(endpointLocality *core.Locality, targets []string) priorityKey {
+	for i, target := range targets {
+		if endpointLocalityMatch(endpointLocality, target) {
+			return priorityKey{tier: PriorityRegionMatch, sub: i}
+		}
+	}
+	return priorityKey{tier: PriorityFailoverMiss}
+}
+
+// regionFailoverPriority returns the priority of a group of endpoints of another region than the proxy one,
+// given the ordered failover regions of the proxy region: every region of the chain is a step of the
+// failover tier, after the previous ones, and the regions out of the chain miss the failover settings.
+func regionFailoverPriority(proxyLocality, endpointLocality *core.Locality, targets []string, zonePreference bool) priorityKey {
+	for i, target := range targets {
+		if endpointLocality.GetRegion() != target {
+			continue
+		}
+		// the topological distances go from 0 to PriorityOtherRegion, they order the endpoints within a step.
+		priority := priorityKey{tier: PriorityOtherRegion, sub: i * (PriorityOtherRegion + 1)}
+		if zonePreference {
+			priority.sub += util.LbPriority(&core.Locality{
+				Region:  target,
+				Zone:    proxyLocality.Zone,
+				SubZone: proxyLocality.SubZone,
+			}, endpointLocality)
+		}
+		return priority
+	}
+	return priorityKey{tier: PriorityFailoverMiss}
+}
+
+// ensureFailoverPriority splits a ClusterLoadAssignment whose endpoints all share a single priority
+// into two priorities, by moving the endpoints of the least preferred regions to priority 1.
+// If the option is disabled or no region is preferred over another, it returns a warning instead.
+func ensureFailoverPriority(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover,
+	opts *Options) string {
+	if !opts.EnsureFailoverPriority {
+		return fmt.Sprintf("locality failover is configured for %s but all endpoints have the same priority",
+			loadAssignment.ClusterName)
+	}
+
+	ranks := failoverRegionRanks(locality, failover)
+	leastPreferred, mostPreferred := 0, len(failover)+1
+	for _, localityEndpoint := range loadAssignment.Endpoints {
+		rank := regionRank(ranks, localityEndpoint.Locality.GetRegion(), len(failover)+1)
+		if rank > leastPreferred {
+			leastPreferred = rank
+		}
+		if rank < mostPreferred {
+			mostPreferred = rank
+		}
+	}
+	if leastPreferred == mostPreferred {
+		return fmt.Sprintf("locality failover is configured for %s but no region of its endpoints is preferred "+
+			"over another, no failover priority can be created", loadAssignment.ClusterName)
+	}
+	for _, localityEndpoint := range loadAssignment.Endpoints {
+		if regionRank(ranks, localityEndpoint.Locality.GetRegion(), len(failover)+1) == leastPreferred {
+			localityEndpoint.Priority = 1
+		}
+	}
+	return ""
+}
+
+// failoverRegionRanks ranks the regions by the failover settings, the lower the more preferred: the proxy
+// region comes first, then the regions the proxy region fails over to, then the other failover targets in
+// the order of the settings. FailoverSelfRegion stands for the proxy region, already ranked first.
+func failoverRegionRanks(locality *core.Locality, failover []*v1alpha3.LocalityLoadBalancerSetting_Failover) map[string]int {
+	ranks := map[string]int{locality.GetRegion(): 0}
+	rank := 1
+	for _, fromProxy := range []bool{true, false} {
+		for _, f := range failover {
+			if f == nil {
+				continue
 			}
+			if _, ok := ranks[f.To]; ok || f.To == FailoverSelfRegion || (f.From == locality.GetRegion()) != fromProxy {
+				continue
+			}
+			ranks[f.To] = rank
+			rank++
 		}
 	}
+	return ranks
+}
 
+// regionRank returns the rank of a region, or unranked if no failover setting targets it.
+func regionRank(ranks map[string]int, region string, unranked int) int {
+	if rank, ok := ranks[region]; ok {
+		return rank
+	}
+	return unranked
 }
@@ -15,13 +15,18 @@
 package loadbalancer
 
 import (
+	"fmt"
+	"math"
 	"reflect"
 	"testing"
+	"time"
 
 	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
 	"github.com/gogo/protobuf/types"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
 	. "github.com/onsi/gomega"
 
 	meshconfig "istio.io/api/mesh/v1alpha1"
@@ -29,6 +34,7 @@ import (
 
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/fakes"
+	"istio.io/istio/pilot/pkg/networking/util"
 	"istio.io/istio/pkg/config/mesh"
 	"istio.io/istio/pkg/config/protocol"
 	"istio.io/istio/pkg/config/schema/collections"
@@ -158,6 +164,4689 @@ func TestApplyLocalitySetting(t *testing.T) {
 	})
 }
 
+func TestApplyLocalitySettingWithCapacityHints(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 100,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		hints    map[string]uint32
+		expected []int
+	}{
+		{
+			name:     "no hints",
+			hints:    nil,
+			expected: []int{25, 25, 25, 25, 0, 0, 0},
+		},
+		{
+			name: "equal hints",
+			hints: map[string]uint32{
+				"region1/zone1/subzone1": 3,
+				"region1/zone1/subzone2": 3,
+				"region1/zone1/subzone3": 3,
+			},
+			expected: []int{25, 25, 25, 25, 0, 0, 0},
+		},
+		{
+			name: "skewed hints",
+			hints: map[string]uint32{
+				"region1/zone1/subzone2": 2,
+			},
+			expected: []int{20, 20, 40, 20, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := buildFakeCluster()
+			ApplyLocalityLBSettingWithOptions(locality, cluster.LoadAssignment, setting, true, &Options{CapacityHints: tt.hints})
+			weights := make([]int, 0)
+			for _, localityEndpoint := range cluster.LoadAssignment.Endpoints {
+				weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalitySettingWithLessSpecificProxy(t *testing.T) {
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/*":       20,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		proxy    *envoycore.Locality
+		expected []int
+	}{
+		{
+			name:     "region only proxy",
+			proxy:    &envoycore.Locality{Region: "region1"},
+			expected: []int{20, 20, 20, 20, 0, 20, 0},
+		},
+		{
+			name:     "region and zone proxy",
+			proxy:    &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			expected: []int{20, 20, 20, 20, 0, 20, 0},
+		},
+		{
+			name:     "region only proxy in another region",
+			proxy:    &envoycore.Locality{Region: "region2"},
+			expected: []int{0, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			name:     "proxy in another zone",
+			proxy:    &envoycore.Locality{Region: "region1", Zone: "zone2"},
+			expected: []int{0, 0, 0, 0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cluster := buildFakeCluster()
+			ApplyLocalityLBSetting(tt.proxy, cluster.LoadAssignment, setting, true)
+			weights := make([]int, 0)
+			for _, localityEndpoint := range cluster.LoadAssignment.Endpoints {
+				weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverEnsureFailoverPriority(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region4",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		setting  *networking.LocalityLoadBalancerSetting
+		cla      *apiv2.ClusterLoadAssignment
+		expected []uint32
+		warned   bool
+	}{
+		{
+			name: "disabled",
+			opts: &Options{},
+			cla: buildCLA(
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region3/zone1"},
+				localitySpec{locality: "region2/zone2"},
+			),
+			expected: []uint32{0, 0, 0},
+			warned:   true,
+		},
+		{
+			name: "enabled",
+			opts: &Options{EnsureFailoverPriority: true},
+			cla: buildCLA(
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region3/zone1"},
+				localitySpec{locality: "region2/zone2"},
+			),
+			expected: []uint32{0, 1, 0},
+		},
+		{
+			name: "enabled prefers the failover targets over the region sorted first",
+			opts: &Options{EnsureFailoverPriority: true},
+			cla: buildCLA(
+				localitySpec{locality: "region0/zone1"},
+				localitySpec{locality: "region2/zone1"},
+			),
+			expected: []uint32{1, 0},
+		},
+		{
+			name: "enabled with regions no failover setting prefers",
+			opts: &Options{EnsureFailoverPriority: true},
+			cla: buildCLA(
+				localitySpec{locality: "region3/zone1"},
+				localitySpec{locality: "region5/zone1"},
+			),
+			expected: []uint32{0, 0},
+			warned:   true,
+		},
+		{
+			name: "enabled with a single region",
+			opts: &Options{EnsureFailoverPriority: true},
+			cla: buildCLA(
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region2/zone2"},
+			),
+			expected: []uint32{0, 0},
+			warned:   true,
+		},
+		{
+			name: "enabled with multiple priorities",
+			opts: &Options{EnsureFailoverPriority: true},
+			cla: buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1"},
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region3/zone1"},
+			),
+			expected: []uint32{0, 1, 1},
+		},
+		{
+			name: "enabled skips the unset failover settings",
+			opts: &Options{EnsureFailoverPriority: true},
+			setting: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					nil,
+					{
+						From: "region4",
+						To:   "region2",
+					},
+				},
+			},
+			cla: buildCLA(
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region3/zone1"},
+			),
+			expected: []uint32{0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := setting
+			if tt.setting != nil {
+				s = tt.setting
+			}
+			result := ApplyLocalityLBSettingWithOptions(locality, tt.cla, s, true, tt.opts)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range tt.cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+			if warned := len(result.Warnings) > 0; warned != tt.warned {
+				t.Errorf("Got warnings %v, expected warned %v", result.Warnings, tt.warned)
+			}
+		})
+	}
+}
+
+func TestApplyLocalitySettingWithWeightMetadata(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/*": 100,
+				},
+			},
+		},
+	}
+	opts := &Options{WeightMetadataKey: &MetadataKey{Filter: "istio", Key: "weight"}}
+
+	tests := []struct {
+		name     string
+		cla      func() *apiv2.ClusterLoadAssignment
+		expected []int
+	}{
+		{
+			name: "weight only in metadata",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				cla := buildCLA(
+					localitySpec{locality: "region1/zone1", endpoints: 1},
+					localitySpec{locality: "region1/zone2", endpoints: 1},
+				)
+				setWeightMetadata(cla.Endpoints[0].LbEndpoints[0], &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: 3}})
+				setWeightMetadata(cla.Endpoints[1].LbEndpoints[0], &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: "1"}})
+				return cla
+			},
+			expected: []int{75, 25},
+		},
+		{
+			name: "weight only in the field",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA(
+					localitySpec{locality: "region1/zone1", weight: 1, endpoints: 1},
+					localitySpec{locality: "region1/zone2", weight: 3, endpoints: 1},
+				)
+			},
+			expected: []int{25, 75},
+		},
+		{
+			name: "weight in both, field wins",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				cla := buildCLA(
+					localitySpec{locality: "region1/zone1", weight: 1, endpoints: 1},
+					localitySpec{locality: "region1/zone2", weight: 1, endpoints: 1},
+				)
+				setWeightMetadata(cla.Endpoints[0].LbEndpoints[0], &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: 3}})
+				return cla
+			},
+			expected: []int{50, 50},
+		},
+		{
+			name: "weight in neither",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA(
+					localitySpec{locality: "region1/zone1", endpoints: 1},
+					localitySpec{locality: "region1/zone2", endpoints: 1},
+				)
+			},
+			expected: []int{50, 50},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := tt.cla()
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, opts)
+			weights := make([]int, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func setWeightMetadata(ep *endpoint.LbEndpoint, weight *structpb.Value) {
+	ep.Metadata = &envoycore.Metadata{
+		FilterMetadata: map[string]*structpb.Struct{
+			"istio": {Fields: map[string]*structpb.Value{"weight": weight}},
+		},
+	}
+}
+
+func TestApplyLocalityWeightNonMatchingRules(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	matching := &networking.LocalityLoadBalancerSetting_Distribute{
+		From: "region1/zone1/*",
+		To: map[string]uint32{
+			"region1/zone1/*": 80,
+			"region2/*":       20,
+		},
+	}
+	nonMatching := &networking.LocalityLoadBalancerSetting_Distribute{
+		From: "region2/*",
+		To: map[string]uint32{
+			"region3/*": 100,
+		},
+	}
+	buildCluster := func() *apiv2.ClusterLoadAssignment {
+		return buildCLA(
+			localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+			localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+			localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+			localitySpec{locality: "region3/zone1/subzone1", endpoints: 1},
+		)
+	}
+
+	t.Run("earlier non matching rules have no side effect", func(t *testing.T) {
+		expected := buildCluster()
+		applyLocalityWeight(locality, expected, []*networking.LocalityLoadBalancerSetting_Distribute{matching}, &Options{})
+
+		got := buildCluster()
+		applyLocalityWeight(locality, got, []*networking.LocalityLoadBalancerSetting_Distribute{nil, nonMatching, matching}, &Options{})
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Got %v expected %v", got, expected)
+		}
+	})
+
+	t.Run("no matching rules leave the assignment untouched", func(t *testing.T) {
+		got := buildCluster()
+		applyLocalityWeight(locality, got, []*networking.LocalityLoadBalancerSetting_Distribute{nonMatching}, &Options{})
+		if !reflect.DeepEqual(got, buildCluster()) {
+			t.Errorf("Got %v expected %v", got, buildCluster())
+		}
+	})
+}
+
+func TestApplyLocalityFailoverZonePreference(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	buildCluster := func() *apiv2.ClusterLoadAssignment {
+		return buildCLA(
+			localitySpec{locality: "region1/zone1/subzone1"},
+			localitySpec{locality: "region2/zone2/subzone1"},
+			localitySpec{locality: "region2/zone1/subzone2"},
+			localitySpec{locality: "region2/zone1/subzone1"},
+			localitySpec{locality: "region3/zone1/subzone1"},
+		)
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected []uint32
+	}{
+		{
+			name:     "default",
+			opts:     &Options{},
+			expected: []uint32{0, 3, 2, 1, 4},
+		},
+		{
+			name:     "disabled",
+			opts:     &Options{NoFailoverZonePreference: true},
+			expected: []uint32{0, 1, 1, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCluster()
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightHysteresis(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/*",
+				To: map[string]uint32{
+					"region1/zone1": 55,
+					"region1/zone2": 45,
+				},
+			},
+		},
+	}
+	priorWeights := map[string]uint32{
+		"region1/zone1": 50,
+		"region1/zone2": 50,
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected []int
+	}{
+		{
+			name:     "no threshold",
+			opts:     &Options{PriorWeights: priorWeights},
+			expected: []int{55, 45},
+		},
+		{
+			name:     "sub-threshold changes are suppressed",
+			opts:     &Options{PriorWeights: priorWeights, HysteresisThreshold: 5},
+			expected: []int{50, 50},
+		},
+		{
+			name:     "changes exceeding the threshold are applied",
+			opts:     &Options{PriorWeights: priorWeights, HysteresisThreshold: 4},
+			expected: []int{55, 45},
+		},
+		{
+			name:     "no prior weights",
+			opts:     &Options{HysteresisThreshold: 5},
+			expected: []int{55, 45},
+		},
+		{
+			name:     "the weights of the other localities compensate the prior weights kept",
+			opts:     &Options{PriorWeights: map[string]uint32{"region1/zone1": 52}, HysteresisThreshold: 5},
+			expected: []int{52, 48},
+		},
+		{
+			name:     "prior weights not keeping the sum are not kept",
+			opts:     &Options{PriorWeights: map[string]uint32{"region1/zone1": 51, "region1/zone2": 48}, HysteresisThreshold: 5},
+			expected: []int{55, 45},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1"},
+				localitySpec{locality: "region1/zone2"},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			weights := make([]int, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverZoneFailover(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone-a",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		targets  []string
+		expected []uint32
+	}{
+		{
+			name:     "no zone failover",
+			expected: []uint32{0, 1, 1, 1, 1, 2},
+		},
+		{
+			name:     "b then c",
+			targets:  []string{"region1/zone-b", "region1/zone-c"},
+			expected: []uint32{0, 1, 2, 4, 4, 3},
+		},
+		{
+			name:     "c then b",
+			targets:  []string{"region1/zone-c", "region1/zone-b"},
+			expected: []uint32{0, 2, 1, 4, 4, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone-a"},
+				localitySpec{locality: "region1/zone-b"},
+				localitySpec{locality: "region1/zone-c"},
+				localitySpec{locality: "region1/zone-d"},
+				localitySpec{locality: "region1/zone-e"},
+				localitySpec{locality: "region2/zone-a"},
+			)
+			opts := &Options{}
+			if tt.targets != nil {
+				opts.FailoverRules = []*FailoverRule{
+					{Mode: FailoverZones, From: "region1/zone-x", To: []string{"region1/zone-e"}},
+					{Mode: FailoverZones, From: "region1/zone-a", To: tt.targets},
+				}
+			}
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, opts)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightSmallPercentage(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 1,
+					"region2/*":       99,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1/subzone1"},
+		localitySpec{locality: "region1/zone1/subzone2", weight: 1000000},
+		localitySpec{locality: "region1/zone1/subzone3", weight: 3000000},
+		localitySpec{locality: "region2/zone1", weight: 50000000},
+		localitySpec{locality: "region2/zone2", weight: 50000000},
+	)
+	cla.Endpoints[0].LoadBalancingWeight = &wrappers.UInt32Value{Value: 0}
+
+	ApplyLocalityLBSetting(locality, cla, setting, true)
+	weights := make([]int, 0)
+	for _, localityEndpoint := range cla.Endpoints {
+		weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+	}
+	// the 99 are split evenly between region2/zone1 and region2/zone2, the remainder going to the first one.
+	expected := []int{1, 1, 1, 50, 49}
+	if !reflect.DeepEqual(weights, expected) {
+		t.Errorf("Got weights %v expected %v", weights, expected)
+	}
+}
+
+func TestApplyLocalityWeightDropUnlistedLocalities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/*":       20,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		opts      *Options
+		weights   []int
+		endpoints []int
+	}{
+		{
+			name:      "default",
+			opts:      &Options{},
+			weights:   []int{80, 20, 0},
+			endpoints: []int{1, 1, 0},
+		},
+		{
+			name:      "drop",
+			opts:      &Options{UnlistedLocalities: UnlistedLocalityDrop},
+			weights:   []int{80, 20, 0},
+			endpoints: []int{1, 1, 0},
+		},
+		{
+			name:      "keep",
+			opts:      &Options{UnlistedLocalities: UnlistedLocalityKeep},
+			weights:   []int{80, 20, 1},
+			endpoints: []int{1, 1, 1},
+		},
+		{
+			name:      "keep with residual weight",
+			opts:      &Options{UnlistedLocalities: UnlistedLocalityKeep, UnlistedLocalityWeight: 5},
+			weights:   []int{80, 20, 5},
+			endpoints: []int{1, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			weights := make([]int, 0)
+			endpoints := make([]int, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+				endpoints = append(endpoints, len(localityEndpoint.LbEndpoints))
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(endpoints, tt.endpoints) {
+				t.Errorf("Got endpoints %v expected %v", endpoints, tt.endpoints)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightUnlistedLocalities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 60,
+					"region2/*":       20,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		opts      *Options
+		weights   []int
+		endpoints []int
+	}{
+		{
+			// the weights of the dropped localities are left as is.
+			opts:      &Options{UnlistedLocalities: UnlistedLocalityDrop},
+			weights:   []int{60, 20, 1, 3},
+			endpoints: []int{1, 1, 0, 0},
+		},
+		{
+			opts:      &Options{UnlistedLocalities: UnlistedLocalityKeep},
+			weights:   []int{60, 20, 1, 1},
+			endpoints: []int{1, 1, 1, 3},
+		},
+		{
+			// the 20% left over are split 1:3 by the weights of the unlisted localities.
+			opts:      &Options{UnlistedLocalities: UnlistedLocalityResidual},
+			weights:   []int{60, 20, 5, 15},
+			endpoints: []int{1, 1, 1, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.opts.UnlistedLocalities.String(), func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", weight: 1, endpoints: 1},
+				localitySpec{locality: "region3/zone2", weight: 3, endpoints: 3},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			weights := make([]int, 0)
+			endpoints := make([]int, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+				endpoints = append(endpoints, len(localityEndpoint.LbEndpoints))
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(endpoints, tt.endpoints) {
+				t.Errorf("Got endpoints %v expected %v", endpoints, tt.endpoints)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverWeightedFailover(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	opts := &Options{
+		FailoverRules: []*FailoverRule{
+			{
+				Mode: FailoverWeighted,
+				From: "region1",
+				Weights: map[string]uint32{
+					"region2": 70,
+					"region3": 30,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1"},
+		localitySpec{locality: "region2/zone1"},
+		localitySpec{locality: "region2/zone2"},
+		localitySpec{locality: "region3/zone1"},
+		localitySpec{locality: "region4/zone1"},
+	)
+
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, opts)
+	priorities := make([]uint32, 0)
+	weights := make([]int, 0)
+	for _, localityEndpoint := range cla.Endpoints {
+		priorities = append(priorities, localityEndpoint.Priority)
+		weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+	}
+	expectedPriorities := []uint32{0, 1, 1, 1, 2}
+	expectedWeights := []int{0, 35, 35, 30, 0}
+	if !reflect.DeepEqual(priorities, expectedPriorities) {
+		t.Errorf("Got priorities %v expected %v", priorities, expectedPriorities)
+	}
+	if !reflect.DeepEqual(weights, expectedWeights) {
+		t.Errorf("Got weights %v expected %v", weights, expectedWeights)
+	}
+}
+
+func TestApplyLocalityFailoverWeightedFailoverRounding(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	opts := &Options{
+		FailoverRules: []*FailoverRule{
+			{
+				Mode: FailoverWeighted,
+				From: "region1",
+				Weights: map[string]uint32{
+					"region2": 70,
+					"region3": 30,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1"},
+		localitySpec{locality: "region2/zone1"},
+		localitySpec{locality: "region2/zone2"},
+		localitySpec{locality: "region2/zone3"},
+		localitySpec{locality: "region3/zone1"},
+	)
+
+	ApplyLocalityLBSettingWithOptions(locality, cla, &networking.LocalityLoadBalancerSetting{}, true, opts)
+	weights := make([]int, 0)
+	for _, localityEndpoint := range cla.Endpoints {
+		weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+	}
+	// the weight of region2 is split without rounding every share up, so that its groups sum up to 70.
+	expectedWeights := []int{0, 24, 23, 23, 30}
+	if !reflect.DeepEqual(weights, expectedWeights) {
+		t.Errorf("Got weights %v expected %v", weights, expectedWeights)
+	}
+}
+
+func TestApplyLocalityLBSettingNilSetting(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	cluster := buildFakeCluster()
+	ApplyLocalityLBSetting(locality, cluster.LoadAssignment, nil, true)
+	if !reflect.DeepEqual(cluster, buildFakeCluster()) {
+		t.Errorf("Expected a nil setting to leave the assignment untouched, got %v", cluster.LoadAssignment)
+	}
+}
+
+func TestApplyLocalityLBSettingPriorityMask(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	buildCluster := func() *apiv2.ClusterLoadAssignment {
+		return buildCLA(
+			localitySpec{locality: "region1/zone1", weight: 50, endpoints: 1},
+			localitySpec{locality: "region2/zone1", priority: 1, endpoints: 1},
+			localitySpec{locality: "region1/zone2", weight: 50, endpoints: 1},
+			localitySpec{locality: "region3/zone1", priority: 1, endpoints: 1},
+		)
+	}
+	mask := map[uint32]bool{1: true}
+
+	t.Run("failover", func(t *testing.T) {
+		setting := &networking.LocalityLoadBalancerSetting{
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{
+					From: "region1",
+					To:   "region2",
+				},
+			},
+		}
+		cla := buildCluster()
+		ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{PriorityMask: mask})
+		priorities := make([]uint32, 0)
+		weights := make([]int, 0)
+		for _, localityEndpoint := range cla.Endpoints {
+			priorities = append(priorities, localityEndpoint.Priority)
+			weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+		}
+		if expected := []uint32{0, 1, 0, 2}; !reflect.DeepEqual(priorities, expected) {
+			t.Errorf("Got priorities %v expected %v", priorities, expected)
+		}
+		if expected := []int{50, 0, 50, 0}; !reflect.DeepEqual(weights, expected) {
+			t.Errorf("Got weights %v expected %v", weights, expected)
+		}
+	})
+
+	t.Run("distribute", func(t *testing.T) {
+		setting := &networking.LocalityLoadBalancerSetting{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/*",
+					To: map[string]uint32{
+						"region2/*": 100,
+					},
+				},
+			},
+		}
+		cla := buildCluster()
+		ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{PriorityMask: mask})
+		priorities := make([]uint32, 0)
+		weights := make([]int, 0)
+		endpoints := make([]int, 0)
+		for _, localityEndpoint := range cla.Endpoints {
+			priorities = append(priorities, localityEndpoint.Priority)
+			weights = append(weights, int(localityEndpoint.LoadBalancingWeight.GetValue()))
+			endpoints = append(endpoints, len(localityEndpoint.LbEndpoints))
+		}
+		if expected := []uint32{0, 1, 0, 1}; !reflect.DeepEqual(priorities, expected) {
+			t.Errorf("Got priorities %v expected %v", priorities, expected)
+		}
+		if expected := []int{50, 100, 50, 0}; !reflect.DeepEqual(weights, expected) {
+			t.Errorf("Got weights %v expected %v", weights, expected)
+		}
+		if expected := []int{1, 1, 1, 0}; !reflect.DeepEqual(endpoints, expected) {
+			t.Errorf("Got endpoints %v expected %v", endpoints, expected)
+		}
+	})
+}
+
+func TestApplyLocalityLBSettingMode(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	distribute := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To:   map[string]uint32{"region1/*": 100},
+			},
+		},
+	}
+	failover := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		setting        *networking.LocalityLoadBalancerSetting
+		enableFailover bool
+		expected       Mode
+	}{
+		{"nil setting", nil, true, ModeNone},
+		{"distribute", distribute, true, ModeDistribute},
+		{"distribute without failover", distribute, false, ModeDistribute},
+		{"failover", failover, true, ModeFailover},
+		{"failover disabled", failover, false, ModeNone},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ApplyLocalityLBSettingWithOptions(locality, buildFakeCluster().LoadAssignment, tt.setting, tt.enableFailover, nil)
+			if result.Mode != tt.expected {
+				t.Errorf("Got mode %v expected %v", result.Mode, tt.expected)
+			}
+			if result.Setting != tt.setting {
+				t.Errorf("Got setting %v expected %v", result.Setting, tt.setting)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverDemotedLocalities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		demoted  []string
+		expected []uint32
+	}{
+		{
+			name:     "none demoted",
+			expected: []uint32{0, 1, 2, 3},
+		},
+		{
+			name:     "proxy zone demoted",
+			demoted:  []string{"region1/zone1"},
+			expected: []uint32{3, 0, 1, 2},
+		},
+		{
+			name:     "failover region demoted",
+			demoted:  []string{"region2/*"},
+			expected: []uint32{0, 1, 3, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1"},
+				localitySpec{locality: "region1/zone2"},
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region3/zone1"},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{DemotedLocalities: tt.demoted})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightDuplicateLocalities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 50,
+					"region2/zone1/*": 50,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		merge     bool
+		weights   []uint32
+		endpoints []int
+	}{
+		{
+			name:      "not merged",
+			weights:   []uint32{25, 25, 50},
+			endpoints: []int{1, 1, 2},
+		},
+		{
+			name:      "merged",
+			merge:     true,
+			weights:   []uint32{50, 50},
+			endpoints: []int{2, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1/subzone1", endpoints: 2},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{MergeDuplicateLocalities: tt.merge})
+			weights := make([]uint32, 0)
+			endpoints := make([]int, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+				endpoints = append(endpoints, len(localityEndpoint.LbEndpoints))
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(endpoints, tt.endpoints) {
+				t.Errorf("Got endpoints %v expected %v", endpoints, tt.endpoints)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingDisabled(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	defer SetLocalityLBDisabled(false)
+
+	tests := []struct {
+		name     string
+		disabled bool
+		expected []uint32
+	}{
+		{
+			name:     "disabled",
+			disabled: true,
+			expected: []uint32{0, 0, 0},
+		},
+		{
+			name:     "enabled again",
+			disabled: false,
+			expected: []uint32{0, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetLocalityLBDisabled(tt.disabled)
+			if got := LocalityLBDisabled(); got != tt.disabled {
+				t.Fatalf("Got disabled %v expected %v", got, tt.disabled)
+			}
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1"},
+				localitySpec{locality: "region1/zone2"},
+				localitySpec{locality: "region2/zone1"},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, nil)
+			if tt.disabled && result.Mode != ModeNone {
+				t.Errorf("Got mode %v expected %v", result.Mode, ModeNone)
+			}
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverTargetWithoutEndpoints(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+
+	tests := []struct {
+		name     string
+		to       string
+		warnings int
+	}{
+		{
+			name: "target with endpoints",
+			to:   "region2",
+		},
+		{
+			name:     "target absent",
+			to:       "region4",
+			warnings: 1,
+		},
+		{
+			name:     "target without endpoints",
+			to:       "region3",
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setting := &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+						To:   tt.to,
+					},
+				},
+			}
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1"},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, nil)
+			if len(result.Warnings) != tt.warnings {
+				t.Errorf("Got warnings %v expected %d", result.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestCheckFailoverRegions(t *testing.T) {
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1"},
+	)
+
+	tests := []struct {
+		name     string
+		failover []*networking.LocalityLoadBalancerSetting_Failover
+		warnings int
+	}{
+		{
+			name: "regions with endpoints",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "region1", To: "region2"},
+				{From: "region2", To: "region1"},
+			},
+		},
+		{
+			name: "nonexistent region",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "region1", To: "region2"},
+				{From: "us-west1", To: "region1"},
+			},
+			warnings: 1,
+		},
+		{
+			name: "region without endpoints",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "region2", To: "region3"},
+				{From: "region1", To: "region3"},
+			},
+			warnings: 1,
+		},
+		{
+			name: "keywords",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "*", To: FailoverSelfRegion},
+			},
+		},
+		{
+			name: "wildcard from",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "region*", To: "region2"},
+				{From: "us-*", To: "region1"},
+			},
+			warnings: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if warnings := CheckFailoverRegions(cla, tt.failover); len(warnings) != tt.warnings {
+				t.Errorf("Got warnings %v expected %d", warnings, tt.warnings)
+			}
+			// failover warns the same, the checked regions do not depend on the proxy locality.
+			locality := &envoycore.Locality{Region: "region1", Zone: "zone1"}
+			applied := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1"},
+			)
+			setting := &networking.LocalityLoadBalancerSetting{Failover: tt.failover}
+			result := ApplyLocalityLBSettingWithOptions(locality, applied, setting, true, &Options{CheckFailoverRegions: true})
+			if len(result.Warnings) != tt.warnings {
+				t.Errorf("Got applied warnings %v expected %d", result.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightConsistentHash(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 70,
+					"region2/*":       30,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		consistentHash bool
+		expected       []uint32
+	}{
+		{
+			name:     "default",
+			expected: []uint32{35, 35, 10, 20},
+		},
+		{
+			name:           "consistent hash",
+			consistentHash: true,
+			expected:       []uint32{3500, 3500, 1000, 2000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1"},
+				localitySpec{locality: "region1/zone1/subzone2"},
+				localitySpec{locality: "region2/zone1", weight: 1},
+				localitySpec{locality: "region2/zone2", weight: 2},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{ConsistentHash: tt.consistentHash})
+			weights := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverZoneAndRegion(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	opts := &Options{
+		FailoverRules: []*FailoverRule{
+			{
+				Mode: FailoverZones,
+				From: "region1/zone1",
+				To:   []string{"region1/zone3", "region1/zone2"},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1/subzone1"},
+		localitySpec{locality: "region1/zone1/subzone2"},
+		localitySpec{locality: "region1/zone2"},
+		localitySpec{locality: "region1/zone3"},
+		localitySpec{locality: "region1/zone4"},
+		localitySpec{locality: "region2/zone1"},
+		localitySpec{locality: "region2/zone2"},
+		localitySpec{locality: "region3/zone1"},
+	)
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, opts)
+
+	priorities := make([]uint32, 0)
+	for _, localityEndpoint := range cla.Endpoints {
+		priorities = append(priorities, localityEndpoint.Priority)
+	}
+	expected := []uint32{0, 1, 3, 2, 6, 4, 5, 6}
+	if !reflect.DeepEqual(priorities, expected) {
+		t.Errorf("Got priorities %v expected %v", priorities, expected)
+	}
+}
+
+func TestApplyLocalityLBSettingOverprovisioningFactor(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	dropOverloads := []*apiv2.ClusterLoadAssignment_Policy_DropOverload{
+		{
+			Category: "throttle",
+		},
+	}
+	original := &apiv2.ClusterLoadAssignment_Policy{DropOverloads: dropOverloads}
+	cla := buildCLA(localitySpec{locality: "region1/zone1"})
+	cla.Policy = original
+
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{OverprovisioningFactor: 200})
+	if got := cla.Policy.GetOverprovisioningFactor().GetValue(); got != 200 {
+		t.Errorf("Got overprovisioning factor %d expected 200", got)
+	}
+	if !reflect.DeepEqual(cla.Policy.DropOverloads, dropOverloads) {
+		t.Errorf("Got drop overloads %v expected %v", cla.Policy.DropOverloads, dropOverloads)
+	}
+	if original.OverprovisioningFactor != nil {
+		t.Errorf("the original policy must not be modified")
+	}
+}
+
+func TestApplyLocalityLBSettingPerPriorityFactors(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		factor   *wrappers.UInt32Value
+		warnings int
+	}{
+		{
+			// the primary factor applies, the lower fallback factors cannot be expressed.
+			name:     "sticky primary",
+			opts:     &Options{PerPriorityFactors: map[uint32]uint32{0: 200, 1: 100, 2: 100}},
+			factor:   &wrappers.UInt32Value{Value: 200},
+			warnings: 2,
+		},
+		{
+			name:   "same factors",
+			opts:   &Options{PerPriorityFactors: map[uint32]uint32{0: 150, 1: 150}},
+			factor: &wrappers.UInt32Value{Value: 150},
+		},
+		{
+			// priority 0 has no factor, the factor of the next most preferred priority applies.
+			name:   "fallback only",
+			opts:   &Options{PerPriorityFactors: map[uint32]uint32{1: 120}},
+			factor: &wrappers.UInt32Value{Value: 120},
+		},
+		{
+			name:   "over the cluster wide factor",
+			opts:   &Options{OverprovisioningFactor: 300, PerPriorityFactors: map[uint32]uint32{0: 200}},
+			factor: &wrappers.UInt32Value{Value: 200},
+		},
+		{
+			name: "absent priorities",
+			opts: &Options{PerPriorityFactors: map[uint32]uint32{5: 200}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			if got := cla.GetPolicy().GetOverprovisioningFactor(); !reflect.DeepEqual(got, tt.factor) {
+				t.Errorf("Got overprovisioning factor %v expected %v", got, tt.factor)
+			}
+			if len(result.Warnings) != tt.warnings {
+				t.Errorf("Got warnings %q expected %d", result.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightCompactPriorities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region3/zone1/*": 20,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected []uint32
+	}{
+		{
+			name:     "dropped priority removed",
+			expected: []uint32{0, 1, 1},
+		},
+		{
+			name:     "unlisted localities kept",
+			opts:     &Options{UnlistedLocalities: UnlistedLocalityKeep},
+			expected: []uint32{0, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", priority: 0, endpoints: 1},
+				localitySpec{locality: "region2/zone1/subzone1", priority: 1, endpoints: 1},
+				localitySpec{locality: "region3/zone1/subzone1", priority: 2, endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightNormalizeDistribute(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+
+	tests := []struct {
+		name      string
+		to        map[string]uint32
+		normalize bool
+		expected  []uint32
+	}{
+		{
+			name:     "sum of 100",
+			to:       map[string]uint32{"region1/*": 60, "region2/*": 40},
+			expected: []uint32{60, 40},
+		},
+		{
+			name:     "sum of 120 not normalized",
+			to:       map[string]uint32{"region1/*": 72, "region2/*": 48},
+			expected: []uint32{72, 48},
+		},
+		{
+			name:      "sum of 50",
+			to:        map[string]uint32{"region1/*": 30, "region2/*": 20},
+			normalize: true,
+			expected:  []uint32{60, 40},
+		},
+		{
+			name:      "sum of 100 normalized",
+			to:        map[string]uint32{"region1/*": 60, "region2/*": 40},
+			normalize: true,
+			expected:  []uint32{60, 40},
+		},
+		{
+			name:      "sum of 120",
+			to:        map[string]uint32{"region1/*": 72, "region2/*": 48},
+			normalize: true,
+			expected:  []uint32{60, 40},
+		},
+		{
+			name:      "ratio of 2:1",
+			to:        map[string]uint32{"region1/*": 2, "region2/*": 1},
+			normalize: true,
+			expected:  []uint32{67, 33},
+		},
+		{
+			// the same ratio as 2:1.
+			name:      "ratio of 66:33",
+			to:        map[string]uint32{"region1/*": 66, "region2/*": 33},
+			normalize: true,
+			expected:  []uint32{67, 33},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setting := &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1/*",
+						To:   tt.to,
+					},
+				},
+			}
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1"},
+				localitySpec{locality: "region2/zone1"},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{NormalizeDistribute: tt.normalize})
+			weights := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverTopologyLadder(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	// the localities are listed from the least to the most preferred one, one per tier.
+	cla := buildCLA(
+		localitySpec{locality: "region3/zone1/subzone1"},
+		localitySpec{locality: "region2/zone1/subzone1"},
+		localitySpec{locality: "region1/zone2/subzone1"},
+		localitySpec{locality: "region1/zone1/subzone2"},
+		localitySpec{locality: "region1/zone1/subzone1"},
+	)
+	ApplyLocalityLBSetting(locality, cla, setting, true)
+
+	priorities := make([]uint32, 0)
+	for _, localityEndpoint := range cla.Endpoints {
+		priorities = append(priorities, localityEndpoint.Priority)
+	}
+	expected := []uint32{4, 3, 2, 1, 0}
+	if !reflect.DeepEqual(priorities, expected) {
+		t.Errorf("Got priorities %v expected %v", priorities, expected)
+	}
+}
+
+func TestApplyLocalityLBSettingNamedEndpoints(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/zone1/*": 20,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1"},
+		localitySpec{locality: "region2/zone1"},
+	)
+	cla.NamedEndpoints = map[string]*endpoint.Endpoint{}
+	for i, localityEndpoint := range cla.Endpoints {
+		name := fmt.Sprintf("endpoint%d", i)
+		cla.NamedEndpoints[name] = buildLbEndpoint(fmt.Sprintf("10.0.%d.0", i)).GetEndpoint()
+		localityEndpoint.LbEndpoints = []*endpoint.LbEndpoint{
+			{
+				HostIdentifier: &endpoint.LbEndpoint_EndpointName{EndpointName: name},
+			},
+		}
+	}
+
+	ApplyLocalityLBSetting(locality, cla, setting, true)
+	for i, expected := range []uint32{80, 20} {
+		localityEndpoint := cla.Endpoints[i]
+		if got := localityEndpoint.LoadBalancingWeight.GetValue(); got != expected {
+			t.Errorf("Got weight %d expected %d", got, expected)
+		}
+		if len(localityEndpoint.LbEndpoints) != 1 || localityEndpoint.LbEndpoints[0].GetEndpointName() != fmt.Sprintf("endpoint%d", i) {
+			t.Errorf("Got endpoints %v expected a reference to endpoint%d", localityEndpoint.LbEndpoints, i)
+		}
+	}
+	if len(cla.NamedEndpoints) != 2 {
+		t.Errorf("Got named endpoints %v expected 2", cla.NamedEndpoints)
+	}
+}
+
+func TestApplyLocalityFailoverExplicitPriorities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		explicit map[string]uint32
+		expected []uint32
+	}{
+		{
+			name:     "topology",
+			expected: []uint32{0, 1, 2, 3},
+		},
+		{
+			name: "reversed topology",
+			explicit: map[string]uint32{
+				"region3/zone1": 0,
+				"region2/zone1": 1,
+				"region1/zone2": 2,
+				"region1/zone1": 3,
+			},
+			expected: []uint32{3, 2, 1, 0},
+		},
+		{
+			name: "gaps and unlisted localities",
+			explicit: map[string]uint32{
+				"region2/zone1": 5,
+				"region1/zone2": 10,
+			},
+			expected: []uint32{2, 1, 0, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1"},
+				localitySpec{locality: "region1/zone2"},
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region3/zone1"},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{ExplicitPriorities: tt.explicit})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightSingleLocality(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region2/zone1/*": 100,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1/subzone1", weight: 3, endpoints: 1},
+		localitySpec{locality: "region1/zone2/subzone1", priority: 1, endpoints: 1},
+		localitySpec{locality: "region2/zone1/subzone1", priority: 2, endpoints: 2},
+	)
+	ApplyLocalityLBSetting(locality, cla, setting, true)
+
+	if len(cla.Endpoints) != 1 {
+		t.Fatalf("Got %d groups of endpoints expected 1", len(cla.Endpoints))
+	}
+	localityEndpoint := cla.Endpoints[0]
+	if got := util.LocalityToString(localityEndpoint.Locality); got != "region2/zone1/subzone1" {
+		t.Errorf("Got locality %s expected region2/zone1/subzone1", got)
+	}
+	if got := localityEndpoint.LoadBalancingWeight.GetValue(); got != 100 {
+		t.Errorf("Got weight %d expected 100", got)
+	}
+	if localityEndpoint.Priority != 0 {
+		t.Errorf("Got priority %d expected 0", localityEndpoint.Priority)
+	}
+	if len(localityEndpoint.LbEndpoints) != 2 {
+		t.Errorf("Got %d endpoints expected 2", len(localityEndpoint.LbEndpoints))
+	}
+}
+
+func TestApplyLocalityWeightSkipSingleLocalityWeight(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	local := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/subzone1": 100,
+				},
+			},
+		},
+	}
+	spread := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 100,
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name    string
+		setting *networking.LocalityLoadBalancerSetting
+		opts    *Options
+		// outlier detection enables failover and locality weighted load balancing.
+		outlierDetection bool
+		weights          []uint32
+		unset            []bool
+	}{
+		{
+			name:    "all local",
+			setting: local,
+			opts:    &Options{SkipSingleLocalityWeight: true},
+			weights: []uint32{0},
+			unset:   []bool{true},
+		},
+		{
+			// Envoy would give no traffic to the locality without a weight.
+			name:             "all local with outlier detection",
+			setting:          local,
+			opts:             &Options{SkipSingleLocalityWeight: true},
+			outlierDetection: true,
+			weights:          []uint32{100},
+			unset:            []bool{false},
+		},
+		{
+			name:    "all local without the option",
+			setting: local,
+			weights: []uint32{100},
+			unset:   []bool{false},
+		},
+		{
+			name:    "several localities",
+			setting: spread,
+			opts:    &Options{SkipSingleLocalityWeight: true},
+			weights: []uint32{50, 50},
+			unset:   []bool{false, false},
+		},
+		{
+			name:    "unlisted localities kept",
+			setting: local,
+			opts:    &Options{SkipSingleLocalityWeight: true, UnlistedLocalities: UnlistedLocalityKeep},
+			weights: []uint32{100, 1, 1},
+			unset:   []bool{false, false, false},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, tt.outlierDetection, tt.opts)
+			weights := make([]uint32, 0, len(cla.Endpoints))
+			unset := make([]bool, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				if len(localityEndpoint.LbEndpoints) == 0 {
+					continue
+				}
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+				unset = append(unset, localityEndpoint.LoadBalancingWeight == nil)
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(unset, tt.unset) {
+				t.Errorf("Got unset weights %v expected %v", unset, tt.unset)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingNilLocality(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	failover := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	distribute := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"*": 100,
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name       string
+		locality   *envoycore.Locality
+		setting    *networking.LocalityLoadBalancerSetting
+		opts       *Options
+		priorities []uint32
+		weights    []uint32
+		endpoints  []int
+	}{
+		{
+			name:       "failover",
+			locality:   locality,
+			setting:    failover,
+			priorities: []uint32{3, 0, 1, 2},
+			weights:    []uint32{0, 0, 0, 0},
+			endpoints:  []int{1, 1, 1, 1},
+		},
+		{
+			// failover is not applied to a proxy without a region, all the endpoints keep their priority.
+			name:       "failover from an empty locality",
+			locality:   &envoycore.Locality{},
+			setting:    failover,
+			priorities: []uint32{0, 0, 0, 0},
+			weights:    []uint32{0, 0, 0, 0},
+			endpoints:  []int{1, 1, 1, 1},
+		},
+		{
+			name:       "distribute drops",
+			locality:   locality,
+			setting:    distribute,
+			priorities: []uint32{0, 0, 0, 0},
+			weights:    []uint32{0, 34, 33, 33},
+			endpoints:  []int{0, 1, 1, 1},
+		},
+		{
+			name:       "distribute keeps",
+			locality:   locality,
+			setting:    distribute,
+			opts:       &Options{UnlistedLocalities: UnlistedLocalityKeep},
+			priorities: []uint32{0, 0, 0, 0},
+			weights:    []uint32{1, 34, 33, 33},
+			endpoints:  []int{1, 1, 1, 1},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{endpoints: 1},
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(tt.locality, cla, tt.setting, true, tt.opts)
+			priorities := make([]uint32, 0, len(cla.Endpoints))
+			weights := make([]uint32, 0, len(cla.Endpoints))
+			endpoints := make([]int, 0, len(cla.Endpoints))
+			for _, ep := range cla.Endpoints {
+				priorities = append(priorities, ep.Priority)
+				weights = append(weights, ep.GetLoadBalancingWeight().GetValue())
+				endpoints = append(endpoints, len(ep.LbEndpoints))
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(endpoints, tt.endpoints) {
+				t.Errorf("Got endpoints %v expected %v", endpoints, tt.endpoints)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingHostnameEndpoints(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	settings := []*networking.LocalityLoadBalancerSetting{
+		{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/*": 100,
+					},
+				},
+			},
+		},
+		{
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{
+					From: "region1",
+					To:   "region2",
+				},
+			},
+		},
+	}
+	for i, setting := range settings {
+		// a STRICT_DNS cluster resolves a hostname, its single group of endpoints has no locality.
+		cla := buildCLA(localitySpec{endpoints: 2})
+		for j, lbEp := range cla.Endpoints[0].LbEndpoints {
+			lbEp.GetEndpoint().GetAddress().GetSocketAddress().Address = fmt.Sprintf("host%d.example.org", j)
+		}
+		cla.Endpoints[0].Locality = &envoycore.Locality{}
+		before := SnapshotLoadAssignment(cla)
+
+		result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, nil)
+		if result.Mode != ModeNone {
+			t.Errorf("setting %d: got mode %v expected none", i, result.Mode)
+		}
+		for _, diff := range CompareSnapshots(before, SnapshotLoadAssignment(cla)) {
+			t.Errorf("setting %d: the load assignment was modified: %v", i, diff)
+		}
+		if len(cla.Endpoints) != 1 || len(cla.Endpoints[0].LbEndpoints) != 2 {
+			t.Errorf("setting %d: the hostname endpoints were dropped", i)
+		}
+	}
+}
+
+func TestApplyLocalityWeightDefaultWeight(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/*": 100,
+				},
+			},
+		},
+	}
+
+	cases := []struct {
+		name          string
+		defaultWeight uint32
+		expected      []uint32
+	}{
+		{
+			// a group without a weight is 100 times smaller than the weighted one.
+			name:     "default weight 1",
+			expected: []uint32{98, 1, 1},
+		},
+		{
+			// the groups without a weight have the capacity of the weighted one.
+			name:          "default weight 100",
+			defaultWeight: 100,
+			expected:      []uint32{34, 33, 33},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", weight: 100, endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region1/zone3", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{DefaultWeight: tt.defaultWeight})
+			weights := make([]uint32, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverPreferredMetadata(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	premium := &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: "premium"}}
+	standard := &structpb.Value{Kind: &structpb.Value_StringValue{StringValue: "standard"}}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", weight: 3, endpoints: 3},
+		localitySpec{locality: "region2/zone1", endpoints: 2},
+		localitySpec{locality: "region2/zone2", endpoints: 1},
+	)
+	for _, lbEp := range []*endpoint.LbEndpoint{cla.Endpoints[0].LbEndpoints[0], cla.Endpoints[0].LbEndpoints[2],
+		cla.Endpoints[1].LbEndpoints[1]} {
+		lbEp.Metadata = &envoycore.Metadata{FilterMetadata: map[string]*structpb.Struct{
+			"istio": {Fields: map[string]*structpb.Value{"tier": premium}},
+		}}
+	}
+	cla.Endpoints[2].LbEndpoints[0].Metadata = &envoycore.Metadata{FilterMetadata: map[string]*structpb.Struct{
+		"istio": {Fields: map[string]*structpb.Value{"tier": standard}},
+	}}
+
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{
+		FailoverPreferredMetadata: &MetadataMatch{MetadataKey: MetadataKey{Filter: "istio", Key: "tier"}, Value: "premium"},
+	})
+
+	type group struct {
+		locality  string
+		priority  uint32
+		weight    uint32
+		addresses []string
+	}
+	expected := []group{
+		{locality: "region1/zone1", priority: 0, weight: 3, addresses: []string{"10.0.0.0", "10.0.0.2"}},
+		{locality: "region1/zone1", priority: 1, weight: 3, addresses: []string{"10.0.0.1"}},
+		{locality: "region2/zone1", priority: 2, addresses: []string{"10.0.1.1"}},
+		{locality: "region2/zone1", priority: 3, addresses: []string{"10.0.1.0"}},
+		{locality: "region2/zone2", priority: 4, addresses: []string{"10.0.2.0"}},
+	}
+	got := make([]group, 0, len(cla.Endpoints))
+	for _, localityEndpoint := range cla.Endpoints {
+		g := group{
+			locality: util.LocalityToString(localityEndpoint.Locality),
+			priority: localityEndpoint.Priority,
+			weight:   localityEndpoint.LoadBalancingWeight.GetValue(),
+		}
+		for _, lbEp := range localityEndpoint.LbEndpoints {
+			g.addresses = append(g.addresses, lbEp.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+		}
+		got = append(got, g)
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got groups of endpoints %v expected %v", got, expected)
+	}
+}
+
+func TestApplyLocalityLBSettingMaxPriority(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	cases := []struct {
+		name       string
+		setting    *networking.LocalityLoadBalancerSetting
+		localities []localitySpec
+	}{
+		{
+			name:    "topological failover",
+			setting: &networking.LocalityLoadBalancerSetting{},
+			localities: []localitySpec{
+				{locality: "region1/zone1/subzone1", endpoints: 1},
+				{locality: "region1/zone1/subzone2", endpoints: 1},
+				{locality: "region1/zone2/subzone1", endpoints: 1},
+				{locality: "region2/zone1/subzone1", endpoints: 1},
+			},
+		},
+		{
+			name: "failover",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+						To:   "region3",
+					},
+				},
+			},
+			localities: []localitySpec{
+				{locality: "region1/zone1/subzone1", endpoints: 1},
+				{locality: "region2/zone1/subzone1", endpoints: 1},
+				{locality: "region3/zone1/subzone1", endpoints: 1},
+			},
+		},
+		{
+			name:    "single priority",
+			setting: &networking.LocalityLoadBalancerSetting{},
+			localities: []localitySpec{
+				{locality: "region1/zone1/subzone1", endpoints: 1},
+				{locality: "region1/zone1/subzone1", endpoints: 1},
+			},
+		},
+		{
+			name: "distribute",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1/*",
+						To: map[string]uint32{
+							"region1/*": 100,
+						},
+					},
+				},
+			},
+			localities: []localitySpec{
+				{locality: "region1/zone1/subzone1", endpoints: 1},
+				{locality: "region1/zone2/subzone1", priority: 1, endpoints: 1},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(tt.localities...)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, true, nil)
+			priorities := map[uint32]bool{}
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities[localityEndpoint.Priority] = true
+			}
+			if int(result.MaxPriority) != len(priorities)-1 {
+				t.Errorf("Got max priority %d expected %d", result.MaxPriority, len(priorities)-1)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverRegionGeos(t *testing.T) {
+	geos := map[string]string{
+		"region1": "geo1",
+		"region2": "geo1",
+		"region3": "geo2",
+		"region4": "geo2",
+	}
+	failover := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region4",
+			},
+			{
+				From: "region3",
+				To:   "region1",
+			},
+		},
+	}
+	cases := []struct {
+		name       string
+		locality   *envoycore.Locality
+		setting    *networking.LocalityLoadBalancerSetting
+		geos       map[string]string
+		priorities []uint32
+	}{
+		{
+			name:       "topological without geos",
+			locality:   &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			setting:    &networking.LocalityLoadBalancerSetting{},
+			priorities: []uint32{0, 1, 2, 2, 2, 2},
+		},
+		{
+			name:       "topological",
+			locality:   &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			setting:    &networking.LocalityLoadBalancerSetting{},
+			geos:       geos,
+			priorities: []uint32{0, 1, 2, 3, 3, 3},
+		},
+		{
+			name:       "topological from the other geo",
+			locality:   &envoycore.Locality{Region: "region4", Zone: "zone1"},
+			setting:    &networking.LocalityLoadBalancerSetting{},
+			geos:       geos,
+			priorities: []uint32{2, 2, 2, 1, 1, 0},
+		},
+		{
+			// the failover region comes first even if it is in another geo.
+			name:       "failover across geos",
+			locality:   &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			setting:    failover,
+			geos:       geos,
+			priorities: []uint32{0, 1, 3, 4, 4, 2},
+		},
+		{
+			// the other regions still fail over within the geo of the proxy first.
+			name:       "failover then within the geo",
+			locality:   &envoycore.Locality{Region: "region3", Zone: "zone1"},
+			setting:    failover,
+			geos:       geos,
+			priorities: []uint32{2, 3, 5, 0, 1, 4},
+		},
+		{
+			name:       "region without a geo",
+			locality:   &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			setting:    &networking.LocalityLoadBalancerSetting{},
+			geos:       map[string]string{"region1": "geo1", "region3": "geo1"},
+			priorities: []uint32{0, 1, 3, 2, 2, 3},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone2", endpoints: 1},
+				localitySpec{locality: "region4/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(tt.locality, cla, tt.setting, true, &Options{RegionGeos: tt.geos})
+			priorities := make([]uint32, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverMatrix(t *testing.T) {
+	// every region fails over to a different region, an asymmetric topology.
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+			{
+				From: "region2",
+				To:   "region3",
+			},
+			{
+				From: "region3",
+				To:   "region1",
+			},
+			// only the first failover setting matching the proxy region applies.
+			{
+				From: "region1",
+				To:   "region3",
+			},
+		},
+	}
+	cases := []struct {
+		name       string
+		locality   *envoycore.Locality
+		priorities []uint32
+	}{
+		{
+			name:       "region1",
+			locality:   &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			priorities: []uint32{0, 1, 2},
+		},
+		{
+			name:       "region2",
+			locality:   &envoycore.Locality{Region: "region2", Zone: "zone1"},
+			priorities: []uint32{2, 0, 1},
+		},
+		{
+			name:       "region3",
+			locality:   &envoycore.Locality{Region: "region3", Zone: "zone1"},
+			priorities: []uint32{1, 2, 0},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSetting(tt.locality, cla, setting, true)
+			priorities := make([]uint32, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverDegradedThreshold(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	cases := []struct {
+		name       string
+		threshold  float64
+		degraded   []int
+		priorities []uint32
+	}{
+		{
+			name:       "disabled",
+			degraded:   []int{4, 0, 0},
+			priorities: []uint32{0, 1, 2},
+		},
+		{
+			name:       "below the threshold",
+			threshold:  0.5,
+			degraded:   []int{2, 0, 0},
+			priorities: []uint32{0, 1, 2},
+		},
+		{
+			// the proxy locality shares the priority of the failover region.
+			name:       "above the threshold",
+			threshold:  0.5,
+			degraded:   []int{3, 0, 0},
+			priorities: []uint32{0, 0, 1},
+		},
+		{
+			// the priority of the failover region is left empty and compacted.
+			name:       "failover region degraded",
+			threshold:  0.5,
+			degraded:   []int{0, 4, 0},
+			priorities: []uint32{0, 1, 1},
+		},
+		{
+			name:       "all degraded",
+			threshold:  0.25,
+			degraded:   []int{4, 4, 4},
+			priorities: []uint32{0, 1, 2},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 4},
+				localitySpec{locality: "region2/zone1", endpoints: 4},
+				localitySpec{locality: "region3/zone1", endpoints: 4},
+			)
+			for group, count := range tt.degraded {
+				for i := 0; i < count; i++ {
+					cla.Endpoints[group].LbEndpoints[i].HealthStatus = envoycore.HealthStatus_DEGRADED
+				}
+			}
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{DegradedThreshold: tt.threshold})
+			priorities := make([]uint32, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverMaxActiveLocalities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{}
+
+	tests := []struct {
+		name     string
+		max      int
+		expected []uint32
+	}{
+		{
+			name:     "unset",
+			expected: []uint32{3, 2, 0, 3, 1},
+		},
+		{
+			name:     "two",
+			max:      2,
+			expected: []uint32{2, 1, 0, 2, 0},
+		},
+		{
+			// the first of the localities sharing a priority is kept active.
+			name:     "four",
+			max:      4,
+			expected: []uint32{0, 0, 0, 1, 0},
+		},
+		{
+			name:     "all",
+			max:      5,
+			expected: []uint32{0, 0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{MaxActiveLocalities: tt.max})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingCombineFailover(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	failover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region2",
+		},
+	}
+
+	tests := []struct {
+		name            string
+		from            string
+		opts            *Options
+		disableFailover bool
+		mode            Mode
+		weights         []uint32
+		priorities      []uint32
+	}{
+		{
+			name:            "distribute only",
+			from:            "region1/zone1",
+			opts:            &Options{},
+			disableFailover: true,
+			mode:            ModeDistribute,
+			weights:         []uint32{40, 40, 20, 0},
+			priorities:      []uint32{0, 0, 0, 0},
+		},
+		{
+			// each locality is alone in its priority, the dropped one is moved to the lowest priority.
+			name:       "combined",
+			from:       "region1/zone1",
+			opts:       &Options{},
+			mode:       ModeCombined,
+			weights:    []uint32{100, 100, 100, 0},
+			priorities: []uint32{0, 1, 2, 2},
+		},
+		{
+			// failover applies on its own, no weight is set.
+			name:       "distribute not matching",
+			from:       "region9/zone1",
+			opts:       &Options{},
+			mode:       ModeFailover,
+			weights:    []uint32{0, 0, 0, 0},
+			priorities: []uint32{0, 1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setting := &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: tt.from,
+						To: map[string]uint32{
+							"region1/*": 80,
+							"region2/*": 20,
+						},
+					},
+				},
+				Failover: failover,
+			}
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, !tt.disableFailover, tt.opts)
+			if result.Mode != tt.mode {
+				t.Errorf("Got mode %v expected %v", result.Mode, tt.mode)
+			}
+			weights := make([]uint32, 0)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingDistributeAndFailover(t *testing.T) {
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/subzone1": 60,
+					"region1/zone1/subzone2": 20,
+					"region2/*":              20,
+				},
+			},
+			{
+				From: "region2/*",
+				To: map[string]uint32{
+					"region2/*":       50,
+					"region1/zone1/*": 50,
+				},
+			},
+		},
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+			{
+				From: "region2",
+				To:   "region1",
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		locality       *envoycore.Locality
+		enableFailover bool
+		mode           Mode
+		weights        []uint32
+		priorities     []uint32
+	}{
+		{
+			// region1/zone2 shares the proxy region, but being dropped it takes the lowest priority as region3.
+			name:           "proxy in region1",
+			locality:       &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			enableFailover: true,
+			mode:           ModeCombined,
+			weights:        []uint32{75, 25, 0, 100, 0},
+			priorities:     []uint32{0, 0, 1, 1, 1},
+		},
+		{
+			name:           "proxy in region2",
+			locality:       &envoycore.Locality{Region: "region2", Zone: "zone1"},
+			enableFailover: true,
+			mode:           ModeCombined,
+			weights:        []uint32{50, 50, 0, 100, 0},
+			priorities:     []uint32{1, 1, 1, 0, 1},
+		},
+		{
+			name:       "failover disabled",
+			locality:   &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			mode:       ModeDistribute,
+			weights:    []uint32{60, 20, 0, 20, 0},
+			priorities: []uint32{0, 0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(tt.locality, cla, setting, tt.enableFailover, nil)
+			if result.Mode != tt.mode {
+				t.Errorf("Got mode %v expected %v", result.Mode, tt.mode)
+			}
+			weights := make([]uint32, 0)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+			if err := ValidateTransformedCLA(cla); err != nil {
+				t.Errorf("Got an invalid load assignment: %v", err)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingCombineFailoverPriorityWeights(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/subzone1": 40,
+					"region1/zone1/subzone2": 20,
+					"region1/zone1/subzone3": 10,
+					"region2/*":              30,
+				},
+			},
+		},
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected map[uint32][]uint32
+	}{
+		{
+			// both zones of the failover region share its priority.
+			name: "combined",
+			opts: &Options{NoFailoverZonePreference: true},
+			expected: map[uint32][]uint32{
+				0: {100},
+				1: {67, 33},
+				2: {50, 50},
+			},
+		},
+		{
+			name: "combined with consistent hashing",
+			opts: &Options{ConsistentHash: true, NoFailoverZonePreference: true},
+			expected: map[uint32][]uint32{
+				0: {100 * consistentHashWeightScale},
+				1: {6667, 3333},
+				2: {5000, 5000},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone3", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone2", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			bands := map[uint32][]uint32{}
+			for _, localityEndpoint := range cla.Endpoints {
+				bands[localityEndpoint.Priority] = append(bands[localityEndpoint.Priority], localityEndpoint.LoadBalancingWeight.GetValue())
+			}
+			if !reflect.DeepEqual(bands, tt.expected) {
+				t.Errorf("Got weights by priority %v expected %v", bands, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightCompleteWeights(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 100,
+					"region2/*":       0,
+					"region3/*":       0,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", priority: 0, endpoints: 1},
+		localitySpec{locality: "region2/zone1", priority: 0, endpoints: 1},
+		localitySpec{locality: "region3/zone1", priority: 1, endpoints: 1},
+		localitySpec{locality: "region4/zone1", priority: 0, endpoints: 1},
+	)
+	ApplyLocalityLBSetting(locality, cla, setting, true)
+
+	// the 0% locality is weighted along with the 100% one, the priority without weights is left unweighted.
+	weights := make([]*wrappers.UInt32Value, 0)
+	for _, localityEndpoint := range cla.Endpoints {
+		weights = append(weights, localityEndpoint.LoadBalancingWeight)
+	}
+	expected := []*wrappers.UInt32Value{{Value: 100}, {Value: 1}, nil, nil}
+	if !reflect.DeepEqual(weights, expected) {
+		t.Errorf("Got weights %v expected %v", weights, expected)
+	}
+	weighted := map[uint32]int{}
+	groups := map[uint32]int{}
+	for _, localityEndpoint := range cla.Endpoints {
+		if len(localityEndpoint.LbEndpoints) == 0 {
+			continue
+		}
+		groups[localityEndpoint.Priority]++
+		if localityEndpoint.LoadBalancingWeight != nil {
+			weighted[localityEndpoint.Priority]++
+		}
+	}
+	for priority, count := range weighted {
+		if count != groups[priority] {
+			t.Errorf("Got %d weighted localities out of %d in priority %d", count, groups[priority], priority)
+		}
+	}
+}
+
+func TestApplyLocalityFailoverSelfRegion(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+
+	tests := []struct {
+		name     string
+		failover []*networking.LocalityLoadBalancerSetting_Failover
+		expected []uint32
+	}{
+		{
+			name:     "no failover",
+			expected: []uint32{0, 1, 2, 2},
+		},
+		{
+			// effectively prefer local: the same priorities as without failover settings.
+			name: "catch-all to self region",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "*", To: FailoverSelfRegion},
+			},
+			expected: []uint32{0, 1, 2, 2},
+		},
+		{
+			name: "catch-all",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "*", To: "region3"},
+			},
+			expected: []uint32{0, 1, 3, 2},
+		},
+		{
+			name: "proxy region before catch-all",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "*", To: FailoverSelfRegion},
+				{From: "region1", To: "region2"},
+			},
+			expected: []uint32{0, 1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla,
+				&networking.LocalityLoadBalancerSetting{Failover: tt.failover}, true, nil)
+			if len(result.Warnings) != 0 {
+				t.Errorf("Got warnings %v expected none", result.Warnings)
+			}
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverFromWildcard(t *testing.T) {
+	usFailover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{From: "us-*", To: "eu-west1"},
+	}
+	// the wildcard takes precedence over the catch-all, whatever their order.
+	catchAllFailover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{From: "*", To: "ap-south1"},
+		{From: "us-*", To: "eu-west1"},
+	}
+
+	tests := []struct {
+		name     string
+		proxy    string
+		failover []*networking.LocalityLoadBalancerSetting_Failover
+		expected []uint32
+	}{
+		{
+			name:     "us-east1",
+			proxy:    "us-east1/zone1",
+			failover: usFailover,
+			expected: []uint32{0, 2, 1, 2},
+		},
+		{
+			name:     "us-west2",
+			proxy:    "us-west2/zone1",
+			failover: usFailover,
+			expected: []uint32{2, 0, 1, 2},
+		},
+		{
+			name:     "eu-west1 not matched",
+			proxy:    "eu-west1/zone1",
+			failover: usFailover,
+			expected: []uint32{1, 1, 0, 1},
+		},
+		{
+			name:     "wildcard before catch-all",
+			proxy:    "us-west2/zone1",
+			failover: catchAllFailover,
+			expected: []uint32{2, 0, 1, 2},
+		},
+		{
+			name:     "catch-all",
+			proxy:    "eu-west1/zone1",
+			failover: catchAllFailover,
+			expected: []uint32{2, 2, 0, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "us-east1/zone1", endpoints: 1},
+				localitySpec{locality: "us-west2/zone1", endpoints: 1},
+				localitySpec{locality: "eu-west1/zone1", endpoints: 1},
+				localitySpec{locality: "ap-south1/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSetting(util.ConvertLocality(tt.proxy), cla,
+				&networking.LocalityLoadBalancerSetting{Failover: tt.failover}, true)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPriorityTiers(t *testing.T) {
+	// the documented tiers, from the most to the least preferred.
+	tiers := []int{
+		PrioritySubzoneMatch,
+		PriorityZoneMatch,
+		PriorityRegionMatch,
+		PriorityOtherRegion,
+		PriorityFailoverMiss,
+		PriorityDemoted,
+	}
+	for i, tier := range tiers {
+		if tier != i {
+			t.Errorf("Got tier %d at position %d", tier, i)
+		}
+	}
+
+	proxy := util.ConvertLocality("region1/zone1/subzone1")
+	for locality, expected := range map[string]int{
+		"region1/zone1/subzone1": PrioritySubzoneMatch,
+		"region1/zone1/subzone2": PriorityZoneMatch,
+		"region1/zone2/subzone1": PriorityRegionMatch,
+		"region2/zone1/subzone1": PriorityOtherRegion,
+	} {
+		if got := util.LbPriority(proxy, util.ConvertLocality(locality)); got != expected {
+			t.Errorf("Got tier %d for %s expected %d", got, locality, expected)
+		}
+	}
+
+	// with a group of endpoints in every tier, the compacted priorities are the tiers.
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+		localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+		localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+		localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1/subzone1", endpoints: 1},
+		localitySpec{locality: "region4/zone1/subzone1", endpoints: 1},
+	)
+	ApplyLocalityLBSettingWithOptions(proxy, cla, setting, true, &Options{DemotedLocalities: []string{"region4/*"}})
+	for i, localityEndpoint := range cla.Endpoints {
+		if int(localityEndpoint.Priority) != tiers[i] {
+			t.Errorf("Got priority %d for %s expected %d",
+				localityEndpoint.Priority, util.LocalityToString(localityEndpoint.Locality), tiers[i])
+		}
+	}
+}
+
+func TestApplyLocalityWeightPreservesEndpointOrder(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+
+	tests := []struct {
+		name     string
+		to       map[string]uint32
+		opts     *Options
+		expected [][]string
+	}{
+		{
+			name: "groups dropped",
+			to:   map[string]uint32{"region1/*": 100},
+			opts: &Options{},
+			expected: [][]string{
+				{"10.0.0.2", "10.0.0.0", "10.0.0.1"},
+				{"10.0.1.1", "10.0.1.0"},
+				nil,
+				{"10.0.3.0"},
+			},
+		},
+		{
+			name: "groups removed",
+			to:   map[string]uint32{"region1/zone2/*": 100},
+			opts: &Options{},
+			expected: [][]string{
+				{"10.0.1.1", "10.0.1.0"},
+			},
+		},
+		{
+			name: "duplicate localities merged",
+			to:   map[string]uint32{"region1/*": 100},
+			opts: &Options{MergeDuplicateLocalities: true},
+			expected: [][]string{
+				{"10.0.0.2", "10.0.0.0", "10.0.0.1", "10.0.3.0"},
+				{"10.0.1.1", "10.0.1.0"},
+				nil,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 3},
+				localitySpec{locality: "region1/zone2", endpoints: 2},
+				localitySpec{locality: "region2/zone1", endpoints: 2},
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+			)
+			// the endpoints are not in address order.
+			lbEndpoints := cla.Endpoints[0].LbEndpoints
+			cla.Endpoints[0].LbEndpoints = []*endpoint.LbEndpoint{lbEndpoints[2], lbEndpoints[0], lbEndpoints[1]}
+			lbEndpoints = cla.Endpoints[1].LbEndpoints
+			cla.Endpoints[1].LbEndpoints = []*endpoint.LbEndpoint{lbEndpoints[1], lbEndpoints[0]}
+
+			setting := &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1",
+						To:   tt.to,
+					},
+				},
+			}
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			got := make([][]string, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				var addresses []string
+				for _, lbEp := range localityEndpoint.LbEndpoints {
+					addresses = append(addresses, lbEp.GetEndpoint().GetAddress().GetSocketAddress().GetAddress())
+				}
+				got = append(got, addresses)
+			}
+			if !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Got endpoints %v expected %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestMergeDuplicateLocalitiesLeavesCloneSourceUntouched(t *testing.T) {
+	source := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+	)
+	// spare capacity that appending to the shared endpoints would write into.
+	shared := make([]*endpoint.LbEndpoint, 1, 4)
+	shared[0] = source.Endpoints[0].LbEndpoints[0]
+	source.Endpoints[0].LbEndpoints = shared
+
+	cloned := util.CloneClusterLoadAssignment(source)
+	mergeDuplicateLocalities(&cloned, true)
+	if len(cloned.Endpoints) != 1 || len(cloned.Endpoints[0].LbEndpoints) != 2 {
+		t.Fatalf("Got %v expected a single group of 2 endpoints", cloned.Endpoints)
+	}
+	if len(source.Endpoints[0].LbEndpoints) != 1 {
+		t.Errorf("Got %d endpoints in the source group expected 1", len(source.Endpoints[0].LbEndpoints))
+	}
+	for i, lbEp := range shared[:cap(shared)][1:] {
+		if lbEp != nil {
+			t.Errorf("the backing array of the source endpoints was written at %d: %v", i+1, lbEp)
+		}
+	}
+}
+
+func TestApplyLocalityFailoverLatencyMatrix(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+
+	tests := []struct {
+		name     string
+		latency  map[string]map[string]float64
+		expected []uint32
+	}{
+		{
+			name:     "topology",
+			expected: []uint32{0, 1, 2, 2, 2},
+		},
+		{
+			// region3 is looked up by region, region4 has no latency and comes last.
+			name: "latency",
+			latency: map[string]map[string]float64{
+				"region1/zone1": {
+					"region1/zone2": 10,
+					"region2/zone1": 2,
+					"region3":       5,
+				},
+			},
+			expected: []uint32{0, 3, 1, 2, 4},
+		},
+		{
+			name: "equal latencies",
+			latency: map[string]map[string]float64{
+				"region1": {
+					"region2": 2,
+					"region3": 2,
+				},
+			},
+			expected: []uint32{0, 2, 1, 1, 3},
+		},
+		{
+			name: "no latency from the proxy",
+			latency: map[string]map[string]float64{
+				"region2": {
+					"region1": 2,
+				},
+			},
+			expected: []uint32{0, 1, 2, 2, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+				localitySpec{locality: "region4/zone1", endpoints: 1},
+			)
+			setting := &networking.LocalityLoadBalancerSetting{}
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{LatencyMatrix: tt.latency})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingDeadline(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	settings := map[string]*networking.LocalityLoadBalancerSetting{
+		"distribute": {
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1",
+					To: map[string]uint32{
+						"region1/*": 80,
+						"region2/*": 20,
+					},
+				},
+			},
+		},
+		"failover": {
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{
+					From: "region1",
+					To:   "region2",
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		deadline time.Duration
+		overrun  bool
+	}{
+		{
+			name: "no deadline",
+		},
+		{
+			name:     "within deadline",
+			deadline: time.Hour,
+		},
+		{
+			name:     "overrun",
+			deadline: 5 * time.Millisecond,
+			overrun:  true,
+		},
+	}
+	for mode, setting := range settings {
+		for _, tt := range tests {
+			t.Run(mode+" "+tt.name, func(t *testing.T) {
+				// every reading of the clock takes a millisecond.
+				clock := time.Unix(0, 0)
+				now := func() time.Time {
+					clock = clock.Add(time.Millisecond)
+					return clock
+				}
+				newCLA := func() *apiv2.ClusterLoadAssignment {
+					specs := make([]localitySpec, 0, 10)
+					for i := 0; i < 10; i++ {
+						specs = append(specs, localitySpec{locality: fmt.Sprintf("region%d/zone1", i%3+1), endpoints: 1})
+					}
+					return buildCLA(specs...)
+				}
+				cla := newCLA()
+				result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{Deadline: tt.deadline, Now: now})
+				if untransformed := reflect.DeepEqual(cla, newCLA()); untransformed != tt.overrun {
+					t.Errorf("Got untransformed %v expected %v", untransformed, tt.overrun)
+				}
+				if warned := len(result.Warnings) > 0; warned != tt.overrun {
+					t.Errorf("Got warnings %v expected overrun %v", result.Warnings, tt.overrun)
+				}
+				if tt.overrun && result.Mode != ModeNone {
+					t.Errorf("Got mode %v expected %v", result.Mode, ModeNone)
+				}
+			})
+		}
+	}
+}
+
+func TestApplyLocalityWeightComposeDistribute(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	regionLevel := &networking.LocalityLoadBalancerSetting_Distribute{
+		From: "region1/*",
+		To: map[string]uint32{
+			"region1/*": 70,
+			"region2/*": 30,
+		},
+	}
+	zoneLevel := &networking.LocalityLoadBalancerSetting_Distribute{
+		From: "region1/zone1/*",
+		To: map[string]uint32{
+			"region1/zone1/*": 60,
+			"region3/*":       40,
+		},
+	}
+	overlappingZoneLevel := &networking.LocalityLoadBalancerSetting_Distribute{
+		From: "region1/zone1",
+		To: map[string]uint32{
+			"region1/zone1/*": 90,
+			"region2/*":       10,
+		},
+	}
+	otherZoneLevel := &networking.LocalityLoadBalancerSetting_Distribute{
+		From: "region1/zone2",
+		To: map[string]uint32{
+			"region4/*": 100,
+		},
+	}
+
+	tests := []struct {
+		name       string
+		distribute []*networking.LocalityLoadBalancerSetting_Distribute
+		expected   []*wrappers.UInt32Value
+		dropped    []bool
+	}{
+		{
+			name:       "region level only",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{regionLevel},
+			expected:   []*wrappers.UInt32Value{{Value: 35}, {Value: 35}, {Value: 30}, nil, nil},
+			dropped:    []bool{false, false, false, true, true},
+		},
+		{
+			// the zone level rule claims region1/zone1, the region level one still sends region1/zone2 its share.
+			name:       "zone level over region level",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{regionLevel, zoneLevel},
+			expected:   []*wrappers.UInt32Value{{Value: 60}, {Value: 70}, {Value: 30}, {Value: 40}, nil},
+			dropped:    []bool{false, false, false, false, true},
+		},
+		{
+			name:       "listing order does not matter",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{zoneLevel, regionLevel},
+			expected:   []*wrappers.UInt32Value{{Value: 60}, {Value: 70}, {Value: 30}, {Value: 40}, nil},
+			dropped:    []bool{false, false, false, false, true},
+		},
+		{
+			// both rules list region2/*, the zone level percentage wins.
+			name:       "same To locality",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{regionLevel, overlappingZoneLevel},
+			expected:   []*wrappers.UInt32Value{{Value: 90}, {Value: 70}, {Value: 10}, nil, nil},
+			dropped:    []bool{false, false, false, true, true},
+		},
+		{
+			name:       "non matching rule",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{otherZoneLevel, regionLevel, zoneLevel},
+			expected:   []*wrappers.UInt32Value{{Value: 60}, {Value: 70}, {Value: 30}, {Value: 40}, nil},
+			dropped:    []bool{false, false, false, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+				localitySpec{locality: "region4/zone1", endpoints: 1},
+			)
+			applyLocalityWeight(locality, cla, tt.distribute, &Options{})
+
+			weights := make([]*wrappers.UInt32Value, 0)
+			dropped := make([]bool, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight)
+				dropped = append(dropped, len(localityEndpoint.LbEndpoints) == 0)
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+			if !reflect.DeepEqual(dropped, tt.dropped) {
+				t.Errorf("Got dropped %v expected %v", dropped, tt.dropped)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightDropsProxyLocality(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	distribute := func(to map[string]uint32) *networking.LocalityLoadBalancerSetting {
+		return &networking.LocalityLoadBalancerSetting{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To:   to,
+				},
+			},
+		}
+	}
+	warning := "the distribute rules of outbound|8080||test.example.org drop the endpoints of the proxy locality " +
+		"region1/zone1, their To localities do not list it"
+
+	tests := []struct {
+		name     string
+		setting  *networking.LocalityLoadBalancerSetting
+		opts     *Options
+		warnings []string
+	}{
+		{
+			name:     "proxy locality not listed",
+			setting:  distribute(map[string]uint32{"region1/zone2/*": 50, "region2/*": 50}),
+			opts:     &Options{},
+			warnings: []string{warning},
+		},
+		{
+			name:    "proxy locality listed",
+			setting: distribute(map[string]uint32{"region1/zone1/*": 50, "region2/*": 50}),
+			opts:    &Options{},
+		},
+		{
+			name:    "proxy region listed",
+			setting: distribute(map[string]uint32{"region1/*": 50, "region2/*": 50}),
+			opts:    &Options{},
+		},
+		{
+			name:    "unlisted localities kept",
+			setting: distribute(map[string]uint32{"region1/zone2/*": 50, "region2/*": 50}),
+			opts:    &Options{UnlistedLocalities: UnlistedLocalityKeep},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, true, tt.opts)
+			if !reflect.DeepEqual(result.Warnings, tt.warnings) {
+				t.Errorf("Got warnings %q expected %q", result.Warnings, tt.warnings)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightMaxSkewRatio(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	distribute := func(to map[string]uint32) *networking.LocalityLoadBalancerSetting {
+		return &networking.LocalityLoadBalancerSetting{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1",
+					To:   to,
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		setting  *networking.LocalityLoadBalancerSetting
+		ratio    float64
+		expected []*wrappers.UInt32Value
+	}{
+		{
+			name:     "within the ratio",
+			setting:  distribute(map[string]uint32{"region1/*": 60, "region2/*": 40}),
+			ratio:    3,
+			expected: []*wrappers.UInt32Value{{Value: 60}, {Value: 40}, nil},
+		},
+		{
+			// 90 is capped to 15, then the weights are scaled back to a sum of 100.
+			name:     "compressed",
+			setting:  distribute(map[string]uint32{"region1/*": 90, "region2/*": 5, "region3/*": 5}),
+			ratio:    3,
+			expected: []*wrappers.UInt32Value{{Value: 60}, {Value: 20}, {Value: 20}},
+		},
+		{
+			// 70 is capped to 30, scaled back to 50, 33.3 and 16.7.
+			name:     "compressed and rounded",
+			setting:  distribute(map[string]uint32{"region1/*": 70, "region2/*": 20, "region3/*": 10}),
+			ratio:    3,
+			expected: []*wrappers.UInt32Value{{Value: 50}, {Value: 33}, {Value: 17}},
+		},
+		{
+			name:     "equal weights",
+			setting:  distribute(map[string]uint32{"region1/*": 70, "region2/*": 20, "region3/*": 10}),
+			ratio:    1,
+			expected: []*wrappers.UInt32Value{{Value: 33}, {Value: 33}, {Value: 33}},
+		},
+		{
+			name:     "disabled",
+			setting:  distribute(map[string]uint32{"region1/*": 90, "region2/*": 5, "region3/*": 5}),
+			expected: []*wrappers.UInt32Value{{Value: 90}, {Value: 5}, {Value: 5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, true, &Options{MaxSkewRatio: tt.ratio})
+			weights := make([]*wrappers.UInt32Value, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight)
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+			if tt.ratio > 0 {
+				min, max := uint32(math.MaxUint32), uint32(0)
+				for _, weight := range weights {
+					if weight == nil {
+						continue
+					}
+					if weight.GetValue() < min {
+						min = weight.GetValue()
+					}
+					if weight.GetValue() > max {
+						max = weight.GetValue()
+					}
+				}
+				if float64(max) > float64(min)*tt.ratio {
+					t.Errorf("Got weights %v skewed beyond %v", weights, tt.ratio)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverExtendsTopologyLadder(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected []uint32
+	}{
+		{
+			name:     "failover region",
+			opts:     &Options{NoFailoverZonePreference: true},
+			expected: []uint32{0, 1, 2, 2, 3, 3, 4},
+		},
+		{
+			name:     "failover zone preference",
+			opts:     &Options{},
+			expected: []uint32{0, 1, 2, 2, 3, 4, 5},
+		},
+		{
+			name: "weighted failover",
+			opts: &Options{FailoverRules: []*FailoverRule{
+				{Mode: FailoverWeighted, From: "region1", Weights: map[string]uint32{"region2": 60, "region3": 40}},
+			}},
+			expected: []uint32{0, 1, 2, 2, 3, 3, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+				localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone3/subzone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region2/zone2/subzone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1/subzone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+
+			// the subzone, zone and region tiers are kept ahead of the failover targets.
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightBalancedDistribute(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	distribute := func(to map[string]uint32) []*networking.LocalityLoadBalancerSetting_Distribute {
+		return []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To:   to,
+			},
+		}
+	}
+	balanced := distribute(map[string]uint32{BalancedDistribute: 100})
+
+	tests := []struct {
+		name       string
+		distribute []*networking.LocalityLoadBalancerSetting_Distribute
+		localities []localitySpec
+		expected   []*wrappers.UInt32Value
+	}{
+		{
+			name:       "2 localities",
+			distribute: balanced,
+			localities: []localitySpec{
+				{locality: "region1/zone1", weight: 3, endpoints: 1},
+				{locality: "region2/zone1", endpoints: 1},
+			},
+			expected: []*wrappers.UInt32Value{{Value: 50}, {Value: 50}},
+		},
+		{
+			name:       "3 localities",
+			distribute: balanced,
+			localities: []localitySpec{
+				{locality: "region1/zone1", endpoints: 1},
+				{locality: "region1/zone2", endpoints: 2},
+				{locality: "region2/zone1", endpoints: 1},
+			},
+			expected: []*wrappers.UInt32Value{{Value: 34}, {Value: 33}, {Value: 33}},
+		},
+		{
+			name:       "4 localities",
+			distribute: balanced,
+			localities: []localitySpec{
+				{locality: "region1/zone1", endpoints: 1},
+				{locality: "region1/zone2", endpoints: 1},
+				{locality: "region2/zone1", endpoints: 1},
+				{locality: "region3/zone1", weight: 10, endpoints: 1},
+			},
+			expected: []*wrappers.UInt32Value{{Value: 25}, {Value: 25}, {Value: 25}, {Value: 25}},
+		},
+		{
+			// a locality without endpoints is not present, it is left out of the split.
+			name:       "locality without endpoints",
+			distribute: balanced,
+			localities: []localitySpec{
+				{locality: "region1/zone1", endpoints: 1},
+				{locality: "region2/zone1", endpoints: 1},
+				{locality: "region3/zone1"},
+			},
+			expected: []*wrappers.UInt32Value{{Value: 50}, {Value: 50}, nil},
+		},
+		{
+			name:       "balanced remainder",
+			distribute: distribute(map[string]uint32{"region1/*": 50, BalancedDistribute: 50}),
+			localities: []localitySpec{
+				{locality: "region1/zone1", endpoints: 1},
+				{locality: "region1/zone2", endpoints: 1},
+				{locality: "region2/zone1", endpoints: 1},
+				{locality: "region3/zone1", endpoints: 1},
+			},
+			expected: []*wrappers.UInt32Value{{Value: 25}, {Value: 25}, {Value: 25}, {Value: 25}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(tt.localities...)
+			applyLocalityWeight(locality, cla, tt.distribute, &Options{})
+			weights := make([]*wrappers.UInt32Value, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight)
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverMinPriorityEndpoints(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		min      int
+		expected []uint32
+	}{
+		{
+			name:     "disabled",
+			expected: []uint32{0, 1, 2, 3},
+		},
+		{
+			name:     "enough endpoints",
+			min:      2,
+			expected: []uint32{0, 1, 2, 3},
+		},
+		{
+			// the 2 endpoints of the proxy zone are merged with the 3 of the other zone.
+			name:     "proxy zone too small",
+			min:      3,
+			expected: []uint32{0, 0, 1, 2},
+		},
+		{
+			name:     "merged up to the failover region",
+			min:      6,
+			expected: []uint32{0, 0, 0, 1},
+		},
+		{
+			// the last priority has nothing to spill over to, it keeps its few endpoints.
+			name:     "last priority too small",
+			min:      20,
+			expected: []uint32{0, 0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 2},
+				localitySpec{locality: "region1/zone2", endpoints: 3},
+				localitySpec{locality: "region2/zone1", endpoints: 4},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{MinPriorityEndpoints: tt.min})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverPrimaryAllowlist(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		allowlist []string
+		expected  []uint32
+		warning   bool
+	}{
+		{
+			name:     "disabled",
+			expected: []uint32{0, 1, 2, 3},
+		},
+		{
+			name:      "proxy locality allowed",
+			allowlist: []string{"region1/*"},
+			expected:  []uint32{0, 1, 2, 3},
+		},
+		{
+			// the proxy zone is demoted right after the allowed zone.
+			name:      "proxy locality excluded",
+			allowlist: []string{"region1/zone2"},
+			expected:  []uint32{1, 0, 2, 3},
+		},
+		{
+			name:      "only the failover region allowed",
+			allowlist: []string{"region2/*"},
+			expected:  []uint32{1, 2, 0, 3},
+		},
+		{
+			name:      "several allowed localities",
+			allowlist: []string{"region2/*", "region3/*"},
+			expected:  []uint32{1, 2, 0, 3},
+		},
+		{
+			name:      "no allowed locality with endpoints",
+			allowlist: []string{"region4/*"},
+			expected:  []uint32{0, 1, 2, 3},
+			warning:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{PrimaryAllowlist: tt.allowlist})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+			if warned := len(result.Warnings) > 0; warned != tt.warning {
+				t.Errorf("Got warnings %v expected a warning %v", result.Warnings, tt.warning)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightUnknownLocality(t *testing.T) {
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/*":       20,
+				},
+			},
+			{
+				From: "region2/*",
+				To: map[string]uint32{
+					"region2/*": 100,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		locality *envoycore.Locality
+		setting  *networking.LocalityLoadBalancerSetting
+		apply    bool
+		expected []uint32
+	}{
+		{
+			name:     "topology-less proxy without the option",
+			locality: &envoycore.Locality{},
+			setting:  setting,
+			expected: []uint32{0, 0, 0},
+		},
+		{
+			name:     "topology-less proxy with the option",
+			locality: &envoycore.Locality{},
+			setting:  setting,
+			apply:    true,
+			expected: []uint32{80, 20, 1},
+		},
+		{
+			// a rule matching the proxy is applied rather than the default one.
+			name:     "topology-less proxy matching a wildcard rule",
+			locality: &envoycore.Locality{},
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: append([]*networking.LocalityLoadBalancerSetting_Distribute{},
+					setting.Distribute[0],
+					&networking.LocalityLoadBalancerSetting_Distribute{
+						From: "*",
+						To: map[string]uint32{
+							"region3/*": 100,
+						},
+					}),
+			},
+			apply:    true,
+			expected: []uint32{1, 1, 100},
+		},
+		{
+			// the proxies with a region are left to the regular rules.
+			name:     "proxy with a region matching no rule",
+			locality: &envoycore.Locality{Region: "region3"},
+			setting:  setting,
+			apply:    true,
+			expected: []uint32{0, 0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(tt.locality, cla, tt.setting, false,
+				&Options{ApplyDistributeToUnknownLocality: tt.apply, UnlistedLocalities: UnlistedLocalityKeep})
+			if result.Setting != tt.setting {
+				t.Errorf("Got the setting %v reported expected the given one", result.Setting)
+			}
+			weights := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.GetLoadBalancingWeight().GetValue())
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverPreservePriorities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected []uint32
+	}{
+		{
+			name:     "incoming priorities overwritten",
+			opts:     &Options{},
+			expected: []uint32{0, 2, 1, 3},
+		},
+		{
+			// the groups of endpoints arriving with priority 1 come after the ones arriving with priority 0.
+			name:     "incoming priorities preserved",
+			opts:     &Options{PreservePriorities: true},
+			expected: []uint32{0, 1, 2, 3},
+		},
+		{
+			name:     "incoming priorities preserved with a comparator",
+			opts:     &Options{PreservePriorities: true, LocalityComparator: TopologyComparator{}},
+			expected: []uint32{0, 1, 2, 3},
+		},
+		{
+			// the incoming priority 1 is frozen, the failover priorities come after it.
+			name:     "incoming priority masked",
+			opts:     &Options{PriorityMask: map[uint32]bool{0: true}},
+			expected: []uint32{2, 3, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", priority: 1, endpoints: 1},
+				localitySpec{locality: "region3/zone1", priority: 1, endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightOverlappingTo(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+
+	tests := []struct {
+		name     string
+		to       map[string]uint32
+		expected []uint32
+	}{
+		{
+			// the zone level To wins over the region level one for the proxy zone.
+			name: "most specific wins",
+			to: map[string]uint32{
+				"region1/*":       40,
+				"region1/zone1/*": 50,
+				"region2/*":       10,
+			},
+			expected: []uint32{50, 40, 10},
+		},
+		{
+			// equally specific, the first one in lexical order wins.
+			name: "lexical order breaks ties",
+			to: map[string]uint32{
+				"region1/*":       40,
+				"region1/zone1":   20,
+				"region1/zone1/*": 30,
+				"region2/*":       10,
+			},
+			expected: []uint32{20, 40, 10},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setting := &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1/*",
+						To:   tt.to,
+					},
+				},
+			}
+			for i := 0; i < 100; i++ {
+				cla := buildCLA(
+					localitySpec{locality: "region1/zone1", endpoints: 1},
+					localitySpec{locality: "region1/zone2", endpoints: 1},
+					localitySpec{locality: "region2/zone1", endpoints: 1},
+				)
+				ApplyLocalityLBSetting(locality, cla, setting, false)
+				weights := make([]uint32, 0)
+				for _, localityEndpoint := range cla.Endpoints {
+					weights = append(weights, localityEndpoint.GetLoadBalancingWeight().GetValue())
+				}
+				if !reflect.DeepEqual(weights, tt.expected) {
+					t.Fatalf("Got weights %v expected %v at run %d", weights, tt.expected, i)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightSubzoneTo(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+
+	tests := []struct {
+		name     string
+		to       map[string]uint32
+		expected []uint32
+		total    uint32
+	}{
+		{
+			// the subzone is claimed by its own To only, the zone level one splits its share between the
+			// other groups of the zone, the ones without a subzone included.
+			name: "subzone and zone",
+			to: map[string]uint32{
+				"region1/zone1/subzone1": 50,
+				"region1/zone1":          30,
+				"region2":                20,
+			},
+			expected: []uint32{50, 15, 15, 20},
+			total:    100,
+		},
+		{
+			// a subzone To does not match the groups of endpoints without a subzone.
+			name: "subzone only",
+			to: map[string]uint32{
+				"region1/zone1/subzone1": 80,
+				"region2/*":              20,
+			},
+			expected: []uint32{80, 0, 0, 20},
+			total:    100,
+		},
+		{
+			// the more specific To localities claim all the groups of region1, the region level one is left
+			// without endpoints and its share is not counted, as for a To locality without endpoints.
+			name: "subzone, zone and region",
+			to: map[string]uint32{
+				"region1/zone1/subzone2": 40,
+				"region1/zone1/*":        20,
+				"region1":                10,
+				"region2/zone1":          30,
+			},
+			expected: []uint32{10, 40, 10, 30},
+			total:    90,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setting := &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1/*",
+						To:   tt.to,
+					},
+				},
+			}
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSetting(locality, cla, setting, false)
+			weights := make([]uint32, 0)
+			total := uint32(0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.GetLoadBalancingWeight().GetValue())
+				total += localityEndpoint.GetLoadBalancingWeight().GetValue()
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+			if total != tt.total {
+				t.Errorf("Got total weight %d expected %d", total, tt.total)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingNilAndEmpty(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+
+	tests := []struct {
+		name           string
+		setting        *networking.LocalityLoadBalancerSetting
+		enableFailover bool
+		mode           Mode
+		priorities     []uint32
+	}{
+		{
+			name:           "nil setting",
+			enableFailover: true,
+			mode:           ModeNone,
+			priorities:     []uint32{1, 1, 0},
+		},
+		{
+			name:       "empty setting without failover",
+			setting:    &networking.LocalityLoadBalancerSetting{},
+			mode:       ModeNone,
+			priorities: []uint32{1, 1, 0},
+		},
+		{
+			name: "empty rules without failover",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{},
+				Failover:   []*networking.LocalityLoadBalancerSetting_Failover{},
+			},
+			mode:       ModeNone,
+			priorities: []uint32{1, 1, 0},
+		},
+		{
+			// the default locality failover prioritizes by topology.
+			name:           "empty setting with failover",
+			setting:        &networking.LocalityLoadBalancerSetting{},
+			enableFailover: true,
+			mode:           ModeFailover,
+			priorities:     []uint32{0, 1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", priority: 1, endpoints: 1},
+				localitySpec{locality: "region1/zone2", priority: 1, endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, tt.enableFailover,
+				&Options{OverprovisioningFactor: 200})
+			if result.Mode != tt.mode {
+				t.Errorf("Got mode %s expected %s", result.Mode, tt.mode)
+			}
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+			if untouched := tt.mode == ModeNone; untouched != (cla.Policy == nil) {
+				t.Errorf("Got policy %v with mode %s", cla.Policy, result.Mode)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverEmptyProxyLocality(t *testing.T) {
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	distributed := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "*",
+				To: map[string]uint32{
+					"region1/*": 50,
+					"region2/*": 50,
+				},
+			},
+		},
+		Failover: setting.Failover,
+	}
+
+	tests := []struct {
+		name     string
+		locality *envoycore.Locality
+		setting  *networking.LocalityLoadBalancerSetting
+		mode     Mode
+		weights  []uint32
+	}{
+		{
+			name:    "nil locality",
+			setting: setting,
+			mode:    ModeNone,
+			weights: []uint32{0, 0, 0},
+		},
+		{
+			name:     "empty locality",
+			locality: &envoycore.Locality{},
+			setting:  setting,
+			mode:     ModeNone,
+			weights:  []uint32{0, 0, 0},
+		},
+		{
+			// a zone without a region is no locality either.
+			name:     "zone only",
+			locality: &envoycore.Locality{Zone: "zone1"},
+			setting:  setting,
+			mode:     ModeNone,
+			weights:  []uint32{0, 0, 0},
+		},
+		{
+			// the distribute rules matching any proxy still weight the localities.
+			name:     "empty locality with distribute",
+			locality: &envoycore.Locality{},
+			setting:  distributed,
+			mode:     ModeDistribute,
+			weights:  []uint32{50, 50, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			result := ApplyLocalityLBSettingWithOptions(tt.locality, cla, tt.setting, true, nil)
+			if result.Mode != tt.mode {
+				t.Errorf("Got mode %s expected %s", result.Mode, tt.mode)
+			}
+			priorities := make([]uint32, 0)
+			weights := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+				weights = append(weights, localityEndpoint.GetLoadBalancingWeight().GetValue())
+			}
+			if expected := []uint32{0, 0, 0}; !reflect.DeepEqual(priorities, expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, expected)
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightMinHealthyEndpoints(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/*": 60, "region2/*": 40},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		min       int
+		endpoints []int
+		unhealthy []int
+		expected  []*wrappers.UInt32Value
+	}{
+		{
+			// The single endpoint is half of the threshold, the 30 taken from it go to region2.
+			name:      "single endpoint",
+			min:       2,
+			endpoints: []int{1, 2},
+			expected:  []*wrappers.UInt32Value{{Value: 30}, {Value: 70}},
+		},
+		{
+			name:      "unhealthy endpoint",
+			min:       2,
+			endpoints: []int{2, 2},
+			unhealthy: []int{1, 0},
+			expected:  []*wrappers.UInt32Value{{Value: 30}, {Value: 70}},
+		},
+		{
+			name:      "no healthy endpoint",
+			min:       2,
+			endpoints: []int{2, 2},
+			unhealthy: []int{2, 0},
+			expected:  []*wrappers.UInt32Value{{Value: 1}, {Value: 99}},
+		},
+		{
+			name:      "above the threshold",
+			min:       2,
+			endpoints: []int{3, 2},
+			expected:  []*wrappers.UInt32Value{{Value: 60}, {Value: 40}},
+		},
+		{
+			// Nowhere to hand the weight over to, the weights are only scaled down.
+			name:      "all below the threshold",
+			min:       2,
+			endpoints: []int{1, 1},
+			expected:  []*wrappers.UInt32Value{{Value: 30}, {Value: 20}},
+		},
+		{
+			name:      "disabled",
+			endpoints: []int{1, 2},
+			expected:  []*wrappers.UInt32Value{{Value: 60}, {Value: 40}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: tt.endpoints[0]},
+				localitySpec{locality: "region2/zone1", endpoints: tt.endpoints[1]},
+			)
+			for i, unhealthy := range tt.unhealthy {
+				for j := 0; j < unhealthy; j++ {
+					cla.Endpoints[i].LbEndpoints[j].HealthStatus = envoycore.HealthStatus_UNHEALTHY
+				}
+			}
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{MinHealthyEndpoints: tt.min})
+			weights := make([]*wrappers.UInt32Value, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight)
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightPreservesTotal(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/*": 70, "region2/*": 30},
+			},
+		},
+	}
+	// 7 groups of endpoints in region1 and 3 in region2, of uneven sizes, none of the shares is a whole number.
+	var localities []localitySpec
+	for i := 0; i < 7; i++ {
+		localities = append(localities, localitySpec{locality: fmt.Sprintf("region1/zone%d", i), endpoints: i%3 + 1})
+	}
+	for i := 0; i < 3; i++ {
+		localities = append(localities, localitySpec{locality: fmt.Sprintf("region2/zone%d", i), endpoints: 2*i + 1})
+	}
+
+	for _, unitWeighting := range []bool{false, true} {
+		cla := buildCLA(localities...)
+		ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{RegionUnitWeighting: unitWeighting})
+		totals := map[string]uint32{}
+		for _, localityEndpoint := range cla.Endpoints {
+			totals[localityEndpoint.Locality.Region] += localityEndpoint.LoadBalancingWeight.GetValue()
+		}
+		for region, expected := range map[string]uint32{"region1": 70, "region2": 30} {
+			if totals[region]+1 < expected || totals[region] > expected+1 {
+				t.Errorf("unit weighting %v: Got weight %d for %s expected %d", unitWeighting, totals[region], region, expected)
+			}
+		}
+	}
+}
+
+func TestApplyLocalityWeightExactLocalityMatch(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/zone1": 80, "region2/zone1": 20},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		exact    bool
+		expected []*wrappers.UInt32Value
+	}{
+		{
+			// region1/zone1 matches its subzones but not region1/zone10.
+			name:     "prefix",
+			expected: []*wrappers.UInt32Value{{Value: 40}, {Value: 40}, nil, {Value: 20}},
+		},
+		{
+			name:     "exact",
+			exact:    true,
+			expected: []*wrappers.UInt32Value{{Value: 80}, nil, nil, {Value: 20}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone10", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{ExactLocalityMatch: tt.exact})
+			weights := make([]*wrappers.UInt32Value, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight)
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingApplied(t *testing.T) {
+	distribute := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/*": 80, "region2/*": 20},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		locality       *envoycore.Locality
+		setting        *networking.LocalityLoadBalancerSetting
+		enableFailover bool
+		expected       bool
+	}{
+		{
+			name:     "matching From",
+			locality: &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			setting:  distribute,
+			expected: true,
+		},
+		{
+			name:     "no matching From",
+			locality: &envoycore.Locality{Region: "region3", Zone: "zone1"},
+			setting:  distribute,
+			expected: false,
+		},
+		{
+			name:           "failover",
+			locality:       &envoycore.Locality{Region: "region3", Zone: "zone1"},
+			setting:        &networking.LocalityLoadBalancerSetting{},
+			enableFailover: true,
+			expected:       true,
+		},
+		{
+			name:     "nil setting",
+			locality: &envoycore.Locality{Region: "region1", Zone: "zone1"},
+			expected: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			before := SnapshotLoadAssignment(cla)
+			if got := ApplyLocalityLBSetting(tt.locality, cla, tt.setting, tt.enableFailover); got != tt.expected {
+				t.Errorf("Got applied %v expected %v", got, tt.expected)
+			}
+			if !tt.expected {
+				for _, diff := range CompareSnapshots(before, SnapshotLoadAssignment(cla)) {
+					t.Errorf("the load assignment was modified: %v", diff)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightHealthyEndpointWeighting(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/*": 80, "region2/*": 20},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		enabled  bool
+		expected []uint32
+		perPod   []float64
+	}{
+		{
+			// the zones of region1 get the same share whatever their number of pods.
+			name:     "off",
+			expected: []uint32{40, 40, 20},
+			perPod:   []float64{20, 2.5, 20},
+		},
+		{
+			// the 80 of region1 are split 2:16, the unhealthy pods of zone2 not counting.
+			name:     "on",
+			enabled:  true,
+			expected: []uint32{9, 71, 20},
+			perPod:   []float64{4.5, 4.4375, 20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 2},
+				localitySpec{locality: "region1/zone2", endpoints: 20},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			)
+			for _, lbEp := range cla.Endpoints[1].LbEndpoints[:4] {
+				lbEp.HealthStatus = envoycore.HealthStatus_UNHEALTHY
+			}
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{HealthyEndpointWeighting: tt.enabled})
+			weights := make([]uint32, 0)
+			perPod := make([]float64, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weight := localityEndpoint.LoadBalancingWeight.GetValue()
+				weights = append(weights, weight)
+				perPod = append(perPod, float64(weight)/float64(healthyEndpoints(localityEndpoint)))
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+			if !reflect.DeepEqual(perPod, tt.perPod) {
+				t.Errorf("Got weights per pod %v expected %v", perPod, tt.perPod)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverRegionFailover(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	chain := []*FailoverRule{
+		{Mode: FailoverRegions, From: "region5", To: []string{"region1"}},
+		{Mode: FailoverRegions, From: "region1", To: []string{"region2", "region3", "region4"}},
+	}
+
+	tests := []struct {
+		name           string
+		localities     []string
+		zonePreference bool
+		expected       []uint32
+	}{
+		{
+			name:       "three region chain",
+			localities: []string{"region1/zone1", "region3/zone1", "region2/zone1", "region5/zone1", "region4/zone1"},
+			expected:   []uint32{0, 2, 1, 4, 3},
+		},
+		{
+			// region2 and region4 have no endpoints, their steps take no priority.
+			name:       "compacted",
+			localities: []string{"region5/zone1", "region3/zone1", "region1/zone2"},
+			expected:   []uint32{2, 1, 0},
+		},
+		{
+			name:           "zone preference",
+			localities:     []string{"region2/zone2", "region3/zone1", "region2/zone1", "region1/zone1"},
+			zonePreference: true,
+			expected:       []uint32{2, 3, 1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var specs []localitySpec
+			for _, l := range tt.localities {
+				specs = append(specs, localitySpec{locality: l, endpoints: 1})
+			}
+			cla := buildCLA(specs...)
+			ApplyLocalityLBSettingWithOptions(locality, cla, &networking.LocalityLoadBalancerSetting{}, true,
+				&Options{FailoverRules: chain, NoFailoverZonePreference: !tt.zonePreference})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityFailoverRulesPrecedence(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	zones := &FailoverRule{Mode: FailoverZones, From: "region1/zone1", To: []string{"region1/zone2"}}
+	weighted := &FailoverRule{Mode: FailoverWeighted, From: "region1", Weights: map[string]uint32{"region3": 100}}
+	regions := &FailoverRule{Mode: FailoverRegions, From: "region1", To: []string{"region2"}}
+
+	tests := []struct {
+		name     string
+		rules    []*FailoverRule
+		expected []uint32
+	}{
+		{
+			name:     "weighted first",
+			rules:    []*FailoverRule{zones, weighted, regions},
+			expected: []uint32{0, 1, 3, 2},
+		},
+		{
+			name:     "regions first",
+			rules:    []*FailoverRule{regions, weighted, zones},
+			expected: []uint32{0, 1, 2, 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1"},
+				localitySpec{locality: "region1/zone2"},
+				localitySpec{locality: "region2/zone1"},
+				localitySpec{locality: "region3/zone1"},
+			)
+			ApplyLocalityLBSettingWithOptions(locality, cla, &networking.LocalityLoadBalancerSetting{}, true,
+				&Options{FailoverRules: tt.rules})
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityWeightEmptyGroups(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 60,
+					"region2/*":       40,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name      string
+		endpoints []int
+		expected  []uint32
+	}{
+		{
+			name:      "populated",
+			endpoints: []int{1, 1, 1, 1},
+			expected:  []uint32{30, 30, 20, 20},
+		},
+		{
+			// the share of the drained group goes to the populated groups of the same To locality.
+			name:      "drained group",
+			endpoints: []int{1, 0, 1, 1},
+			expected:  []uint32{60, 0, 20, 20},
+		},
+		{
+			name:      "drained To locality",
+			endpoints: []int{0, 0, 1, 1},
+			expected:  []uint32{30, 30, 20, 20},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: tt.endpoints[0]},
+				localitySpec{locality: "region1/zone1/subzone2", endpoints: tt.endpoints[1]},
+				localitySpec{locality: "region2/zone1/subzone1", endpoints: tt.endpoints[2]},
+				localitySpec{locality: "region2/zone2/subzone1", endpoints: tt.endpoints[3]},
+			)
+			ApplyLocalityLBSetting(locality, cla, setting, false)
+			weights := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.GetLoadBalancingWeight().GetValue())
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
 func TestGetLocalityLbSetting(t *testing.T) {
 	// dummy config for test
 	failover := []*networking.LocalityLoadBalancerSetting_Failover{nil}
@@ -167,38 +4856,645 @@ func TestGetLocalityLbSetting(t *testing.T) {
 		dr       *networking.LocalityLoadBalancerSetting
 		expected *networking.LocalityLoadBalancerSetting
 	}{
-		{"all disabled",
-			nil,
-			nil,
-			nil,
+		{"all disabled",
+			nil,
+			nil,
+			nil,
+		},
+		{"mesh only",
+			&networking.LocalityLoadBalancerSetting{},
+			nil,
+			&networking.LocalityLoadBalancerSetting{},
+		},
+		{"dr only",
+			nil,
+			&networking.LocalityLoadBalancerSetting{},
+			nil,
+		},
+		{"dr only override",
+			nil,
+			&networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+			&networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+		},
+		{"both",
+			&networking.LocalityLoadBalancerSetting{},
+			&networking.LocalityLoadBalancerSetting{Failover: failover},
+			&networking.LocalityLoadBalancerSetting{Failover: failover},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GetLocalityLbSetting(tt.mesh, tt.dr)
+			if !reflect.DeepEqual(tt.expected, got) {
+				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestMergeLocalityLbSetting(t *testing.T) {
+	meshDistribute := []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region1/*",
+			To:   map[string]uint32{"region1/*": 80, "region2/*": 20},
+		},
+	}
+	drDistribute := []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region2/*",
+			To:   map[string]uint32{"region2/*": 100},
+		},
+	}
+	meshFailover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region2",
+		},
+	}
+	drFailover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region3",
+		},
+	}
+	mesh := &networking.LocalityLoadBalancerSetting{Distribute: meshDistribute, Failover: meshFailover}
+
+	cases := []struct {
+		name     string
+		mesh     *networking.LocalityLoadBalancerSetting
+		dr       *networking.LocalityLoadBalancerSetting
+		expected *networking.LocalityLoadBalancerSetting
+	}{
+		{
+			name: "all disabled",
+		},
+		{
+			name:     "mesh only",
+			mesh:     mesh,
+			expected: mesh,
+		},
+		{
+			name: "dr only",
+			dr:   &networking.LocalityLoadBalancerSetting{Failover: drFailover},
+		},
+		{
+			name:     "dr only enabled",
+			dr:       &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}, Failover: drFailover},
+			expected: &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}, Failover: drFailover},
+		},
+		{
+			name:     "dr failover inherits the mesh distribute",
+			mesh:     mesh,
+			dr:       &networking.LocalityLoadBalancerSetting{Failover: drFailover},
+			expected: &networking.LocalityLoadBalancerSetting{Distribute: meshDistribute, Failover: drFailover},
+		},
+		{
+			name:     "dr distribute inherits the mesh failover",
+			mesh:     mesh,
+			dr:       &networking.LocalityLoadBalancerSetting{Distribute: drDistribute},
+			expected: &networking.LocalityLoadBalancerSetting{Distribute: drDistribute, Failover: meshFailover},
+		},
+		{
+			name:     "dr overrides both",
+			mesh:     mesh,
+			dr:       &networking.LocalityLoadBalancerSetting{Distribute: drDistribute, Failover: drFailover},
+			expected: &networking.LocalityLoadBalancerSetting{Distribute: drDistribute, Failover: drFailover},
+		},
+		{
+			name: "dr enables mesh settings",
+			mesh: &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}, Failover: meshFailover},
+			dr:   &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+			expected: &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true},
+				Failover: meshFailover},
+		},
+		{
+			name: "dr disabled",
+			mesh: mesh,
+			dr:   &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			var dr networking.LocalityLoadBalancerSetting
+			if tt.dr != nil {
+				dr = *tt.dr
+			}
+			got := MergeLocalityLbSetting(tt.mesh, tt.dr)
+			if !reflect.DeepEqual(tt.expected, got) {
+				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
+			}
+			if tt.dr != nil && !reflect.DeepEqual(*tt.dr, dr) {
+				t.Errorf("Got the destination rule setting modified: %v", tt.dr)
+			}
+		})
+	}
+}
+
+func TestGetLocalityLbSettingWithMeshFailover(t *testing.T) {
+	distribute := []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region1/zone1/*",
+			To: map[string]uint32{
+				"region1/zone1/subzone1": 80,
+				"region1/zone1/subzone2": 20,
+			},
+		},
+	}
+	meshFailover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region2",
+		},
+	}
+	destruleFailover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region3",
+		},
+	}
+	mesh := &networking.LocalityLoadBalancerSetting{Failover: meshFailover}
+
+	cases := []struct {
+		name     string
+		mesh     *networking.LocalityLoadBalancerSetting
+		dr       *networking.LocalityLoadBalancerSetting
+		expected *networking.LocalityLoadBalancerSetting
+	}{
+		{
+			name:     "mesh only",
+			mesh:     mesh,
+			expected: mesh,
 		},
-		{"mesh only",
-			&networking.LocalityLoadBalancerSetting{},
-			nil,
-			&networking.LocalityLoadBalancerSetting{},
+		{
+			name:     "dr distribute only",
+			mesh:     mesh,
+			dr:       &networking.LocalityLoadBalancerSetting{Distribute: distribute},
+			expected: &networking.LocalityLoadBalancerSetting{Distribute: distribute, Failover: meshFailover},
 		},
-		{"dr only",
-			nil,
-			&networking.LocalityLoadBalancerSetting{},
-			nil,
+		{
+			name:     "dr failover kept",
+			mesh:     mesh,
+			dr:       &networking.LocalityLoadBalancerSetting{Distribute: distribute, Failover: destruleFailover},
+			expected: &networking.LocalityLoadBalancerSetting{Distribute: distribute, Failover: destruleFailover},
 		},
-		{"dr only override",
-			nil,
-			&networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
-			&networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+		{
+			name:     "mesh without failover",
+			mesh:     &networking.LocalityLoadBalancerSetting{},
+			dr:       &networking.LocalityLoadBalancerSetting{Distribute: distribute},
+			expected: &networking.LocalityLoadBalancerSetting{Distribute: distribute},
 		},
-		{"both",
-			&networking.LocalityLoadBalancerSetting{},
-			&networking.LocalityLoadBalancerSetting{Failover: failover},
-			&networking.LocalityLoadBalancerSetting{Failover: failover},
+		{
+			name:     "dr disabled",
+			mesh:     mesh,
+			dr:       &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}, Distribute: distribute},
+			expected: nil,
 		},
 	}
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
-			got := GetLocalityLbSetting(tt.mesh, tt.dr)
+			got := GetLocalityLbSettingWithMeshFailover(tt.mesh, tt.dr)
 			if !reflect.DeepEqual(tt.expected, got) {
 				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
 			}
+			if tt.dr != nil && got != nil && got != tt.dr && tt.dr.Failover != nil {
+				t.Errorf("Got the destination rule setting copied though it has a failover")
+			}
+		})
+	}
+
+	// the destination rule distribute weights the proxy region, the mesh failover orders the other regions.
+	t.Run("applied", func(t *testing.T) {
+		dr := &networking.LocalityLoadBalancerSetting{Distribute: distribute}
+		cla := buildCLA(
+			localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+			localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+			localitySpec{locality: "region2/zone1", endpoints: 1},
+			localitySpec{locality: "region3/zone1", endpoints: 1},
+		)
+		locality := &envoycore.Locality{Region: "region1", Zone: "zone1"}
+		result := ApplyLocalityLBSettingWithOptions(locality, cla, GetLocalityLbSettingWithMeshFailover(mesh, dr), true,
+			&Options{UnlistedLocalities: UnlistedLocalityKeep})
+		if result.Mode != ModeCombined {
+			t.Errorf("Got mode %s expected %s", result.Mode, ModeCombined)
+		}
+		if dr.Failover != nil {
+			t.Errorf("Got the destination rule modified: %v", dr)
+		}
+		weights := make([]uint32, 0)
+		priorities := make([]uint32, 0)
+		for _, localityEndpoint := range cla.Endpoints {
+			weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+			priorities = append(priorities, localityEndpoint.Priority)
+		}
+		if expected := []uint32{80, 20, 100, 100}; !reflect.DeepEqual(weights, expected) {
+			t.Errorf("Got weights %v expected %v", weights, expected)
+		}
+		// the failover region comes before region3 as the mesh failover says.
+		if expected := []uint32{0, 0, 1, 2}; !reflect.DeepEqual(priorities, expected) {
+			t.Errorf("Got priorities %v expected %v", priorities, expected)
+		}
+	})
+}
+
+func TestGetLocalityLbSettingForWorkload(t *testing.T) {
+	distribute := []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region1/*",
+			To:   map[string]uint32{"region1/*": 100},
+		},
+	}
+	failover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region2",
+		},
+	}
+	mesh := &networking.LocalityLoadBalancerSetting{}
+	destrule := &networking.LocalityLoadBalancerSetting{Failover: failover}
+	enabledDestrule := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}, Failover: failover}
+	subset := &networking.LocalityLoadBalancerSetting{Distribute: distribute}
+	workload := &networking.LocalityLoadBalancerSetting{Distribute: distribute[:0]}
+	disabled := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}}
+	enabled := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}}
+
+	cases := []struct {
+		name     string
+		mesh     *networking.LocalityLoadBalancerSetting
+		dr       *networking.LocalityLoadBalancerSetting
+		subset   *networking.LocalityLoadBalancerSetting
+		workload *networking.LocalityLoadBalancerSetting
+		expected *networking.LocalityLoadBalancerSetting
+	}{
+		{
+			name:     "mesh and destination rule",
+			mesh:     mesh,
+			dr:       destrule,
+			expected: destrule,
+		},
+		{
+			name:     "subset over destination rule",
+			mesh:     mesh,
+			dr:       destrule,
+			subset:   subset,
+			expected: subset,
+		},
+		{
+			name:     "workload over subset",
+			mesh:     mesh,
+			dr:       destrule,
+			subset:   subset,
+			workload: workload,
+			expected: workload,
+		},
+		{
+			name:     "workload over destination rule",
+			mesh:     mesh,
+			dr:       destrule,
+			workload: workload,
+			expected: workload,
+		},
+		{
+			name:     "workload disables enabled destination rule",
+			dr:       enabledDestrule,
+			workload: disabled,
+			expected: nil,
+		},
+		{
+			name:     "workload disables mesh",
+			mesh:     mesh,
+			subset:   subset,
+			workload: disabled,
+			expected: nil,
+		},
+		{
+			name:     "workload enables disabled subset",
+			mesh:     mesh,
+			subset:   disabled,
+			workload: enabled,
+			expected: enabled,
+		},
+		{
+			name:     "subset disables, workload does not override",
+			mesh:     mesh,
+			dr:       enabledDestrule,
+			subset:   disabled,
+			workload: workload,
+			expected: nil,
+		},
+		{
+			name:     "workload only",
+			workload: workload,
+			expected: nil,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GetLocalityLbSettingForWorkload(tt.mesh, tt.dr, tt.subset, tt.workload)
+			if got != tt.expected {
+				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestGetLocalityLbSettingForPort(t *testing.T) {
+	mesh := &networking.LocalityLoadBalancerSetting{}
+	destrule := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "region1", To: "region2"}},
+	}
+	http := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{From: "region1/*", To: map[string]uint32{"region1/*": 80, "region2/*": 20}},
+		},
+	}
+	grpc := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "region1", To: "region3"}},
+	}
+	admin := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}}
+	ports := &PortLocalityLbSettings{
+		ByPort: map[uint32]*networking.LocalityLoadBalancerSetting{
+			9090: admin,
+		},
+		ByProtocol: map[string]*networking.LocalityLoadBalancerSetting{
+			"HTTP": http,
+			"GRPC": grpc,
+		},
+	}
+
+	cases := []struct {
+		name     string
+		ports    *PortLocalityLbSettings
+		port     uint32
+		protocol string
+		expected *networking.LocalityLoadBalancerSetting
+	}{
+		{
+			name:     "http port",
+			ports:    ports,
+			port:     8080,
+			protocol: "HTTP",
+			expected: http,
+		},
+		{
+			name:     "grpc port",
+			ports:    ports,
+			port:     8081,
+			protocol: "GRPC",
+			expected: grpc,
+		},
+		{
+			// the port number takes precedence over the protocol.
+			name:     "disabled port",
+			ports:    ports,
+			port:     9090,
+			protocol: "HTTP",
+			expected: nil,
+		},
+		{
+			name:     "unlisted port",
+			ports:    ports,
+			port:     3306,
+			protocol: "TCP",
+			expected: destrule,
+		},
+		{
+			name:     "no port settings",
+			port:     8080,
+			protocol: "HTTP",
+			expected: destrule,
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := GetLocalityLbSettingForPort(mesh, destrule, tt.ports, tt.port, tt.protocol)
+			if got != tt.expected {
+				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLB(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	mesh := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	distribute := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/zone1/*": 20,
+				},
+			},
+		},
+	}
+	disabled := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}}
+	enabled := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}}
+
+	cases := []struct {
+		name           string
+		mesh           *networking.LocalityLoadBalancerSetting
+		dr             *networking.LocalityLoadBalancerSetting
+		enableFailover bool
+		expected       *networking.LocalityLoadBalancerSetting
+		// expected priorities and weights of the groups of endpoints in region1, region2 and region3.
+		priorities []uint32
+		weights    []uint32
+	}{
+		{
+			name:       "all disabled",
+			priorities: []uint32{0, 0, 0},
+		},
+		{
+			name:           "mesh failover",
+			mesh:           mesh,
+			enableFailover: true,
+			expected:       mesh,
+			priorities:     []uint32{0, 1, 2},
+		},
+		{
+			name:       "mesh failover without outlier detection",
+			mesh:       mesh,
+			expected:   mesh,
+			priorities: []uint32{0, 0, 0},
+		},
+		{
+			name:           "dr disables mesh",
+			mesh:           mesh,
+			dr:             disabled,
+			enableFailover: true,
+			priorities:     []uint32{0, 0, 0},
+		},
+		{
+			name:           "dr only is disabled",
+			dr:             distribute,
+			enableFailover: true,
+			priorities:     []uint32{0, 0, 0},
+		},
+		{
+			name:           "dr only enabled",
+			dr:             enabled,
+			enableFailover: true,
+			expected:       enabled,
+			priorities:     []uint32{0, 1, 1},
+		},
+		{
+			name:           "dr overrides mesh",
+			mesh:           mesh,
+			dr:             distribute,
+			enableFailover: true,
+			expected:       distribute,
+			priorities:     []uint32{0, 0, 0},
+			weights:        []uint32{80, 20, 0},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			got := ApplyLocalityLB(locality, cla, tt.mesh, tt.dr, tt.enableFailover)
+			if got != tt.expected {
+				t.Fatalf("Expected setting: %v, got: %v", tt.expected, got)
+			}
+			priorities := make([]uint32, 0, len(cla.Endpoints))
+			weights := make([]uint32, 0, len(cla.Endpoints))
+			for _, ep := range cla.Endpoints {
+				priorities = append(priorities, ep.Priority)
+				weights = append(weights, ep.GetLoadBalancingWeight().GetValue())
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Expected priorities %v, got %v", tt.priorities, priorities)
+			}
+			if tt.weights != nil && !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Expected weights %v, got %v", tt.weights, weights)
+			}
+		})
+	}
+}
+
+func TestGetLocalityLbSettingWithProvenance(t *testing.T) {
+	mesh := &networking.LocalityLoadBalancerSetting{}
+	destrule := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	cases := []struct {
+		name       string
+		mesh       *networking.LocalityLoadBalancerSetting
+		dr         *networking.LocalityLoadBalancerSetting
+		expected   *networking.LocalityLoadBalancerSetting
+		provenance string
+	}{
+		{
+			name:       "disabled",
+			provenance: "none",
+		},
+		{
+			name:       "mesh",
+			mesh:       mesh,
+			expected:   mesh,
+			provenance: "mesh config",
+		},
+		{
+			name:       "destrule override",
+			mesh:       mesh,
+			dr:         destrule,
+			expected:   destrule,
+			provenance: "destination rule default/reviews",
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got, provenance := GetLocalityLbSettingWithProvenance(tt.mesh, tt.dr, "default/reviews")
+			if got != tt.expected {
+				t.Fatalf("Expected: %v, got: %v", tt.expected, got)
+			}
+			if provenance.String() != tt.provenance {
+				t.Fatalf("Expected provenance %q, got %q", tt.provenance, provenance)
+			}
+			if got == nil {
+				return
+			}
+			result := ApplyLocalityLBSettingWithOptions(&envoycore.Locality{Region: "region1"}, buildCLA(), got, true,
+				&Options{Provenance: provenance})
+			if result.Provenance != provenance {
+				t.Fatalf("Expected result provenance %v, got %v", provenance, result.Provenance)
+			}
+		})
+	}
+}
+
+func TestResolveAll(t *testing.T) {
+	mesh := &networking.LocalityLoadBalancerSetting{}
+	disabled := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}}
+	enabled := &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}}
+	override := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	destrules := map[string]*networking.LocalityLoadBalancerSetting{
+		"default/none":     nil,
+		"default/disabled": disabled,
+		"default/enabled":  enabled,
+		"default/override": override,
+	}
+	cases := []struct {
+		name     string
+		mesh     *networking.LocalityLoadBalancerSetting
+		expected map[string]*networking.LocalityLoadBalancerSetting
+	}{
+		{
+			name: "mesh enabled",
+			mesh: mesh,
+			expected: map[string]*networking.LocalityLoadBalancerSetting{
+				"default/none":     mesh,
+				"default/disabled": nil,
+				"default/enabled":  enabled,
+				"default/override": override,
+			},
+		},
+		{
+			name: "mesh disabled",
+			expected: map[string]*networking.LocalityLoadBalancerSetting{
+				"default/none":     nil,
+				"default/disabled": nil,
+				"default/enabled":  enabled,
+				"default/override": nil,
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ResolveAll(tt.mesh, destrules)
+			if len(got) != len(tt.expected) {
+				t.Fatalf("Got %d settings expected %d", len(got), len(tt.expected))
+			}
+			for name, expected := range tt.expected {
+				if actual, ok := got[name]; !ok || actual != expected {
+					t.Errorf("%s: got setting %v expected %v", name, actual, expected)
+				}
+			}
 		})
 	}
 }
@@ -325,115 +5621,88 @@ func buildEnvForClustersWithFailover() *model.Environment {
 func buildFakeCluster() *apiv2.Cluster {
 	return &apiv2.Cluster{
 		Name: "outbound|8080||test.example.org",
-		LoadAssignment: &apiv2.ClusterLoadAssignment{
-			ClusterName: "outbound|8080||test.example.org",
-			Endpoints: []*endpoint.LocalityLbEndpoints{
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region1",
-						Zone:    "zone1",
-						SubZone: "subzone1",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region1",
-						Zone:    "zone1",
-						SubZone: "subzone1",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region1",
-						Zone:    "zone1",
-						SubZone: "subzone2",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region1",
-						Zone:    "zone1",
-						SubZone: "subzone3",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region1",
-						Zone:    "zone2",
-						SubZone: "",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region2",
-						Zone:    "",
-						SubZone: "",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region3",
-						Zone:    "",
-						SubZone: "",
-					},
-				},
-			},
-		},
+		LoadAssignment: buildCLA(
+			localitySpec{locality: "region1/zone1/subzone1"},
+			localitySpec{locality: "region1/zone1/subzone1"},
+			localitySpec{locality: "region1/zone1/subzone2"},
+			localitySpec{locality: "region1/zone1/subzone3"},
+			localitySpec{locality: "region1/zone2"},
+			localitySpec{locality: "region2"},
+			localitySpec{locality: "region3"},
+		),
 	}
-
 }
 
 func buildSmallCluster() *apiv2.Cluster {
 	return &apiv2.Cluster{
 		Name: "outbound|8080||test.example.org",
-		LoadAssignment: &apiv2.ClusterLoadAssignment{
-			ClusterName: "outbound|8080||test.example.org",
-			Endpoints: []*endpoint.LocalityLbEndpoints{
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region1",
-						Zone:    "zone1",
-						SubZone: "subzone2",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region2",
-						Zone:    "zone1",
-						SubZone: "subzone2",
-					},
-				},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region2",
-						Zone:    "zone1",
-						SubZone: "subzone2",
-					},
-				},
-			},
-		},
+		LoadAssignment: buildCLA(
+			localitySpec{locality: "region1/zone1/subzone2"},
+			localitySpec{locality: "region2/zone1/subzone2"},
+			localitySpec{locality: "region2/zone1/subzone2"},
+		),
 	}
 }
 
 func buildSmallClusterWithNilLocalities() *apiv2.Cluster {
 	return &apiv2.Cluster{
 		Name: "outbound|8080||test.example.org",
-		LoadAssignment: &apiv2.ClusterLoadAssignment{
-			ClusterName: "outbound|8080||test.example.org",
-			Endpoints: []*endpoint.LocalityLbEndpoints{
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region1",
-						Zone:    "zone1",
-						SubZone: "subzone2",
-					},
-				},
-				{},
-				{
-					Locality: &envoycore.Locality{
-						Region:  "region2",
-						Zone:    "zone1",
-						SubZone: "subzone2",
+		LoadAssignment: buildCLA(
+			localitySpec{locality: "region1/zone1/subzone2"},
+			localitySpec{},
+			localitySpec{locality: "region2/zone1/subzone2"},
+		),
+	}
+}
+
+// localitySpec describes one LocalityLbEndpoints of a test ClusterLoadAssignment.
+type localitySpec struct {
+	// locality in region/zone/subzone form, empty means the group has no locality.
+	locality string
+	// weight of the group, 0 means unset.
+	weight uint32
+	// priority of the group.
+	priority uint32
+	// endpoints is the number of LbEndpoints in the group.
+	endpoints int
+}
+
+// buildCLA builds a ClusterLoadAssignment with one LocalityLbEndpoints per spec.
+// Endpoint addresses are derived from the group and endpoint indexes, e.g. 10.0.1.2 is the
+// third endpoint of the second group.
+func buildCLA(localities ...localitySpec) *apiv2.ClusterLoadAssignment {
+	cla := &apiv2.ClusterLoadAssignment{
+		ClusterName: "outbound|8080||test.example.org",
+		Endpoints:   make([]*endpoint.LocalityLbEndpoints, 0, len(localities)),
+	}
+	for i, spec := range localities {
+		group := &endpoint.LocalityLbEndpoints{
+			Priority: spec.priority,
+		}
+		if spec.locality != "" {
+			group.Locality = util.ConvertLocality(spec.locality)
+		}
+		if spec.weight > 0 {
+			group.LoadBalancingWeight = &wrappers.UInt32Value{Value: spec.weight}
+		}
+		for j := 0; j < spec.endpoints; j++ {
+			group.LbEndpoints = append(group.LbEndpoints, buildLbEndpoint(fmt.Sprintf("10.0.%d.%d", i, j)))
+		}
+		cla.Endpoints = append(cla.Endpoints, group)
+	}
+	return cla
+}
+
+func buildLbEndpoint(address string) *endpoint.LbEndpoint {
+	return &endpoint.LbEndpoint{
+		HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+			Endpoint: &endpoint.Endpoint{
+				Address: &envoycore.Address{
+					Address: &envoycore.Address_SocketAddress{
+						SocketAddress: &envoycore.SocketAddress{
+							Address:       address,
+							PortSpecifier: &envoycore.SocketAddress_PortValue{PortValue: 8080},
+						},
 					},
 				},
 			},
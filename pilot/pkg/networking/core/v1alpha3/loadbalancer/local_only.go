@@ -0,0 +1,92 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// LocalOnlyScope selects how far from the proxy locality failover may send the traffic, see
+// Options.LocalOnly.
+type LocalOnlyScope int
+
+const (
+	// LocalOnlyOff lets failover send the traffic to every locality, in priority order.
+	LocalOnlyOff LocalOnlyScope = iota
+	// LocalOnlyRegion keeps the traffic within the proxy region.
+	LocalOnlyRegion
+	// LocalOnlyZone keeps the traffic within the proxy zone.
+	LocalOnlyZone
+	// LocalOnlySubzone keeps the traffic within the proxy subzone.
+	LocalOnlySubzone
+)
+
+func (s LocalOnlyScope) String() string {
+	switch s {
+	case LocalOnlyRegion:
+		return "region"
+	case LocalOnlyZone:
+		return "zone"
+	case LocalOnlySubzone:
+		return "subzone"
+	default:
+		return "off"
+	}
+}
+
+// tier returns the least preferred failover tier within the scope.
+func (s LocalOnlyScope) tier() int {
+	switch s {
+	case LocalOnlyZone:
+		return PriorityZoneMatch
+	case LocalOnlySubzone:
+		return PrioritySubzoneMatch
+	default:
+		return PriorityRegionMatch
+	}
+}
+
+// applyLocalOnly gives priority 0 to the groups of endpoints within the scope of the proxy locality and
+// drops the endpoints of the others, so that Envoy has nowhere to fail over to and the requests fail once
+// the local endpoints are gone. It returns a warning if no endpoint is local.
+func applyLocalOnly(locality *core.Locality, loadAssignment *apiv2.ClusterLoadAssignment, opts *Options) []string {
+	local := 0
+	for _, ep := range loadAssignment.Endpoints {
+		ep.Priority = 0
+		if ep.Locality != nil && util.LbPriority(locality, ep.Locality) <= opts.LocalOnly.tier() {
+			local += len(ep.LbEndpoints)
+			if opts.annotating() {
+				opts.recordPriorityRationale(ep, fmt.Sprintf("local only, same %v", opts.LocalOnly))
+			}
+			continue
+		}
+		if len(ep.LbEndpoints) > 0 && opts.annotating() {
+			opts.recordPriorityRationale(ep, fmt.Sprintf("local only, dropped out of the %v", opts.LocalOnly))
+		}
+		opts.dropEndpoints(ep)
+	}
+	if local > 0 {
+		return nil
+	}
+	warning := fmt.Sprintf("locality failover of %s is local only, but no endpoint is in the %v of %s",
+		loadAssignment.ClusterName, opts.LocalOnly, util.LocalityToString(locality))
+	lbLog.Debug(warning)
+	return []string{warning}
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestApplyLocalityFailoverLocalOnly(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{From: "region1", To: "region2"},
+		},
+	}
+
+	tests := []struct {
+		name       string
+		scope      LocalOnlyScope
+		localities []string
+		endpoints  []int
+		priorities []uint32
+		warnings   int
+	}{
+		{
+			name:       "off",
+			localities: []string{"region1/zone1/subzone1", "region1/zone1/subzone2", "region1/zone2", "region2/zone1"},
+			endpoints:  []int{1, 1, 1, 1},
+			priorities: []uint32{0, 1, 2, 3},
+		},
+		{
+			name:       "region",
+			scope:      LocalOnlyRegion,
+			localities: []string{"region1/zone1/subzone1", "region1/zone1/subzone2", "region1/zone2", "region2/zone1"},
+			endpoints:  []int{1, 1, 1, 0},
+			priorities: []uint32{0, 0, 0, 0},
+		},
+		{
+			name:       "zone",
+			scope:      LocalOnlyZone,
+			localities: []string{"region1/zone1/subzone1", "region1/zone1/subzone2", "region1/zone2", "region2/zone1"},
+			endpoints:  []int{1, 1, 0, 0},
+			priorities: []uint32{0, 0, 0, 0},
+		},
+		{
+			name:       "subzone",
+			scope:      LocalOnlySubzone,
+			localities: []string{"region1/zone1/subzone1", "region1/zone1/subzone2", "region1/zone2", "region2/zone1"},
+			endpoints:  []int{1, 0, 0, 0},
+			priorities: []uint32{0, 0, 0, 0},
+		},
+		{
+			// the endpoints are dropped all the same, the requests fail.
+			name:       "no local endpoint",
+			scope:      LocalOnlyZone,
+			localities: []string{"region1/zone2", "region2/zone1"},
+			endpoints:  []int{0, 0},
+			priorities: []uint32{0, 0},
+			warnings:   1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var specs []localitySpec
+			for i, l := range tt.localities {
+				specs = append(specs, localitySpec{locality: l, priority: uint32(i), endpoints: 1})
+			}
+			cla := buildCLA(specs...)
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{LocalOnly: tt.scope})
+			endpoints := make([]int, 0)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				endpoints = append(endpoints, len(localityEndpoint.LbEndpoints))
+				priorities = append(priorities, localityEndpoint.Priority)
+				if len(localityEndpoint.LbEndpoints) == 0 && localityEndpoint.LbEndpoints != nil {
+					t.Errorf("Got empty LbEndpoints for %v expected nil", localityEndpoint.Locality)
+				}
+			}
+			if !reflect.DeepEqual(endpoints, tt.endpoints) {
+				t.Errorf("Got endpoints %v expected %v", endpoints, tt.endpoints)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+			if len(result.Warnings) != tt.warnings {
+				t.Errorf("Got warnings %v expected %d", result.Warnings, tt.warnings)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"strconv"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/pkg/monitoring"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+var (
+	clusterTag  = monitoring.MustCreateLabel("cluster")
+	localityTag = monitoring.MustCreateLabel("locality")
+	priorityTag = monitoring.MustCreateLabel("priority")
+	// the weights and priorities of the localities are relative to the locality of the proxies.
+	proxyLocalityTag = monitoring.MustCreateLabel("proxy_locality")
+
+	localityWeight = monitoring.NewGauge(
+		"pilot_locality_lb_weight",
+		"Weight of each locality of a cluster for the proxies of a locality, as of the last locality lb transform recording it.",
+		monitoring.WithLabels(clusterTag, proxyLocalityTag, localityTag),
+	)
+
+	priorityEndpoints = monitoring.NewGauge(
+		"pilot_locality_lb_priority_endpoints",
+		"Number of endpoints locality failover assigned to each priority of a cluster for the proxies of a locality, "+
+			"as of the last locality lb transform recording it.",
+		monitoring.WithLabels(clusterTag, proxyLocalityTag, priorityTag),
+	)
+	droppedLocalities = monitoring.NewGauge(
+		"pilot_locality_lb_dropped_localities",
+		"Number of groups of endpoints of a cluster the distribute settings dropped for the proxies of a locality, "+
+			"as of the last locality lb transform recording it.",
+		monitoring.WithLabels(clusterTag, proxyLocalityTag),
+	)
+
+	transformCacheHits = monitoring.NewSum(
+		"pilot_locality_lb_cache_hits_total",
+		"Total number of locality lb transforms served from the cache.",
+	)
+	transformCacheMisses = monitoring.NewSum(
+		"pilot_locality_lb_cache_misses_total",
+		"Total number of locality lb transforms computed on a cache miss.",
+	)
+)
+
+func init() {
+	monitoring.MustRegister(transformCacheHits, transformCacheMisses, localityWeight, priorityEndpoints, droppedLocalities)
+}
+
+// recordPriorityEndpoints records the number of endpoints of every priority of a load assignment transformed
+// for a proxy in the given locality, a single update per priority.
+func recordPriorityEndpoints(proxyLocality *core.Locality, loadAssignment *apiv2.ClusterLoadAssignment) {
+	endpoints := map[uint32]int{}
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 {
+			endpoints[ep.Priority] += len(ep.LbEndpoints)
+		}
+	}
+	for priority, count := range endpoints {
+		priorityEndpoints.With(clusterTag.Value(loadAssignment.ClusterName),
+			proxyLocalityTag.Value(util.LocalityToString(proxyLocality)),
+			priorityTag.Value(strconv.Itoa(int(priority)))).Record(float64(count))
+	}
+}
+
+// recordDroppedLocalities records the number of groups of endpoints the distribute settings dropped from a
+// load assignment transformed for a proxy in the given locality.
+func recordDroppedLocalities(proxyLocality *core.Locality, loadAssignment *apiv2.ClusterLoadAssignment, dropped int) {
+	droppedLocalities.With(clusterTag.Value(loadAssignment.ClusterName),
+		proxyLocalityTag.Value(util.LocalityToString(proxyLocality))).Record(float64(dropped))
+}
+
+// recordLocalityWeights records the weight of every weighted locality with endpoints of a load assignment
+// transformed for a proxy in the given locality. The weights of the groups of endpoints sharing a locality
+// add up.
+func recordLocalityWeights(proxyLocality *core.Locality, loadAssignment *apiv2.ClusterLoadAssignment) {
+	weights := map[string]uint32{}
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 && ep.LoadBalancingWeight != nil {
+			weights[util.LocalityToString(ep.Locality)] += ep.LoadBalancingWeight.Value
+		}
+	}
+	for locality, weight := range weights {
+		localityWeight.With(clusterTag.Value(loadAssignment.ClusterName),
+			proxyLocalityTag.Value(util.LocalityToString(proxyLocality)), localityTag.Value(locality)).Record(float64(weight))
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"go.opencensus.io/stats/view"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// labeledValues returns the values of a gauge for a cluster and a proxy locality, by the value of the given label.
+func labeledValues(t *testing.T, name, cluster, proxyLocality, label string) map[string]float64 {
+	t.Helper()
+	rows, err := view.RetrieveData(name)
+	if err != nil {
+		t.Fatalf("failed to get the values of %s: %v", name, err)
+	}
+	values := map[string]float64{}
+	for _, row := range rows {
+		var rowCluster, rowProxyLocality, rowLabel string
+		for _, tag := range row.Tags {
+			switch tag.Key.Name() {
+			case "cluster":
+				rowCluster = tag.Value
+			case "proxy_locality":
+				rowProxyLocality = tag.Value
+			case label:
+				rowLabel = tag.Value
+			}
+		}
+		if rowCluster == cluster && rowProxyLocality == proxyLocality {
+			values[rowLabel] = row.Data.(*view.LastValueData).Value
+		}
+	}
+	return values
+}
+
+func TestApplyLocalityLBSettingRecordWeights(t *testing.T) {
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To: map[string]uint32{
+					"region1/*": 80,
+					"region2/*": 20,
+				},
+			},
+			{
+				From: "region2/zone1",
+				To: map[string]uint32{
+					"region1/*": 30,
+					"region2/*": 70,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		opts     *Options
+		expected map[string]map[string]float64
+	}{
+		{
+			name: "not recorded",
+			opts: &Options{},
+			expected: map[string]map[string]float64{
+				"region1/zone1": {},
+				"region2/zone1": {},
+			},
+		},
+		{
+			name: "recorded",
+			opts: &Options{RecordMetrics: true},
+			expected: map[string]map[string]float64{
+				"region1/zone1": {
+					"region1/zone1": 80,
+					"region2/zone1": 20,
+				},
+				"region2/zone1": {
+					"region1/zone1": 30,
+					"region2/zone1": 70,
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a cluster per test, the gauge is shared.
+			cluster := "outbound|8080||" + tt.name + ".example.org"
+			// the weights for the proxies of a locality do not overwrite the ones for another locality.
+			for _, proxyLocality := range []string{"region1/zone1", "region2/zone1"} {
+				cla := buildCLA(
+					localitySpec{locality: "region1/zone1", endpoints: 1},
+					localitySpec{locality: "region2/zone1", endpoints: 1},
+				)
+				cla.ClusterName = cluster
+				ApplyLocalityLBSettingWithOptions(util.ConvertLocality(proxyLocality), cla, setting, true, tt.opts)
+			}
+			for proxyLocality, expected := range tt.expected {
+				if got := labeledValues(t, localityWeight.Name(), cluster, proxyLocality, "locality"); !reflect.DeepEqual(got, expected) {
+					t.Errorf("Got weights %v expected %v for the proxies in %s", got, expected, proxyLocality)
+				}
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingRecordTiers(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/*": 100},
+			},
+		},
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{From: "region1", To: "region2"},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 2},
+		localitySpec{locality: "region1/zone2", endpoints: 3},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	)
+
+	tests := []struct {
+		name       string
+		opts       *Options
+		priorities map[string]float64
+		dropped    map[string]float64
+	}{
+		{
+			name:       "not recorded",
+			opts:       &Options{},
+			priorities: map[string]float64{},
+			dropped:    map[string]float64{},
+		},
+		{
+			name:       "recorded",
+			opts:       &Options{RecordMetrics: true},
+			priorities: map[string]float64{"0": 2, "1": 3},
+			dropped:    map[string]float64{"": 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformed := util.CloneClusterLoadAssignment(cla)
+			// a cluster per test, the gauges are shared.
+			transformed.ClusterName = "outbound|8080||" + tt.name + ".example.org"
+			// twice, the gauges are not added up.
+			for i := 0; i < 2; i++ {
+				transformed := util.CloneClusterLoadAssignment(&transformed)
+				ApplyLocalityLBSettingWithOptions(locality, &transformed, setting, true, tt.opts)
+			}
+			got := labeledValues(t, priorityEndpoints.Name(), transformed.ClusterName, "region1/zone1", "priority")
+			if !reflect.DeepEqual(got, tt.priorities) {
+				t.Errorf("Got endpoints by priority %v expected %v", got, tt.priorities)
+			}
+			got = labeledValues(t, droppedLocalities.Name(), transformed.ClusterName, "region1/zone1", "")
+			if !reflect.DeepEqual(got, tt.dropped) {
+				t.Errorf("Got dropped localities %v expected %v", got, tt.dropped)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// The well-known topology labels, as set on the kubernetes nodes and copied to the workloads
+// by the kubernetes service registry.
+const (
+	nodeRegionLabel   = "failure-domain.beta.kubernetes.io/region"
+	nodeZoneLabel     = "failure-domain.beta.kubernetes.io/zone"
+	nodeRegionLabelGA = "topology.kubernetes.io/region"
+	nodeZoneLabelGA   = "topology.kubernetes.io/zone"
+	subzoneLabel      = "topology.istio.io/subzone"
+)
+
+// LocalityFromNodeMetadata recovers the locality of a proxy from its node metadata, for proxies whose
+// locality is not reported. The istio-locality label takes precedence over the topology labels.
+// It returns nil if the metadata carries no locality.
+func LocalityFromNodeMetadata(meta *model.NodeMetadata) *core.Locality {
+	if meta == nil {
+		return nil
+	}
+	if locality := model.GetLocalityOrDefault(meta.LocalityLabel,
+		model.GetLocalityOrDefault(meta.Labels[model.LocalityLabel], "")); locality != "" {
+		return util.ConvertLocality(locality)
+	}
+
+	locality := &core.Locality{
+		Region:  firstLabel(meta.Labels, nodeRegionLabelGA, nodeRegionLabel),
+		Zone:    firstLabel(meta.Labels, nodeZoneLabelGA, nodeZoneLabel),
+		SubZone: meta.Labels[subzoneLabel],
+	}
+	if util.IsLocalityEmpty(locality) {
+		return nil
+	}
+	return locality
+}
+
+// firstLabel returns the value of the first of the keys set in the labels.
+func firstLabel(labels map[string]string, keys ...string) string {
+	for _, key := range keys {
+		if value := labels[key]; value != "" {
+			return value
+		}
+	}
+	return ""
+}
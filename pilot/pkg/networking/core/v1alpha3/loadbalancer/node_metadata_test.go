@@ -0,0 +1,100 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/model"
+)
+
+func TestLocalityFromNodeMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		meta     *model.NodeMetadata
+		expected *envoycore.Locality
+	}{
+		{
+			name: "nil metadata",
+		},
+		{
+			name: "no locality",
+			meta: &model.NodeMetadata{Labels: map[string]string{"app": "reviews"}},
+		},
+		{
+			name: "locality metadata",
+			meta: &model.NodeMetadata{LocalityLabel: "region1/zone1/subzone1"},
+			expected: &envoycore.Locality{
+				Region:  "region1",
+				Zone:    "zone1",
+				SubZone: "subzone1",
+			},
+		},
+		{
+			name: "locality label",
+			meta: &model.NodeMetadata{Labels: map[string]string{"istio-locality": "region1.zone1"}},
+			expected: &envoycore.Locality{
+				Region: "region1",
+				Zone:   "zone1",
+			},
+		},
+		{
+			name: "topology labels",
+			meta: &model.NodeMetadata{Labels: map[string]string{
+				"topology.kubernetes.io/region": "region1",
+				"topology.kubernetes.io/zone":   "zone1",
+				"topology.istio.io/subzone":     "subzone1",
+			}},
+			expected: &envoycore.Locality{
+				Region:  "region1",
+				Zone:    "zone1",
+				SubZone: "subzone1",
+			},
+		},
+		{
+			name: "beta topology labels",
+			meta: &model.NodeMetadata{Labels: map[string]string{
+				"failure-domain.beta.kubernetes.io/region": "region1",
+				"failure-domain.beta.kubernetes.io/zone":   "zone1",
+			}},
+			expected: &envoycore.Locality{
+				Region: "region1",
+				Zone:   "zone1",
+			},
+		},
+		{
+			name: "locality label overrides topology labels",
+			meta: &model.NodeMetadata{Labels: map[string]string{
+				"istio-locality":                "region2.zone2",
+				"topology.kubernetes.io/region": "region1",
+				"topology.kubernetes.io/zone":   "zone1",
+			}},
+			expected: &envoycore.Locality{
+				Region: "region2",
+				Zone:   "zone2",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LocalityFromNodeMetadata(tt.meta); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("Got locality %v expected %v", got, tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,609 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"context"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// Options holds optional knobs that tune how a LocalityLoadBalancerSetting is applied.
+// The zero value preserves the default behavior of ApplyLocalityLBSetting.
+type Options struct {
+	// CapacityHints maps a locality string (region/zone/subzone) to a static capacity multiplier.
+	// When a distribute To entry matches several groups of endpoints, the share of that entry is
+	// split in proportion to each group's weight multiplied by its capacity hint.
+	// Localities without a hint, or with a hint of 0, use a multiplier of 1.
+	CapacityHints map[string]uint32
+
+	// EnsureFailoverPriority makes sure failover produces at least two priorities. When all endpoints
+	// would otherwise end up in a single priority, the endpoints of the least preferred regions
+	// are moved to priority 1 so that Envoy has a tier to fail over to. The proxy region is preferred, then
+	// the regions it fails over to, then the other failover targets in the order of the failover settings.
+	EnsureFailoverPriority bool
+
+	// WeightMetadataKey is consulted for the weight of a group of endpoints whose LoadBalancingWeight
+	// is unset. The weight of the group is the sum of the weights found in the metadata of its endpoints.
+	WeightMetadataKey *MetadataKey
+
+	// NoFailoverZonePreference gives all the endpoints of a failover target region the same priority. By
+	// default they are ordered by their topological distance to the proxy zone and subzone, producing a
+	// priority per distance within the failover tier, as the localities of the proxy region are.
+	NoFailoverZonePreference bool
+
+	// PriorWeights maps a locality string to the weight computed for it by a previous push.
+	PriorWeights map[string]uint32
+
+	// HysteresisThreshold suppresses weight changes of at most this amount. When the weight computed
+	// for a locality differs from its prior weight by no more than the threshold, the prior weight is kept,
+	// so that distribute only acts as the initial placement of traffic. The weights of the other localities
+	// are adjusted for the weights to keep their sum.
+	HysteresisThreshold uint32
+
+	// FailoverRules lists failover settings finer than the ones of the LocalityLoadBalancerSetting, see
+	// FailoverMode. The first FailoverZones rule whose From matches the proxy locality orders the zones of
+	// the proxy region, and the first FailoverRegions or FailoverWeighted rule whose From is the proxy region
+	// orders the other regions, taking precedence over the failover settings of the setting.
+	FailoverRules []*FailoverRule
+
+	// UnlistedLocalities selects what happens to the groups of endpoints whose locality is not listed in
+	// the To of the applied distribute setting. They are dropped by default.
+	UnlistedLocalities UnlistedLocalityMode
+
+	// UnlistedLocalityWeight is the weight of the groups of endpoints kept with UnlistedLocalityKeep.
+	// Defaults to 1.
+	UnlistedLocalityWeight uint32
+
+	// LocalOnly isolates the traffic within the proxy region, zone or subzone: failover gives priority 0 to
+	// the groups of endpoints within that scope and drops the endpoints of all the others, e.g. for data
+	// residency, so that the requests fail rather than leave the scope once the local endpoints are gone.
+	// It takes precedence over the other failover settings, except ExplicitPriorities.
+	LocalOnly LocalOnlyScope
+
+	// FailoverTricklePercent, between 1 and 99, keeps the failover localities warm: failover sends that
+	// percentage of the traffic of every priority to the groups of endpoints of the next priority, copied
+	// into it, so that their connection pools and caches are ready when Envoy fails over to them. Only
+	// adjacent priorities trickle, and combined with distribute rules the distributed weights of a priority
+	// are scaled down to make room for the trickle. 0, the default, disables it.
+	FailoverTricklePercent uint32
+
+	// CheckFailoverRegions makes failover warn about every failover From or To region none of the endpoints
+	// is in, as CheckFailoverRegions does, rather than only about the failover region of the proxy.
+	CheckFailoverRegions bool
+
+	// PriorityMask is the set of priorities the transform may modify. When set, the groups of endpoints
+	// in other priorities are left untouched, and the failover priorities computed for the modifiable
+	// groups start after the highest untouched priority.
+	PriorityMask map[uint32]bool
+
+	// PreservePriorities keeps the priorities the groups of endpoints arrive with, e.g. assigned by the
+	// builder of the load assignment from the network topology, as the primary order: failover orders the
+	// groups of endpoints of each incoming priority by locality, after the groups of the preferred incoming
+	// priorities, rather than from priority 0 regardless of the incoming priorities.
+	PreservePriorities bool
+
+	// DemotedLocalities lists localities, possibly with wildcards as in distribute settings, that are
+	// known to be unhealthy from external signals. Failover moves their endpoints to the lowest priority,
+	// regardless of the health of the endpoints.
+	DemotedLocalities []string
+
+	// PrimaryAllowlist lists localities, possibly with wildcards as in distribute settings, that may serve
+	// as primary. When set, failover moves the groups of endpoints of the other localities to priority 1
+	// or lower whatever their topological match, and the allowed localities of the best priority take
+	// priority 0.
+	PrimaryAllowlist []string
+
+	// MergeDuplicateLocalities merges the groups of endpoints that share a locality before transforming
+	// the load assignment, so that distribute does not count the locality several times.
+	// When unset, duplicate localities are only reported with a warning.
+	MergeDuplicateLocalities bool
+
+	// Provenance tells where the applied setting comes from, see GetLocalityLbSettingWithProvenance.
+	// It is only reported in the Result.
+	Provenance Provenance
+
+	// ConsistentHash tells the cluster uses a consistent hashing load balancer, ring hash or maglev.
+	// The distribute weights are then scaled to a larger base, so that rounding them to integers
+	// does not unbalance the hash ring.
+	ConsistentHash bool
+
+	// OverprovisioningFactor, when set, is written to the policy of the load assignment. It tunes how much
+	// of a priority or locality may become unhealthy before Envoy spills traffic over. The other fields of
+	// the policy are preserved.
+	OverprovisioningFactor uint32
+
+	// PerPriorityFactors maps the priorities of the transformed load assignment to an overprovisioning factor,
+	// e.g. a high one for the primary priority to be sticky and lower ones for the fallback priorities to spill
+	// over more eagerly. Envoy applies a single overprovisioning factor to all the priorities of a load
+	// assignment, and weighted priority health is not part of the v2 API, so the closest approximation is
+	// emitted: the factor of the most preferred priority with endpoints is written to the policy, since it
+	// governs how much traffic the primary priority keeps, and the other factors are reported as warnings.
+	// It takes precedence over OverprovisioningFactor.
+	PerPriorityFactors map[uint32]uint32
+
+	// NormalizeDistribute divides the percentages of a distribute rule by their actual sum rather than
+	// assuming they sum up to 100, so that a rule whose To sums up to e.g. 120 splits the traffic proportionally.
+	// This makes the To values ratios, e.g. {a: 2, b: 1} sends twice as much traffic to a as to b.
+	NormalizeDistribute bool
+
+	// ExactLocalityMatch makes a distribute To locality match the groups of endpoints whose region, zone and
+	// subzone are all equal to the ones it names, rather than the ones it names a prefix of, e.g. region1/zone1
+	// then matches the groups of endpoints of region1/zone1 but not the ones of region1/zone1/subzone1, and
+	// "*" is taken literally. The From localities are matched as usual.
+	ExactLocalityMatch bool
+
+	// ApplyDistributeToUnknownLocality applies a distribute rule to the proxies without a region, e.g. for a
+	// node without topology labels, which no From matches but "*". When no rule matches such a proxy, the
+	// first distribute rule of the setting, whatever its From, is the default one applied to it.
+	ApplyDistributeToUnknownLocality bool
+
+	// StrictResidency keeps the traffic within the proxy region unless the setting explicitly sends it
+	// elsewhere. The groups of endpoints in other regions are dropped, except the ones a distribute rule
+	// gives a non-zero percentage to, and the ones in the failover region, which stay in their failover priority.
+	StrictResidency bool
+
+	// AnnotateMetadata records in the metadata of every transformed endpoint the priority and the weight
+	// assigned to its locality, under the LocalityLbMetadataFilter namespace, e.g. for access logs.
+	AnnotateMetadata bool
+
+	// RecordOriginals records in the metadata of every endpoint the priority and the weight its group had
+	// before the setting was applied, under the LocalityLbMetadataFilter namespace, so that
+	// ResetLocalityLBSetting restores them rather than clearing them.
+	RecordOriginals bool
+
+	// AnnotateRationale records in the metadata of every endpoint kept by the transform a short rationale of
+	// the weight and the priority of its locality under the LocalityLbMetadataFilter namespace, in the
+	// rationale field, e.g. "matched To region1/zone1/* @50%; failover priority 1 via same zone", for debugging.
+	AnnotateRationale bool
+
+	// rationales collects the rationales of the groups of endpoints, set for the duration of a transform
+	// when AnnotateRationale is set.
+	rationales *rationales
+
+	// sideEffectFree leaves out the metrics of the transform, for the dry runs reporting its outcome to a
+	// caller rather than pushing it. The warnings of the transforms are only logged at debug level.
+	sideEffectFree bool
+
+	// precomputed holds the composed distribute and the failover targets of a Transformer, computed once
+	// for the load assignments it transforms.
+	precomputed *precomputedTransform
+
+	// DefaultWeight is the weight of a group of endpoints, or of an endpoint, without a weight when
+	// splitting the share of a distribute To entry between the groups of endpoints it matches.
+	// Defaults to 1, a larger value lets groups without a weight compare with weighted ones.
+	DefaultWeight uint32
+
+	// FailoverPreferredMetadata orders the endpoints within each failover priority: the endpoints whose
+	// metadata matches come first, the others get the next priority. A group of endpoints mixing both
+	// is split in two groups of the same locality and weight.
+	FailoverPreferredMetadata *MetadataMatch
+
+	// RegionUnitWeighting treats every distribute To entry, e.g. a region, as a single unit: its share is
+	// split between the groups of endpoints it matches in proportion to their number of endpoints rather
+	// than to their weights, so the endpoints of the region receive the same traffic however it is subdivided.
+	// It takes precedence over the weights, the weight metadata and the capacity hints.
+	RegionUnitWeighting bool
+
+	// HealthyEndpointWeighting splits the share of a distribute To entry between the groups of endpoints it
+	// matches in proportion to their number of healthy endpoints, as MinHealthyEndpoints counts them, so that
+	// a zone of 2 pods and a zone of 20 pods of the same region load their pods evenly while the regions keep
+	// the configured ratio. It takes precedence over RegionUnitWeighting. Like DegradedThreshold, it depends
+	// on the health of the endpoints.
+	HealthyEndpointWeighting bool
+
+	// RegionGeos maps regions to the geo they belong to, a grouping of regions above the locality topology.
+	// Among the regions failover does not prefer, the ones in the geo of the proxy region come first, so
+	// that the traffic fails over within the geo before crossing geos.
+	RegionGeos map[string]string
+
+	// SkipSingleLocalityWeight leaves the weight of a group of endpoints unset when distribute leaves it as
+	// the only group with endpoints, e.g. when distribute keeps all the traffic local, so that its weight
+	// does not churn the config. Envoy gives no traffic to a locality without a weight when locality weighted
+	// load balancing is configured, which the clusters with outlier detection have, so the weight is only
+	// skipped when failover is not enabled.
+	SkipSingleLocalityWeight bool
+
+	// DegradedThreshold demotes by one priority the localities whose fraction of endpoints reported as
+	// degraded exceeds it, before Envoy would spill their traffic over on its own. It ranges from 0 to 1,
+	// 0 disables the demotion. Unlike the rest of the transform, it depends on the health of the endpoints.
+	DegradedThreshold float64
+
+	// LatencyMatrix maps a locality string to the latencies, e.g. measured RTTs in ms, from it to other
+	// localities. Localities are looked up from the most to the least specific, e.g. region/zone/subzone,
+	// region/zone then region. When it has latencies from the proxy locality, failover orders the localities
+	// with a latency by ascending latency, right after the proxy subzone and regardless of the topology and
+	// the failover settings. The localities without a latency come after them in their usual order.
+	LatencyMatrix map[string]map[string]float64
+
+	// LocalityComparator, when set, orders the localities failover assigns priorities to instead of the
+	// topology and the failover settings, see TopologyComparator for the default tiering. The other failover
+	// options, e.g. DemotedLocalities or LatencyMatrix, are ignored, except the ones adjusting the priorities
+	// once assigned, e.g. MinPriorityEndpoints.
+	LocalityComparator LocalityComparator
+
+	// RecordMetrics records the outcome of the transform in gauges labeled by cluster and proxy locality: the
+	// weights of the localities in pilot_locality_lb_weight, the endpoints of every failover priority in
+	// pilot_locality_lb_priority_endpoints and the groups of endpoints the distribute settings dropped in
+	// pilot_locality_lb_dropped_localities. The number of series grows with the number of clusters times the
+	// square of the number of localities, so it is off by default.
+	RecordMetrics bool
+
+	// Deadline bounds the time spent transforming a load assignment, most of which goes into matching its
+	// endpoints to the setting. When the transform overruns it, it is aborted, as early as during the matching,
+	// and the load assignment is left untransformed, with a warning.
+	Deadline time.Duration
+
+	// Now returns the current time the Deadline is checked against, time.Now by default.
+	Now func() time.Time
+
+	// deadline is the time the transform overruns the Deadline at, set for the duration of a transform.
+	deadline time.Time
+
+	// ValidateTransform checks the transformed load assignment with ValidateTransformedCLA before returning
+	// it. An invalid one is logged and the load assignment is left untransformed, with a warning.
+	ValidateTransform bool
+
+	// VerifyAddresses checks that the transform keeps every endpoint address of the load assignment, except
+	// the ones of the groups of endpoints the distribute settings or the strict residency drop. A load assignment
+	// losing other addresses is logged and left untransformed, with a warning.
+	VerifyAddresses bool
+
+	// intendedDrops collects the addresses the transform drops on purpose, set for the duration of a transform
+	// when VerifyAddresses is set.
+	intendedDrops map[string]bool
+
+	// MinHealthyEndpoints, when set, scales down the weight distribute gives a locality with fewer healthy
+	// endpoints, e.g. a single pod left during a partial outage, by its number of healthy endpoints out of
+	// MinHealthyEndpoints, and hands the difference over to the localities of the same priority with enough
+	// healthy endpoints, in proportion to their weights. The endpoints are healthy unless reported unhealthy,
+	// draining or timed out. Like DegradedThreshold, it depends on the health of the endpoints.
+	MinHealthyEndpoints int
+
+	// MaxSkewRatio, when at least 1, caps the ratio between the weights of any two localities of a priority
+	// once the distribute settings are applied, e.g. 3 for no locality to get more than 3 times the weight of
+	// another. The weights beyond the ratio are compressed and the weights of the priority renormalized to
+	// their original sum.
+	MaxSkewRatio float64
+
+	// MaxActiveLocalities, when set, only keeps the nearest localities at priority 0: failover moves the
+	// first MaxActiveLocalities localities in priority order to priority 0, and the others after them.
+	MaxActiveLocalities int
+
+	// MinPriorityEndpoints, when set, is the number of endpoints a failover priority needs to hold its
+	// traffic. Envoy only spills traffic over to the next priority as the healthy fraction of a priority drops,
+	// whatever its number of endpoints, so this is approximated: a priority with fewer endpoints is merged with
+	// the following ones until the merged priority has enough endpoints, which spreads the traffic the few
+	// endpoints would have received over the next localities. The last priority may have fewer endpoints.
+	MinPriorityEndpoints int
+
+	// StabilityMode tunes the overprovisioning factor of the load assignment policy, unless
+	// OverprovisioningFactor is set.
+	StabilityMode StabilityMode
+
+	// ExplicitPriorities maps a locality string (region/zone/subzone) to the priority of its endpoints.
+	// When set, failover ignores the topology and the failover settings: the localities get the given
+	// priorities, the unlisted ones come last, and the priorities are compacted.
+	ExplicitPriorities map[string]uint32
+
+	// TraceContext carries the tracing span the transform is attributed to, e.g. the span of a push.
+	// The transform records a child span with the endpoint count and the applied mode.
+	TraceContext context.Context
+}
+
+func (o *Options) now() time.Time {
+	if o.Now != nil {
+		return o.Now()
+	}
+	return time.Now()
+}
+
+// overrun checks whether the transform overran its deadline, if any.
+func (o *Options) overrun() bool {
+	return !o.deadline.IsZero() && o.now().After(o.deadline)
+}
+
+// cacheable checks whether the transforms with the options only depend on the load assignment, the proxy
+// locality and the setting, not on the time they are computed at or on the previous pushes.
+func (o *Options) cacheable() bool {
+	return o.Deadline == 0 && o.PriorWeights == nil
+}
+
+// overprovisioningFactor returns the overprovisioning factor to set in the load assignment policy, or 0.
+func (o *Options) overprovisioningFactor() uint32 {
+	if o.OverprovisioningFactor > 0 {
+		return o.OverprovisioningFactor
+	}
+	return o.StabilityMode.OverprovisioningFactor()
+}
+
+// consistentHashWeightScale multiplies the distribute percentages when the cluster uses consistent hashing.
+const consistentHashWeightScale = 100
+
+// weightScale returns the factor applied to the distribute percentages.
+func (o *Options) weightScale() uint32 {
+	if o.ConsistentHash {
+		return consistentHashWeightScale
+	}
+	return 1
+}
+
+// FailoverMode selects how a FailoverRule fails the traffic over.
+type FailoverMode int
+
+const (
+	// FailoverRegions fails the From region over to the To regions in order, e.g. to region2, then region3.
+	// Each To region gets its own priority, the regions that are not listed come after all of them.
+	FailoverRegions FailoverMode = iota
+	// FailoverWeighted fails the From region over to the regions of Weights at once: they share the same
+	// priority, right after the proxy region, and split the failover traffic by their weights.
+	FailoverWeighted
+	// FailoverZones fails the From region/zone over to the To region/zones of its region in order. The zones
+	// of the region that are not listed are treated as not matching the failover settings.
+	FailoverZones
+)
+
+// FailoverRule describes where the traffic of the From locality fails over to.
+type FailoverRule struct {
+	Mode FailoverMode
+	// From is the region of the proxy, or its region/zone with FailoverZones.
+	From string
+	// To is the ordered list of regions, or of region/zones with FailoverZones, the traffic fails over to.
+	// It is unused with FailoverWeighted.
+	To []string
+	// Weights maps the failover regions to their share of the failover traffic, with FailoverWeighted.
+	Weights map[string]uint32
+}
+
+// regionFailoverRule returns the first FailoverRegions or FailoverWeighted rule of the proxy region, or nil.
+func (o *Options) regionFailoverRule(proxyLocality *core.Locality) *FailoverRule {
+	for _, rule := range o.FailoverRules {
+		if rule != nil && rule.Mode != FailoverZones && rule.From == proxyLocality.GetRegion() {
+			return rule
+		}
+	}
+	return nil
+}
+
+// zoneFailoverTargets returns the ordered failover zones configured for the proxy locality, or nil.
+func (o *Options) zoneFailoverTargets(proxyLocality *core.Locality) []string {
+	for _, rule := range o.FailoverRules {
+		if rule != nil && rule.Mode == FailoverZones && util.LocalityMatch(proxyLocality, rule.From) {
+			return rule.To
+		}
+	}
+	return nil
+}
+
+func (o *Options) dropUnlistedLocalities() bool {
+	return o.UnlistedLocalities == UnlistedLocalityDrop
+}
+
+func (o *Options) unlistedLocalityWeight() uint32 {
+	if o.UnlistedLocalityWeight == 0 {
+		return 1
+	}
+	return o.UnlistedLocalityWeight
+}
+
+// isDemoted checks whether the locality of a group of endpoints is demoted.
+func (o *Options) isDemoted(locality *core.Locality) bool {
+	for _, demoted := range o.DemotedLocalities {
+		if endpointLocalityMatch(locality, demoted) {
+			return true
+		}
+	}
+	return false
+}
+
+// basePriority returns the incoming priority failover keeps for a group of endpoints, see PreservePriorities.
+func (o *Options) basePriority(localityEndpoint *endpoint.LocalityLbEndpoints) int {
+	if !o.PreservePriorities {
+		return 0
+	}
+	return int(localityEndpoint.Priority)
+}
+
+// isPrimaryAllowed checks whether the locality of a group of endpoints may serve as primary.
+func (o *Options) isPrimaryAllowed(locality *core.Locality) bool {
+	if o.PrimaryAllowlist == nil {
+		return true
+	}
+	for _, allowed := range o.PrimaryAllowlist {
+		if endpointLocalityMatch(locality, allowed) {
+			return true
+		}
+	}
+	return false
+}
+
+// stickyWeights keeps the prior weight of the localities whose newly computed weight is within the
+// hysteresis threshold of it, and re-apportions what is left of the total of the weights between the
+// others, in proportion to their new weights, so that the weights keep their sum. The new weights are
+// returned as is when the prior ones can not be kept without changing the sum.
+func (o *Options) stickyWeights(localities []string, weights []uint32) []uint32 {
+	if o.HysteresisThreshold == 0 || len(o.PriorWeights) == 0 {
+		return weights
+	}
+	total, kept := uint64(0), uint64(0)
+	sticky := make([]bool, len(weights))
+	var moving []uint32
+	for i, weight := range weights {
+		total += uint64(weight)
+		if prior, ok := o.PriorWeights[localities[i]]; ok && o.withinHysteresis(prior, weight) {
+			sticky[i] = true
+			kept += uint64(prior)
+			continue
+		}
+		moving = append(moving, weight)
+	}
+	if len(moving) == len(weights) {
+		return weights
+	}
+	// every moving locality keeps a non-zero weight.
+	if kept+uint64(len(moving)) > total || (len(moving) == 0 && kept != total) {
+		return weights
+	}
+	shares := apportion(moving, uint32(total-kept))
+	sticked := make([]uint32, len(weights))
+	for i := range weights {
+		if sticky[i] {
+			sticked[i] = o.PriorWeights[localities[i]]
+			continue
+		}
+		sticked[i], shares = shares[0], shares[1:]
+	}
+	return sticked
+}
+
+// withinHysteresis tells whether the weight differs from the prior one by no more than the threshold.
+func (o *Options) withinHysteresis(prior, weight uint32) bool {
+	if prior > weight {
+		return prior-weight <= o.HysteresisThreshold
+	}
+	return weight-prior <= o.HysteresisThreshold
+}
+
+// MetadataKey identifies a value in the filter metadata of an endpoint.
+type MetadataKey struct {
+	// Filter is the filter metadata namespace, e.g. istio.
+	Filter string
+	// Key is the field in the filter metadata.
+	Key string
+}
+
+// weight reads an uint32 weight, encoded as a number or a numeric string, from the metadata.
+// It returns 0 if the weight is absent or malformed.
+func (k *MetadataKey) weight(metadata *core.Metadata) uint32 {
+	value := metadata.GetFilterMetadata()[k.Filter].GetFields()[k.Key]
+	if value == nil {
+		return 0
+	}
+	switch v := value.GetKind().(type) {
+	case *structpb.Value_NumberValue:
+		if v.NumberValue > 0 && v.NumberValue <= math.MaxUint32 {
+			return uint32(v.NumberValue)
+		}
+	case *structpb.Value_StringValue:
+		if weight, err := strconv.ParseUint(v.StringValue, 10, 32); err == nil {
+			return uint32(weight)
+		}
+	}
+	return 0
+}
+
+// defaultWeight returns the weight of a group of endpoints or of an endpoint without a weight.
+func (o *Options) defaultWeight() uint32 {
+	if o.DefaultWeight == 0 {
+		return 1
+	}
+	return o.DefaultWeight
+}
+
+// MetadataMatch matches the endpoints whose filter metadata has a string value, e.g. a label.
+type MetadataMatch struct {
+	MetadataKey
+	// Value is the expected value.
+	Value string
+}
+
+// matches checks whether the metadata has the expected value.
+func (m *MetadataMatch) matches(metadata *core.Metadata) bool {
+	return metadata.GetFilterMetadata()[m.Filter].GetFields()[m.Key].GetStringValue() == m.Value
+}
+
+// matchesAll checks whether all the endpoints of a group of endpoints match.
+func (m *MetadataMatch) matchesAll(localityEndpoint *endpoint.LocalityLbEndpoints) bool {
+	for _, lbEp := range localityEndpoint.LbEndpoints {
+		if !m.matches(lbEp.GetMetadata()) {
+			return false
+		}
+	}
+	return true
+}
+
+// geoDistance returns 0 if the region of the endpoints is in the same geo as the proxy region, 1 otherwise.
+// Regions without a geo are in no geo.
+func (o *Options) geoDistance(proxyLocality, endpointLocality *core.Locality) int {
+	geo, ok := o.RegionGeos[proxyLocality.GetRegion()]
+	if ok && geo == o.RegionGeos[endpointLocality.GetRegion()] {
+		return 0
+	}
+	return 1
+}
+
+// latencyRanks returns the rank of the latency from the proxy locality of every group of endpoints with
+// a latency in the LatencyMatrix, the lowest latency ranking 0, or nil if there is none.
+func (o *Options) latencyRanks(proxyLocality *core.Locality, loadAssignment *apiv2.ClusterLoadAssignment) map[int]int {
+	var latencies map[string]float64
+	for _, from := range localityLevels(proxyLocality) {
+		if latencies = o.LatencyMatrix[from]; latencies != nil {
+			break
+		}
+	}
+	if latencies == nil {
+		return nil
+	}
+	measured := map[int]float64{}
+	var values []float64
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		for _, to := range localityLevels(localityEndpoint.Locality) {
+			if latency, ok := latencies[to]; ok {
+				measured[i] = latency
+				values = append(values, latency)
+				break
+			}
+		}
+	}
+	sort.Float64s(values)
+	ranks := make(map[int]int, len(measured))
+	for i, latency := range measured {
+		// equal latencies share a rank.
+		ranks[i] = sort.SearchFloat64s(values, latency)
+	}
+	return ranks
+}
+
+// localityLevels returns the locality strings of a locality from the most to the least specific.
+func localityLevels(locality *core.Locality) []string {
+	if locality == nil {
+		return nil
+	}
+	levels := []string{locality.Region}
+	if locality.Zone != "" {
+		levels = append([]string{locality.Region + "/" + locality.Zone}, levels...)
+		if locality.SubZone != "" {
+			levels = append([]string{util.LocalityToString(locality)}, levels...)
+		}
+	}
+	return levels
+}
+
+// capacityHint returns the capacity multiplier configured for the locality, defaulting to 1.
+func (o *Options) capacityHint(locality string) uint32 {
+	if hint := o.CapacityHints[locality]; hint > 0 {
+		return hint
+	}
+	return 1
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+// LocalityPlanEntry is what the locality lb setting decides for a group of endpoints.
+type LocalityPlanEntry struct {
+	LocalitySnapshot
+	// From is the From of the distribute rule weighting the group of endpoints, empty if none does.
+	From string
+	// To is the To locality of the distribute rule matching the group of endpoints, empty if none does.
+	To string
+}
+
+// LocalityPlan is what the locality lb setting decides for a load assignment, see ComputeLocalityPlan.
+type LocalityPlan struct {
+	// Mode is the kind of locality load balancing applied.
+	Mode Mode
+	// Warnings describe the settings that could not be honored.
+	Warnings []string
+	// Localities has an entry per group of endpoints of the load assignment, in order.
+	Localities []LocalityPlanEntry
+}
+
+// ComputeLocalityPlan is a dry run of ApplyLocalityLBSetting: it returns, for every group of endpoints of
+// the load assignment, the distribute rule matching it along with the weight and the priority the setting
+// gives it, e.g. for a debug endpoint. The given load assignment is left untouched, and no warning is logged
+// nor metric recorded. A group of endpoints removed from the load assignment is reported as dropped.
+func ComputeLocalityPlan(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) *LocalityPlan {
+	if loadAssignment == nil {
+		return nil
+	}
+	snapshot, result := settingEffect(locality, loadAssignment, localityLB, enableFailover)
+	plan := &LocalityPlan{
+		Mode:       result.Mode,
+		Warnings:   result.Warnings,
+		Localities: make([]LocalityPlanEntry, 0, len(snapshot)),
+	}
+	var rule *composedDistribute
+	if result.Mode == ModeDistribute || result.Mode == ModeCombined {
+		rule = composeDistribute(locality, loadAssignment, localityLB.GetDistribute(), &Options{sideEffectFree: true})
+	}
+	for i, state := range snapshot {
+		entry := LocalityPlanEntry{LocalitySnapshot: state}
+		if rule != nil {
+			if to, ok := rule.claim(loadAssignment.Endpoints[i].Locality); ok {
+				entry.From, entry.To = rule.fromOf[to], to
+			}
+		}
+		plan.Localities = append(plan.Localities, entry)
+	}
+	return plan
+}
@@ -0,0 +1,138 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestComputeLocalityPlan(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/*",
+				To: map[string]uint32{
+					"region1/*": 60,
+					"region2/*": 40,
+				},
+			},
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/*":       20,
+				},
+			},
+		},
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region1/zone2", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	)
+	original := SnapshotLoadAssignment(cla)
+
+	tests := []struct {
+		name           string
+		enableFailover bool
+		mode           Mode
+		expected       []LocalityPlanEntry
+	}{
+		{
+			// the zone level rule claims the proxy zone and region2, the region level one the rest of region1.
+			name: "distribute",
+			mode: ModeDistribute,
+			expected: []LocalityPlanEntry{
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region1/zone1", Weight: 80},
+					From:             "region1/zone1/*",
+					To:               "region1/zone1/*",
+				},
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region1/zone2", Weight: 60},
+					From:             "region1/*",
+					To:               "region1/*",
+				},
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region2/zone1", Weight: 20},
+					From:             "region1/zone1/*",
+					To:               "region2/*",
+				},
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region3/zone1", Dropped: true},
+				},
+			},
+		},
+		{
+			name:           "combined",
+			enableFailover: true,
+			mode:           ModeCombined,
+			expected: []LocalityPlanEntry{
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region1/zone1", Weight: 100},
+					From:             "region1/zone1/*",
+					To:               "region1/zone1/*",
+				},
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region1/zone2", Priority: 1, Weight: 100},
+					From:             "region1/*",
+					To:               "region1/*",
+				},
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region2/zone1", Priority: 2, Weight: 100},
+					From:             "region1/zone1/*",
+					To:               "region2/*",
+				},
+				{
+					LocalitySnapshot: LocalitySnapshot{Locality: "region3/zone1", Priority: 2, Dropped: true},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plan := ComputeLocalityPlan(locality, cla, setting, tt.enableFailover)
+			if plan.Mode != tt.mode {
+				t.Errorf("Got mode %s expected %s", plan.Mode, tt.mode)
+			}
+			if !reflect.DeepEqual(plan.Localities, tt.expected) {
+				t.Errorf("Got plan %+v expected %+v", plan.Localities, tt.expected)
+			}
+			if snapshot := SnapshotLoadAssignment(cla); !reflect.DeepEqual(snapshot, original) {
+				t.Errorf("Got the load assignment changed: %v", CompareSnapshots(original, snapshot))
+			}
+		})
+	}
+
+	if plan := ComputeLocalityPlan(locality, nil, setting, true); plan != nil {
+		t.Errorf("Got %v expected no plan without load assignment", plan)
+	}
+}
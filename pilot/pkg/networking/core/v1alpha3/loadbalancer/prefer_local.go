@@ -0,0 +1,58 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// ApplyPreferLocal prioritizes the endpoints by their proximity to the proxy, without any
+// LocalityLoadBalancerSetting: the endpoints in the proxy zone come first, then the endpoints in
+// the proxy region, then all the others. Weights are left untouched. Like failover, it needs
+// outlier detection for Envoy to ever drop down to a lower priority.
+func ApplyPreferLocal(locality *core.Locality, loadAssignment *apiv2.ClusterLoadAssignment) *Result {
+	result := &Result{Mode: ModeNone}
+	if locality == nil || loadAssignment == nil || LocalityLBDisabled() {
+		return result
+	}
+
+	priorityMap := map[priorityKey][]int{}
+	for i, localityEndpoint := range loadAssignment.Endpoints {
+		priority := priorityKey{}
+		// a group of endpoints without a locality is never considered local
+		lbPriority := PriorityOtherRegion
+		if localityEndpoint.Locality != nil {
+			lbPriority = util.LbPriority(locality, localityEndpoint.Locality)
+		}
+		switch lbPriority {
+		case PrioritySubzoneMatch, PriorityZoneMatch:
+			// same zone, whatever the subzone
+			priority.tier = 0
+		case PriorityRegionMatch:
+			priority.tier = 1
+		default:
+			priority.tier = 2
+		}
+		priorityMap[priority] = append(priorityMap[priority], i)
+	}
+	if priorities := assignPriorities(loadAssignment, priorityMap); priorities > 0 {
+		result.MaxPriority = uint32(priorities - 1)
+	}
+	result.Mode = ModePreferLocal
+	return result
+}
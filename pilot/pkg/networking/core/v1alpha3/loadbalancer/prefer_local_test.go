@@ -0,0 +1,97 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+)
+
+func TestApplyPreferLocal(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+
+	tests := []struct {
+		name       string
+		localities []localitySpec
+		priorities []uint32
+		weights    []uint32
+	}{
+		{
+			name: "three tiers",
+			localities: []localitySpec{
+				{locality: "region1/zone1/subzone1"},
+				{locality: "region1/zone1/subzone2"},
+				{locality: "region1/zone2/subzone1", weight: 3},
+				{locality: "region2/zone1/subzone1"},
+				{locality: "region3/zone1/subzone1", weight: 5},
+			},
+			priorities: []uint32{0, 0, 1, 2, 2},
+			weights:    []uint32{0, 0, 3, 0, 5},
+		},
+		{
+			name: "no endpoint in the proxy zone",
+			localities: []localitySpec{
+				{locality: "region1/zone2/subzone1"},
+				{locality: "region2/zone1/subzone1"},
+			},
+			priorities: []uint32{0, 1},
+			weights:    []uint32{0, 0},
+		},
+		{
+			name: "existing priorities are overridden",
+			localities: []localitySpec{
+				{locality: "region2/zone1/subzone1"},
+				{locality: "region1/zone1/subzone1", priority: 3},
+			},
+			priorities: []uint32{1, 0},
+			weights:    []uint32{0, 0},
+		},
+		{
+			name: "endpoints without a locality",
+			localities: []localitySpec{
+				{},
+				{locality: "region1/zone2/subzone1"},
+			},
+			priorities: []uint32{1, 0},
+			weights:    []uint32{0, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(tt.localities...)
+			if result := ApplyPreferLocal(locality, cla); result.Mode != ModePreferLocal {
+				t.Fatalf("Got mode %v expected %v", result.Mode, ModePreferLocal)
+			}
+			priorities := make([]uint32, 0)
+			weights := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+				weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+		})
+	}
+}
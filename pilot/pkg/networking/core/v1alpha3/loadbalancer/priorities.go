@@ -0,0 +1,137 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// ComputePriorities returns the failover priority of every locality for a proxy in the given locality, as
+// the failover settings assign it to the groups of endpoints of a load assignment, compacted so that the
+// priorities range from 0 without skipping: the localities of the proxy subzone, zone and region first,
+// then the failover region, then the other regions and last the nil localities. Only the failover settings
+// apply, not the Options tuning failover.
+func ComputePriorities(
+	proxyLocality *core.Locality,
+	localities []*core.Locality,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover,
+) []uint32 {
+	opts := &Options{}
+	targets := opts.failoverTargets(proxyLocality, failover)
+	priorityMap := map[priorityKey][]int{}
+	for i, locality := range localities {
+		priority, _ := opts.localityPriority(proxyLocality, locality, targets)
+		priorityMap[priority] = append(priorityMap[priority], i)
+	}
+	priorities := make([]uint32, len(localities))
+	for compacted, priority := range sortedPriorities(priorityMap) {
+		for _, i := range priorityMap[priority] {
+			priorities[i] = uint32(compacted)
+		}
+	}
+	return priorities
+}
+
+// failoverTargets holds the failover settings of the proxy locality, resolved once for all its groups of endpoints.
+type failoverTargets struct {
+	// ordered zones to fail over to within the proxy region, if any
+	zones []string
+	// weighted failover regions of the proxy region, if any
+	weighted map[string]uint32
+	// ordered regions to fail over to from the proxy region, if any
+	regions []string
+	// the region the failover settings prefer for the proxy region, if any
+	region string
+	match  bool
+}
+
+func (o *Options) failoverTargets(
+	locality *core.Locality,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover,
+) *failoverTargets {
+	if targets, ok := o.precomputed.failoverTargetsFor(locality, failover); ok {
+		return targets
+	}
+	targets := &failoverTargets{
+		zones: o.zoneFailoverTargets(locality),
+	}
+	if rule := o.regionFailoverRule(locality); rule != nil && rule.Mode == FailoverWeighted {
+		targets.weighted = rule.Weights
+	} else if rule != nil {
+		targets.regions = rule.To
+	}
+	targets.region, targets.match = failoverTarget(locality, failover)
+	return targets
+}
+
+// regionFailover returns whether a failover setting orders the other regions.
+func (t *failoverTargets) regionFailover() bool {
+	return t.weighted != nil || t.regions != nil || t.match
+}
+
+// localityPriority returns the failover priority of a locality relative to the proxy locality, before
+// compaction, and whether the locality is in a weighted failover region, whose weight its groups of
+// endpoints split even if demoted.
+func (o *Options) localityPriority(
+	locality, endpointLocality *core.Locality,
+	targets *failoverTargets,
+) (priorityKey, bool) {
+	// if region/zone/subZone all match, the priority is 0.
+	// if region/zone match, the priority is 1.
+	// if region matches, the priority is 2.
+	// if locality not match, the priority is 3.
+	priority := priorityKey{tier: util.LbPriority(locality, endpointLocality)}
+	weighted := false
+	// region not match, apply failover settings when specified
+	// update localityLbEndpoints' priority to 4 if failover not match
+	// failover extends the topological tiers 0 to 2 rather than replacing them, its targets come after them
+	if priority.tier == PriorityOtherRegion && targets.weighted != nil {
+		if _, weighted = targets.weighted[endpointLocality.GetRegion()]; !weighted {
+			priority.tier = PriorityFailoverMiss
+		}
+	} else if priority.tier == PriorityOtherRegion && targets.regions != nil {
+		priority = regionFailoverPriority(locality, endpointLocality, targets.regions, !o.NoFailoverZonePreference)
+	} else if priority.tier == PriorityOtherRegion && targets.match {
+		if endpointLocality == nil || endpointLocality.Region != targets.region {
+			priority.tier = PriorityFailoverMiss
+		} else if !o.NoFailoverZonePreference {
+			// prefer the endpoints in the same zone/subzone as the proxy within the failover region
+			priority.sub = util.LbPriority(&core.Locality{
+				Region:  endpointLocality.Region,
+				Zone:    locality.Zone,
+				SubZone: locality.SubZone,
+			}, endpointLocality)
+		}
+	}
+	// among the other regions not preferred by the failover settings,
+	// the regions in the same geo as the proxy come first
+	if o.RegionGeos != nil && (priority.tier == PriorityFailoverMiss || priority.tier == PriorityOtherRegion && !targets.regionFailover()) {
+		priority.sub = o.geoDistance(locality, endpointLocality)
+	}
+	// same region but different zone, apply zone failover settings when specified
+	if priority.tier == PriorityRegionMatch && targets.zones != nil {
+		priority = zoneFailoverPriority(endpointLocality, targets.zones)
+	}
+	// localities reported unhealthy by external signals go below every other tier
+	// as do the groups of endpoints without a locality, whatever the proxy locality.
+	if endpointLocality == nil || o.isDemoted(endpointLocality) {
+		priority = priorityKey{tier: PriorityDemoted}
+	}
+	return priority, weighted
+}
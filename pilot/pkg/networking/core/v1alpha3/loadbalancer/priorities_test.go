@@ -0,0 +1,94 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestComputePriorities(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+
+	tests := []struct {
+		name       string
+		failover   []*networking.LocalityLoadBalancerSetting_Failover
+		localities []string
+		expected   []uint32
+	}{
+		{
+			name:       "topology",
+			localities: []string{"region2/zone1", "region1/zone2", "region1/zone1/subzone2", "region1/zone1/subzone1"},
+			expected:   []uint32{3, 2, 1, 0},
+		},
+		{
+			// the failover region comes before the other regions.
+			name: "failover",
+			failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{From: "region1", To: "region3"},
+			},
+			localities: []string{"region2/zone1", "region3/zone1", "region1/zone1/subzone1"},
+			expected:   []uint32{2, 1, 0},
+		},
+		{
+			// the priorities do not skip the tiers without localities.
+			name:       "compacted",
+			localities: []string{"region2/zone1", "region1/zone1/subzone1", "region2/zone2"},
+			expected:   []uint32{1, 0, 1},
+		},
+		{
+			name:       "without locality",
+			localities: []string{"", "region2/zone1", "region1/zone2"},
+			expected:   []uint32{2, 1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			localities := make([]*envoycore.Locality, 0, len(tt.localities))
+			specs := make([]localitySpec, 0, len(tt.localities))
+			for _, l := range tt.localities {
+				var endpointLocality *envoycore.Locality
+				if l != "" {
+					endpointLocality = util.ConvertLocality(l)
+				}
+				localities = append(localities, endpointLocality)
+				specs = append(specs, localitySpec{locality: l, endpoints: 1})
+			}
+			priorities := ComputePriorities(locality, localities, tt.failover)
+			if !reflect.DeepEqual(priorities, tt.expected) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.expected)
+			}
+			// the priorities are the ones failover assigns to the groups of endpoints.
+			cla := buildCLA(specs...)
+			ApplyLocalityLBSetting(locality, cla, &networking.LocalityLoadBalancerSetting{Failover: tt.failover}, true)
+			applied := make([]uint32, 0, len(cla.Endpoints))
+			for _, localityEndpoint := range cla.Endpoints {
+				applied = append(applied, localityEndpoint.Priority)
+			}
+			if !reflect.DeepEqual(applied, priorities) {
+				t.Errorf("Got applied priorities %v expected %v", applied, priorities)
+			}
+		})
+	}
+}
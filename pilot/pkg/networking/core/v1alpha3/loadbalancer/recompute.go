@@ -0,0 +1,60 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// RecomputeForSettingChange recomputes a load assignment when only the locality lb setting changed,
+// the services and their endpoints being the same. prevResult is the load assignment previously emitted
+// for the proxy, and origLocalities are the groups of endpoints it was transformed from, as built before
+// the locality lb setting was applied. The groups of endpoints are restored from origLocalities on a
+// copy of prevResult, the new setting is applied to the copy and the copy is returned, without building
+// the load assignment again. prevResult and origLocalities are left untouched.
+//
+// A nil origLocalities restores the groups of endpoints from the originals stashed in prevResult instead,
+// see ResetLocalityLBSetting, so prevResult must have been applied with Options.RecordOriginals or
+// recomputed, and with a setting that dropped, merged or split no groups of endpoints. The returned load
+// assignment records its originals too, so it can be recomputed again the same way.
+func RecomputeForSettingChange(
+	prevResult *apiv2.ClusterLoadAssignment,
+	origLocalities []*endpoint.LocalityLbEndpoints,
+	locality *core.Locality,
+	newSetting *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) *apiv2.ClusterLoadAssignment {
+	if prevResult == nil {
+		return nil
+	}
+	restored := *prevResult
+	if origLocalities != nil {
+		restored.Endpoints = origLocalities
+	}
+	recomputed := util.CloneClusterLoadAssignment(&restored)
+	if origLocalities == nil {
+		ResetLocalityLBSetting(&recomputed)
+	}
+	// the originals are stashed whatever the setting, even if it does not apply.
+	recordOriginals(&recomputed)
+	ApplyLocalityLBSetting(locality, &recomputed, newSetting, enableFailover)
+	return &recomputed
+}
@@ -0,0 +1,177 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestRecomputeForSettingChange(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	settings := []*networking.LocalityLoadBalancerSetting{
+		{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/zone1/*": 80,
+						"region2/zone1/*": 20,
+					},
+				},
+			},
+		},
+		{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/zone1/*": 50,
+					},
+				},
+			},
+		},
+		{
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{
+					From: "region1",
+					To:   "region3",
+				},
+			},
+		},
+		nil,
+	}
+	original := buildCLA(
+		localitySpec{locality: "region1/zone1", weight: 2, endpoints: 2},
+		localitySpec{locality: "region1/zone2", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	)
+	before := SnapshotLoadAssignment(original)
+
+	// every setting change is recomputed from the previous result of the previous setting.
+	prev := util.CloneClusterLoadAssignment(original)
+	ApplyLocalityLBSetting(locality, &prev, settings[len(settings)-1], true)
+	prevResult := &prev
+	for i, setting := range settings {
+		recomputed := RecomputeForSettingChange(prevResult, original.Endpoints, locality, setting, true)
+		expected := util.CloneClusterLoadAssignment(original)
+		ApplyLocalityLBSetting(locality, &expected, setting, true)
+		for _, diff := range CompareSnapshots(SnapshotLoadAssignment(&expected), SnapshotLoadAssignment(recomputed)) {
+			t.Errorf("setting %d: recomputed load assignment differs from the transform from scratch: %v", i, diff)
+		}
+		prevResult = recomputed
+	}
+	for _, diff := range CompareSnapshots(before, SnapshotLoadAssignment(original)) {
+		t.Errorf("the original load assignment was modified: %v", diff)
+	}
+	if RecomputeForSettingChange(nil, original.Endpoints, locality, settings[0], true) != nil {
+		t.Errorf("expected no load assignment to be recomputed without a previous result")
+	}
+}
+
+func TestRecomputeForSettingChangeFromStashedOriginals(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	settings := []*networking.LocalityLoadBalancerSetting{
+		{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/zone1/*": 60,
+						"*":               40,
+					},
+				},
+			},
+		},
+		{
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+				{
+					From: "region1",
+					To:   "region3",
+				},
+			},
+		},
+		nil,
+	}
+	original := buildCLA(
+		localitySpec{locality: "region1/zone1", weight: 2, endpoints: 2},
+		localitySpec{locality: "region1/zone2", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	)
+
+	// the groups of endpoints are restored from the previous result only, its originals being recorded.
+	prev := util.CloneClusterLoadAssignment(original)
+	ApplyLocalityLBSettingWithOptions(locality, &prev, settings[1], true, &Options{RecordOriginals: true})
+	prevResult := &prev
+	for i, setting := range settings {
+		before := SnapshotLoadAssignment(prevResult)
+		recomputed := RecomputeForSettingChange(prevResult, nil, locality, setting, true)
+		expected := util.CloneClusterLoadAssignment(original)
+		ApplyLocalityLBSetting(locality, &expected, setting, true)
+		for _, diff := range CompareSnapshots(SnapshotLoadAssignment(&expected), SnapshotLoadAssignment(recomputed)) {
+			t.Errorf("setting %d: recomputed load assignment differs from the transform from scratch: %v", i, diff)
+		}
+		for _, diff := range CompareSnapshots(before, SnapshotLoadAssignment(prevResult)) {
+			t.Errorf("setting %d: the previous result was modified: %v", i, diff)
+		}
+		prevResult = recomputed
+	}
+}
+
+func BenchmarkRecomputeForSettingChange(b *testing.B) {
+	locality, distribute := benchmarkSettings()
+	setting := &networking.LocalityLoadBalancerSetting{Distribute: distribute}
+	original := benchmarkCLA(1000)
+	prev := util.CloneClusterLoadAssignment(original)
+	ApplyLocalityLBSetting(locality, &prev, setting, true)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		RecomputeForSettingChange(&prev, original.Endpoints, locality, setting, true)
+	}
+}
+
+func BenchmarkRecomputeFromStashedOriginals(b *testing.B) {
+	locality, distribute := benchmarkSettings()
+	setting := &networking.LocalityLoadBalancerSetting{Distribute: distribute}
+	prev := util.CloneClusterLoadAssignment(benchmarkCLA(1000))
+	ApplyLocalityLBSettingWithOptions(locality, &prev, setting, true, &Options{RecordOriginals: true})
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		RecomputeForSettingChange(&prev, nil, locality, setting, true)
+	}
+}
+
+// BenchmarkRecomputeFromScratch builds the load assignment again before applying the setting, as a full push does.
+func BenchmarkRecomputeFromScratch(b *testing.B) {
+	locality, distribute := benchmarkSettings()
+	setting := &networking.LocalityLoadBalancerSetting{Distribute: distribute}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ApplyLocalityLBSetting(locality, benchmarkCLA(1000), setting, true)
+	}
+}
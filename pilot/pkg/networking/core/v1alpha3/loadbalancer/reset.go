@@ -0,0 +1,98 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	structpb "github.com/golang/protobuf/ptypes/struct"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// The fields of the LocalityLbMetadataFilter metadata recording the priority and the weight a group of
+// endpoints had before the locality lb setting was applied, see Options.RecordOriginals.
+const (
+	originalPriorityField = "original_priority"
+	originalWeightField   = "original_weight"
+)
+
+// ResetLocalityLBSetting reverts the weights and the priorities a locality lb setting gave the groups of
+// endpoints of a load assignment, e.g. once locality lb is turned off for its cluster, without building the
+// load assignment again. The groups of endpoints get back the weight and the priority recorded when the
+// setting was applied with Options.RecordOriginals, or else get no weight and priority 0, and the metadata
+// the transform recorded in their endpoints is removed. The groups of endpoints the setting dropped are left
+// empty, their endpoints cannot be restored. The endpoints with metadata are copied rather than modified.
+func ResetLocalityLBSetting(loadAssignment *apiv2.ClusterLoadAssignment) {
+	if loadAssignment == nil {
+		return
+	}
+	for _, ep := range loadAssignment.Endpoints {
+		ep.Priority, ep.LoadBalancingWeight = 0, nil
+		if len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		fields := ep.LbEndpoints[0].GetMetadata().GetFilterMetadata()[LocalityLbMetadataFilter].GetFields()
+		if priority, ok := fields[originalPriorityField]; ok {
+			ep.Priority = uint32(priority.GetNumberValue())
+		}
+		if weight, ok := fields[originalWeightField]; ok {
+			ep.LoadBalancingWeight = &wrappers.UInt32Value{Value: uint32(weight.GetNumberValue())}
+		}
+		ep.LbEndpoints = withoutLocalityLbMetadata(ep.LbEndpoints)
+	}
+}
+
+// recordOriginals records the priority and the weight of every group of endpoints with endpoints in the
+// metadata of its endpoints, for ResetLocalityLBSetting to restore them.
+func recordOriginals(loadAssignment *apiv2.ClusterLoadAssignment) {
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		fields := map[string]*structpb.Value{
+			originalPriorityField: {Kind: &structpb.Value_NumberValue{NumberValue: float64(ep.Priority)}},
+		}
+		if ep.LoadBalancingWeight != nil {
+			fields[originalWeightField] = &structpb.Value{Kind: &structpb.Value_NumberValue{NumberValue: float64(ep.LoadBalancingWeight.Value)}}
+		}
+		ep.LbEndpoints = withLocalityLbFields(ep.LbEndpoints, fields)
+	}
+}
+
+// withoutLocalityLbMetadata returns copies of the endpoints without their LocalityLbMetadataFilter metadata,
+// the endpoints without it being kept as is.
+func withoutLocalityLbMetadata(lbEndpoints []*endpoint.LbEndpoint) []*endpoint.LbEndpoint {
+	stripped := make([]*endpoint.LbEndpoint, 0, len(lbEndpoints))
+	for _, lbEp := range lbEndpoints {
+		if _, ok := lbEp.GetMetadata().GetFilterMetadata()[LocalityLbMetadataFilter]; !ok {
+			stripped = append(stripped, lbEp)
+			continue
+		}
+		copied := *lbEp
+		filterMetadata := make(map[string]*structpb.Struct, len(lbEp.Metadata.FilterMetadata)-1)
+		for filter, metadata := range lbEp.Metadata.FilterMetadata {
+			if filter != LocalityLbMetadataFilter {
+				filterMetadata[filter] = metadata
+			}
+		}
+		copied.Metadata = nil
+		if len(filterMetadata) > 0 {
+			copied.Metadata = &core.Metadata{FilterMetadata: filterMetadata}
+		}
+		stripped = append(stripped, &copied)
+	}
+	return stripped
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestResetLocalityLBSetting(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To:   map[string]uint32{"region1/*": 80, "region2/*": 20},
+			},
+		},
+	}
+	failover := &networking.LocalityLoadBalancerSetting{}
+
+	tests := []struct {
+		name       string
+		setting    *networking.LocalityLoadBalancerSetting
+		opts       *Options
+		weights    []*wrappers.UInt32Value
+		priorities []uint32
+	}{
+		{
+			name:       "distribute",
+			setting:    setting,
+			opts:       &Options{AnnotateMetadata: true},
+			weights:    []*wrappers.UInt32Value{nil, nil, nil},
+			priorities: []uint32{0, 0, 0},
+		},
+		{
+			name:       "failover",
+			setting:    failover,
+			opts:       &Options{},
+			weights:    []*wrappers.UInt32Value{nil, nil, nil},
+			priorities: []uint32{0, 0, 0},
+		},
+		{
+			name:       "distribute with originals",
+			setting:    setting,
+			opts:       &Options{AnnotateMetadata: true, RecordOriginals: true},
+			weights:    []*wrappers.UInt32Value{{Value: 3}, nil, {Value: 5}},
+			priorities: []uint32{0, 1, 1},
+		},
+		{
+			name:       "failover with originals",
+			setting:    failover,
+			opts:       &Options{RecordOriginals: true},
+			weights:    []*wrappers.UInt32Value{{Value: 3}, nil, {Value: 5}},
+			priorities: []uint32{0, 1, 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region2/zone1", weight: 3, endpoints: 1},
+				localitySpec{locality: "region1/zone1", priority: 1, endpoints: 2},
+				localitySpec{locality: "region1/zone2", weight: 5, priority: 1, endpoints: 1},
+			)
+			shared := cla.Endpoints[1].LbEndpoints[0]
+			ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, true, tt.opts)
+			ResetLocalityLBSetting(cla)
+
+			weights := make([]*wrappers.UInt32Value, 0)
+			priorities := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				weights = append(weights, localityEndpoint.LoadBalancingWeight)
+				priorities = append(priorities, localityEndpoint.Priority)
+				for _, lbEp := range localityEndpoint.LbEndpoints {
+					if lbEp.GetMetadata() != nil {
+						t.Errorf("Got metadata %v expected none", lbEp.GetMetadata())
+					}
+				}
+			}
+			if !reflect.DeepEqual(weights, tt.weights) {
+				t.Errorf("Got weights %v expected %v", weights, tt.weights)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+			if shared.GetMetadata() != nil {
+				t.Errorf("the original endpoint must not be annotated")
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// enforceResidency drops the groups of endpoints outside of the proxy region, unless the applied mode
+// explicitly sends traffic to them: a distribute rule with a non-zero percentage for their locality,
+// or a failover setting targeting their region. It returns the indexes of the dropped groups of endpoints.
+func enforceResidency(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting,
+	mode Mode,
+	opts *Options,
+) []int {
+	allowed := residencyAllowed(locality, loadAssignment, localityLB, mode, opts)
+	var dropped []int
+	for i, ep := range loadAssignment.Endpoints {
+		if ep.Locality.GetRegion() == locality.GetRegion() || allowed(ep.Locality) {
+			continue
+		}
+		if len(ep.LbEndpoints) > 0 {
+			lbLog.Debugf("strict residency drops the endpoints of %s from cluster %s",
+				util.LocalityToString(ep.Locality), loadAssignment.ClusterName)
+		}
+		opts.dropEndpoints(ep)
+		dropped = append(dropped, i)
+	}
+	return dropped
+}
+
+// residencyAllowed returns whether the applied mode explicitly allows traffic to leave the proxy region
+// for an endpoint locality.
+func residencyAllowed(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	localityLB *v1alpha3.LocalityLoadBalancerSetting,
+	mode Mode,
+	opts *Options,
+) func(*core.Locality) bool {
+	switch mode {
+	case ModeDistribute:
+		rule := composeDistribute(locality, loadAssignment, localityLB.GetDistribute(), opts)
+		return func(endpointLocality *core.Locality) bool {
+			if rule == nil {
+				return false
+			}
+			for to, weight := range rule.to {
+				if weight > 0 && rule.match(endpointLocality, to) {
+					return true
+				}
+			}
+			return false
+		}
+	case ModeFailover:
+		regions := map[string]bool{}
+		if targets := opts.failoverTargets(locality, localityLB.GetFailover()); targets.weighted != nil {
+			for region := range targets.weighted {
+				regions[region] = true
+			}
+		} else if targets.regions != nil {
+			for _, region := range targets.regions {
+				regions[region] = true
+			}
+		} else if targets.match {
+			regions[targets.region] = true
+		}
+		return func(endpointLocality *core.Locality) bool {
+			return regions[endpointLocality.GetRegion()]
+		}
+	case ModeCombined:
+		distributed := residencyAllowed(locality, loadAssignment, localityLB, ModeDistribute, opts)
+		failedOver := residencyAllowed(locality, loadAssignment, localityLB, ModeFailover, opts)
+		return func(endpointLocality *core.Locality) bool {
+			return distributed(endpointLocality) || failedOver(endpointLocality)
+		}
+	default:
+		return func(*core.Locality) bool {
+			return false
+		}
+	}
+}
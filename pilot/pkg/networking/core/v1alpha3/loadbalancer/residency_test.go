@@ -0,0 +1,113 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestApplyLocalityLBSettingStrictResidency(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	failover := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	distribute := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/*": 90,
+					"region2/*": 10,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name           string
+		setting        *networking.LocalityLoadBalancerSetting
+		enableFailover bool
+		residual       bool
+		priorities     []uint32
+		endpoints      []int
+	}{
+		{
+			name:           "failover",
+			setting:        failover,
+			enableFailover: true,
+			priorities:     []uint32{0, 1, 2, 2},
+			endpoints:      []int{1, 1, 1, 0},
+		},
+		{
+			name:       "failover disabled",
+			setting:    failover,
+			priorities: []uint32{0, 0, 0, 0},
+			endpoints:  []int{1, 1, 0, 0},
+		},
+		{
+			name:       "distribute",
+			setting:    distribute,
+			priorities: []uint32{0, 0, 0, 0},
+			endpoints:  []int{1, 1, 1, 0},
+		},
+		{
+			name:       "distribute with residual weight",
+			setting:    distribute,
+			residual:   true,
+			priorities: []uint32{0, 0, 0, 0},
+			endpoints:  []int{1, 1, 1, 0},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			opts := &Options{StrictResidency: true}
+			if tt.residual {
+				opts.UnlistedLocalities = UnlistedLocalityKeep
+			}
+			ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, tt.enableFailover, opts)
+			priorities := make([]uint32, 0)
+			endpoints := make([]int, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				priorities = append(priorities, localityEndpoint.Priority)
+				endpoints = append(endpoints, len(localityEndpoint.LbEndpoints))
+			}
+			if !reflect.DeepEqual(endpoints, tt.endpoints) {
+				t.Errorf("Got endpoints %v expected %v", endpoints, tt.endpoints)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+		})
+	}
+}
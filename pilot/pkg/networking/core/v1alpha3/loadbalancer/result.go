@@ -0,0 +1,101 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+// Mode is the kind of locality load balancing applied to a ClusterLoadAssignment.
+type Mode int
+
+const (
+	// ModeNone means the load assignment was left untouched.
+	ModeNone Mode = iota
+	// ModeDistribute means the distribute settings were applied to weight the localities.
+	ModeDistribute
+	// ModeFailover means the failover settings were applied to prioritize the localities.
+	ModeFailover
+	// ModePreferLocal means the localities were prioritized by proximity, see ApplyPreferLocal.
+	ModePreferLocal
+	// ModeCombined means the distribute settings weighted the localities, then the failover settings
+	// prioritized them, see ApplyLocalityLBSetting.
+	ModeCombined
+)
+
+func (m Mode) String() string {
+	switch m {
+	case ModeDistribute:
+		return "distribute"
+	case ModeFailover:
+		return "failover"
+	case ModePreferLocal:
+		return "prefer local"
+	case ModeCombined:
+		return "combined"
+	default:
+		return "none"
+	}
+}
+
+// Source is the kind of configuration a LocalityLoadBalancerSetting is resolved from.
+type Source int
+
+const (
+	// SourceNone means no setting applies.
+	SourceNone Source = iota
+	// SourceMeshConfig means the setting comes from the mesh config.
+	SourceMeshConfig
+	// SourceDestinationRule means the setting comes from a destination rule.
+	SourceDestinationRule
+)
+
+// Provenance identifies the configuration a LocalityLoadBalancerSetting is resolved from.
+type Provenance struct {
+	Source Source
+	// DestinationRule identifies the destination rule when Source is SourceDestinationRule.
+	DestinationRule string
+}
+
+func (p Provenance) String() string {
+	switch p.Source {
+	case SourceMeshConfig:
+		return "mesh config"
+	case SourceDestinationRule:
+		return fmt.Sprintf("destination rule %s", p.DestinationRule)
+	default:
+		return "none"
+	}
+}
+
+// Result describes what ApplyLocalityLBSettingWithOptions did to a ClusterLoadAssignment.
+type Result struct {
+	// Mode is the kind of locality load balancing applied.
+	Mode Mode
+	// Applied is whether the setting applied to the proxy: a distribute rule matches the proxy locality, or
+	// failover prioritized the endpoints. The Mode is ModeDistribute even if no distribute rule matches.
+	Applied bool
+	// Setting is the LocalityLoadBalancerSetting the mode was resolved from.
+	Setting *v1alpha3.LocalityLoadBalancerSetting
+	// Provenance is where Setting comes from, as given in the Options.
+	Provenance Provenance
+	// Warnings describe the settings that could not be honored, e.g. a failover region without endpoints.
+	Warnings []string
+	// MaxPriority is the lowest priority, i.e. the highest priority number, of the load assignment once
+	// transformed: the transform produced MaxPriority+1 priority levels.
+	MaxPriority uint32
+}
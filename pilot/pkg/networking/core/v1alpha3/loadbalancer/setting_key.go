@@ -0,0 +1,104 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+// SettingKey returns a string identifying a LocalityLoadBalancerSetting, suitable as a cache key.
+// Two settings with the same rules have the same key whatever the iteration order of their
+// distribute To maps. The order of the distribute and failover rules is part of the key, since
+// it breaks the ties between equally specific distribute rules, and the first failover rule
+// matching the proxy locality is the one applied. An empty distribute, unlike an
+// absent one, disables failover, so the two have different keys.
+func SettingKey(setting *v1alpha3.LocalityLoadBalancerSetting) string {
+	if setting == nil {
+		return ""
+	}
+	var sb strings.Builder
+	if setting.Enabled != nil {
+		fmt.Fprintf(&sb, "enabled=%t;", setting.Enabled.GetValue())
+	}
+	if setting.Distribute == nil {
+		sb.WriteString("distribute=nil")
+	} else {
+		sb.WriteString("distribute=[")
+	}
+	for i, distribute := range setting.Distribute {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		if distribute == nil {
+			sb.WriteString("nil")
+			continue
+		}
+		localities := make([]string, 0, len(distribute.To))
+		for locality := range distribute.To {
+			localities = append(localities, locality)
+		}
+		sort.Strings(localities)
+		fmt.Fprintf(&sb, "%q:{", distribute.From)
+		for j, locality := range localities {
+			if j > 0 {
+				sb.WriteString(",")
+			}
+			fmt.Fprintf(&sb, "%q:%d", locality, distribute.To[locality])
+		}
+		sb.WriteString("}")
+	}
+	if setting.Distribute != nil {
+		sb.WriteString("]")
+	}
+	sb.WriteString(";failover=[")
+	for i, failover := range setting.Failover {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		if failover == nil {
+			sb.WriteString("nil")
+			continue
+		}
+		fmt.Fprintf(&sb, "%q:%q", failover.From, failover.To)
+	}
+	sb.WriteString("]")
+	return sb.String()
+}
+
+// SettingsEqual checks whether two LocalityLoadBalancerSettings have the same effect, e.g. to skip
+// a push when a setting did not change. The iteration order of the distribute To maps, and nil versus
+// empty maps or failover rules, do not matter. An unset Enabled, which defers to the mesh config, differs
+// from a false one, and an absent distribute from an empty one. A nil setting only equals a nil setting.
+func SettingsEqual(a, b *v1alpha3.LocalityLoadBalancerSetting) bool {
+	if a == b {
+		return true
+	}
+	if a == nil || b == nil {
+		return false
+	}
+	return SettingKey(a) == SettingKey(b)
+}
+
+// SettingHash returns a hash of the key of a LocalityLoadBalancerSetting, see SettingKey.
+func SettingHash(setting *v1alpha3.LocalityLoadBalancerSetting) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(SettingKey(setting)))
+	return h.Sum64()
+}
@@ -0,0 +1,201 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/gogo/protobuf/types"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestSettingKey(t *testing.T) {
+	// a To map with many keys, inserted in different orders, is iterated in different orders.
+	forward := map[string]uint32{}
+	backward := map[string]uint32{}
+	for i := 0; i < 20; i++ {
+		forward[fmt.Sprintf("region%d/*", i)] = uint32(i)
+	}
+	for i := 19; i >= 0; i-- {
+		backward[fmt.Sprintf("region%d/*", i)] = uint32(i)
+	}
+	distribute := func(to map[string]uint32) *networking.LocalityLoadBalancerSetting {
+		return &networking.LocalityLoadBalancerSetting{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/*",
+					To:   to,
+				},
+			},
+		}
+	}
+	failover := func(from ...string) *networking.LocalityLoadBalancerSetting {
+		setting := &networking.LocalityLoadBalancerSetting{}
+		for _, f := range from {
+			setting.Failover = append(setting.Failover, &networking.LocalityLoadBalancerSetting_Failover{From: f, To: "region9"})
+		}
+		return setting
+	}
+
+	tests := []struct {
+		name  string
+		a     *networking.LocalityLoadBalancerSetting
+		b     *networking.LocalityLoadBalancerSetting
+		equal bool
+	}{
+		{
+			name:  "differently ordered To",
+			a:     distribute(forward),
+			b:     distribute(backward),
+			equal: true,
+		},
+		{
+			name:  "different percentage",
+			a:     distribute(map[string]uint32{"region1/*": 60, "region2/*": 40}),
+			b:     distribute(map[string]uint32{"region1/*": 40, "region2/*": 60}),
+			equal: false,
+		},
+		{
+			name:  "different failover",
+			a:     failover("region1"),
+			b:     failover("region2"),
+			equal: false,
+		},
+		{
+			name:  "differently ordered failover rules",
+			a:     failover("region1", "region2"),
+			b:     failover("region2", "region1"),
+			equal: false,
+		},
+		{
+			name:  "enabled set",
+			a:     &networking.LocalityLoadBalancerSetting{},
+			b:     &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+			equal: false,
+		},
+		{
+			name:  "nil and empty",
+			a:     nil,
+			b:     &networking.LocalityLoadBalancerSetting{},
+			equal: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if equal := SettingKey(tt.a) == SettingKey(tt.b); equal != tt.equal {
+				t.Errorf("Got equal keys %v expected %v: %q %q", equal, tt.equal, SettingKey(tt.a), SettingKey(tt.b))
+			}
+			if equal := SettingHash(tt.a) == SettingHash(tt.b); equal != tt.equal {
+				t.Errorf("Got equal hashes %v expected %v", equal, tt.equal)
+			}
+			if equal := SettingsEqual(tt.a, tt.b); equal != tt.equal {
+				t.Errorf("Got equal settings %v expected %v", equal, tt.equal)
+			}
+		})
+	}
+}
+
+func TestSettingsEqual(t *testing.T) {
+	distribute := []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region1/*",
+			To: map[string]uint32{
+				"region1/*": 100,
+			},
+		},
+	}
+	tests := []struct {
+		name  string
+		a     *networking.LocalityLoadBalancerSetting
+		b     *networking.LocalityLoadBalancerSetting
+		equal bool
+	}{
+		{
+			name:  "both nil",
+			equal: true,
+		},
+		{
+			name:  "enabled nil and false",
+			a:     &networking.LocalityLoadBalancerSetting{},
+			b:     &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}},
+			equal: false,
+		},
+		{
+			name:  "enabled false and true",
+			a:     &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}},
+			b:     &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: true}},
+			equal: false,
+		},
+		{
+			name:  "enabled false and false",
+			a:     &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}},
+			b:     &networking.LocalityLoadBalancerSetting{Enabled: &types.BoolValue{Value: false}},
+			equal: true,
+		},
+		{
+			// an empty distribute disables failover.
+			name:  "absent and empty distribute",
+			a:     &networking.LocalityLoadBalancerSetting{},
+			b:     &networking.LocalityLoadBalancerSetting{Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{}},
+			equal: false,
+		},
+		{
+			name:  "empty distributes",
+			a:     &networking.LocalityLoadBalancerSetting{Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{}},
+			b:     &networking.LocalityLoadBalancerSetting{Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{}},
+			equal: true,
+		},
+		{
+			name:  "absent and empty failover",
+			a:     &networking.LocalityLoadBalancerSetting{},
+			b:     &networking.LocalityLoadBalancerSetting{Failover: []*networking.LocalityLoadBalancerSetting_Failover{}},
+			equal: true,
+		},
+		{
+			name: "nil and empty To",
+			a: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{{From: "region1/*"}},
+			},
+			b: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{{From: "region1/*", To: map[string]uint32{}}},
+			},
+			equal: true,
+		},
+		{
+			name:  "same distribute",
+			a:     &networking.LocalityLoadBalancerSetting{Distribute: distribute},
+			b:     &networking.LocalityLoadBalancerSetting{Distribute: distribute[:1:1]},
+			equal: true,
+		},
+		{
+			name:  "distribute and nothing",
+			a:     &networking.LocalityLoadBalancerSetting{Distribute: distribute},
+			b:     &networking.LocalityLoadBalancerSetting{},
+			equal: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if equal := SettingsEqual(tt.a, tt.b); equal != tt.equal {
+				t.Errorf("Got equal %v expected %v", equal, tt.equal)
+			}
+			if equal := SettingsEqual(tt.b, tt.a); equal != tt.equal {
+				t.Errorf("Got reversed equal %v expected %v", equal, tt.equal)
+			}
+		})
+	}
+}
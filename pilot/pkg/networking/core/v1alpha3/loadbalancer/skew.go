@@ -0,0 +1,64 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"math"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/protobuf/ptypes/wrappers"
+)
+
+// enforceMaxSkewRatio compresses the weights of the groups of endpoints of each priority so that none is
+// more than ratio times the weight of another: the weights above ratio times the lowest one are lowered to it,
+// then the weights of the priority are scaled back up to their original sum. The groups of endpoints without
+// endpoints or without a weight are left as is.
+func enforceMaxSkewRatio(loadAssignment *apiv2.ClusterLoadAssignment, ratio float64) {
+	priorities := map[uint32][]int{}
+	for i, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 && ep.LoadBalancingWeight != nil {
+			priorities[ep.Priority] = append(priorities[ep.Priority], i)
+		}
+	}
+	for _, indexes := range priorities {
+		if len(indexes) < 2 {
+			continue
+		}
+		min, max, sum := float64(math.MaxUint32), float64(0), float64(0)
+		for _, i := range indexes {
+			weight := float64(loadAssignment.Endpoints[i].LoadBalancingWeight.GetValue())
+			min = math.Min(min, weight)
+			max = math.Max(max, weight)
+			sum += weight
+		}
+		if max <= min*ratio {
+			continue
+		}
+		compressed := make([]float64, len(indexes))
+		compressedSum := float64(0)
+		for j, i := range indexes {
+			compressed[j] = math.Min(float64(loadAssignment.Endpoints[i].LoadBalancingWeight.GetValue()), min*ratio)
+			compressedSum += compressed[j]
+		}
+		// the rounded weights must still satisfy the ratio to the rounded lowest weight.
+		factor := sum / compressedSum
+		lowest := math.Max(1, math.Round(min*factor))
+		highest := math.Min(math.Floor(lowest*ratio), math.MaxUint32)
+		for j, i := range indexes {
+			weight := math.Min(math.Max(math.Round(compressed[j]*factor), lowest), highest)
+			loadAssignment.Endpoints[i].LoadBalancingWeight = &wrappers.UInt32Value{Value: uint32(weight)}
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"strconv"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+)
+
+// LocalitySnapshot is the locality load balancing outcome for a group of endpoints.
+type LocalitySnapshot struct {
+	Locality string
+	Priority uint32
+	Weight   uint32
+	// Dropped tells the group of endpoints has no endpoint left.
+	Dropped bool
+}
+
+// Snapshot captures the outcome of a locality load balancing transform, one entry per group of
+// endpoints of the load assignment in order. It is meant for tests pinning the behavior of the
+// transform across changes, see CompareSnapshots.
+type Snapshot []LocalitySnapshot
+
+// SnapshotLoadAssignment takes a snapshot of the priorities, weights and dropped groups of endpoints
+// of a load assignment.
+func SnapshotLoadAssignment(loadAssignment *apiv2.ClusterLoadAssignment) Snapshot {
+	if loadAssignment == nil {
+		return nil
+	}
+	states := snapshotLocalities(loadAssignment)
+	snapshot := make(Snapshot, 0, len(states))
+	for _, state := range states {
+		snapshot = append(snapshot, LocalitySnapshot{
+			Locality: state.locality,
+			Priority: state.priority,
+			Weight:   state.weight,
+			Dropped:  state.endpoints == 0,
+		})
+	}
+	return snapshot
+}
+
+// SnapshotDiff is a difference between two snapshots for a group of endpoints.
+type SnapshotDiff struct {
+	// Index is the position of the group of endpoints in the load assignment.
+	Index int
+	// Field is the differing field: locality, priority, weight, dropped, or group when the group of
+	// endpoints only exists in one of the snapshots.
+	Field string
+	// A and B are the values of the field in the two snapshots.
+	A, B string
+}
+
+func (d SnapshotDiff) String() string {
+	return fmt.Sprintf("[%d] %s: %s -> %s", d.Index, d.Field, d.A, d.B)
+}
+
+// CompareSnapshots returns the differences between two snapshots, field by field and group by group.
+// It returns nil if the snapshots are equal.
+func CompareSnapshots(a, b Snapshot) []SnapshotDiff {
+	var diffs []SnapshotDiff
+	for i := 0; i < len(a) || i < len(b); i++ {
+		switch {
+		case i >= len(a):
+			diffs = append(diffs, SnapshotDiff{Index: i, Field: "group", A: "missing", B: b[i].Locality})
+			continue
+		case i >= len(b):
+			diffs = append(diffs, SnapshotDiff{Index: i, Field: "group", A: a[i].Locality, B: "missing"})
+			continue
+		}
+		if a[i].Locality != b[i].Locality {
+			diffs = append(diffs, SnapshotDiff{Index: i, Field: "locality", A: a[i].Locality, B: b[i].Locality})
+		}
+		if a[i].Priority != b[i].Priority {
+			diffs = append(diffs, SnapshotDiff{Index: i, Field: "priority",
+				A: strconv.FormatUint(uint64(a[i].Priority), 10), B: strconv.FormatUint(uint64(b[i].Priority), 10)})
+		}
+		if a[i].Weight != b[i].Weight {
+			diffs = append(diffs, SnapshotDiff{Index: i, Field: "weight",
+				A: strconv.FormatUint(uint64(a[i].Weight), 10), B: strconv.FormatUint(uint64(b[i].Weight), 10)})
+		}
+		if a[i].Dropped != b[i].Dropped {
+			diffs = append(diffs, SnapshotDiff{Index: i, Field: "dropped",
+				A: strconv.FormatBool(a[i].Dropped), B: strconv.FormatBool(b[i].Dropped)})
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,194 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestCompareSnapshots(t *testing.T) {
+	a := Snapshot{
+		{Locality: "region1/zone1", Weight: 80},
+		{Locality: "region1/zone2", Weight: 20},
+		{Locality: "region2/zone1", Dropped: true},
+	}
+	b := Snapshot{
+		{Locality: "region1/zone1", Weight: 70},
+		{Locality: "region1/zone2", Priority: 1, Weight: 20},
+	}
+	expected := []SnapshotDiff{
+		{Index: 0, Field: "weight", A: "80", B: "70"},
+		{Index: 1, Field: "priority", A: "0", B: "1"},
+		{Index: 2, Field: "group", A: "region2/zone1", B: "missing"},
+	}
+	if got := CompareSnapshots(a, b); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got diffs %v expected %v", got, expected)
+	}
+	if got := CompareSnapshots(a, a); got != nil {
+		t.Errorf("Got diffs %v expected none", got)
+	}
+}
+
+// TestApplyLocalityLBSettingSnapshots pins the outcome of the transform over a suite of scenarios,
+// so that refactors of the weight and priority math do not change it unnoticed.
+func TestApplyLocalityLBSettingSnapshots(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	localities := []localitySpec{
+		{locality: "region1/zone1/subzone1", endpoints: 2},
+		{locality: "region1/zone1/subzone2", endpoints: 1},
+		{locality: "region1/zone2/subzone1", endpoints: 1},
+		{locality: "region2/zone1/subzone1", endpoints: 1},
+		{locality: "region3/zone1/subzone1", endpoints: 1},
+	}
+
+	scenarios := []struct {
+		name     string
+		setting  *networking.LocalityLoadBalancerSetting
+		opts     *Options
+		expected Snapshot
+	}{
+		{
+			name: "distribute",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1/*",
+						To: map[string]uint32{
+							"region1/zone1/*": 60,
+							"region2/zone1/*": 40,
+						},
+					},
+				},
+			},
+			expected: Snapshot{
+				{Locality: "region1/zone1/subzone1", Weight: 30},
+				{Locality: "region1/zone1/subzone2", Weight: 30},
+				{Locality: "region1/zone2/subzone1", Dropped: true},
+				{Locality: "region2/zone1/subzone1", Weight: 40},
+				{Locality: "region3/zone1/subzone1", Dropped: true},
+			},
+		},
+		{
+			name: "distribute keeping unlisted localities",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/*",
+						To: map[string]uint32{
+							"region1/*": 90,
+							"region2/*": 10,
+						},
+					},
+				},
+			},
+			opts: &Options{UnlistedLocalities: UnlistedLocalityKeep},
+			expected: Snapshot{
+				{Locality: "region1/zone1/subzone1", Weight: 30},
+				{Locality: "region1/zone1/subzone2", Weight: 30},
+				{Locality: "region1/zone2/subzone1", Weight: 30},
+				{Locality: "region2/zone1/subzone1", Weight: 10},
+				{Locality: "region3/zone1/subzone1", Weight: 1},
+			},
+		},
+		{
+			name: "distribute with consistent hashing",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1/*",
+						To: map[string]uint32{
+							"region1/zone1/*": 50,
+							"region2/*":       50,
+						},
+					},
+				},
+			},
+			opts: &Options{ConsistentHash: true},
+			expected: Snapshot{
+				{Locality: "region1/zone1/subzone1", Weight: 2500},
+				{Locality: "region1/zone1/subzone2", Weight: 2500},
+				{Locality: "region1/zone2/subzone1", Dropped: true},
+				{Locality: "region2/zone1/subzone1", Weight: 5000},
+				{Locality: "region3/zone1/subzone1", Dropped: true},
+			},
+		},
+		{
+			name:    "topological failover",
+			setting: &networking.LocalityLoadBalancerSetting{},
+			expected: Snapshot{
+				{Locality: "region1/zone1/subzone1", Priority: 0},
+				{Locality: "region1/zone1/subzone2", Priority: 1},
+				{Locality: "region1/zone2/subzone1", Priority: 2},
+				{Locality: "region2/zone1/subzone1", Priority: 3},
+				{Locality: "region3/zone1/subzone1", Priority: 3},
+			},
+		},
+		{
+			name: "failover",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+						To:   "region3",
+					},
+				},
+			},
+			expected: Snapshot{
+				{Locality: "region1/zone1/subzone1", Priority: 0},
+				{Locality: "region1/zone1/subzone2", Priority: 1},
+				{Locality: "region1/zone2/subzone1", Priority: 2},
+				{Locality: "region2/zone1/subzone1", Priority: 4},
+				{Locality: "region3/zone1/subzone1", Priority: 3},
+			},
+		},
+		{
+			name: "failover with demoted locality",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+						To:   "region2",
+					},
+				},
+			},
+			opts: &Options{DemotedLocalities: []string{"region1/zone2/*"}},
+			expected: Snapshot{
+				{Locality: "region1/zone1/subzone1", Priority: 0},
+				{Locality: "region1/zone1/subzone2", Priority: 1},
+				{Locality: "region1/zone2/subzone1", Priority: 4},
+				{Locality: "region2/zone1/subzone1", Priority: 2},
+				{Locality: "region3/zone1/subzone1", Priority: 3},
+			},
+		},
+	}
+	for _, tt := range scenarios {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(localities...)
+			ApplyLocalityLBSettingWithOptions(locality, cla, tt.setting, true, tt.opts)
+			for _, diff := range CompareSnapshots(tt.expected, SnapshotLoadAssignment(cla)) {
+				t.Errorf("unexpected change %v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+)
+
+// StabilityMode selects how eagerly Envoy fails over between priorities as the health of the endpoints changes.
+type StabilityMode int
+
+const (
+	// StabilityModeDefault keeps the Envoy defaults.
+	StabilityModeDefault StabilityMode = iota
+	// StabilityModeStable only fails over after a significant health loss, and enters panic mode early,
+	// so that health flaps do not make the traffic oscillate between priorities.
+	StabilityModeStable
+	// StabilityModeResponsive fails over as soon as endpoints become unhealthy.
+	StabilityModeResponsive
+)
+
+func (m StabilityMode) String() string {
+	switch m {
+	case StabilityModeStable:
+		return "stable"
+	case StabilityModeResponsive:
+		return "responsive"
+	default:
+		return "default"
+	}
+}
+
+// OverprovisioningFactor returns the overprovisioning factor of the load assignment policy for the mode,
+// 0 meaning the Envoy default of 140.
+func (m StabilityMode) OverprovisioningFactor() uint32 {
+	switch m {
+	case StabilityModeStable:
+		return 200
+	case StabilityModeResponsive:
+		return 100
+	default:
+		return 0
+	}
+}
+
+// HealthyPanicThreshold returns the percentage of healthy endpoints under which the cluster enters panic mode
+// for the mode, nil meaning the Envoy default of 50%. It belongs to the CommonLbConfig of the cluster.
+func (m StabilityMode) HealthyPanicThreshold() *float64 {
+	var threshold float64
+	switch m {
+	case StabilityModeStable:
+		threshold = 70
+	case StabilityModeResponsive:
+		threshold = 30
+	default:
+		return nil
+	}
+	return &threshold
+}
+
+// CommonLbConfig returns the CommonLbConfig of a cluster balanced by locality in the mode: locality weighted
+// load balancing, which the distribute weights need, and the panic threshold of the mode.
+func (m StabilityMode) CommonLbConfig() *apiv2.Cluster_CommonLbConfig {
+	config := &apiv2.Cluster_CommonLbConfig{
+		LocalityConfigSpecifier: &apiv2.Cluster_CommonLbConfig_LocalityWeightedLbConfig_{
+			LocalityWeightedLbConfig: &apiv2.Cluster_CommonLbConfig_LocalityWeightedLbConfig{},
+		},
+	}
+	if threshold := m.HealthyPanicThreshold(); threshold != nil {
+		config.HealthyPanicThreshold = &envoy_type.Percent{Value: *threshold}
+	}
+	return config
+}
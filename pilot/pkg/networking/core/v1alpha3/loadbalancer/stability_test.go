@@ -0,0 +1,161 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"math"
+	"testing"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestApplyLocalityLBSettingStabilityMode(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	tests := []struct {
+		opts           *Options
+		factor         uint32
+		panicThreshold float64
+	}{
+		{
+			opts: &Options{StabilityMode: StabilityModeDefault},
+		},
+		{
+			opts:           &Options{StabilityMode: StabilityModeStable},
+			factor:         200,
+			panicThreshold: 70,
+		},
+		{
+			opts:           &Options{StabilityMode: StabilityModeResponsive},
+			factor:         100,
+			panicThreshold: 30,
+		},
+		{
+			opts:           &Options{StabilityMode: StabilityModeStable, OverprovisioningFactor: 150},
+			factor:         150,
+			panicThreshold: 70,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.opts.StabilityMode.String(), func(t *testing.T) {
+			cla := buildCLA(localitySpec{locality: "region1/zone1"})
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, tt.opts)
+			if tt.factor == 0 {
+				if cla.Policy != nil {
+					t.Errorf("Got policy %v expected none", cla.Policy)
+				}
+			} else if got := cla.Policy.GetOverprovisioningFactor().GetValue(); got != tt.factor {
+				t.Errorf("Got overprovisioning factor %d expected %d", got, tt.factor)
+			}
+
+			threshold := tt.opts.StabilityMode.HealthyPanicThreshold()
+			if tt.panicThreshold == 0 {
+				if threshold != nil {
+					t.Errorf("Got panic threshold %v expected none", *threshold)
+				}
+			} else if threshold == nil || *threshold != tt.panicThreshold {
+				t.Errorf("Got panic threshold %v expected %v", threshold, tt.panicThreshold)
+			}
+		})
+	}
+}
+
+// TestFailoverClusterConsistency checks that a failover transformed load assignment and the CommonLbConfig
+// of its cluster make a consistent Envoy configuration: gapless priorities, a policy matching the mode and
+// valid locality weights, since with locality weighted load balancing a group without weight gets no traffic.
+func TestFailoverClusterConsistency(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+
+	for _, mode := range []StabilityMode{StabilityModeDefault, StabilityModeStable, StabilityModeResponsive} {
+		t.Run(mode.String(), func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region3/zone1", weight: 1, endpoints: 1},
+				localitySpec{locality: "region1/zone2", weight: 2, endpoints: 2},
+				localitySpec{locality: "region2/zone1", weight: 1, endpoints: 1},
+				localitySpec{locality: "region1/zone1", weight: 3, endpoints: 3},
+				localitySpec{locality: "region2/zone2", weight: 1, endpoints: 1},
+			)
+			cluster := &apiv2.Cluster{
+				Name:           cla.ClusterName,
+				CommonLbConfig: mode.CommonLbConfig(),
+			}
+			result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{StabilityMode: mode})
+
+			if cluster.CommonLbConfig.GetLocalityWeightedLbConfig() == nil {
+				t.Errorf("Got no locality weighted lb config")
+			}
+			threshold := cluster.CommonLbConfig.GetHealthyPanicThreshold()
+			if expected := mode.HealthyPanicThreshold(); expected == nil {
+				if threshold != nil {
+					t.Errorf("Got panic threshold %v expected none", threshold.Value)
+				}
+			} else if threshold.GetValue() != *expected {
+				t.Errorf("Got panic threshold %v expected %v", threshold.GetValue(), *expected)
+			}
+			if got, expected := cla.GetPolicy().GetOverprovisioningFactor().GetValue(), mode.OverprovisioningFactor(); got != expected {
+				t.Errorf("Got overprovisioning factor %d expected %d", got, expected)
+			}
+
+			weights := map[uint32]uint64{}
+			for _, group := range cla.Endpoints {
+				if group.GetLoadBalancingWeight().GetValue() == 0 {
+					t.Errorf("Got locality %v without weight", group.Locality)
+				}
+				weights[group.Priority] += uint64(group.GetLoadBalancingWeight().GetValue())
+			}
+			// the proxy zone, the proxy region, the two zones of the failover region and the rest.
+			if len(weights) != 5 {
+				t.Errorf("Got priorities %v expected 5", weights)
+			}
+			for priority := uint32(0); priority < uint32(len(weights)); priority++ {
+				weight, ok := weights[priority]
+				if !ok {
+					t.Errorf("Got priorities %v with a gap at %d", weights, priority)
+				}
+				if weight > math.MaxUint32 {
+					t.Errorf("Got priority %d weight %d overflowing", priority, weight)
+				}
+			}
+			if result.MaxPriority != uint32(len(weights)-1) {
+				t.Errorf("Got max priority %d expected %d", result.MaxPriority, len(weights)-1)
+			}
+		})
+	}
+}
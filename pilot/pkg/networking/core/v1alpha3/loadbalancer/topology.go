@@ -0,0 +1,95 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// GetLocalityLbSettingValidated resolves the locality lb setting as GetLocalityLbSetting does, and checks
+// the localities its distribute and failover settings refer to against the current topology. knownLocalities
+// are the localities of the proxies and endpoints of the mesh, as region/zone/subzone strings. It returns a
+// warning for every reference that no known locality matches, e.g. a misspelled region, which would
+// otherwise be silently ignored. The setting is returned as is, whatever the warnings.
+func GetLocalityLbSettingValidated(
+	mesh *v1alpha3.LocalityLoadBalancerSetting,
+	destrule *v1alpha3.LocalityLoadBalancerSetting,
+	knownLocalities map[string]bool,
+) (*v1alpha3.LocalityLoadBalancerSetting, []string) {
+	setting := GetLocalityLbSetting(mesh, destrule)
+	if setting == nil {
+		return nil, nil
+	}
+	known := make([]string, 0, len(knownLocalities))
+	for locality, ok := range knownLocalities {
+		if ok {
+			known = append(known, locality)
+		}
+	}
+	var warnings []string
+	for _, rule := range setting.GetDistribute() {
+		if rule == nil {
+			continue
+		}
+		if !knownLocalityMatch(known, rule.From) {
+			warnings = append(warnings, fmt.Sprintf("distribute From %q matches no known locality", rule.From))
+		}
+		for _, to := range sortedTo(rule.To) {
+			if to != BalancedDistribute && !knownLocalityMatch(known, to) {
+				warnings = append(warnings, fmt.Sprintf("distribute To %q of the rule from %q matches no known locality",
+					to, rule.From))
+			}
+		}
+	}
+	for _, failover := range setting.GetFailover() {
+		if failover == nil {
+			continue
+		}
+		if !knownRegion(known, failover.From) {
+			warnings = append(warnings, fmt.Sprintf("failover From region %q has no known locality", failover.From))
+		}
+		// FailoverSelfRegion stands for the region of the proxy, not for a region of the topology.
+		if failover.To != FailoverSelfRegion && !knownRegion(known, failover.To) {
+			warnings = append(warnings, fmt.Sprintf("failover To region %q of the failover from %q has no known locality",
+				failover.To, failover.From))
+		}
+	}
+	return setting, warnings
+}
+
+// knownLocalityMatch checks whether one of the known localities matches a locality of a rule.
+func knownLocalityMatch(known []string, ruleLocality string) bool {
+	for _, locality := range known {
+		if util.LocalityMatch(util.ConvertLocality(locality), ruleLocality) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownRegion checks whether one of the known localities is in the region, or in a region the failover
+// From wildcard matches.
+func knownRegion(known []string, region string) bool {
+	for _, locality := range known {
+		if failoverFromMatch(region, util.ConvertLocality(locality).GetRegion()) {
+			return true
+		}
+	}
+	return false
+}
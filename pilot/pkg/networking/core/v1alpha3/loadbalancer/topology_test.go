@@ -0,0 +1,124 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestGetLocalityLbSettingValidated(t *testing.T) {
+	known := map[string]bool{
+		"region1/zone1/subzone1": true,
+		"region1/zone2":          true,
+		"region2/zone1":          true,
+		// a locality known to be gone.
+		"region4/zone1": false,
+	}
+
+	cases := []struct {
+		name     string
+		setting  *networking.LocalityLoadBalancerSetting
+		warnings []string
+	}{
+		{
+			name: "present localities",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region1/zone1/*",
+						To: map[string]uint32{
+							"region1/zone1/subzone1": 50,
+							"region1/*":              30,
+							"region2/zone1":          10,
+							BalancedDistribute:       10,
+						},
+					},
+				},
+			},
+		},
+		{
+			name: "absent distribute localities",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "region3/*",
+						To: map[string]uint32{
+							"region1/zone3/*": 50,
+							"region1/*":       30,
+							"region4/*":       20,
+						},
+					},
+				},
+			},
+			warnings: []string{
+				`distribute From "region3/*" matches no known locality`,
+				`distribute To "region1/zone3/*" of the rule from "region3/*" matches no known locality`,
+				`distribute To "region4/*" of the rule from "region3/*" matches no known locality`,
+			},
+		},
+		{
+			name: "failover regions",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+						To:   "region2",
+					},
+					{
+						From: "region2",
+						To:   "region3",
+					},
+					{
+						From: "region4",
+						To:   "region1",
+					},
+				},
+			},
+			warnings: []string{
+				`failover To region "region3" of the failover from "region2" has no known locality`,
+				`failover From region "region4" has no known locality`,
+			},
+		},
+		{
+			name: "failover to the proxy region",
+			setting: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "*",
+						To:   FailoverSelfRegion,
+					},
+				},
+			},
+		},
+	}
+	for _, tt := range cases {
+		t.Run(tt.name, func(t *testing.T) {
+			setting, warnings := GetLocalityLbSettingValidated(tt.setting, nil, known)
+			if setting != tt.setting {
+				t.Errorf("Got setting %v expected %v", setting, tt.setting)
+			}
+			if !reflect.DeepEqual(warnings, tt.warnings) {
+				t.Errorf("Got warnings %q expected %q", warnings, tt.warnings)
+			}
+		})
+	}
+
+	if setting, warnings := GetLocalityLbSettingValidated(nil, nil, known); setting != nil || warnings != nil {
+		t.Errorf("Got %v %v expected nothing with locality lb disabled", setting, warnings)
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"context"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"go.opencensus.io/trace"
+)
+
+const (
+	// applySpanName is the name of the tracing span around a transform of a load assignment.
+	applySpanName = "locality-lb/apply"
+	// computeFailoverSpanName is the name of the tracing span around the failover of a load assignment computed
+	// for a batch of proxy localities.
+	computeFailoverSpanName = "locality-lb/compute-failover"
+)
+
+// startApplySpan starts the tracing span of a transform of the load assignment, as a child of the span in
+// opts.TraceContext. Without a TraceContext no span is started, the transform of every cluster on every
+// push would otherwise allocate one, and it returns nil. Like all opencensus spans, the span is only
+// recorded when sampled and only exported to the registered exporters.
+func startApplySpan(loadAssignment *apiv2.ClusterLoadAssignment, opts *Options) *trace.Span {
+	if opts.TraceContext == nil {
+		return nil
+	}
+	_, span := trace.StartSpan(opts.TraceContext, applySpanName)
+	// counting the endpoints is only worth it for a recorded span.
+	if span.IsRecordingEvents() {
+		endpoints := 0
+		for _, ep := range loadAssignment.Endpoints {
+			endpoints += len(ep.LbEndpoints)
+		}
+		span.AddAttributes(
+			trace.StringAttribute("cluster", loadAssignment.ClusterName),
+			trace.Int64Attribute("localities", int64(len(loadAssignment.Endpoints))),
+			trace.Int64Attribute("endpoints", int64(endpoints)),
+		)
+	}
+	return span
+}
+
+// endApplySpan records the mode of the transform and ends its tracing span, if any.
+func endApplySpan(span *trace.Span, result *Result) {
+	if span == nil {
+		return
+	}
+	span.AddAttributes(trace.StringAttribute("mode", result.Mode.String()))
+	span.End()
+}
+
+// startComputeFailoverSpan starts the tracing span of the failover computed for the proxy localities, as a
+// child of the span in traceContext. As for startApplySpan, it returns nil without a traceContext.
+func startComputeFailoverSpan(traceContext context.Context, baseCLA *apiv2.ClusterLoadAssignment, localities int) *trace.Span {
+	if traceContext == nil {
+		return nil
+	}
+	_, span := trace.StartSpan(traceContext, computeFailoverSpanName)
+	span.AddAttributes(
+		trace.StringAttribute("cluster", baseCLA.ClusterName),
+		trace.Int64Attribute("localities", int64(len(baseCLA.Endpoints))),
+		trace.Int64Attribute("proxy_localities", int64(localities)),
+	)
+	return span
+}
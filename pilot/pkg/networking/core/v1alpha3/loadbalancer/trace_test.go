@@ -0,0 +1,146 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"go.opencensus.io/trace"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+// spanRecorder is a trace exporter recording the exported spans.
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*trace.SpanData
+}
+
+func (r *spanRecorder) ExportSpan(s *trace.SpanData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.spans = append(r.spans, s)
+}
+
+func TestApplyLocalityLBSettingTraceSpan(t *testing.T) {
+	recorder := &spanRecorder{}
+	trace.RegisterExporter(recorder)
+	defer trace.UnregisterExporter(recorder)
+
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 2},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+	)
+
+	// without a trace context, no span is started.
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, nil)
+	if len(recorder.spans) != 0 {
+		t.Fatalf("Got %d spans expected none", len(recorder.spans))
+	}
+	if span := startApplySpan(cla, &Options{}); span != nil {
+		t.Errorf("Got span %v expected none", span)
+	}
+
+	// an unsampled span, as when tracing is not set up, records nothing.
+	ctx, _ := trace.StartSpan(context.Background(), "push", trace.WithSampler(trace.NeverSample()))
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{TraceContext: ctx})
+	if len(recorder.spans) != 0 {
+		t.Fatalf("Got %d spans expected none", len(recorder.spans))
+	}
+
+	ctx, parent := trace.StartSpan(context.Background(), "push", trace.WithSampler(trace.AlwaysSample()))
+	ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{TraceContext: ctx})
+	if len(recorder.spans) != 1 {
+		t.Fatalf("Got %d spans expected 1", len(recorder.spans))
+	}
+	span := recorder.spans[0]
+	if span.Name != applySpanName {
+		t.Errorf("Got span %q expected %q", span.Name, applySpanName)
+	}
+	expected := map[string]interface{}{
+		"cluster":    "outbound|8080||test.example.org",
+		"localities": int64(2),
+		"endpoints":  int64(3),
+		"mode":       "failover",
+	}
+	if !reflect.DeepEqual(span.Attributes, expected) {
+		t.Errorf("Got attributes %v expected %v", span.Attributes, expected)
+	}
+	parent.End()
+}
+
+func TestComputeFailoverForLocalitiesTraceSpan(t *testing.T) {
+	recorder := &spanRecorder{}
+	trace.RegisterExporter(recorder)
+	defer trace.UnregisterExporter(recorder)
+
+	localities := []*envoycore.Locality{
+		{Region: "region1", Zone: "zone1"},
+		{Region: "region2", Zone: "zone1"},
+	}
+	failover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{
+			From: "region1",
+			To:   "region2",
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 2},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+	)
+
+	ComputeFailoverForLocalities(nil, localities, cla, failover)
+	if len(recorder.spans) != 0 {
+		t.Fatalf("Got %d spans expected none", len(recorder.spans))
+	}
+
+	ctx, parent := trace.StartSpan(context.Background(), "push", trace.WithSampler(trace.AlwaysSample()))
+	ComputeFailoverForLocalities(ctx, localities, cla, failover)
+	if len(recorder.spans) != 1 {
+		t.Fatalf("Got %d spans expected 1", len(recorder.spans))
+	}
+	span := recorder.spans[0]
+	if span.Name != computeFailoverSpanName {
+		t.Errorf("Got span %q expected %q", span.Name, computeFailoverSpanName)
+	}
+	if span.ParentSpanID != parent.SpanContext().SpanID {
+		t.Errorf("Got parent %v expected %v", span.ParentSpanID, parent.SpanContext().SpanID)
+	}
+	expected := map[string]interface{}{
+		"cluster":          "outbound|8080||test.example.org",
+		"localities":       int64(2),
+		"proxy_localities": int64(2),
+	}
+	if !reflect.DeepEqual(span.Attributes, expected) {
+		t.Errorf("Got attributes %v expected %v", span.Attributes, expected)
+	}
+	parent.End()
+}
@@ -0,0 +1,150 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"math"
+	"math/rand"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// defaultOverprovisioningFactor is the overprovisioning factor of Envoy when the policy does not set it, in percent.
+const defaultOverprovisioningFactor = 140
+
+// simulationSeed seeds the random selections of SimulateTraffic, so that simulations are reproducible.
+const simulationSeed = 1
+
+// CrossLocalityTrafficFraction computes, from the final weights of a transformed ClusterLoadAssignment,
+// the fraction of the traffic of the proxy that leaves its zone and its region. Only the groups of endpoints
+// at priority 0 that still have endpoints receive traffic, a group without LoadBalancingWeight weighs 1.
+// Traffic leaving the region also leaves the zone, so crossRegion is never greater than crossZone.
+func CrossLocalityTrafficFraction(proxy *core.Locality, cla *apiv2.ClusterLoadAssignment) (crossZone, crossRegion float64) {
+	var total, zoneWeight, regionWeight uint64
+	for _, ep := range cla.GetEndpoints() {
+		if ep.Priority != 0 || len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		weight := uint64(1)
+		if ep.LoadBalancingWeight != nil {
+			weight = uint64(ep.LoadBalancingWeight.Value)
+		}
+		total += weight
+		if ep.Locality.GetRegion() != proxy.GetRegion() {
+			regionWeight += weight
+			zoneWeight += weight
+		} else if ep.Locality.GetZone() != proxy.GetZone() {
+			zoneWeight += weight
+		}
+	}
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(zoneWeight) / float64(total), float64(regionWeight) / float64(total)
+}
+
+// SimulateTraffic simulates samples requests balanced by Envoy over a transformed ClusterLoadAssignment and
+// returns the number of requests each locality receives. As in Envoy, a priority only receives the share of
+// the traffic its health allows, the healthy fraction of its endpoints multiplied by the overprovisioning
+// factor, the rest spilling over to the next priorities, so that the traffic stays in priority 0 unless it is
+// degraded. Within a priority, a locality is picked in proportion to its weight multiplied by its own health.
+// The simulation is deterministic, it is meant for asserting the outcome of the transform statistically.
+func SimulateTraffic(cla *apiv2.ClusterLoadAssignment, samples int) map[string]int {
+	type localityTraffic struct {
+		locality string
+		weight   float64
+	}
+	type priorityTraffic struct {
+		healthy, total int
+		localities     []localityTraffic
+		totalWeight    float64
+	}
+	overprovisioning := float64(defaultOverprovisioningFactor)
+	if factor := cla.GetPolicy().GetOverprovisioningFactor(); factor != nil {
+		overprovisioning = float64(factor.Value)
+	}
+	health := func(healthy, total int) float64 {
+		if total == 0 {
+			return 0
+		}
+		return math.Min(1, overprovisioning/100*float64(healthy)/float64(total))
+	}
+
+	var priorities []*priorityTraffic
+	for _, ep := range cla.GetEndpoints() {
+		if len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		for len(priorities) <= int(ep.Priority) {
+			priorities = append(priorities, &priorityTraffic{})
+		}
+		priority := priorities[ep.Priority]
+		healthy := 0
+		for _, lbEp := range ep.LbEndpoints {
+			if lbEp.HealthStatus != core.HealthStatus_UNHEALTHY {
+				healthy++
+			}
+		}
+		priority.healthy += healthy
+		priority.total += len(ep.LbEndpoints)
+		weight := float64(1)
+		if ep.LoadBalancingWeight != nil {
+			weight = float64(ep.LoadBalancingWeight.Value)
+		}
+		weight *= health(healthy, len(ep.LbEndpoints))
+		priority.localities = append(priority.localities, localityTraffic{locality: util.LocalityToString(ep.Locality), weight: weight})
+		priority.totalWeight += weight
+	}
+
+	// the load of every priority, normalized if the priorities together are not healthy enough.
+	loads := make([]float64, len(priorities))
+	remaining, totalHealth := float64(1), float64(0)
+	for p, priority := range priorities {
+		h := health(priority.healthy, priority.total)
+		loads[p] = math.Min(remaining, h)
+		remaining -= loads[p]
+		totalHealth += h
+	}
+	if totalHealth > 0 && totalHealth < 1 {
+		for p := range loads {
+			loads[p] /= totalHealth
+		}
+	}
+
+	hits := map[string]int{}
+	random := rand.New(rand.NewSource(simulationSeed))
+	for i := 0; i < samples; i++ {
+		pick := random.Float64()
+		p := 0
+		for ; p < len(priorities)-1 && pick >= loads[p]; p++ {
+			pick -= loads[p]
+		}
+		if len(priorities) == 0 || priorities[p].totalWeight == 0 {
+			continue
+		}
+		pick = random.Float64() * priorities[p].totalWeight
+		for _, locality := range priorities[p].localities {
+			if pick < locality.weight {
+				hits[locality.locality]++
+				break
+			}
+			pick -= locality.weight
+		}
+	}
+	return hits
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"math"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestCrossLocalityTrafficFraction(t *testing.T) {
+	proxy := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/subzone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 60,
+					"region1/zone2/*": 30,
+					"region2/*":       10,
+				},
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+		localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+		localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+		localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1/subzone1", endpoints: 1},
+	)
+	ApplyLocalityLBSetting(proxy, cla, setting, true)
+
+	crossZone, crossRegion := CrossLocalityTrafficFraction(proxy, cla)
+	if crossZone != 0.4 || crossRegion != 0.1 {
+		t.Errorf("Got cross zone %v, cross region %v, expected 0.4, 0.1", crossZone, crossRegion)
+	}
+
+	t.Run("failover tiers receive no traffic", func(t *testing.T) {
+		cla := buildCLA(
+			localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+			localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+			localitySpec{locality: "region2/zone1/subzone1", priority: 1, endpoints: 1},
+		)
+		crossZone, crossRegion := CrossLocalityTrafficFraction(proxy, cla)
+		if crossZone != 0.5 || crossRegion != 0 {
+			t.Errorf("Got cross zone %v, cross region %v, expected 0.5, 0", crossZone, crossRegion)
+		}
+	})
+
+	t.Run("empty assignment", func(t *testing.T) {
+		crossZone, crossRegion := CrossLocalityTrafficFraction(proxy, buildCLA())
+		if crossZone != 0 || crossRegion != 0 {
+			t.Errorf("Got cross zone %v, cross region %v, expected 0, 0", crossZone, crossRegion)
+		}
+	})
+}
+
+func TestSimulateTraffic(t *testing.T) {
+	proxy := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	const samples = 10000
+	// the fraction of the samples a locality may deviate from its expected share.
+	const tolerance = 0.02
+	assertHits := func(t *testing.T, hits map[string]int, expected map[string]float64) {
+		t.Helper()
+		for locality, fraction := range expected {
+			if got := float64(hits[locality]) / samples; math.Abs(got-fraction) > tolerance {
+				t.Errorf("locality %s: got %v of the traffic expected %v (all: %v)", locality, got, fraction, hits)
+			}
+		}
+		for locality, count := range hits {
+			if _, ok := expected[locality]; !ok {
+				t.Errorf("locality %s: got %d unexpected hits", locality, count)
+			}
+		}
+	}
+
+	t.Run("distribute", func(t *testing.T) {
+		setting := &networking.LocalityLoadBalancerSetting{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/zone1/*": 70,
+						"region2/zone1/*": 30,
+					},
+				},
+			},
+		}
+		cla := buildCLA(
+			localitySpec{locality: "region1/zone1", endpoints: 2},
+			localitySpec{locality: "region2/zone1", endpoints: 2},
+			localitySpec{locality: "region3/zone1", endpoints: 2},
+		)
+		ApplyLocalityLBSetting(proxy, cla, setting, true)
+		assertHits(t, SimulateTraffic(cla, samples), map[string]float64{
+			"region1/zone1": 0.7,
+			"region2/zone1": 0.3,
+		})
+	})
+
+	failover := &networking.LocalityLoadBalancerSetting{
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region2",
+			},
+		},
+	}
+	t.Run("failover", func(t *testing.T) {
+		cla := buildCLA(
+			localitySpec{locality: "region1/zone1", endpoints: 10},
+			localitySpec{locality: "region2/zone1", endpoints: 10},
+		)
+		ApplyLocalityLBSetting(proxy, cla, failover, true)
+		assertHits(t, SimulateTraffic(cla, samples), map[string]float64{"region1/zone1": 1})
+	})
+
+	t.Run("degraded failover", func(t *testing.T) {
+		cla := buildCLA(
+			localitySpec{locality: "region1/zone1", endpoints: 10},
+			localitySpec{locality: "region2/zone1", endpoints: 10},
+		)
+		ApplyLocalityLBSetting(proxy, cla, failover, true)
+		// 50% healthy, 70% of the traffic stays in priority 0.
+		for i := 0; i < 5; i++ {
+			cla.Endpoints[0].LbEndpoints[i].HealthStatus = envoycore.HealthStatus_UNHEALTHY
+		}
+		assertHits(t, SimulateTraffic(cla, samples), map[string]float64{
+			"region1/zone1": 0.7,
+			"region2/zone1": 0.3,
+		})
+	})
+
+	t.Run("empty assignment", func(t *testing.T) {
+		if hits := SimulateTraffic(buildCLA(), samples); len(hits) != 0 {
+			t.Errorf("Got hits %v expected none", hits)
+		}
+	})
+}
@@ -0,0 +1,139 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+)
+
+// Transformer applies a locality lb setting to the load assignments of a proxy, e.g. the stream of load
+// assignments of a push. What only depends on the proxy locality and the setting, the distribute rules
+// matching the proxy locality composed and the failover targets of the proxy locality, is computed once
+// when the Transformer is built rather than for every load assignment. A Transformer holds no state across
+// load assignments and is safe for concurrent use.
+type Transformer struct {
+	locality       *core.Locality
+	setting        *v1alpha3.LocalityLoadBalancerSetting
+	enableFailover bool
+	// setting restricted to the distribute rules matching the proxy locality, if any matches
+	matched *v1alpha3.LocalityLoadBalancerSetting
+	// options carrying the precomputed transform
+	opts *Options
+}
+
+// NewLocalityLBTransformer returns a Transformer applying the setting to the load assignments of a proxy
+// in the given locality, as ApplyLocalityLBSetting does.
+func NewLocalityLBTransformer(
+	proxy *core.Locality,
+	setting *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) *Transformer {
+	t := &Transformer{
+		locality:       proxy,
+		setting:        setting,
+		enableFailover: enableFailover,
+	}
+	t.matched = setting
+	// without a matching rule the setting is applied as is, so that the unmatched distribute rules are
+	// reported as ApplyLocalityLBSetting does.
+	if rules := matchingDistributes(proxy, setting.GetDistribute()); len(rules) > 0 {
+		matched := *setting
+		matched.Distribute = rules
+		t.matched = &matched
+	}
+	t.opts = &Options{}
+	t.opts.precomputed = precomputeTransform(proxy, t.matched, t.opts)
+	return t
+}
+
+// Apply transforms the load assignment, with the same outcome as ApplyLocalityLBSetting for the locality,
+// setting and enableFailover of the Transformer. The Result reports the setting of the Transformer.
+func (t *Transformer) Apply(loadAssignment *apiv2.ClusterLoadAssignment) *Result {
+	result := ApplyLocalityLBSettingWithOptions(t.locality, loadAssignment, t.matched, t.enableFailover, t.opts)
+	result.Setting = t.setting
+	return result
+}
+
+// precomputedTransform holds what the transform derives from the proxy locality and the setting only. It
+// is only used for that locality and the distribute and failover settings it is computed from, which a
+// transform may replace, e.g. for an unknown proxy locality, and is never modified.
+type precomputedTransform struct {
+	locality   *core.Locality
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute
+	failover   []*v1alpha3.LocalityLoadBalancerSetting_Failover
+	// the distribute rules composed, nil if none matches; unset if a matching rule has a BalancedDistribute
+	// entry, expanded against the localities of each load assignment
+	composed    *composedDistribute
+	hasComposed bool
+	targets     *failoverTargets
+}
+
+func precomputeTransform(
+	locality *core.Locality,
+	setting *v1alpha3.LocalityLoadBalancerSetting,
+	opts *Options,
+) *precomputedTransform {
+	p := &precomputedTransform{
+		locality:   locality,
+		distribute: setting.GetDistribute(),
+		failover:   setting.GetFailover(),
+		targets:    opts.failoverTargets(locality, setting.GetFailover()),
+	}
+	p.hasComposed = true
+	for _, rule := range matchingDistributes(locality, p.distribute) {
+		if _, ok := rule.To[BalancedDistribute]; ok {
+			p.hasComposed = false
+		}
+	}
+	if p.hasComposed {
+		p.composed = composeDistribute(locality, nil, p.distribute, opts)
+	}
+	return p
+}
+
+// composedFor returns the precomputed composed distribute of the proxy locality and distribute rules, if any.
+func (p *precomputedTransform) composedFor(
+	locality *core.Locality,
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute,
+) (*composedDistribute, bool) {
+	if p == nil || !p.hasComposed || locality != p.locality || !sameDistribute(distribute, p.distribute) {
+		return nil, false
+	}
+	return p.composed, true
+}
+
+// failoverTargetsFor returns the precomputed failover targets of the proxy locality and failover settings, if any.
+func (p *precomputedTransform) failoverTargetsFor(
+	locality *core.Locality,
+	failover []*v1alpha3.LocalityLoadBalancerSetting_Failover,
+) (*failoverTargets, bool) {
+	if p == nil || locality != p.locality || !sameFailover(failover, p.failover) {
+		return nil, false
+	}
+	return p.targets, true
+}
+
+// sameDistribute checks whether the slices are the same slice, rather than slices of equal rules.
+func sameDistribute(a, b []*v1alpha3.LocalityLoadBalancerSetting_Distribute) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+// sameFailover checks whether the slices are the same slice, rather than slices of equal settings.
+func sameFailover(a, b []*v1alpha3.LocalityLoadBalancerSetting_Failover) bool {
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
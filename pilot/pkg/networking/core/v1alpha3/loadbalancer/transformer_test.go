@@ -0,0 +1,244 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestLocalityLBTransformer(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	settings := []*networking.LocalityLoadBalancerSetting{
+		{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region2/*",
+					To:   map[string]uint32{"region2/*": 100},
+				},
+				{
+					From: "region1/*",
+					To:   map[string]uint32{"region1/*": 70, "region2/*": 30},
+				},
+				{
+					From: "region1/zone1/*",
+					To:   map[string]uint32{"region1/zone1/*": 60, "region3/*": 40},
+				},
+			},
+		},
+		{
+			// no distribute rule matches, which still disables failover.
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region2/*",
+					To:   map[string]uint32{"region2/*": 100},
+				},
+			},
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "region1", To: "region3"}},
+		},
+		{
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "region1", To: "region3"}},
+		},
+		{
+			// the balanced share is expanded against the localities of each load assignment.
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/*",
+					To:   map[string]uint32{"region1/zone1/*": 40, BalancedDistribute: 60},
+				},
+			},
+		},
+		nil,
+	}
+	for i, setting := range settings {
+		transformer := NewLocalityLBTransformer(locality, setting, true)
+		// the transformer is applied to a stream of load assignments.
+		for j := 0; j < 2; j++ {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", weight: 2, endpoints: 2},
+				localitySpec{locality: "region1/zone2", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			expected := util.CloneClusterLoadAssignment(cla)
+			expectedResult := ApplyLocalityLBSettingWithOptions(locality, &expected, setting, true, nil)
+			result := transformer.Apply(cla)
+			for _, diff := range CompareSnapshots(SnapshotLoadAssignment(&expected), SnapshotLoadAssignment(cla)) {
+				t.Errorf("setting %d: transformed load assignment differs from ApplyLocalityLBSetting: %v", i, diff)
+			}
+			if result.Mode != expectedResult.Mode || result.Setting != setting {
+				t.Errorf("setting %d: got mode %v and setting %v expected %v and %v",
+					i, result.Mode, result.Setting, expectedResult.Mode, setting)
+			}
+		}
+	}
+}
+
+func TestLocalityLBTransformerUnmatched(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	settings := []*networking.LocalityLoadBalancerSetting{
+		{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region2/*",
+					To:   map[string]uint32{"region2/*": 100},
+				},
+			},
+		},
+		{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region2/*",
+					To:   map[string]uint32{"region2/*": 100},
+				},
+			},
+			Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "region1", To: "region3"}},
+		},
+	}
+	for i, setting := range settings {
+		for _, enableFailover := range []bool{false, true} {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+				localitySpec{locality: "region3/zone1", endpoints: 1},
+			)
+			expected := util.CloneClusterLoadAssignment(cla)
+			expectedResult := ApplyLocalityLBSettingWithOptions(locality, &expected, setting, enableFailover, nil)
+			result := NewLocalityLBTransformer(locality, setting, enableFailover).Apply(cla)
+			if !reflect.DeepEqual(result, expectedResult) {
+				t.Errorf("setting %d, failover %v: got result %+v expected %+v", i, enableFailover, result, expectedResult)
+			}
+			for _, diff := range CompareSnapshots(SnapshotLoadAssignment(&expected), SnapshotLoadAssignment(cla)) {
+				t.Errorf("setting %d, failover %v: transformed load assignment differs from ApplyLocalityLBSetting: %v",
+					i, enableFailover, diff)
+			}
+		}
+	}
+}
+
+func TestLocalityLBTransformerPrecomputed(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/*",
+				To:   map[string]uint32{"region1/*": 70, "region2/*": 30},
+			},
+		},
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{{From: "region1", To: "region3"}},
+	}
+	transformer := NewLocalityLBTransformer(locality, setting, true)
+	precomputed := transformer.opts.precomputed
+	if precomputed.composed == nil || precomputed.targets == nil {
+		t.Fatalf("expected the composed distribute and the failover targets to be precomputed")
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+	)
+	if composed := composeDistribute(locality, cla, transformer.matched.GetDistribute(), transformer.opts); composed != precomputed.composed {
+		t.Errorf("expected the precomputed composed distribute to be used")
+	}
+	if targets := transformer.opts.failoverTargets(locality, setting.GetFailover()); targets != precomputed.targets {
+		t.Errorf("expected the precomputed failover targets to be used")
+	}
+	// another proxy locality or other rules are composed as usual.
+	other := &envoycore.Locality{Region: "region1", Zone: "zone2"}
+	if composed := composeDistribute(other, cla, transformer.matched.GetDistribute(), transformer.opts); composed == precomputed.composed {
+		t.Errorf("expected the distribute of another proxy locality to be composed")
+	}
+	distribute := append([]*networking.LocalityLoadBalancerSetting_Distribute{}, setting.Distribute...)
+	if composed := composeDistribute(locality, cla, distribute, transformer.opts); composed == precomputed.composed {
+		t.Errorf("expected other distribute rules to be composed")
+	}
+}
+
+func TestLocalityLBTransformerConcurrent(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/*",
+				To:   map[string]uint32{"region1/*": 70, "region2/*": 30},
+			},
+		},
+	}
+	transformer := NewLocalityLBTransformer(locality, setting, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			transformer.Apply(buildCLA(
+				localitySpec{locality: "region1/zone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1", endpoints: 1},
+			))
+		}()
+	}
+	wg.Wait()
+}
+
+// benchmarkTransformerSetting returns a setting with many distribute rules, few of them matching the
+// proxy locality of benchmarkSettings.
+func benchmarkTransformerSetting() *networking.LocalityLoadBalancerSetting {
+	_, distribute := benchmarkSettings()
+	for i := 1; i < 100; i++ {
+		distribute = append(distribute, &networking.LocalityLoadBalancerSetting_Distribute{
+			From: fmt.Sprintf("region%d/zone%d/*", i%4, i),
+			To:   map[string]uint32{"region0/*": 100},
+		})
+	}
+	return &networking.LocalityLoadBalancerSetting{Distribute: distribute}
+}
+
+func BenchmarkLocalityLBTransformer(b *testing.B) {
+	locality, _ := benchmarkSettings()
+	transformer := NewLocalityLBTransformer(locality, benchmarkTransformerSetting(), true)
+	cla := benchmarkCLA(16)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		transformer.Apply(cla)
+	}
+}
+
+func BenchmarkLocalityLBTransformerRepeatedCalls(b *testing.B) {
+	locality, _ := benchmarkSettings()
+	setting := benchmarkTransformerSetting()
+	cla := benchmarkCLA(16)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ApplyLocalityLBSetting(locality, cla, setting, true)
+	}
+}
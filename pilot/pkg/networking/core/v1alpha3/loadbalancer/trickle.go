@@ -0,0 +1,102 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// applyFailoverTrickle sends percent of the traffic of every priority, from first on, to the groups of
+// endpoints of the next priority, so that their connection pools and caches are warm when Envoy fails over
+// to them. Envoy sends all the traffic to a healthy priority whatever the weights, so the groups of the next
+// priority are copied into the priority, weighted percent of its total weight, the weights of its own groups
+// being scaled down so that the total is preserved. A group whose locality the priority already holds is not
+// copied, and only the groups of the original priorities are, the trickle does not cascade. The unweighted
+// groups of the priorities involved are weighted as localityLbWeight does, a priority being either fully
+// weighted or not at all.
+func applyFailoverTrickle(loadAssignment *apiv2.ClusterLoadAssignment, first, percent uint32, opts *Options) {
+	if percent == 0 || percent >= 100 {
+		return
+	}
+	priorities := map[uint32][]*endpoint.LocalityLbEndpoints{}
+	last := first
+	for _, ep := range loadAssignment.Endpoints {
+		if ep.Priority < first || len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		priorities[ep.Priority] = append(priorities[ep.Priority], ep)
+		if ep.Priority > last {
+			last = ep.Priority
+		}
+	}
+	for priority := first; priority < last; priority++ {
+		own, next := priorities[priority], priorities[priority+1]
+		if len(own) == 0 || len(next) == 0 {
+			continue
+		}
+		localities := make(map[string]bool, len(own))
+		weights := make([]uint32, 0, len(own))
+		total := uint32(0)
+		for _, ep := range own {
+			localities[util.LocalityToString(ep.Locality)] = true
+			weight := localityLbWeight(ep, opts)
+			weights = append(weights, weight)
+			total += weight
+		}
+		copies := make([]*endpoint.LocalityLbEndpoints, 0, len(next))
+		copiedWeights := make([]uint32, 0, len(next))
+		for _, ep := range next {
+			weight := localityLbWeight(ep, opts)
+			if ep.LoadBalancingWeight == nil {
+				ep.LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+			}
+			if localities[util.LocalityToString(ep.Locality)] {
+				continue
+			}
+			copied := *ep
+			copied.Priority = priority
+			copies = append(copies, &copied)
+			copiedWeights = append(copiedWeights, weight)
+		}
+		if len(copies) == 0 {
+			continue
+		}
+		trickle := roundWeight(float64(total) * float64(percent) / 100)
+		if trickle == 0 {
+			trickle = 1
+		}
+		if trickle >= total {
+			// the priority is too lightly weighted to keep its share, it is weighted 100 instead.
+			weights, total = apportion(weights, 100), 100
+			trickle = percent
+		}
+		for i, weight := range apportion(weights, total-trickle) {
+			own[i].LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+		}
+		for i, weight := range apportion(copiedWeights, trickle) {
+			copies[i].LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+			if opts.annotating() {
+				opts.recordPriorityRationale(copies[i], fmt.Sprintf("trickle of %d%% from priority %d", percent, priority+1))
+			}
+		}
+		loadAssignment.Endpoints = append(loadAssignment.Endpoints, copies...)
+	}
+}
@@ -0,0 +1,129 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	networking "istio.io/api/networking/v1alpha3"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestApplyLocalityFailoverTrickle(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	failover := []*networking.LocalityLoadBalancerSetting_Failover{
+		{From: "region1", To: "region2"},
+	}
+
+	tests := []struct {
+		name       string
+		distribute []*networking.LocalityLoadBalancerSetting_Distribute
+		percent    uint32
+		weights    []uint32
+		localities []string
+		priorities []uint32
+		expected   []uint32
+	}{
+		{
+			name:       "off",
+			localities: []string{"region1/zone1/subzone1", "region1/zone2/subzone1", "region2/zone1/subzone1"},
+			priorities: []uint32{0, 1, 2},
+			expected:   []uint32{0, 0, 0},
+		},
+		{
+			// the unweighted priorities are weighted 100.
+			name:       "unweighted",
+			percent:    10,
+			localities: []string{"region1/zone1/subzone1", "region1/zone2/subzone1", "region2/zone1/subzone1", "region1/zone2/subzone1", "region2/zone1/subzone1"},
+			priorities: []uint32{0, 1, 2, 0, 1},
+			expected:   []uint32{90, 90, 1, 10, 10},
+		},
+		{
+			name:       "weighted",
+			percent:    5,
+			weights:    []uint32{30, 10, 20},
+			localities: []string{"region1/zone1/subzone1", "region1/zone2/subzone1", "region2/zone1/subzone1", "region1/zone2/subzone1", "region2/zone1/subzone1"},
+			priorities: []uint32{0, 1, 2, 0, 1},
+			expected:   []uint32{28, 9, 20, 2, 1},
+		},
+		{
+			// the copies split the trickle as distributed, the localities distribute drops get none.
+			name: "distribute",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/zone1/*": 40,
+						"region1/zone2/*": 60,
+					},
+				},
+			},
+			percent:    10,
+			localities: []string{"region1/zone1/subzone1", "region1/zone2/subzone1", "region1/zone2/subzone2", "region2/zone1/subzone1", "region1/zone2/subzone1", "region1/zone2/subzone2"},
+			priorities: []uint32{0, 1, 1, 1, 0, 0},
+			expected:   []uint32{90, 50, 50, 0, 5, 5},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := buildCLA(
+				localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+				localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+				localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+			)
+			if tt.distribute != nil {
+				cla = buildCLA(
+					localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+					localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+					localitySpec{locality: "region1/zone2/subzone2", endpoints: 1},
+					localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+				)
+			}
+			for i, weight := range tt.weights {
+				cla.Endpoints[i].LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+			}
+			setting := &networking.LocalityLoadBalancerSetting{Distribute: tt.distribute, Failover: failover}
+			ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{FailoverTricklePercent: tt.percent})
+			localities := make([]string, 0)
+			priorities := make([]uint32, 0)
+			weights := make([]uint32, 0)
+			for _, localityEndpoint := range cla.Endpoints {
+				localities = append(localities, util.LocalityToString(localityEndpoint.Locality))
+				priorities = append(priorities, localityEndpoint.Priority)
+				weights = append(weights, localityEndpoint.GetLoadBalancingWeight().GetValue())
+			}
+			if !reflect.DeepEqual(localities, tt.localities) {
+				t.Errorf("Got localities %v expected %v", localities, tt.localities)
+			}
+			if !reflect.DeepEqual(priorities, tt.priorities) {
+				t.Errorf("Got priorities %v expected %v", priorities, tt.priorities)
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+			if err := ValidateTransformedCLA(cla); err != nil {
+				t.Errorf("Got invalid load assignment: %v", err)
+			}
+		})
+	}
+}
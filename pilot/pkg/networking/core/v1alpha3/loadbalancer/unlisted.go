@@ -0,0 +1,43 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+// UnlistedLocalityMode selects what distribute does with the groups of endpoints whose locality matches
+// none of the To localities of the applied rule.
+type UnlistedLocalityMode int
+
+const (
+	// UnlistedLocalityDrop drops their endpoints, the default.
+	UnlistedLocalityDrop UnlistedLocalityMode = iota
+	// UnlistedLocalityKeep keeps them with UnlistedLocalityWeight, 1 by default.
+	UnlistedLocalityKeep
+	// UnlistedLocalityResidual keeps them with the percentage the To localities leave over, 100 minus
+	// their sum, split in proportion to their weights. Like any share, a group gets a weight of at least 1,
+	// even when nothing is left over, e.g. when the percentages are normalized by NormalizeDistribute.
+	UnlistedLocalityResidual
+)
+
+func (m UnlistedLocalityMode) String() string {
+	switch m {
+	case UnlistedLocalityDrop:
+		return "drop"
+	case UnlistedLocalityKeep:
+		return "keep"
+	case UnlistedLocalityResidual:
+		return "residual"
+	default:
+		return "unknown"
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// ValidateTransformedCLA checks that a transformed ClusterLoadAssignment is well formed before it is pushed
+// to Envoy: its priorities range from 0 to N without skipping, each of them has endpoints, the weights of
+// its groups of endpoints are at least 1, and within a priority either all or none of the groups of
+// endpoints with endpoints are weighted. The groups of endpoints without endpoints, e.g. the ones dropped
+// by the distribute settings, receive no traffic and their weights are not checked.
+func ValidateTransformedCLA(loadAssignment *apiv2.ClusterLoadAssignment) error {
+	if loadAssignment == nil {
+		return fmt.Errorf("nil load assignment")
+	}
+	type priorityState struct {
+		endpoints  int
+		weighted   int
+		unweighted []string
+	}
+	priorities := map[uint32]*priorityState{}
+	max := uint32(0)
+	for i, ep := range loadAssignment.Endpoints {
+		if ep == nil {
+			return fmt.Errorf("nil group of endpoints at index %d", i)
+		}
+		state := priorities[ep.Priority]
+		if state == nil {
+			state = &priorityState{}
+			priorities[ep.Priority] = state
+		}
+		if ep.Priority > max {
+			max = ep.Priority
+		}
+		if len(ep.LbEndpoints) == 0 {
+			continue
+		}
+		state.endpoints += len(ep.LbEndpoints)
+		if ep.LoadBalancingWeight == nil {
+			state.unweighted = append(state.unweighted, util.LocalityToString(ep.Locality))
+			continue
+		}
+		if ep.LoadBalancingWeight.GetValue() == 0 {
+			return fmt.Errorf("locality %s at priority %d has a weight of 0",
+				util.LocalityToString(ep.Locality), ep.Priority)
+		}
+		state.weighted++
+	}
+	for priority := uint32(0); len(priorities) > 0 && priority <= max; priority++ {
+		state, ok := priorities[priority]
+		if !ok {
+			return fmt.Errorf("priority %d is skipped, the priorities range up to %d", priority, max)
+		}
+		if state.endpoints == 0 {
+			return fmt.Errorf("priority %d has no endpoints", priority)
+		}
+		if state.weighted > 0 && len(state.unweighted) > 0 {
+			return fmt.Errorf("priority %d has both weighted and unweighted localities, unweighted: %v",
+				priority, state.unweighted)
+		}
+	}
+	return nil
+}
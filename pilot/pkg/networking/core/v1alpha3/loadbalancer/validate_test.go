@@ -0,0 +1,163 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"testing"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestValidateTransformedCLA(t *testing.T) {
+	zeroWeight := buildCLA(
+		localitySpec{locality: "region1/zone1", weight: 1, endpoints: 1},
+		localitySpec{locality: "region2/zone1", weight: 1, endpoints: 1},
+	)
+	zeroWeight.Endpoints[1].LoadBalancingWeight = &wrappers.UInt32Value{Value: 0}
+
+	tests := []struct {
+		name  string
+		cla   func() *apiv2.ClusterLoadAssignment
+		valid bool
+	}{
+		{
+			name: "weighted",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA(
+					localitySpec{locality: "region1/zone1", weight: 60, priority: 0, endpoints: 1},
+					localitySpec{locality: "region2/zone1", weight: 40, priority: 0, endpoints: 1},
+					localitySpec{locality: "region3/zone1", priority: 1, endpoints: 1},
+				)
+			},
+			valid: true,
+		},
+		{
+			// a dropped group of endpoints keeps its weight and priority, it receives no traffic.
+			name: "dropped group",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA(
+					localitySpec{locality: "region1/zone1", weight: 100, priority: 0, endpoints: 1},
+					localitySpec{locality: "region2/zone1", priority: 0},
+				)
+			},
+			valid: true,
+		},
+		{
+			name: "no groups",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA()
+			},
+			valid: true,
+		},
+		{
+			name: "skipped priority",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA(
+					localitySpec{locality: "region1/zone1", priority: 0, endpoints: 1},
+					localitySpec{locality: "region2/zone1", priority: 2, endpoints: 1},
+				)
+			},
+		},
+		{
+			name: "priority without endpoints",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA(
+					localitySpec{locality: "region1/zone1", priority: 0, endpoints: 1},
+					localitySpec{locality: "region2/zone1", priority: 1},
+					localitySpec{locality: "region3/zone1", priority: 2, endpoints: 1},
+				)
+			},
+		},
+		{
+			name: "zero weight",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return zeroWeight
+			},
+		},
+		{
+			name: "partially weighted priority",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return buildCLA(
+					localitySpec{locality: "region1/zone1", weight: 10, priority: 0, endpoints: 1},
+					localitySpec{locality: "region2/zone1", priority: 0, endpoints: 1},
+				)
+			},
+		},
+		{
+			name: "nil",
+			cla: func() *apiv2.ClusterLoadAssignment {
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateTransformedCLA(tt.cla())
+			if valid := err == nil; valid != tt.valid {
+				t.Errorf("Got valid %v expected %v: %v", valid, tt.valid, err)
+			}
+		})
+	}
+}
+
+func TestApplyLocalityLBSettingValidateTransform(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/*":       20,
+				},
+			},
+		},
+	}
+
+	// the transform of a well formed load assignment is valid.
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	)
+	result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, &Options{ValidateTransform: true})
+	if result.Mode != ModeDistribute || len(result.Warnings) != 0 {
+		t.Errorf("Got mode %v and warnings %q expected distribute without warnings", result.Mode, result.Warnings)
+	}
+
+	// masked alone, the group of endpoints at priority 1 is dropped and leaves its priority without endpoints.
+	cla = buildCLA(
+		localitySpec{locality: "region1/zone1", priority: 0, endpoints: 1},
+		localitySpec{locality: "region2/zone1", priority: 0, endpoints: 1},
+		localitySpec{locality: "region3/zone1", priority: 1, endpoints: 1},
+	)
+	result = ApplyLocalityLBSettingWithOptions(locality, cla, setting, true,
+		&Options{ValidateTransform: true, PriorityMask: map[uint32]bool{1: true}})
+	if result.Mode != ModeNone || len(result.Warnings) != 1 {
+		t.Fatalf("Got mode %v and warnings %q expected none with a warning", result.Mode, result.Warnings)
+	}
+	for i, ep := range cla.Endpoints {
+		if ep.LoadBalancingWeight != nil || len(ep.LbEndpoints) != 1 {
+			t.Errorf("Got group %d transformed: weight %v, %d endpoints", i, ep.LoadBalancingWeight, len(ep.LbEndpoints))
+		}
+	}
+}
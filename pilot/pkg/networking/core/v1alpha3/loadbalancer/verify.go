@@ -0,0 +1,77 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+)
+
+// dropEndpoints drops the endpoints of a group of endpoints, recording their addresses as intentionally
+// dropped when the addresses are verified.
+func (o *Options) dropEndpoints(ep *endpoint.LocalityLbEndpoints) {
+	if o.intendedDrops != nil {
+		for _, lbEp := range ep.LbEndpoints {
+			o.intendedDrops[endpointAddress(lbEp)] = true
+		}
+	}
+	ep.LbEndpoints = nil
+}
+
+// endpointAddress identifies an endpoint by its socket address, host:port, or by its name for the endpoints
+// referenced by name.
+func endpointAddress(lbEp *endpoint.LbEndpoint) string {
+	if name := lbEp.GetEndpointName(); name != "" {
+		return "name:" + name
+	}
+	socket := lbEp.GetEndpoint().GetAddress().GetSocketAddress()
+	if socket == nil {
+		return lbEp.GetEndpoint().GetAddress().GetPipe().GetPath()
+	}
+	return net.JoinHostPort(socket.GetAddress(), strconv.Itoa(int(socket.GetPortValue())))
+}
+
+// endpointAddresses returns the addresses of the endpoints of a load assignment.
+func endpointAddresses(loadAssignment *apiv2.ClusterLoadAssignment) map[string]bool {
+	addresses := map[string]bool{}
+	for _, ep := range loadAssignment.Endpoints {
+		for _, lbEp := range ep.LbEndpoints {
+			addresses[endpointAddress(lbEp)] = true
+		}
+	}
+	return addresses
+}
+
+// verifyAddresses returns an error listing the addresses of before missing from the transformed load
+// assignment that are not intentionally dropped.
+func verifyAddresses(before map[string]bool, loadAssignment *apiv2.ClusterLoadAssignment, intendedDrops map[string]bool) error {
+	after := endpointAddresses(loadAssignment)
+	var vanished []string
+	for address := range before {
+		if !after[address] && !intendedDrops[address] {
+			vanished = append(vanished, address)
+		}
+	}
+	if len(vanished) == 0 {
+		return nil
+	}
+	sort.Strings(vanished)
+	return fmt.Errorf("endpoints %v vanished without being dropped by the locality lb setting", vanished)
+}
@@ -0,0 +1,87 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestApplyLocalityLBSettingVerifyAddresses(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	setting := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1",
+				To: map[string]uint32{
+					"region1/zone1/*": 80,
+					"region2/*":       20,
+				},
+			},
+		},
+	}
+
+	// the endpoints of region3 are dropped on purpose, by the distribute settings and by the strict residency.
+	for _, opts := range []*Options{
+		{VerifyAddresses: true},
+		{VerifyAddresses: true, StrictResidency: true},
+	} {
+		cla := buildCLA(
+			localitySpec{locality: "region1/zone1", endpoints: 2},
+			localitySpec{locality: "region2/zone1", endpoints: 1},
+			localitySpec{locality: "region3/zone1", endpoints: 1},
+		)
+		result := ApplyLocalityLBSettingWithOptions(locality, cla, setting, true, opts)
+		if result.Mode != ModeDistribute || len(result.Warnings) != 0 {
+			t.Errorf("Got mode %v and warnings %q expected distribute without warnings", result.Mode, result.Warnings)
+		}
+		if len(cla.Endpoints[2].LbEndpoints) != 0 {
+			t.Errorf("expected the endpoints of region3 to be dropped")
+		}
+	}
+}
+
+func TestVerifyAddresses(t *testing.T) {
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 2},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	)
+	before := endpointAddresses(cla)
+	opts := &Options{intendedDrops: map[string]bool{}}
+
+	// region3 is dropped on purpose, an endpoint of region1 is lost by accident.
+	opts.dropEndpoints(cla.Endpoints[2])
+	cla.Endpoints[0].LbEndpoints = cla.Endpoints[0].LbEndpoints[1:]
+
+	err := verifyAddresses(before, cla, opts.intendedDrops)
+	expected := "endpoints [10.0.0.0:8080] vanished without being dropped by the locality lb setting"
+	if err == nil || err.Error() != expected {
+		t.Errorf("Got error %v expected %q", err, expected)
+	}
+	if err := verifyAddresses(before, cla, endpointAddresses(buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 1},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	))); err != nil {
+		t.Errorf("Got error %v expected every vanished address to be intended", err)
+	}
+}
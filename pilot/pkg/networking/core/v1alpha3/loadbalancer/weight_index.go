@@ -0,0 +1,426 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"math"
+	"sort"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/golang/protobuf/ptypes/wrappers"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// LocalityWeightIndex records which groups of endpoints of a ClusterLoadAssignment are matched by the To
+// localities of the distribute rules matching the proxy locality, along with their original weights. It
+// allows recomputing the weights when only the distribute percentages change, without matching the
+// endpoints again.
+type LocalityWeightIndex struct {
+	locality *core.Locality
+	froms    []string
+	groups   int
+	// To locality -> groups of endpoints it matches
+	matches map[string]*localityMatches
+	// groups of endpoints not matched by any To locality
+	misMatched []int
+	// original weights of the groups of endpoints not matched by any To locality, in the order of misMatched
+	misMatchedWeights     []uint32
+	misMatchedTotalWeight uint32
+}
+
+// localityMatches are the groups of endpoints matched by a To locality.
+type localityMatches struct {
+	// indexes of the groups of endpoints in the ClusterLoadAssignment
+	indexes []int
+	// original weights of the groups of endpoints, in the order of indexes
+	weights     []uint32
+	totalWeight uint32
+}
+
+// NewLocalityWeightIndex indexes the load assignment for the composition of the distribute rules matching
+// the proxy locality. It returns nil if no rule matches. The original weights are read from the load
+// assignment and multiplied by the capacity hints of the options, so the index must be built before the
+// weights are applied.
+func NewLocalityWeightIndex(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute,
+	opts *Options,
+) *LocalityWeightIndex {
+	if locality == nil || loadAssignment == nil {
+		return nil
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	rule := composeDistribute(locality, loadAssignment, distribute, opts)
+	if rule == nil {
+		return nil
+	}
+	return newLocalityWeightIndex(locality, loadAssignment, rule, opts)
+}
+
+// Apply sets the weights of a load assignment with the same groups of endpoints as the indexed one,
+// according to the distribute settings. It returns false, leaving the load assignment untouched, if the
+// distribute settings no longer select rules with the same From and To localities as the indexed ones;
+// the weights must then be computed with ApplyLocalityLBSetting.
+func (idx *LocalityWeightIndex) Apply(
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	distribute []*v1alpha3.LocalityLoadBalancerSetting_Distribute,
+	opts *Options,
+) bool {
+	if idx == nil || loadAssignment == nil || len(loadAssignment.Endpoints) != idx.groups {
+		return false
+	}
+	if opts == nil {
+		opts = &Options{}
+	}
+	rule := composeDistribute(idx.locality, loadAssignment, distribute, opts)
+	if rule == nil || !stringsEqual(rule.froms, idx.froms) || len(rule.to) != len(idx.matches) {
+		return false
+	}
+	for locality := range rule.to {
+		if _, ok := idx.matches[locality]; !ok {
+			return false
+		}
+	}
+	idx.apply(loadAssignment, rule.to, opts)
+	return true
+}
+
+func stringsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func newLocalityWeightIndex(
+	locality *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	rule *composedDistribute,
+	opts *Options,
+) *LocalityWeightIndex {
+	idx := &LocalityWeightIndex{
+		locality: locality,
+		froms:    rule.froms,
+		groups:   len(loadAssignment.Endpoints),
+		matches:  make(map[string]*localityMatches, len(rule.to)),
+	}
+	claimed := make([]bool, len(loadAssignment.Endpoints))
+	// the To localities of the more specific rules claim the groups of endpoints first.
+	for _, locality := range rule.order {
+		matches := &localityMatches{}
+		for i, ep := range loadAssignment.Endpoints {
+			// the index is left incomplete, it must not be applied.
+			if opts.overrun() {
+				return idx
+			}
+			if !claimed[i] && rule.match(ep.Locality, locality) {
+				claimed[i] = true
+				matches.indexes = append(matches.indexes, i)
+			}
+		}
+		// the groups without endpoints, e.g. drained, would dilute the share of the others, they are
+		// left out unless the To locality only matches such groups.
+		if populated := populatedGroups(loadAssignment, matches.indexes); len(populated) > 0 {
+			matches.indexes = populated
+		}
+		for _, i := range matches.indexes {
+			weight := originalWeight(loadAssignment.Endpoints[i], opts)
+			matches.weights = append(matches.weights, weight)
+			matches.totalWeight += weight
+		}
+		idx.matches[locality] = matches
+	}
+	for i := range loadAssignment.Endpoints {
+		if !claimed[i] {
+			idx.misMatched = append(idx.misMatched, i)
+		}
+	}
+	for _, i := range idx.misMatched {
+		weight := originalWeight(loadAssignment.Endpoints[i], opts)
+		idx.misMatchedWeights = append(idx.misMatchedWeights, weight)
+		idx.misMatchedTotalWeight += weight
+	}
+	return idx
+}
+
+// populatedGroups returns the indexes of the groups of endpoints with endpoints among the given ones.
+func populatedGroups(loadAssignment *apiv2.ClusterLoadAssignment, indexes []int) []int {
+	populated := make([]int, 0, len(indexes))
+	for _, i := range indexes {
+		if len(loadAssignment.Endpoints[i].LbEndpoints) > 0 {
+			populated = append(populated, i)
+		}
+	}
+	return populated
+}
+
+// originalWeight returns the weight a group of endpoints is given its share of a To locality by.
+func originalWeight(ep *endpoint.LocalityLbEndpoints, opts *Options) uint32 {
+	if opts.HealthyEndpointWeighting {
+		return uint32(healthyEndpoints(ep))
+	}
+	if opts.RegionUnitWeighting {
+		return uint32(len(ep.LbEndpoints))
+	}
+	// the locality string is only built when it may have a hint.
+	if opts.CapacityHints == nil {
+		return localityLbWeight(ep, opts)
+	}
+	return localityLbWeight(ep, opts) * opts.capacityHint(util.LocalityToString(ep.Locality))
+}
+
+// apply sets the weights of the indexed groups of endpoints for the given To percentages.
+func (idx *LocalityWeightIndex) apply(loadAssignment *apiv2.ClusterLoadAssignment, to map[string]uint32, opts *Options) {
+	// the percentages are assumed to sum up to 100, unless they are normalized by their actual sum.
+	scale := float64(opts.weightScale())
+	sum := uint32(0)
+	for _, weight := range to {
+		sum += weight
+	}
+	if opts.NormalizeDistribute && sum > 0 {
+		scale = scale * 100 / float64(sum)
+	}
+	// the weights are made sticky all at once, for the prior weights kept to be compensated by the others,
+	// the To localities being walked in order for the re-apportioned weights to be stable.
+	toLocalities := make([]string, 0, len(to))
+	for locality := range to {
+		toLocalities = append(toLocalities, locality)
+	}
+	sort.Strings(toLocalities)
+	var indexes []int
+	var localities []string
+	var shares []uint32
+	for _, locality := range toLocalities {
+		weight := to[locality]
+		matches := idx.matches[locality]
+		for _, index := range matches.indexes {
+			if opts.annotating() {
+				opts.recordWeightRationale(loadAssignment.Endpoints[index], fmt.Sprintf("matched To %s @%d%%", locality, weight))
+			}
+		}
+		if weight == 0 {
+			continue
+		}
+		// in case wildcard dest matching multi groups of endpoints
+		// the load balancing weight for a locality is split between them in proportion to their weights,
+		// the rounding remainder going to the largest fractional parts so that the shares keep the sum.
+		// A locality explicitly named in To with a non-zero percentage always receives some traffic,
+		// however small its share of the total weight is.
+		for i, share := range apportion(matches.weights, roundWeight(float64(weight)*scale)) {
+			indexes = append(indexes, matches.indexes[i])
+			localities = append(localities, util.LocalityToString(loadAssignment.Endpoints[matches.indexes[i]].Locality))
+			shares = append(shares, share)
+		}
+	}
+	for i, share := range opts.stickyWeights(localities, shares) {
+		loadAssignment.Endpoints[indexes[i]].LoadBalancingWeight = &wrappers.UInt32Value{Value: share}
+	}
+
+	// remove groups of endpoints in a locality that miss matched,
+	// or keep them with a residual weight if configured so.
+	residual := uint32(0)
+	if sum < 100 && !opts.NormalizeDistribute {
+		residual = 100 - sum
+	}
+	var residualWeights []uint32
+	if opts.UnlistedLocalities == UnlistedLocalityResidual {
+		residualWeights = apportion(idx.misMatchedWeights, residual*opts.weightScale())
+	}
+	for j, i := range idx.misMatched {
+		switch opts.UnlistedLocalities {
+		case UnlistedLocalityDrop:
+			opts.dropEndpoints(loadAssignment.Endpoints[i])
+		case UnlistedLocalityResidual:
+			loadAssignment.Endpoints[i].LoadBalancingWeight = &wrappers.UInt32Value{Value: residualWeights[j]}
+			if opts.annotating() {
+				opts.recordWeightRationale(loadAssignment.Endpoints[i],
+					fmt.Sprintf("kept, unmatched, residual weight %d", loadAssignment.Endpoints[i].LoadBalancingWeight.Value))
+			}
+		default:
+			loadAssignment.Endpoints[i].LoadBalancingWeight = &wrappers.UInt32Value{Value: opts.unlistedLocalityWeight()}
+			if opts.annotating() {
+				opts.recordWeightRationale(loadAssignment.Endpoints[i],
+					fmt.Sprintf("kept, unmatched, weight %d", opts.unlistedLocalityWeight()))
+			}
+		}
+	}
+	// dropping the groups of endpoints may empty whole priorities, the others are renumbered without gaps.
+	// The priorities are shared with the groups of endpoints outside of the priority mask, leave them as is.
+	if opts.dropUnlistedLocalities() && len(idx.misMatched) > 0 && opts.PriorityMask == nil {
+		compactPriorities(loadAssignment, idx.misMatched)
+		// a single locality is left, send it alone rather than along with empty localities.
+		if len(idx.misMatched) == idx.groups-1 {
+			removeLocalities(loadAssignment, idx.misMatched)
+		}
+	}
+	completeWeights(loadAssignment)
+}
+
+// completeWeights gives a weight of 1 to the groups of endpoints left without a weight in a priority where
+// other groups of endpoints have one, e.g. the ones a distribute To entry gives 0%, since Envoy requires
+// either all or none of the localities of a priority to be weighted. The groups of endpoints without
+// endpoints receive no traffic whatever their weight, they are left as is.
+func completeWeights(loadAssignment *apiv2.ClusterLoadAssignment) {
+	weighted := map[uint32]bool{}
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 && ep.LoadBalancingWeight != nil {
+			weighted[ep.Priority] = true
+		}
+	}
+	for _, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 && ep.LoadBalancingWeight == nil && weighted[ep.Priority] {
+			ep.LoadBalancingWeight = &wrappers.UInt32Value{Value: 1}
+		}
+	}
+}
+
+// normalizePriorityWeights scales the weights of the groups of endpoints of each priority so that they sum
+// up to total, Envoy weighting the localities of a priority against each other only. This keeps the weights
+// of the different priorities comparable once failover splits the distributed localities into priorities.
+// The groups of endpoints without endpoints or without a weight are left as is.
+func normalizePriorityWeights(loadAssignment *apiv2.ClusterLoadAssignment, total uint32) {
+	priorities := map[uint32][]int{}
+	for i, ep := range loadAssignment.Endpoints {
+		if len(ep.LbEndpoints) > 0 && ep.LoadBalancingWeight != nil {
+			priorities[ep.Priority] = append(priorities[ep.Priority], i)
+		}
+	}
+	for _, indexes := range priorities {
+		weights := make([]uint32, 0, len(indexes))
+		for _, i := range indexes {
+			weights = append(weights, loadAssignment.Endpoints[i].LoadBalancingWeight.Value)
+		}
+		for j, weight := range apportion(weights, total) {
+			loadAssignment.Endpoints[indexes[j]].LoadBalancingWeight = &wrappers.UInt32Value{Value: weight}
+		}
+	}
+}
+
+// roundWeight rounds a weight to the nearest integer, clamped to the uint32 range.
+func roundWeight(weight float64) uint32 {
+	if weight > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(math.Round(weight))
+}
+
+// apportion splits total proportionally to the weights as apportionExact does, except that every share is
+// at least 1, the shares then sum up to more than total if there are more weights than total.
+func apportion(weights []uint32, total uint32) []uint32 {
+	shares := apportionExact(weights, total)
+	for i := range shares {
+		if shares[i] == 0 {
+			shares[i] = 1
+		}
+	}
+	return shares
+}
+
+// apportionExact splits total proportionally to the weights, rounding down and handing out the rest one by
+// one to the largest remainders, the first ones on ties, so that the shares sum up to total. The shares are
+// all 0 if the weights are.
+func apportionExact(weights []uint32, total uint32) []uint32 {
+	sum := uint64(0)
+	for _, weight := range weights {
+		sum += uint64(weight)
+	}
+	shares := make([]uint32, len(weights))
+	if sum == 0 {
+		return shares
+	}
+	remainders := make([]uint64, len(weights))
+	left := uint64(total)
+	for i, weight := range weights {
+		share := uint64(weight) * uint64(total)
+		shares[i] = uint32(share / sum)
+		remainders[i] = share % sum
+		left -= uint64(shares[i])
+	}
+	order := make([]int, len(weights))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return remainders[order[i]] > remainders[order[j]]
+	})
+	for _, i := range order {
+		if left == 0 {
+			break
+		}
+		shares[i]++
+		left--
+	}
+	return shares
+}
+
+// removeLocalities removes the given groups of endpoints from the load assignment. The last group of
+// endpoints is never removed: if all the groups are given, the load assignment is left as is.
+func removeLocalities(loadAssignment *apiv2.ClusterLoadAssignment, removed []int) {
+	if len(loadAssignment.Endpoints) <= 1 {
+		return
+	}
+	isRemoved := make(map[int]bool, len(removed))
+	for _, i := range removed {
+		isRemoved[i] = true
+	}
+	kept := make([]*endpoint.LocalityLbEndpoints, 0, len(loadAssignment.Endpoints)-len(removed))
+	for i, ep := range loadAssignment.Endpoints {
+		if !isRemoved[i] {
+			kept = append(kept, ep)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	loadAssignment.Endpoints = kept
+}
+
+// compactPriorities renumbers the priorities of the groups of endpoints that are not dropped so that they
+// range from 0 to N without skipping, keeping their order. The dropped groups of endpoints are moved to
+// the lowest priority.
+func compactPriorities(loadAssignment *apiv2.ClusterLoadAssignment, dropped []int) {
+	isDropped := make(map[int]bool, len(dropped))
+	for _, i := range dropped {
+		isDropped[i] = true
+	}
+	priorityMap := map[priorityKey][]int{}
+	for i, ep := range loadAssignment.Endpoints {
+		if !isDropped[i] {
+			priority := priorityKey{tier: int(ep.Priority)}
+			priorityMap[priority] = append(priorityMap[priority], i)
+		}
+	}
+	lowest := uint32(0)
+	if priorities := assignPriorities(loadAssignment, priorityMap); priorities > 0 {
+		lowest = uint32(priorities - 1)
+	}
+	for _, i := range dropped {
+		loadAssignment.Endpoints[i].Priority = lowest
+	}
+}
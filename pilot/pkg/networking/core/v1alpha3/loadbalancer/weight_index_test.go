@@ -0,0 +1,260 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func distributeSetting(to map[string]uint32) []*networking.LocalityLoadBalancerSetting_Distribute {
+	return []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region1/zone1/*",
+			To:   to,
+		},
+	}
+}
+
+func indexTestCLA() *apiv2.ClusterLoadAssignment {
+	return buildCLA(
+		localitySpec{locality: "region1/zone1/subzone1", weight: 2, endpoints: 1},
+		localitySpec{locality: "region1/zone1/subzone2", endpoints: 1},
+		localitySpec{locality: "region1/zone2/subzone1", endpoints: 1},
+		localitySpec{locality: "region2/zone1/subzone1", endpoints: 1},
+	)
+}
+
+func clusterWeights(cla *apiv2.ClusterLoadAssignment) ([]uint32, []int) {
+	weights := make([]uint32, 0, len(cla.Endpoints))
+	endpoints := make([]int, 0, len(cla.Endpoints))
+	for _, localityEndpoint := range cla.Endpoints {
+		weights = append(weights, localityEndpoint.LoadBalancingWeight.GetValue())
+		endpoints = append(endpoints, len(localityEndpoint.LbEndpoints))
+	}
+	return weights, endpoints
+}
+
+func TestLocalityWeightIndexMatchesFullRecompute(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	initial := distributeSetting(map[string]uint32{
+		"region1/zone1/*": 60,
+		"region1/zone2/*": 40,
+	})
+	index := NewLocalityWeightIndex(locality, indexTestCLA(), initial, nil)
+
+	tests := []struct {
+		name    string
+		setting []*networking.LocalityLoadBalancerSetting_Distribute
+		applied bool
+	}{
+		{
+			name:    "same percentages",
+			setting: initial,
+			applied: true,
+		},
+		{
+			name: "changed percentages",
+			setting: distributeSetting(map[string]uint32{
+				"region1/zone1/*": 10,
+				"region1/zone2/*": 90,
+			}),
+			applied: true,
+		},
+		{
+			name: "changed localities",
+			setting: distributeSetting(map[string]uint32{
+				"region1/zone1/*": 50,
+				"region2/zone1/*": 50,
+			}),
+			applied: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			incremental := indexTestCLA()
+			if applied := index.Apply(incremental, tt.setting, nil); applied != tt.applied {
+				t.Fatalf("Got applied %v expected %v", applied, tt.applied)
+			}
+			if !tt.applied {
+				return
+			}
+			full := indexTestCLA()
+			ApplyLocalityLBSetting(locality, full, &networking.LocalityLoadBalancerSetting{Distribute: tt.setting}, true)
+			gotWeights, gotEndpoints := clusterWeights(incremental)
+			wantWeights, wantEndpoints := clusterWeights(full)
+			if !reflect.DeepEqual(gotWeights, wantWeights) {
+				t.Errorf("Got weights %v expected %v", gotWeights, wantWeights)
+			}
+			if !reflect.DeepEqual(gotEndpoints, wantEndpoints) {
+				t.Errorf("Got endpoints %v expected %v", gotEndpoints, wantEndpoints)
+			}
+		})
+	}
+}
+
+func TestLocalityWeightIndexChangedEndpoints(t *testing.T) {
+	locality := &envoycore.Locality{Region: "region1", Zone: "zone1"}
+	setting := distributeSetting(map[string]uint32{"region1/zone1/*": 100})
+	index := NewLocalityWeightIndex(locality, indexTestCLA(), setting, nil)
+	cla := buildCLA(localitySpec{locality: "region1/zone1/subzone1", endpoints: 1})
+	if index.Apply(cla, setting, nil) {
+		t.Fatalf("expected the index not to apply to a different set of endpoints")
+	}
+}
+
+func benchmarkCLA(groups int) *apiv2.ClusterLoadAssignment {
+	specs := make([]localitySpec, 0, groups)
+	for i := 0; i < groups; i++ {
+		specs = append(specs, localitySpec{
+			locality:  fmt.Sprintf("region%d/zone%d/subzone%d", i%4, i%16, i),
+			endpoints: 1,
+		})
+	}
+	return buildCLA(specs...)
+}
+
+func benchmarkSettings() (*envoycore.Locality, []*networking.LocalityLoadBalancerSetting_Distribute) {
+	locality := &envoycore.Locality{Region: "region0", Zone: "zone0", SubZone: "subzone0"}
+	return locality, []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region0/*",
+			To: map[string]uint32{
+				"region0/*": 40,
+				"region1/*": 30,
+				"region2/*": 20,
+				"region3/*": 10,
+			},
+		},
+	}
+}
+
+func BenchmarkApplyLocalityWeightFull(b *testing.B) {
+	locality, distribute := benchmarkSettings()
+	setting := &networking.LocalityLoadBalancerSetting{Distribute: distribute}
+	cla := benchmarkCLA(1000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		ApplyLocalityLBSetting(locality, cla, setting, true)
+	}
+}
+
+func TestLocalityWeightIndexMatchesClaims(t *testing.T) {
+	locality := &envoycore.Locality{Region: "region1", Zone: "zone1"}
+	distribute := []*networking.LocalityLoadBalancerSetting_Distribute{
+		{
+			From: "region1/zone1",
+			To: map[string]uint32{
+				"region1/zone1/subzone1": 40,
+				"region1/*":              30,
+				"*/*/subzone2":           30,
+			},
+		},
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone2/subzone2", endpoints: 1},
+		localitySpec{locality: "region1/zone1/subzone1", endpoints: 1},
+		localitySpec{endpoints: 1},
+		localitySpec{locality: "region2/zone1/subzone2", endpoints: 1},
+		localitySpec{locality: "region1/zone1/subzone1", endpoints: 2},
+		localitySpec{locality: "region3", endpoints: 1},
+		localitySpec{locality: "region1/zone2/subzone2", endpoints: 1},
+	)
+	// a locality without a zone but with a subzone is a distinct locality, whatever its string form.
+	cla.Endpoints[5].Locality.SubZone = "subzone2"
+	rule := composeDistribute(locality, cla, distribute, &Options{})
+	index := newLocalityWeightIndex(locality, cla, rule, &Options{})
+
+	expected := map[string][]int{}
+	var misMatched []int
+	for i, ep := range cla.Endpoints {
+		if to, ok := rule.claim(ep.Locality); ok {
+			expected[to] = append(expected[to], i)
+		} else {
+			misMatched = append(misMatched, i)
+		}
+	}
+	for to, matches := range index.matches {
+		if !reflect.DeepEqual(matches.indexes, expected[to]) {
+			t.Errorf("Got indexes %v for %s expected %v", matches.indexes, to, expected[to])
+		}
+	}
+	if !reflect.DeepEqual(index.misMatched, misMatched) {
+		t.Errorf("Got unmatched indexes %v expected %v", index.misMatched, misMatched)
+	}
+}
+
+func BenchmarkApplyLocalityWeightIndexed(b *testing.B) {
+	locality, distribute := benchmarkSettings()
+	cla := benchmarkCLA(1000)
+	index := NewLocalityWeightIndex(locality, cla, distribute, nil)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if !index.Apply(cla, distribute, nil) {
+			b.Fatalf("index not applied")
+		}
+	}
+}
+
+// BenchmarkNewLocalityWeightIndex matches 5000 groups of endpoints against 10 To localities.
+func BenchmarkNewLocalityWeightIndex(b *testing.B) {
+	locality := &envoycore.Locality{Region: "region0", Zone: "zone0", SubZone: "subzone0"}
+	to := map[string]uint32{}
+	for zone := 0; zone < 10; zone++ {
+		to[fmt.Sprintf("region%d/zone%d", zone%4, zone)] = 10
+	}
+	distribute := []*networking.LocalityLoadBalancerSetting_Distribute{{From: "region0/*", To: to}}
+	cla := benchmarkCLA(5000)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		NewLocalityWeightIndex(locality, cla, distribute, nil)
+	}
+}
+
+func TestRemoveLocalitiesKeepsLastGroup(t *testing.T) {
+	tests := []struct {
+		name     string
+		groups   int
+		removed  []int
+		expected int
+	}{
+		{"some groups", 3, []int{0, 2}, 1},
+		{"all groups", 2, []int{0, 1}, 2},
+		{"single group", 1, []int{0}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var specs []localitySpec
+			for i := 0; i < tt.groups; i++ {
+				specs = append(specs, localitySpec{locality: fmt.Sprintf("region%d/zone1", i), endpoints: 1})
+			}
+			cla := buildCLA(specs...)
+			removeLocalities(cla, tt.removed)
+			if len(cla.Endpoints) != tt.expected {
+				t.Errorf("Got %d groups of endpoints expected %d", len(cla.Endpoints), tt.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"fmt"
+
+	apiv2 "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	"istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+// LocalityEffect is the outcome of two locality lb settings for a group of endpoints.
+type LocalityEffect struct {
+	// Index is the position of the group of endpoints in the load assignment the settings are applied to.
+	Index  int
+	Before LocalitySnapshot
+	After  LocalitySnapshot
+}
+
+// Changed tells whether the group of endpoints has a different priority, weight or is dropped differently.
+func (e LocalityEffect) Changed() bool {
+	return e.Before != e.After
+}
+
+func (e LocalityEffect) String() string {
+	return fmt.Sprintf("[%d] %s: %s -> %s", e.Index, e.Before.Locality, describeSnapshot(e.Before), describeSnapshot(e.After))
+}
+
+func describeSnapshot(s LocalitySnapshot) string {
+	if s.Dropped {
+		return "dropped"
+	}
+	return fmt.Sprintf("priority %d, weight %d", s.Priority, s.Weight)
+}
+
+// SettingsEffectDiff compares the effects of a current and a proposed locality lb setting on the same
+// load assignment.
+type SettingsEffectDiff struct {
+	ModeBefore, ModeAfter Mode
+	// Localities has an entry per group of endpoints of the load assignment, in order.
+	Localities []LocalityEffect
+}
+
+// Changed returns the groups of endpoints whose outcome differs between the two settings.
+func (d *SettingsEffectDiff) Changed() []LocalityEffect {
+	if d == nil {
+		return nil
+	}
+	var changed []LocalityEffect
+	for _, effect := range d.Localities {
+		if effect.Changed() {
+			changed = append(changed, effect)
+		}
+	}
+	return changed
+}
+
+// DiffSettingsEffect is a what-if for a locality lb setting change: oldSetting and newSetting are each
+// applied to a copy of the load assignment for the proxy locality, and the resulting priority and weight
+// of every group of endpoints are returned side by side. The given load assignment is left untouched.
+// A group of endpoints removed from the load assignment by a setting is reported as dropped.
+func DiffSettingsEffect(
+	proxy *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	oldSetting *v1alpha3.LocalityLoadBalancerSetting,
+	newSetting *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) *SettingsEffectDiff {
+	if loadAssignment == nil {
+		return nil
+	}
+	before, resultBefore := settingEffect(proxy, loadAssignment, oldSetting, enableFailover)
+	after, resultAfter := settingEffect(proxy, loadAssignment, newSetting, enableFailover)
+	diff := &SettingsEffectDiff{
+		ModeBefore: resultBefore.Mode,
+		ModeAfter:  resultAfter.Mode,
+		Localities: make([]LocalityEffect, 0, len(loadAssignment.Endpoints)),
+	}
+	for i := range loadAssignment.Endpoints {
+		diff.Localities = append(diff.Localities, LocalityEffect{
+			Index:  i,
+			Before: before[i],
+			After:  after[i],
+		})
+	}
+	return diff
+}
+
+// settingEffect applies the setting to a copy of the load assignment and returns the snapshot of each of
+// its groups of endpoints, in the order of the given load assignment, along with the result of the transform.
+// As a dry run, the transform logs no warning and records no metric.
+func settingEffect(
+	proxy *core.Locality,
+	loadAssignment *apiv2.ClusterLoadAssignment,
+	setting *v1alpha3.LocalityLoadBalancerSetting,
+	enableFailover bool,
+) (Snapshot, *Result) {
+	applied := util.CloneClusterLoadAssignment(loadAssignment)
+	result := ApplyLocalityLBSettingWithOptions(proxy, &applied, setting, enableFailover, &Options{sideEffectFree: true})
+	remaining := SnapshotLoadAssignment(&applied)
+	// groups of endpoints may have been removed, match the remaining ones by locality.
+	used := make([]bool, len(remaining))
+	snapshot := make(Snapshot, 0, len(loadAssignment.Endpoints))
+	for _, ep := range loadAssignment.Endpoints {
+		state := LocalitySnapshot{Locality: util.LocalityToString(ep.Locality), Dropped: true}
+		for j := range remaining {
+			if !used[j] && remaining[j].Locality == state.Locality {
+				used[j] = true
+				state = remaining[j]
+				break
+			}
+		}
+		snapshot = append(snapshot, state)
+	}
+	return snapshot, result
+}
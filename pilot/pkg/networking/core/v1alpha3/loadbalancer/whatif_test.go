@@ -0,0 +1,93 @@
+// Copyright 2020 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package loadbalancer
+
+import (
+	"reflect"
+	"testing"
+
+	envoycore "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+
+	networking "istio.io/api/networking/v1alpha3"
+)
+
+func TestDiffSettingsEffect(t *testing.T) {
+	locality := &envoycore.Locality{
+		Region: "region1",
+		Zone:   "zone1",
+	}
+	distribute := func(local, remote uint32) *networking.LocalityLoadBalancerSetting {
+		return &networking.LocalityLoadBalancerSetting{
+			Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To: map[string]uint32{
+						"region1/zone1/*": local,
+						"region2/*":       remote,
+					},
+				},
+			},
+		}
+	}
+	cla := buildCLA(
+		localitySpec{locality: "region1/zone1", endpoints: 1},
+		localitySpec{locality: "region1/zone2", endpoints: 1},
+		localitySpec{locality: "region2/zone1", endpoints: 2},
+		localitySpec{locality: "region3/zone1", endpoints: 1},
+	)
+	original := SnapshotLoadAssignment(cla)
+
+	diff := DiffSettingsEffect(locality, cla, distribute(80, 20), distribute(60, 40), true)
+	if diff.ModeBefore != ModeDistribute || diff.ModeAfter != ModeDistribute {
+		t.Errorf("Got modes %s -> %s expected distribute -> distribute", diff.ModeBefore, diff.ModeAfter)
+	}
+	expected := []LocalityEffect{
+		{
+			Index:  0,
+			Before: LocalitySnapshot{Locality: "region1/zone1", Weight: 80},
+			After:  LocalitySnapshot{Locality: "region1/zone1", Weight: 60},
+		},
+		{
+			Index:  2,
+			Before: LocalitySnapshot{Locality: "region2/zone1", Weight: 20},
+			After:  LocalitySnapshot{Locality: "region2/zone1", Weight: 40},
+		},
+	}
+	if changed := diff.Changed(); !reflect.DeepEqual(changed, expected) {
+		t.Errorf("Got changes %v expected %v", changed, expected)
+	}
+	if len(diff.Localities) != len(cla.Endpoints) {
+		t.Fatalf("Got %d localities expected %d", len(diff.Localities), len(cla.Endpoints))
+	}
+	for _, i := range []int{1, 3} {
+		if effect := diff.Localities[i]; !effect.Before.Dropped || !effect.After.Dropped {
+			t.Errorf("Got %v expected the group of endpoints dropped by both settings", effect)
+		}
+	}
+	if got := expected[0].String(); got != "[0] region1/zone1: priority 0, weight 80 -> priority 0, weight 60" {
+		t.Errorf("Got %q", got)
+	}
+	if snapshot := SnapshotLoadAssignment(cla); !reflect.DeepEqual(snapshot, original) {
+		t.Errorf("Got the load assignment changed: %v", CompareSnapshots(original, snapshot))
+	}
+
+	// the same setting has no effect to compare.
+	if changed := DiffSettingsEffect(locality, cla, distribute(80, 20), distribute(80, 20), true).Changed(); changed != nil {
+		t.Errorf("Got changes %v expected none", changed)
+	}
+	if diff := DiffSettingsEffect(locality, nil, distribute(80, 20), nil, true); diff != nil {
+		t.Errorf("Got %v expected no diff without load assignment", diff)
+	}
+}
@@ -335,15 +335,28 @@ func IsLocalityEmpty(locality *core.Locality) bool {
 }
 
 func LocalityMatch(proxyLocality *core.Locality, ruleLocality string) bool {
-	ruleRegion, ruleZone, ruleSubzone := SplitLocality(ruleLocality)
-	regionMatch := ruleRegion == "*" || proxyLocality.GetRegion() == ruleRegion
-	zoneMatch := ruleZone == "*" || ruleZone == "" || proxyLocality.GetZone() == ruleZone
-	subzoneMatch := ruleSubzone == "*" || ruleSubzone == "" || proxyLocality.GetSubZone() == ruleSubzone
+	return NewLocalityMatcher(ruleLocality).Match(proxyLocality)
+}
 
-	if regionMatch && zoneMatch && subzoneMatch {
-		return true
-	}
-	return false
+// LocalityMatcher is a rule locality split once into its region, zone and subzone, to match many
+// localities against it.
+type LocalityMatcher struct {
+	Region, Zone, SubZone string
+}
+
+// NewLocalityMatcher splits a '/' separated rule locality into a LocalityMatcher.
+func NewLocalityMatcher(ruleLocality string) LocalityMatcher {
+	region, zone, subzone := SplitLocality(ruleLocality)
+	return LocalityMatcher{Region: region, Zone: zone, SubZone: subzone}
+}
+
+// Match checks whether the locality matches the rule locality, as LocalityMatch does.
+func (m LocalityMatcher) Match(locality *core.Locality) bool {
+	regionMatch := m.Region == "*" || locality.GetRegion() == m.Region
+	zoneMatch := m.Zone == "*" || m.Zone == "" || locality.GetZone() == m.Zone
+	subzoneMatch := m.SubZone == "*" || m.SubZone == "" || locality.GetSubZone() == m.SubZone
+
+	return regionMatch && zoneMatch && subzoneMatch
 }
 
 func SplitLocality(locality string) (region, zone, subzone string) {
@@ -358,6 +371,8 @@ func SplitLocality(locality string) (region, zone, subzone string) {
 	}
 }
 
+// LbPriority returns the priority of the endpoints of a locality from the point of view of the proxy,
+// based on the topology: 0 for the same subzone, 1 for the same zone, 2 for the same region and 3 otherwise.
 func LbPriority(proxyLocality, endpointsLocality *core.Locality) int {
 	if proxyLocality.GetRegion() == endpointsLocality.GetRegion() {
 		if proxyLocality.GetZone() == endpointsLocality.GetZone() {
@@ -386,6 +401,8 @@ func CloneCluster(cluster *xdsapi.Cluster) xdsapi.Cluster {
 }
 
 // return a shallow copy ClusterLoadAssignment
+// Only the groups of endpoints and their weights are copied: the policy, the LbEndpoints and their metadata
+// are shared with the original, so they have to be replaced rather than modified in place on the copy.
 func CloneClusterLoadAssignment(original *xdsapi.ClusterLoadAssignment) xdsapi.ClusterLoadAssignment {
 	out := xdsapi.ClusterLoadAssignment{}
 	if original == nil {
@@ -266,6 +266,61 @@ func TestLocalityMatch(t *testing.T) {
 			if match != tt.match {
 				t.Errorf("Expected matching result %v, but got %v", tt.match, match)
 			}
+			if match := NewLocalityMatcher(tt.rule).Match(tt.locality); match != tt.match {
+				t.Errorf("Expected matcher result %v, but got %v", tt.match, match)
+			}
+		})
+	}
+}
+
+func TestLbPriority(t *testing.T) {
+	proxyLocality := &core.Locality{
+		Region:  "region1",
+		Zone:    "zone1",
+		SubZone: "subzone1",
+	}
+	tests := []struct {
+		name     string
+		locality *core.Locality
+		want     int
+	}{
+		{
+			name:     "same subzone",
+			locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone1"},
+			want:     0,
+		},
+		{
+			name:     "same zone",
+			locality: &core.Locality{Region: "region1", Zone: "zone1", SubZone: "subzone2"},
+			want:     1,
+		},
+		{
+			name:     "same region",
+			locality: &core.Locality{Region: "region1", Zone: "zone2", SubZone: "subzone1"},
+			want:     2,
+		},
+		{
+			name:     "different region",
+			locality: &core.Locality{Region: "region2", Zone: "zone1", SubZone: "subzone1"},
+			want:     3,
+		},
+		{
+			name:     "same zone without subzone",
+			locality: &core.Locality{Region: "region1", Zone: "zone1"},
+			want:     1,
+		},
+		{
+			name:     "nil locality",
+			locality: nil,
+			want:     3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := LbPriority(proxyLocality, tt.locality); got != tt.want {
+				t.Errorf("Expected priority %d, but got %d", tt.want, got)
+			}
 		})
 	}
 }
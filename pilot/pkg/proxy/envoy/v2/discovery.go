@@ -15,12 +15,14 @@
 package v2
 
 import (
+	"context"
 	"strconv"
 	"sync"
 	"time"
 
 	ads "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
 	"github.com/google/uuid"
+	"go.opencensus.io/trace"
 	"go.uber.org/atomic"
 	"google.golang.org/grpc"
 
@@ -29,6 +31,9 @@ import (
 	"istio.io/istio/pilot/pkg/networking/core"
 )
 
+// pushSpanName is the name of the tracing span of a full push.
+const pushSpanName = "xds/push"
+
 var (
 	versionMutex sync.RWMutex
 	// version is the timestamp of the last registry event.
@@ -215,6 +220,10 @@ func (s *DiscoveryServer) Push(req *model.PushRequest) {
 	// saved.
 	t0 := time.Now()
 	push := model.NewPushContext()
+	// the span covers the init of the push context, the config generated for the push being attributed to it.
+	var span *trace.Span
+	push.TraceContext, span = trace.StartSpan(context.Background(), pushSpanName)
+	defer span.End()
 	if err := push.InitContext(s.Env, oldPushContext, req); err != nil {
 		adsLog.Errorf("XDS: Failed to update services: %v", err)
 		// We can't push if we can't read the data - stick with previous version.
@@ -15,8 +15,10 @@
 package v2
 
 import (
+	"context"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -27,6 +29,7 @@ import (
 
 	networkingapi "istio.io/api/networking/v1alpha3"
 
+	"istio.io/istio/pilot/pkg/features"
 	"istio.io/istio/pilot/pkg/model"
 	networking "istio.io/istio/pilot/pkg/networking/core/v1alpha3"
 	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/loadbalancer"
@@ -73,6 +76,14 @@ var (
 
 	// Tracks connections, increment on each new connection.
 	connectionNumber = int64(0)
+
+	// localityLbTransforms caches the locality lb transforms of the load assignments of the current version,
+	// shared by the proxies of a locality.
+	localityLbTransforms = &localityLbCaches{}
+
+	// endpointShardsGeneration counts the updates of the endpoint shards, incremental updates included
+	// which do not change the push version.
+	endpointShardsGeneration = uint64(0)
 )
 
 // EdsCluster tracks eds-related info for monitored cluster. Used in 1.0, where cluster info is not source-dependent.
@@ -386,6 +397,7 @@ func (s *DiscoveryServer) edsUpdate(clusterID, serviceName string, namespace str
 	if len(istioEndpoints) == 0 {
 		if s.EndpointShardsByService[serviceName][namespace] != nil {
 			s.deleteEndpointShards(clusterID, serviceName, namespace)
+			atomic.AddUint64(&endpointShardsGeneration, 1)
 			adsLog.Infof("Incremental push, service %s has no endpoints", serviceName)
 			s.ConfigUpdate(&model.PushRequest{
 				Full:              false,
@@ -440,6 +452,7 @@ func (s *DiscoveryServer) edsUpdate(clusterID, serviceName string, namespace str
 	ep.Shards[clusterID] = istioEndpoints
 	ep.ServiceAccounts = serviceAccounts
 	ep.mutex.Unlock()
+	atomic.AddUint64(&endpointShardsGeneration, 1)
 
 	// for internal update: this called by DiscoveryServer.Push --> updateServiceShards,
 	// no need to trigger push here.
@@ -615,6 +628,9 @@ func (s *DiscoveryServer) generateEndpoints(
 		}
 	}
 
+	// read before the shards, so that the transforms cached for a version of the endpoints are never
+	// computed from older shards.
+	version := localityLbVersion()
 	l := s.loadAssignmentsForClusterIsolated(proxy, push, clusterName)
 
 	if l == nil {
@@ -639,14 +655,78 @@ func (s *DiscoveryServer) generateEndpoints(
 	enableFailover, lb := getOutlierDetectionAndLoadBalancerSettings(push, proxy, clusterName)
 	lbSetting := loadbalancer.GetLocalityLbSetting(push.Mesh.GetLocalityLbSetting(), lb.GetLocalityLbSetting())
 	if lbSetting != nil {
-		// Make a shallow copy of the cla as we are mutating the endpoints with priorities/weights relative to the calling proxy
-		clonedCLA := util.CloneClusterLoadAssignment(l)
-		l = &clonedCLA
-		loadbalancer.ApplyLocalityLBSetting(proxy.Locality, l, lbSetting, enableFailover)
+		// The transform is computed on a copy of the cla, once for all the proxies of a locality sharing it.
+		cache := localityLbTransforms.get(version, lb.GetConsistentHash() != nil, push.TraceContext)
+		var result *loadbalancer.Result
+		l, result = cache.Apply(proxy.Locality, l, localityLbCacheVersion(version, proxy), lbSetting, enableFailover)
+		if !result.Applied {
+			adsLog.Debugf("EDS: locality lb setting of %s does not apply to the locality of %s", clusterName, proxy.ID)
+		}
+		if len(result.Warnings) > 0 {
+			push.AddMetric(model.ProxyStatusLocalityLbWarnings, clusterName, proxy, strings.Join(result.Warnings, "; "))
+		}
 	}
 	return l
 }
 
+// localityLbOptions returns the options the locality lb setting of a cluster is applied with, as for the
+// clusters built with an inline load assignment. The metrics are recorded once per transform, shared by
+// the proxies of a locality, and the transforms traced as part of the push in traceContext.
+func localityLbOptions(consistentHash bool, traceContext context.Context) *loadbalancer.Options {
+	return &loadbalancer.Options{
+		ConsistentHash: consistentHash,
+		RecordMetrics:  features.EnableLocalityLBMetrics,
+		TraceContext:   traceContext,
+	}
+}
+
+// localityLbVersion returns the version of the endpoints the locality lb transforms are cached for: the
+// push version, and the generation of the endpoint shards for the incremental pushes.
+func localityLbVersion() string {
+	return versionInfo() + "/" + strconv.FormatUint(atomic.LoadUint64(&endpointShardsGeneration), 10)
+}
+
+// localityLbCacheVersion returns the version of the load assignments built for the proxy, which depend on
+// the version of the endpoints and on the sidecar scope and the network of the proxy.
+func localityLbCacheVersion(version string, proxy *model.Proxy) string {
+	scope := proxy.ConfigNamespace
+	if proxy.SidecarScope != nil && proxy.SidecarScope.Config != nil {
+		scope = proxy.SidecarScope.Config.Namespace + "/" + proxy.SidecarScope.Config.Name
+	}
+	network := ""
+	if proxy.Metadata != nil {
+		network = proxy.Metadata.Network
+	}
+	return version + "/" + scope + "/" + network
+}
+
+// localityLbCaches holds the caches of the locality lb transforms of a version of the endpoints, one per set
+// of options, see localityLbVersion.
+type localityLbCaches struct {
+	mutex   sync.Mutex
+	version string
+	// keyed by whether the clusters use consistent hashing, see localityLbOptions
+	caches map[bool]*loadbalancer.TransformCache
+}
+
+// get returns the cache of the transforms of the version, the caches of another version being dropped. A
+// cache traces its transforms as part of the push in traceContext it is created for, the first to compute
+// the version.
+func (c *localityLbCaches) get(version string, consistentHash bool, traceContext context.Context) *loadbalancer.TransformCache {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.caches == nil || c.version != version {
+		c.version = version
+		c.caches = map[bool]*loadbalancer.TransformCache{}
+	}
+	cache, f := c.caches[consistentHash]
+	if !f {
+		cache = loadbalancer.NewTransformCache(localityLbOptions(consistentHash, traceContext))
+		c.caches[consistentHash] = cache
+	}
+	return cache
+}
+
 // pushEds is pushing EDS updates for a single connection. Called the first time
 // a client connects, for incremental updates and for full periodic updates.
 func (s *DiscoveryServer) pushEds(push *model.PushContext, con *XdsConnection, version string, edsUpdatedServices map[string]struct{}) error {
@@ -0,0 +1,117 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package v2
+
+import (
+	"reflect"
+	"testing"
+
+	xdsapi "github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+
+	networkingapi "istio.io/api/networking/v1alpha3"
+
+	"istio.io/istio/pilot/pkg/model"
+	"istio.io/istio/pilot/pkg/networking/core/v1alpha3/loadbalancer"
+	"istio.io/istio/pilot/pkg/networking/util"
+)
+
+func TestLocalityLbOptionsConsistentHash(t *testing.T) {
+	setting := &networkingapi.LocalityLoadBalancerSetting{
+		Distribute: []*networkingapi.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "region1/zone1/*",
+				To: map[string]uint32{
+					"region1/zone1/*": 70,
+					"region2/*":       30,
+				},
+			},
+		},
+	}
+
+	tests := []struct {
+		name     string
+		lb       *networkingapi.LoadBalancerSettings
+		expected []uint32
+	}{
+		{
+			name:     "no load balancer settings",
+			expected: []uint32{70, 30},
+		},
+		{
+			name: "round robin",
+			lb: &networkingapi.LoadBalancerSettings{
+				LbPolicy: &networkingapi.LoadBalancerSettings_Simple{Simple: networkingapi.LoadBalancerSettings_ROUND_ROBIN},
+			},
+			expected: []uint32{70, 30},
+		},
+		{
+			// the weights are scaled as for the clusters with an inline load assignment.
+			name: "consistent hash",
+			lb: &networkingapi.LoadBalancerSettings{
+				LbPolicy: &networkingapi.LoadBalancerSettings_ConsistentHash{
+					ConsistentHash: &networkingapi.LoadBalancerSettings_ConsistentHashLB{
+						HashKey: &networkingapi.LoadBalancerSettings_ConsistentHashLB_UseSourceIp{UseSourceIp: true},
+					},
+				},
+			},
+			expected: []uint32{7000, 3000},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cla := &xdsapi.ClusterLoadAssignment{
+				ClusterName: "outbound|8080||test.example.org",
+				Endpoints: []*endpoint.LocalityLbEndpoints{
+					{Locality: util.ConvertLocality("region1/zone1/subzone1"), LbEndpoints: []*endpoint.LbEndpoint{{}}},
+					{Locality: util.ConvertLocality("region2/zone1/subzone1"), LbEndpoints: []*endpoint.LbEndpoint{{}}},
+				},
+			}
+			loadbalancer.ApplyLocalityLBSettingWithOptions(util.ConvertLocality("region1/zone1/subzone1"), cla, setting,
+				false, localityLbOptions(tt.lb.GetConsistentHash() != nil, nil))
+			weights := make([]uint32, 0, len(cla.Endpoints))
+			for _, ep := range cla.Endpoints {
+				weights = append(weights, ep.GetLoadBalancingWeight().GetValue())
+			}
+			if !reflect.DeepEqual(weights, tt.expected) {
+				t.Errorf("Got weights %v expected %v", weights, tt.expected)
+			}
+		})
+	}
+}
+
+func TestLocalityLbCaches(t *testing.T) {
+	caches := &localityLbCaches{}
+	cache := caches.get("1", false, nil)
+	if caches.get("1", false, nil) != cache {
+		t.Errorf("expected the cache of the version to be shared")
+	}
+	if caches.get("1", true, nil) == cache {
+		t.Errorf("expected the clusters using consistent hashing to have their own cache")
+	}
+	if caches.get("2", false, nil) == cache {
+		t.Errorf("expected a new cache for a new version")
+	}
+}
+
+func TestLocalityLbVersionEndpointUpdates(t *testing.T) {
+	s := &DiscoveryServer{EndpointShardsByService: map[string]map[string]*EndpointShards{}}
+	version := localityLbVersion()
+	s.edsUpdate("cluster1", "svc.ns.svc.cluster.local", "ns",
+		[]*model.IstioEndpoint{{Address: "10.0.0.1", EndpointPort: 80}}, true)
+	if localityLbVersion() == version {
+		t.Errorf("expected the version of the transforms to change with the endpoints")
+	}
+}
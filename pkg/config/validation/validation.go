@@ -21,6 +21,7 @@ import (
 	"net/http"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -972,7 +973,7 @@ func validateLoadBalancer(settings *networking.LoadBalancerSettings) (errs error
 			}
 		}
 	}
-	if err := validateLocalityLbSetting(settings.LocalityLbSetting); err != nil {
+	if err := ValidateLocalityLbSetting(settings.LocalityLbSetting); err != nil {
 		errs = multierror.Append(errs, err)
 	}
 	return
@@ -1221,7 +1222,7 @@ func ValidateMeshConfig(mesh *meshconfig.MeshConfig) (errs error) {
 		errs = multierror.Append(errs, err)
 	}
 
-	if err := validateLocalityLbSetting(mesh.LocalityLbSetting); err != nil {
+	if err := ValidateLocalityLbSetting(mesh.LocalityLbSetting); err != nil {
 		errs = multierror.Append(errs, err)
 	}
 
@@ -2763,50 +2764,90 @@ func appendErrors(err error, errs ...error) error {
 	return err
 }
 
-// validateLocalityLbSetting checks the LocalityLbSetting of MeshConfig
-func validateLocalityLbSetting(lb *networking.LocalityLoadBalancerSetting) error {
+// ValidateLocalityLbSetting checks a LocalityLoadBalancerSetting. Rather than stopping at the first problem,
+// all of them are reported, each prefixed with the path of the offending field.
+func ValidateLocalityLbSetting(lb *networking.LocalityLoadBalancerSetting) (errs error) {
 	if lb == nil {
 		return nil
 	}
 
-	if len(lb.GetDistribute()) > 0 && len(lb.GetFailover()) > 0 {
-		return fmt.Errorf("can not simultaneously specify 'distribute' and 'failover'")
+	errs = appendErrors(errs, ValidateDistribute(lb.GetDistribute()))
+
+	for i, failover := range lb.GetFailover() {
+		path := fmt.Sprintf("localityLbSetting.failover[%d]", i)
+		if failover == nil {
+			errs = appendErrors(errs, fmt.Errorf("%s: must not be empty", path))
+			continue
+		}
+		if failover.To == "" {
+			errs = appendErrors(errs, fmt.Errorf("%s.to: must specify a region", path))
+			continue
+		}
+		if failover.From == failover.To {
+			errs = appendErrors(errs, fmt.Errorf("%s: locality lb failover settings must specify different regions", path))
+		}
+		if strings.Contains(failover.To, "*") {
+			errs = appendErrors(errs, fmt.Errorf("%s.to: locality lb failover region should not contain '*' wildcard", path))
+		}
+		if wildcard := strings.Index(failover.From, "*"); wildcard >= 0 && wildcard != len(failover.From)-1 {
+			errs = appendErrors(errs, fmt.Errorf("%s.from: locality lb failover region may only end with a '*' wildcard", path))
+		}
 	}
 
+	return errs
+}
+
+// ValidateDistribute checks the distribute rules of a LocalityLoadBalancerSetting: the From of every rule
+// must be a well-formed locality, not overlapping with the From of another rule, and the To of every rule
+// a percentage distribution over well-formed localities, summing up to 100. Every problem is reported,
+// prefixed with the path of the offending rule.
+func ValidateDistribute(distribute []*networking.LocalityLoadBalancerSetting_Distribute) (errs error) {
 	srcLocalities := make([]string, 0)
-	for _, locality := range lb.GetDistribute() {
-		srcLocalities = append(srcLocalities, locality.From)
-		var totalWeight uint32
-		destLocalities := make([]string, 0)
-		for loc, weight := range locality.To {
+	for i, locality := range distribute {
+		path := fmt.Sprintf("localityLbSetting.distribute[%d]", i)
+		if locality == nil {
+			errs = appendErrors(errs, fmt.Errorf("%s: must not be empty", path))
+			continue
+		}
+		if err := validateLocalities([]string{locality.From}); err != nil {
+			errs = appendErrors(errs, fmt.Errorf("%s.from: %v", path, err))
+		} else {
+			srcLocalities = append(srcLocalities, locality.From)
+		}
+		if len(locality.To) == 0 {
+			errs = appendErrors(errs, fmt.Errorf("%s.to: must specify at least one locality", path))
+			continue
+		}
+
+		destLocalities := make([]string, 0, len(locality.To))
+		for loc := range locality.To {
 			destLocalities = append(destLocalities, loc)
+		}
+		sort.Strings(destLocalities)
+		var totalWeight uint32
+		for _, loc := range destLocalities {
+			weight := locality.To[loc]
 			if weight == 0 {
-				return fmt.Errorf("locality weight must not be in range [1, 100]")
+				errs = appendErrors(errs, fmt.Errorf("%s.to[%s]: locality weight must be in range [1, 100]", path, loc))
 			}
 			totalWeight += weight
 		}
 		if totalWeight != 100 {
-			return fmt.Errorf("total locality weight %v != 100", totalWeight)
+			errs = appendErrors(errs, fmt.Errorf("%s.to: total locality weight %v != 100", path, totalWeight))
 		}
-		if err := validateLocalities(destLocalities); err != nil {
-			return err
+		// the To localities may overlap, e.g. a zone and one of its subzones: an endpoint locality is
+		// claimed by the most specific one only, so the weights are not counted twice.
+		for _, loc := range destLocalities {
+			if err := validateLocalities([]string{loc}); err != nil {
+				errs = appendErrors(errs, fmt.Errorf("%s.to: %v", path, err))
+			}
 		}
 	}
 
 	if err := validateLocalities(srcLocalities); err != nil {
-		return err
+		errs = appendErrors(errs, fmt.Errorf("localityLbSetting.distribute.from: %v", err))
 	}
-
-	for _, failover := range lb.GetFailover() {
-		if failover.From == failover.To {
-			return fmt.Errorf("locality lb failover settings must specify different regions")
-		}
-		if strings.Contains(failover.To, "*") {
-			return fmt.Errorf("locality lb failover region should not contain '*' wildcard")
-		}
-	}
-
-	return nil
+	return errs
 }
 
 func validateLocalities(localities []string) error {
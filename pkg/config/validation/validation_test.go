@@ -16,6 +16,7 @@ package validation
 
 import (
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -5582,7 +5583,7 @@ func TestValidateLocalityLbSetting(t *testing.T) {
 			valid: false,
 		},
 		{
-			name: "invalid LocalityLoadBalancerSetting specify both distribute and failover",
+			name: "valid LocalityLoadBalancerSetting specify both distribute and failover",
 			in: &networking.LocalityLoadBalancerSetting{
 				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
 					{
@@ -5600,7 +5601,7 @@ func TestValidateLocalityLbSetting(t *testing.T) {
 					},
 				},
 			},
-			valid: false,
+			valid: true,
 		},
 
 		{
@@ -5615,16 +5616,275 @@ func TestValidateLocalityLbSetting(t *testing.T) {
 			},
 			valid: false,
 		},
+		{
+			name: "invalid LocalityLoadBalancerSetting_Distribute empty to",
+			in: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "a/b/c",
+					},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "invalid LocalityLoadBalancerSetting_Distribute duplicate from",
+			in: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "a/b/c",
+						To:   map[string]uint32{"a/b/c": 100},
+					},
+					{
+						From: "a/b/c",
+						To:   map[string]uint32{"a/b1": 100},
+					},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "invalid LocalityLoadBalancerSetting_Distribute unknown pattern",
+			in: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "a/b/c",
+						To:   map[string]uint32{"*/b": 100},
+					},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "invalid failover empty to",
+			in: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+					},
+				},
+			},
+			valid: false,
+		},
+		{
+			name: "valid LocalityLoadBalancerSetting_Distribute",
+			in: &networking.LocalityLoadBalancerSetting{
+				Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+					{
+						From: "a/b/c",
+						To: map[string]uint32{
+							"a/b/c": 80,
+							"a/b1":  20,
+						},
+					},
+					{
+						From: "a/b1/*",
+						To:   map[string]uint32{"a/*": 100},
+					},
+				},
+			},
+			valid: true,
+		},
+		{
+			name: "valid failover",
+			in: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "region1",
+						To:   "region2",
+					},
+					{
+						From: "region2",
+						To:   "region1",
+					},
+				},
+			},
+			valid: true,
+		},
+		{
+			name: "valid failover from wildcard",
+			in: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "us-*",
+						To:   "eu-west1",
+					},
+				},
+			},
+			valid: true,
+		},
+		{
+			name: "invalid failover from inner wildcard",
+			in: &networking.LocalityLoadBalancerSetting{
+				Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+					{
+						From: "us-*1",
+						To:   "eu-west1",
+					},
+				},
+			},
+			valid: false,
+		},
 	}
 
 	for _, c := range cases {
-		if got := validateLocalityLbSetting(c.in); (got == nil) != c.valid {
+		if got := ValidateLocalityLbSetting(c.in); (got == nil) != c.valid {
 			t.Errorf("ValidateLocalityLbSetting failed on %v: got valid=%v but wanted valid=%v: %v",
 				c.name, got == nil, c.valid, got)
 		}
 	}
 }
 
+func TestValidateLocalityLbSettingReportsAllErrors(t *testing.T) {
+	in := &networking.LocalityLoadBalancerSetting{
+		Distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+			{
+				From: "a/b/c",
+				To: map[string]uint32{
+					"a/b/c": 0,
+					"a/b1":  90,
+				},
+			},
+			{
+				From: "a/b/c",
+			},
+		},
+		Failover: []*networking.LocalityLoadBalancerSetting_Failover{
+			{
+				From: "region1",
+				To:   "region1",
+			},
+			{
+				From: "region2",
+			},
+		},
+	}
+	expected := []string{
+		"localityLbSetting.distribute[0].to[a/b/c]: locality weight must be in range [1, 100]",
+		"localityLbSetting.distribute[0].to: total locality weight 90 != 100",
+		"localityLbSetting.distribute[1].to: must specify at least one locality",
+		"localityLbSetting.distribute.from: locality a/b/c overlap with previous specified ones",
+		"localityLbSetting.failover[0]: locality lb failover settings must specify different regions",
+		"localityLbSetting.failover[1].to: must specify a region",
+	}
+
+	err, ok := ValidateLocalityLbSetting(in).(*multierror.Error)
+	if !ok {
+		t.Fatalf("expected a multi error as output")
+	}
+	got := make([]string, 0, len(err.Errors))
+	for _, e := range err.Errors {
+		got = append(got, e.Error())
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("got errors %v, want %v", got, expected)
+	}
+}
+
+func TestValidateDistribute(t *testing.T) {
+	cases := []struct {
+		name       string
+		distribute []*networking.LocalityLoadBalancerSetting_Distribute
+		expected   []string
+	}{
+		{
+			name: "valid",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To:   map[string]uint32{"region1/zone1/*": 80, "region2/*": 20},
+				},
+				{
+					From: "region2/*",
+					To:   map[string]uint32{"region2/*": 100},
+				},
+			},
+		},
+		{
+			name: "overlapping to of mixed granularity",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/zone1/*",
+					To:   map[string]uint32{"region1/zone1/subzone1": 50, "region1/zone1": 30, "region1": 20},
+				},
+			},
+		},
+		{
+			name: "malformed to",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/*",
+					To:   map[string]uint32{"region1/*/zone1": 50, "region2//zone1": 50},
+				},
+			},
+			expected: []string{
+				"localityLbSetting.distribute[0].to: locality region1/*/zone1 wildcard '*' number can not exceed 1 and must be in the end",
+				"localityLbSetting.distribute[0].to: locality region2//zone1 must not contain empty region/zone/subzone info",
+			},
+		},
+		{
+			name: "weights not summing up to 100",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/*",
+					To:   map[string]uint32{"region1/*": 30, "region2/*": 7},
+				},
+				{
+					From: "region2/*",
+					To:   map[string]uint32{"region2/*": 150, "region1/*": 100},
+				},
+			},
+			expected: []string{
+				"localityLbSetting.distribute[0].to: total locality weight 37 != 100",
+				"localityLbSetting.distribute[1].to: total locality weight 250 != 100",
+			},
+		},
+		{
+			name: "malformed from",
+			distribute: []*networking.LocalityLoadBalancerSetting_Distribute{
+				{
+					From: "region1/*/zone1",
+					To:   map[string]uint32{"region1/*": 100},
+				},
+				{
+					From: "region2//zone1",
+					To:   map[string]uint32{"region2/*": 100},
+				},
+				{
+					From: "region3/*",
+					To:   map[string]uint32{"region3/*": 100},
+				},
+			},
+			expected: []string{
+				"localityLbSetting.distribute[0].from: locality region1/*/zone1 wildcard '*' number can not exceed 1 and must be in the end",
+				"localityLbSetting.distribute[1].from: locality region2//zone1 must not contain empty region/zone/subzone info",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := ValidateDistribute(c.distribute)
+			if c.expected == nil {
+				if err != nil {
+					t.Fatalf("got unexpected error %v", err)
+				}
+				return
+			}
+			merr, ok := err.(*multierror.Error)
+			if !ok {
+				t.Fatalf("expected a multi error as output, got %v", err)
+			}
+			got := make([]string, 0, len(merr.Errors))
+			for _, e := range merr.Errors {
+				got = append(got, e.Error())
+			}
+			if !reflect.DeepEqual(got, c.expected) {
+				t.Errorf("got errors %v, want %v", got, c.expected)
+			}
+		})
+	}
+}
+
 func TestValidateLocalities(t *testing.T) {
 	cases := []struct {
 		name       string